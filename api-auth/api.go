@@ -2,46 +2,264 @@ package apiauth
 
 import (
 	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
 	"encoding/json"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	defaultTimeout    = 10 * time.Second
+	defaultRetryDelay = 500 * time.Millisecond
+
+	// maxResponseSize limits the auth response that is read
+	maxResponseSize = 1 << 20
+	// maxCacheEntries bounds the result cache, expired results are pruned
+	// when it is full and it is reset when that is not enough
+	maxCacheEntries = 10000
 )
 
 type APIConfig struct {
 	Endpoint string
 	Headers  map[string]string
+
+	// Timeout of a single auth request, 10s when not set
+	Timeout time.Duration
+	// TLSConfig of the connection to the endpoint, e.g. with a client
+	// certificate for mTLS or the CA of the endpoint
+	TLSConfig *tls.Config
+
+	// CacheTTL is how long granted results are cached, NegativeCacheTTL how
+	// long denied results are cached. Zero disables the cache.
+	CacheTTL         time.Duration
+	NegativeCacheTTL time.Duration
+
+	// Retries of requests that failed because the endpoint is unavailable
+	Retries int
+	// RetryDelay is the delay before the first retry, it doubles on every
+	// retry. 500ms when not set.
+	RetryDelay time.Duration
+
+	// InjectHeaders adds headers derived from the context of the
+	// authenticated request to the auth request, e.g. its trace context
+	InjectHeaders func(ctx context.Context, header http.Header)
+}
+
+// Result is the JSON response of a granted auth request, all fields are
+// optional
+type Result struct {
+	// User is the id of the authenticated user, the username when not set
+	User string `json:"user"`
+	// Scopes granted to the user, all scopes when not set
+	Scopes []string `json:"scopes"`
+	// Quota is the number of bytes a single upload of the user may have, 0
+	// is unlimited. Usage isn't tracked across uploads.
+	Quota int64 `json:"quota"`
+}
+
+// UnavailableError is returned when the endpoint could not be reached or
+// failed, as opposed to denying the credentials
+type UnavailableError struct {
+	Err error
+}
+
+func (e *UnavailableError) Error() string {
+	return fmt.Sprintf("auth service unavailable: %s", e.Err.Error())
+}
+
+// Unavailable reports that the credentials could not be checked
+func (e *UnavailableError) Unavailable() bool {
+	return true
+}
+
+type cacheEntry struct {
+	result  Result
+	ok      bool
+	expires time.Time
 }
 
 type APIAuthenticator struct {
 	config APIConfig
+	client *http.Client
+
+	mutex sync.Mutex
+	cache map[[sha256.Size]byte]cacheEntry
 }
 
 func New(cfg APIConfig) *APIAuthenticator {
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = defaultTimeout
+	}
+
+	if cfg.RetryDelay <= 0 {
+		cfg.RetryDelay = defaultRetryDelay
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = cfg.TLSConfig
+
 	return &APIAuthenticator{
 		config: cfg,
+		client: &http.Client{Timeout: cfg.Timeout, Transport: transport},
+		cache:  map[[sha256.Size]byte]cacheEntry{},
 	}
 }
 
 func (a *APIAuthenticator) Authenticate(user, password string) (bool, error) {
+	_, ok, err := a.AuthenticateResult(user, password)
+	return ok, err
+}
+
+// AuthenticateResult checks the credentials with the endpoint. Denied
+// credentials are reported as not ok without an error, an *UnavailableError
+// means the endpoint could not be reached after the retries.
+func (a *APIAuthenticator) AuthenticateResult(user, password string) (Result, bool, error) {
+	return a.AuthenticateResultContext(context.Background(), user, password)
+}
+
+// AuthenticateResultContext is AuthenticateResult for the request of ctx,
+// the auth requests are canceled with ctx
+func (a *APIAuthenticator) AuthenticateResultContext(ctx context.Context, user, password string) (Result, bool, error) {
+	key := sha256.Sum256([]byte(user + "\x00" + password))
+
+	if entry, ok := a.cached(key); ok {
+		return entry.result, entry.ok, nil
+	}
+
+	var result Result
+	var ok bool
+	var err error
+
+	delay := a.config.RetryDelay
+	for attempt := 0; ; attempt++ {
+		result, ok, err = a.request(ctx, user, password)
+		if _, unavailable := err.(*UnavailableError); !unavailable || attempt >= a.config.Retries {
+			break
+		}
+
+		select {
+		case <-ctx.Done():
+			return result, false, ctx.Err()
+		case <-time.After(delay):
+		}
+
+		delay *= 2
+	}
+
+	if err != nil {
+		return result, false, err
+	}
+
+	if ok {
+		a.store(key, cacheEntry{result: result, ok: true}, a.config.CacheTTL)
+	} else {
+		a.store(key, cacheEntry{}, a.config.NegativeCacheTTL)
+	}
+
+	return result, ok, nil
+}
+
+func (a *APIAuthenticator) request(ctx context.Context, user, password string) (Result, bool, error) {
+	var result Result
+
 	data, err := json.Marshal(map[string]string{
 		"username": user,
 		"password": password,
 	})
 	if err != nil {
-		return false, err
+		return result, false, err
 	}
+
 	req, err := http.NewRequest(http.MethodPost, a.config.Endpoint, bytes.NewReader(data))
 	if err != nil {
-		return false, err
+		return result, false, err
+	}
+
+	req = req.WithContext(ctx)
+
+	req.Header.Set("Content-Type", "application/json")
+	for key, value := range a.config.Headers {
+		req.Header.Add(key, value)
+	}
+
+	if a.config.InjectHeaders != nil {
+		a.config.InjectHeaders(ctx, req.Header)
+	}
+
+	resp, err := a.client.Do(req)
+	if err != nil {
+		return result, false, &UnavailableError{err}
 	}
-	if a.config.Headers != nil {
-		for key, value := range a.config.Headers {
-			req.Header.Add(key, value)
+
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxResponseSize))
+	if err != nil {
+		return result, false, &UnavailableError{err}
+	}
+
+	switch {
+	case resp.StatusCode == http.StatusOK:
+	case resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden:
+		return result, false, nil
+	case resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500:
+		return result, false, &UnavailableError{fmt.Errorf("unexpected status %s", resp.Status)}
+	default:
+		return result, false, fmt.Errorf("unexpected status of auth request: %s", resp.Status)
+	}
+
+	if len(bytes.TrimSpace(body)) != 0 {
+		if err := json.Unmarshal(body, &result); err != nil {
+			return result, false, fmt.Errorf("invalid auth response: %s", err.Error())
 		}
 	}
-	resp, err := http.DefaultClient.Do(req)
-	if err != nil || resp.StatusCode != 200 {
-		return false, fmt.Errorf("failed to send an auth request: %v", err)
+
+	if result.User == "" {
+		result.User = user
+	}
+
+	return result, true, nil
+}
+
+func (a *APIAuthenticator) cached(key [sha256.Size]byte) (cacheEntry, bool) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	entry, ok := a.cache[key]
+	if !ok || time.Now().After(entry.expires) {
+		return entry, false
 	}
-	return true, nil
+
+	return entry, true
+}
+
+func (a *APIAuthenticator) store(key [sha256.Size]byte, entry cacheEntry, ttl time.Duration) {
+	if ttl <= 0 {
+		return
+	}
+
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	now := time.Now()
+	if len(a.cache) >= maxCacheEntries {
+		for k, e := range a.cache {
+			if now.After(e.expires) {
+				delete(a.cache, k)
+			}
+		}
+
+		if len(a.cache) >= maxCacheEntries {
+			a.cache = map[[sha256.Size]byte]cacheEntry{}
+		}
+	}
+
+	entry.expires = now.Add(ttl)
+	a.cache[key] = entry
 }
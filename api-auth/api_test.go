@@ -1,9 +1,13 @@
 package apiauth_test
 
 import (
+	"context"
+	"encoding/json"
 	"net/http"
 	"net/http/httptest"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/brianvoe/gofakeit/v5"
 	apiauth "github.com/dutchcoders/transfer.sh/api-auth"
@@ -44,7 +48,172 @@ func TestAPIAuthenticator(t *testing.T) {
 		}
 		api := apiauth.New(cfg)
 		result, err := api.Authenticate(user, password)
-		assert.Error(t, err)
+		assert.NoError(t, err)
 		assert.False(t, result)
 	})
 }
+
+func TestAPIAuthenticatorResult(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var credentials map[string]string
+		json.NewDecoder(r.Body).Decode(&credentials)
+
+		if credentials["password"] != "secret" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+
+		json.NewEncoder(w).Encode(apiauth.Result{User: "42", Scopes: []string{"upload"}, Quota: 1024})
+	}))
+	defer ts.Close()
+
+	api := apiauth.New(apiauth.APIConfig{Endpoint: ts.URL})
+
+	result, ok, err := api.AuthenticateResult("cherie", "secret")
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, apiauth.Result{User: "42", Scopes: []string{"upload"}, Quota: 1024}, result)
+
+	_, ok, err = api.AuthenticateResult("cherie", "wrong")
+	assert.NoError(t, err)
+	assert.False(t, ok)
+}
+
+func TestAPIAuthenticatorCache(t *testing.T) {
+	var requests int32
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+
+		var credentials map[string]string
+		json.NewDecoder(r.Body).Decode(&credentials)
+
+		if credentials["password"] != "secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+		}
+	}))
+	defer ts.Close()
+
+	api := apiauth.New(apiauth.APIConfig{Endpoint: ts.URL, CacheTTL: time.Minute, NegativeCacheTTL: 50 * time.Millisecond})
+
+	for i := 0; i < 3; i++ {
+		ok, err := api.Authenticate("cherie", "secret")
+		assert.NoError(t, err)
+		assert.True(t, ok)
+
+		ok, err = api.Authenticate("cherie", "wrong")
+		assert.NoError(t, err)
+		assert.False(t, ok)
+	}
+
+	assert.Equal(t, int32(2), atomic.LoadInt32(&requests))
+
+	time.Sleep(100 * time.Millisecond)
+
+	_, _ = api.Authenticate("cherie", "wrong")
+	assert.Equal(t, int32(3), atomic.LoadInt32(&requests))
+}
+
+func TestAPIAuthenticatorUnavailable(t *testing.T) {
+	var requests int32
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&requests, 1) < 3 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer ts.Close()
+
+	t.Run("retried", func(t *testing.T) {
+		api := apiauth.New(apiauth.APIConfig{Endpoint: ts.URL, Retries: 2, RetryDelay: time.Millisecond})
+
+		ok, err := api.Authenticate("cherie", "secret")
+		assert.NoError(t, err)
+		assert.True(t, ok)
+		assert.Equal(t, int32(3), atomic.LoadInt32(&requests))
+	})
+
+	t.Run("canceled", func(t *testing.T) {
+		failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}))
+		defer failing.Close()
+
+		api := apiauth.New(apiauth.APIConfig{Endpoint: failing.URL, Retries: 2, RetryDelay: time.Minute})
+
+		ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+		defer cancel()
+
+		start := time.Now()
+		_, ok, err := api.AuthenticateResultContext(ctx, "cherie", "secret")
+		assert.False(t, ok)
+		assert.Equal(t, context.DeadlineExceeded, err)
+		assert.True(t, time.Since(start) < time.Minute)
+	})
+
+	t.Run("timeout", func(t *testing.T) {
+		slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			time.Sleep(200 * time.Millisecond)
+		}))
+		defer slow.Close()
+
+		api := apiauth.New(apiauth.APIConfig{Endpoint: slow.URL, Timeout: 20 * time.Millisecond, NegativeCacheTTL: time.Minute})
+
+		ok, err := api.Authenticate("cherie", "secret")
+		assert.False(t, ok)
+		assert.IsType(t, &apiauth.UnavailableError{}, err)
+	})
+
+	t.Run("misconfigured", func(t *testing.T) {
+		missing := httptest.NewServer(http.NotFoundHandler())
+		defer missing.Close()
+
+		api := apiauth.New(apiauth.APIConfig{Endpoint: missing.URL, Retries: 2})
+
+		ok, err := api.Authenticate("cherie", "secret")
+		assert.False(t, ok)
+		assert.Error(t, err)
+
+		_, unavailable := err.(*apiauth.UnavailableError)
+		assert.False(t, unavailable)
+	})
+}
+
+func TestAPIAuthenticatorInjectHeaders(t *testing.T) {
+	traceparent := "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("traceparent") != traceparent {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer ts.Close()
+
+	type key struct{}
+
+	api := apiauth.New(apiauth.APIConfig{
+		Endpoint: ts.URL,
+		InjectHeaders: func(ctx context.Context, header http.Header) {
+			if value, ok := ctx.Value(key{}).(string); ok {
+				header.Set("traceparent", value)
+			}
+		},
+	})
+
+	_, ok, err := api.AuthenticateResultContext(context.WithValue(context.Background(), key{}, traceparent), "user", "secret")
+	assert.NoError(t, err)
+	assert.True(t, ok)
+
+	_, ok, err = api.AuthenticateResult("user", "secret")
+	assert.NoError(t, err)
+	assert.False(t, ok)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, ok, err = api.AuthenticateResultContext(ctx, "user", "secret")
+	assert.Error(t, err)
+	assert.False(t, ok)
+}
@@ -0,0 +1,115 @@
+package cmd
+
+import (
+	"io"
+	"log"
+	"os"
+
+	"github.com/dutchcoders/transfer.sh/server"
+	"github.com/fatih/color"
+	"github.com/urfave/cli"
+)
+
+var exportFlags = []cli.Flag{
+	cli.StringFlag{
+		Name:  "output",
+		Usage: "path of the archive to write, - for stdout",
+		Value: "-",
+	},
+}
+
+var importFlags = []cli.Flag{
+	cli.StringFlag{
+		Name:  "input",
+		Usage: "path of the archive to read, - for stdin",
+		Value: "-",
+	},
+	cli.BoolFlag{
+		Name:  "restore-reserved",
+		Usage: "restore the reserved tokens of the archive, e.g. the api keys",
+	},
+}
+
+// configuredStorage returns the storage and metadata storage configured by
+// the global provider flags, as used by the server
+func configuredStorage(c *cli.Context, logger *log.Logger) (server.Storage, server.Storage, error) {
+	global := &providerConfig{values: map[string]string{}, global: c}
+
+	storage := getStorage(global, c.GlobalString("provider"), logger)
+	if storage == nil {
+		return nil, nil, cli.NewExitError("Provider not set or invalid.", 1)
+	}
+
+	metaStorage := storage
+	if metaProvider := c.GlobalString("meta-provider"); metaProvider != "" {
+		metaStorage = getStorage(global, metaProvider, logger)
+	}
+
+	if metaStorage == nil {
+		return nil, nil, cli.NewExitError("Metadata Provider not set or invalid.", 1)
+	}
+
+	return storage, metaStorage, nil
+}
+
+func ExportAction(c *cli.Context) error {
+	// the archive may be written to stdout
+	logger := log.New(os.Stderr, "[transfer.sh]", log.LstdFlags)
+
+	storage, metaStorage, err := configuredStorage(c, logger)
+	if err != nil {
+		return err
+	}
+
+	var w io.WriteCloser = os.Stdout
+	if output := c.String("output"); output != "-" {
+		if w, err = os.OpenFile(output, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600); err != nil {
+			return cli.NewExitError(err.Error(), 1)
+		}
+	}
+
+	defer w.Close()
+
+	ctx, cancel := interruptContext()
+	defer cancel()
+
+	manifest, err := server.Export(ctx, w, storage, metaStorage, logger)
+	if err != nil {
+		return cli.NewExitError(color.RedString("Export failed: %s", err.Error()), 1)
+	}
+
+	logger.Printf("exported %d files", len(manifest.Files))
+	return nil
+}
+
+func ImportAction(c *cli.Context) error {
+	logger := log.New(os.Stderr, "[transfer.sh]", log.LstdFlags)
+
+	storage, metaStorage, err := configuredStorage(c, logger)
+	if err != nil {
+		return err
+	}
+
+	var r io.ReadCloser = os.Stdin
+	if input := c.String("input"); input != "-" {
+		if r, err = os.Open(input); err != nil {
+			return cli.NewExitError(err.Error(), 1)
+		}
+	}
+
+	defer r.Close()
+
+	ctx, cancel := interruptContext()
+	defer cancel()
+
+	manifest, err := server.Import(ctx, r, storage, metaStorage, server.ImportOptions{
+		RestoreReserved: c.Bool("restore-reserved"),
+		Logger:          logger,
+	})
+	if err != nil {
+		return cli.NewExitError(color.RedString("Import failed: %s", err.Error()), 1)
+	}
+
+	logger.Printf("imported %d files from backup of %s", len(manifest.Files), manifest.Created)
+	return nil
+}
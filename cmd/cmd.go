@@ -1,12 +1,20 @@
 package cmd
 
 import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"fmt"
+	"io/ioutil"
 	"log"
 	"os"
+	"os/signal"
 	"strings"
+	"syscall"
+	"time"
 
 	apiauth "github.com/dutchcoders/transfer.sh/api-auth"
+	jwtauth "github.com/dutchcoders/transfer.sh/jwt-auth"
 
 	redisStorage "github.com/dutchcoders/transfer.sh/redis-storage"
 
@@ -47,10 +55,58 @@ var globalFlags = []cli.Flag{
 	// hostnames
 	cli.StringFlag{
 		Name:   "profile-listener",
-		Usage:  "127.0.0.1:6060",
+		Usage:  "ops listener for pprof, health probes and the admin routes, e.g. 127.0.0.1:6060",
 		Value:  "",
 		EnvVar: "PROFILE_LISTENER",
 	},
+	cli.StringFlag{
+		Name:   "ops-auth-user",
+		Usage:  "user for http basic auth of pprof on the ops listener",
+		Value:  "",
+		EnvVar: "OPS_AUTH_USER",
+	},
+	cli.StringFlag{
+		Name:   "ops-auth-pass",
+		Usage:  "pass for http basic auth of pprof on the ops listener",
+		Value:  "",
+		EnvVar: "OPS_AUTH_PASS",
+	},
+	cli.StringFlag{
+		Name:   "ops-tls-cert-file",
+		Usage:  "certificate of the ops listener, it serves tls when set",
+		Value:  "",
+		EnvVar: "OPS_TLS_CERT_FILE",
+	},
+	cli.StringFlag{
+		Name:   "ops-tls-private-key",
+		Usage:  "private key of the ops listener",
+		Value:  "",
+		EnvVar: "OPS_TLS_PRIVATE_KEY",
+	},
+	cli.StringFlag{
+		Name:   "ops-tls-client-ca",
+		Usage:  "CA certificates the clients of the ops listener need a certificate of",
+		Value:  "",
+		EnvVar: "OPS_TLS_CLIENT_CA",
+	},
+	cli.StringFlag{
+		Name:   "tracing",
+		Usage:  "exporter of the traces: otlp or stdout, tracing is disabled when not set",
+		Value:  "",
+		EnvVar: "TRACING",
+	},
+	cli.StringFlag{
+		Name:   "tracing-endpoint",
+		Usage:  "OTLP/HTTP traces endpoint of the collector",
+		Value:  "http://localhost:4318/v1/traces",
+		EnvVar: "TRACING_ENDPOINT",
+	},
+	cli.Float64Flag{
+		Name:   "tracing-sample-ratio",
+		Usage:  "ratio of the traces started by the server that are recorded, from 0 to 1",
+		Value:  1,
+		EnvVar: "TRACING_SAMPLE_RATIO",
+	},
 	cli.BoolFlag{
 		Name:   "force-https",
 		Usage:  "",
@@ -77,6 +133,29 @@ var globalFlags = []cli.Flag{
 		Value:  "",
 		EnvVar: "TLS_PRIVATE_KEY",
 	},
+	cli.StringFlag{
+		Name:   "tls-client-ca",
+		Usage:  "CA certificates that verify client certificates on the tls listener",
+		Value:  "",
+		EnvVar: "TLS_CLIENT_CA",
+	},
+	cli.StringFlag{
+		Name:   "tls-client-auth",
+		Usage:  "verify|require, require refuses connections without a valid client certificate",
+		Value:  "verify",
+		EnvVar: "TLS_CLIENT_AUTH",
+	},
+	cli.StringFlag{
+		Name:   "tls-client-user",
+		Usage:  "cn|email|dns|uri, the field of a client certificate that names its user",
+		Value:  "cn",
+		EnvVar: "TLS_CLIENT_USER",
+	},
+	cli.BoolFlag{
+		Name:   "tls-client-uploads",
+		Usage:  "accept uploads of clients with a valid certificate",
+		EnvVar: "TLS_CLIENT_UPLOADS",
+	},
 	cli.StringFlag{
 		Name:   "temp-path",
 		Usage:  "path to temp files",
@@ -101,6 +180,12 @@ var globalFlags = []cli.Flag{
 		Value:  "",
 		EnvVar: "PROXY_PORT",
 	},
+	cli.StringFlag{
+		Name:   "secret",
+		Usage:  "key that signs download cookies and links, random when not set",
+		Value:  "",
+		EnvVar: "SECRET",
+	},
 	cli.StringFlag{
 		Name:   "ga-key",
 		Usage:  "key for google analytics (front end)",
@@ -125,6 +210,99 @@ var globalFlags = []cli.Flag{
 		Value:  "",
 		EnvVar: "API_HEADERS",
 	},
+	cli.DurationFlag{
+		Name:   "api-timeout",
+		Usage:  "timeout of a request to the api authenticator",
+		Value:  10 * time.Second,
+		EnvVar: "API_TIMEOUT",
+	},
+	cli.IntFlag{
+		Name:   "api-retries",
+		Usage:  "number of retries when the api authenticator is unavailable",
+		Value:  0,
+		EnvVar: "API_RETRIES",
+	},
+	cli.DurationFlag{
+		Name:   "api-cache-ttl",
+		Usage:  "how long granted api authenticator results are cached, 0 disables it",
+		Value:  0,
+		EnvVar: "API_CACHE_TTL",
+	},
+	cli.DurationFlag{
+		Name:   "api-negative-cache-ttl",
+		Usage:  "how long denied api authenticator results are cached, 0 disables it",
+		Value:  0,
+		EnvVar: "API_NEGATIVE_CACHE_TTL",
+	},
+	cli.StringFlag{
+		Name:   "api-tls-ca",
+		Usage:  "CA certificates of the api authenticator endpoint",
+		Value:  "",
+		EnvVar: "API_TLS_CA",
+	},
+	cli.StringFlag{
+		Name:   "api-tls-cert",
+		Usage:  "client certificate for the api authenticator endpoint",
+		Value:  "",
+		EnvVar: "API_TLS_CERT",
+	},
+	cli.StringFlag{
+		Name:   "api-tls-key",
+		Usage:  "client private key for the api authenticator endpoint",
+		Value:  "",
+		EnvVar: "API_TLS_KEY",
+	},
+	cli.BoolFlag{
+		Name:   "api-uploads",
+		Usage:  "accept the credentials of the api authenticator for uploads",
+		EnvVar: "API_UPLOADS",
+	},
+	cli.StringFlag{
+		Name:   "jwt-jwks",
+		Usage:  "JWKS file with the keys that sign bearer tokens",
+		Value:  "",
+		EnvVar: "JWT_JWKS",
+	},
+	cli.StringFlag{
+		Name:   "jwt-jwks-url",
+		Usage:  "JWKS url with the keys that sign bearer tokens, refreshed hourly and on unknown key ids",
+		Value:  "",
+		EnvVar: "JWT_JWKS_URL",
+	},
+	cli.StringFlag{
+		Name:   "jwt-secret",
+		Usage:  "secret of HS256 signed bearer tokens",
+		Value:  "",
+		EnvVar: "JWT_SECRET",
+	},
+	cli.StringFlag{
+		Name:   "jwt-issuer",
+		Usage:  "required iss claim of bearer tokens",
+		Value:  "",
+		EnvVar: "JWT_ISSUER",
+	},
+	cli.StringFlag{
+		Name:   "jwt-audience",
+		Usage:  "required aud claim of bearer tokens",
+		Value:  "",
+		EnvVar: "JWT_AUDIENCE",
+	},
+	cli.StringFlag{
+		Name:   "jwt-user-claim",
+		Usage:  "claim with the user of bearer tokens, nested claims are separated by dots",
+		Value:  "sub",
+		EnvVar: "JWT_USER_CLAIM",
+	},
+	cli.BoolFlag{
+		Name:   "api-keys",
+		Usage:  "accept the api keys managed with the keys command",
+		EnvVar: "API_KEYS",
+	},
+	cli.BoolFlag{
+		Name:   "jwt-uploads",
+		Usage:  "accept bearer tokens for uploads",
+		EnvVar: "JWT_UPLOADS",
+	},
 	cli.StringFlag{
 		Name:   "provider",
 		Usage:  "s3|gdrive|local",
@@ -148,6 +326,42 @@ var globalFlags = []cli.Flag{
 		Value:  "",
 		EnvVar: "REDIS_PWD",
 	},
+	cli.DurationFlag{
+		Name:   "storage-timeout",
+		Usage:  "timeout for storage operations, e.g. 30s (0 disables the timeout)",
+		Value:  0,
+		EnvVar: "STORAGE_TIMEOUT",
+	},
+	cli.DurationFlag{
+		Name:   "storage-transfer-timeout",
+		Usage:  "timeout for transferring a file from or to storage, e.g. 1h (0 disables the timeout)",
+		Value:  0,
+		EnvVar: "STORAGE_TRANSFER_TIMEOUT",
+	},
+	cli.IntFlag{
+		Name:   "storage-retries",
+		Usage:  "number of retries of failed idempotent storage operations",
+		Value:  0,
+		EnvVar: "STORAGE_RETRIES",
+	},
+	cli.DurationFlag{
+		Name:   "storage-retry-delay",
+		Usage:  "base delay between storage retries, doubled on every retry",
+		Value:  100 * time.Millisecond,
+		EnvVar: "STORAGE_RETRY_DELAY",
+	},
+	cli.IntFlag{
+		Name:   "storage-breaker-threshold",
+		Usage:  "consecutive storage failures that open the circuit breaker (0 disables the breaker)",
+		Value:  0,
+		EnvVar: "STORAGE_BREAKER_THRESHOLD",
+	},
+	cli.DurationFlag{
+		Name:   "storage-breaker-cooldown",
+		Usage:  "time the storage circuit breaker stays open before a trial request",
+		Value:  30 * time.Second,
+		EnvVar: "STORAGE_BREAKER_COOLDOWN",
+	},
 	cli.StringFlag{
 		Name:   "s3-endpoint",
 		Usage:  "",
@@ -188,6 +402,34 @@ var globalFlags = []cli.Flag{
 		Usage:  "Forces path style URLs, required for Minio.",
 		EnvVar: "S3_PATH_STYLE",
 	},
+	cli.StringFlag{
+		Name:   "s3-sse",
+		Usage:  "server-side encryption of uploads: AES256 or aws:kms",
+		Value:  "",
+		EnvVar: "S3_SSE",
+	},
+	cli.StringFlag{
+		Name:   "s3-sse-kms-key-id",
+		Usage:  "KMS key used for aws:kms server-side encryption",
+		Value:  "",
+		EnvVar: "S3_SSE_KMS_KEY_ID",
+	},
+	cli.StringFlag{
+		Name:   "s3-storage-class",
+		Usage:  "storage class of uploads, e.g. STANDARD_IA",
+		Value:  "",
+		EnvVar: "S3_STORAGE_CLASS",
+	},
+	cli.BoolFlag{
+		Name:   "s3-embed-metadata",
+		Usage:  "stores metadata as user metadata of the uploaded object instead of a separate object",
+		EnvVar: "S3_EMBED_METADATA",
+	},
+	cli.BoolFlag{
+		Name:   "s3-lifecycle-tags",
+		Usage:  "tags uploads with Max-Days as transfersh-max-days for bucket lifecycle rules",
+		EnvVar: "S3_LIFECYCLE_TAGS",
+	},
 	cli.StringFlag{
 		Name:   "gdrive-client-json-filepath",
 		Usage:  "",
@@ -259,6 +501,24 @@ var globalFlags = []cli.Flag{
 		Value:  "",
 		EnvVar: "HTTP_AUTH_PASS",
 	},
+	cli.StringFlag{
+		Name:   "http-auth-htpasswd",
+		Usage:  "htpasswd file with the users for http basic auth, reloaded on change or SIGHUP",
+		Value:  "",
+		EnvVar: "HTTP_AUTH_HTPASSWD",
+	},
+	cli.StringFlag{
+		Name:   "policy-file",
+		Usage:  "JSON file with the authorization rules of the routes",
+		Value:  "",
+		EnvVar: "POLICY_FILE",
+	},
+	cli.StringFlag{
+		Name:   "admin-users",
+		Usage:  "comma separated list of users allowed to use the admin api",
+		Value:  "",
+		EnvVar: "ADMIN_USERS",
+	},
 	cli.StringFlag{
 		Name:   "ip-whitelist",
 		Usage:  "comma separated list of ips allowed to connect to the service",
@@ -303,6 +563,28 @@ func New() *Cmd {
 			Name:   "version",
 			Action: VersionAction,
 		},
+		{
+			Name:      "migrate",
+			Usage:     "copy all files and metadata from one storage provider to another",
+			ArgsUsage: " ",
+			Flags:     migrateFlags,
+			Action:    MigrateAction,
+		},
+		{
+			Name:      "export",
+			Usage:     "write all files and metadata to a tar archive",
+			ArgsUsage: " ",
+			Flags:     exportFlags,
+			Action:    ExportAction,
+		},
+		{
+			Name:      "import",
+			Usage:     "restore files and metadata from a tar archive",
+			ArgsUsage: " ",
+			Flags:     importFlags,
+			Action:    ImportAction,
+		},
+		keysCommand,
 	}
 
 	app.Before = func(c *cli.Context) error {
@@ -330,6 +612,49 @@ func New() *Cmd {
 			options = append(options, server.ProfileListener(v))
 		}
 
+		if opsAuthUser, opsAuthPass := c.String("ops-auth-user"), c.String("ops-auth-pass"); opsAuthUser == "" && opsAuthPass == "" {
+		} else if opsAuthUser == "" || opsAuthPass == "" {
+			panic("ops-auth-user and ops-auth-pass need each other")
+		} else {
+			var authenticator server.DefaultServAuthenticator
+			authenticator.Set(opsAuthUser, opsAuthPass)
+			options = append(options, server.OpsAuth(&authenticator))
+		}
+
+		if cert := c.String("ops-tls-cert-file"); cert == "" {
+			if c.String("ops-tls-client-ca") != "" {
+				panic("ops-tls-client-ca needs ops-tls-cert-file")
+			}
+		} else if pk := c.String("ops-tls-private-key"); pk == "" {
+			panic("ops-tls-cert-file needs ops-tls-private-key")
+		} else {
+			var pool *x509.CertPool
+			if ca := c.String("ops-tls-client-ca"); ca != "" {
+				var err error
+				if pool, err = loadCertPool(ca); err != nil {
+					panic(err)
+				}
+			}
+
+			options = append(options, server.OpsTLS(cert, pk, pool))
+		}
+
+		switch c.String("tracing") {
+		case "":
+		case "otlp":
+			options = append(options, server.Tracing(server.NewOTLPExporter(c.String("tracing-endpoint"), nil)))
+		case "stdout":
+			options = append(options, server.Tracing(server.NewStdoutExporter(os.Stdout)))
+		default:
+			panic("tracing must be otlp or stdout")
+		}
+
+		if v := c.Float64("tracing-sample-ratio"); v < 0 || v > 1 {
+			panic("tracing-sample-ratio must be between 0 and 1")
+		} else {
+			options = append(options, server.TraceSampling(v))
+		}
+
 		if v := c.String("web-path"); v != "" {
 			options = append(options, server.WebPath(v))
 		}
@@ -338,6 +663,10 @@ func New() *Cmd {
 			options = append(options, server.ProxyPath(v))
 		}
 
+		if v := c.String("secret"); v != "" {
+			options = append(options, server.Secret(v))
+		}
+
 		if v := c.String("proxy-port"); v != "" {
 			options = append(options, server.ProxyPort(v))
 		}
@@ -382,6 +711,33 @@ func New() *Cmd {
 			options = append(options, server.TLSConfig(cert, pk))
 		}
 
+		if ca := c.String("tls-client-ca"); ca != "" {
+			pool, err := loadCertPool(ca)
+			if err != nil {
+				panic(err)
+			}
+
+			field, err := server.ParseCertificateUserField(c.String("tls-client-user"))
+			if err != nil {
+				panic(err)
+			}
+
+			var required bool
+			switch c.String("tls-client-auth") {
+			case "verify":
+			case "require":
+				required = true
+			default:
+				panic("tls-client-auth must be verify or require.")
+			}
+
+			options = append(options, server.ClientCertificates(pool, required, field))
+
+			if c.Bool("tls-client-uploads") {
+				options = append(options, server.CertificateUploads())
+			}
+		}
+
 		if c.Bool("profiler") {
 			options = append(options, server.EnableProfiler())
 		}
@@ -390,7 +746,15 @@ func New() *Cmd {
 			options = append(options, server.ForceHTTPs())
 		}
 
-		if httpAuthUser := c.String("http-auth-user"); httpAuthUser == "" {
+		if htpasswd := c.String("http-auth-htpasswd"); htpasswd != "" {
+			authenticator, err := server.NewHtpasswdAuthenticator(htpasswd, logger)
+			if err != nil {
+				panic(err)
+			}
+
+			reloadOnHangup(authenticator.Reload, logger)
+			options = append(options, server.AuthCredential(server.ServerAuthKey, authenticator))
+		} else if httpAuthUser := c.String("http-auth-user"); httpAuthUser == "" {
 		} else if httpAuthPass := c.String("http-auth-pass"); httpAuthPass == "" {
 		} else {
 			var authenticator server.DefaultServAuthenticator
@@ -398,6 +762,26 @@ func New() *Cmd {
 			options = append(options, server.AuthCredential(server.ServerAuthKey, &authenticator))
 		}
 
+		if path := c.String("policy-file"); path != "" {
+			policy, err := server.LoadPolicy(path)
+			if err != nil {
+				panic(err)
+			}
+
+			options = append(options, server.UsePolicy(policy))
+		}
+
+		if adminUsers := c.String("admin-users"); adminUsers != "" {
+			var users []string
+			for _, user := range strings.Split(adminUsers, ",") {
+				if user = strings.TrimSpace(user); user != "" {
+					users = append(users, user)
+				}
+			}
+
+			options = append(options, server.AdminUsers(users...))
+		}
+
 		applyIPFilter := false
 		ipFilterOptions := server.IPFilterOptions{}
 		if ipWhitelist := c.String("ip-whitelist"); ipWhitelist != "" {
@@ -420,8 +804,6 @@ func New() *Cmd {
 			panic("Provider not set or invalid.")
 		}
 
-		options = append(options, server.UseStorage(fileStorage))
-
 		var metaStorage server.Storage
 		if metaProvider := c.String("meta-provider"); metaProvider != "" {
 			metaStorage = getStorage(c, metaProvider, logger)
@@ -433,6 +815,25 @@ func New() *Cmd {
 			panic("Metadata Provider not set or invalid.")
 		}
 
+		timeout, transferTimeout := c.Duration("storage-timeout"), c.Duration("storage-transfer-timeout")
+		retryOptions := server.RetryOptions{
+			Retries:          c.Int("storage-retries"),
+			Delay:            c.Duration("storage-retry-delay"),
+			FailureThreshold: c.Int("storage-breaker-threshold"),
+			Cooldown:         c.Duration("storage-breaker-cooldown"),
+		}
+
+		// the metrics and traces record every attempt made to the backend
+		if metaStorage == fileStorage {
+			fileStorage = server.NewRetryStorage(server.NewTimeoutStorage(server.NewTracingStorage(server.NewMetricsStorage(fileStorage)), timeout, transferTimeout), retryOptions)
+			metaStorage = fileStorage
+		} else {
+			fileStorage = server.NewRetryStorage(server.NewTimeoutStorage(server.NewTracingStorage(server.NewMetricsStorage(fileStorage)), timeout, transferTimeout), retryOptions)
+			metaStorage = server.NewRetryStorage(server.NewTimeoutStorage(server.NewTracingStorage(server.NewMetricsStorage(metaStorage)), timeout, transferTimeout), retryOptions)
+		}
+
+		options = append(options, server.UseStorage(fileStorage))
+
 		if endpoint := c.String("api-endpoint"); endpoint != "" {
 			var headerM map[string]string
 			if headerStr := c.String("api-headers"); headerStr != "" {
@@ -443,10 +844,49 @@ func New() *Cmd {
 					headerM[pair[0]] = pair[1]
 				}
 			}
+
+			tlsConfig, err := clientTLSConfig(c.String("api-tls-ca"), c.String("api-tls-cert"), c.String("api-tls-key"))
+			if err != nil {
+				panic(err)
+			}
+
 			options = append(options, server.UseAPIAuthenticator(apiauth.APIConfig{
-				Endpoint: endpoint,
-				Headers:  headerM,
+				Endpoint:         endpoint,
+				Headers:          headerM,
+				Timeout:          c.Duration("api-timeout"),
+				TLSConfig:        tlsConfig,
+				CacheTTL:         c.Duration("api-cache-ttl"),
+				NegativeCacheTTL: c.Duration("api-negative-cache-ttl"),
+				Retries:          c.Int("api-retries"),
 			}))
+
+			if c.Bool("api-uploads") {
+				options = append(options, server.APIAuthUploads())
+			}
+		}
+
+		if c.String("jwt-jwks") != "" || c.String("jwt-jwks-url") != "" || c.String("jwt-secret") != "" {
+			verifier, err := jwtauth.New(jwtauth.Config{
+				JWKSFile:  c.String("jwt-jwks"),
+				JWKSURL:   c.String("jwt-jwks-url"),
+				Secret:    []byte(c.String("jwt-secret")),
+				Issuer:    c.String("jwt-issuer"),
+				Audience:  c.String("jwt-audience"),
+				UserClaim: c.String("jwt-user-claim"),
+			})
+			if err != nil {
+				panic(err)
+			}
+
+			options = append(options, server.AuthToken(string(server.JWT), verifier))
+
+			if c.Bool("jwt-uploads") {
+				options = append(options, server.AuthToken(server.ServerAuthKey, verifier))
+			}
+		}
+
+		if c.Bool("api-keys") {
+			options = append(options, server.EnableAPIKeys())
 		}
 
 		options = append(options, server.UseMetaStorage(metaStorage))
@@ -468,7 +908,96 @@ func New() *Cmd {
 	}
 }
 
-func getStorage(c *cli.Context, provider string, logger *log.Logger) server.Storage {
+// interruptContext returns a context that is canceled on SIGINT or SIGTERM
+func interruptContext() (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	term := make(chan os.Signal, 1)
+	signal.Notify(term, os.Interrupt, syscall.SIGTERM)
+
+	go func() {
+		select {
+		case <-term:
+			cancel()
+		case <-ctx.Done():
+		}
+
+		signal.Stop(term)
+	}()
+
+	return ctx, cancel
+}
+
+// loadCertPool returns a pool with the PEM certificates of path
+func loadCertPool(path string) (*x509.CertPool, error) {
+	pem, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificates in %s", path)
+	}
+
+	return pool, nil
+}
+
+// clientTLSConfig returns the TLS config of a connection with the CA
+// certificates of caFile and the client certificate of certFile, it is nil
+// when no file is set
+func clientTLSConfig(caFile, certFile, keyFile string) (*tls.Config, error) {
+	if caFile == "" && certFile == "" && keyFile == "" {
+		return nil, nil
+	}
+
+	config := &tls.Config{}
+
+	if caFile != "" {
+		pool, err := loadCertPool(caFile)
+		if err != nil {
+			return nil, err
+		}
+
+		config.RootCAs = pool
+	}
+
+	if certFile != "" || keyFile != "" {
+		certificate, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, err
+		}
+
+		config.Certificates = []tls.Certificate{certificate}
+	}
+
+	return config, nil
+}
+
+// reloadOnHangup calls reload on every SIGHUP
+func reloadOnHangup(reload func() error, logger *log.Logger) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+
+	go func() {
+		for range hup {
+			if err := reload(); err != nil {
+				logger.Printf("Error reloading: %s", err.Error())
+			} else {
+				logger.Printf("Reloaded on SIGHUP")
+			}
+		}
+	}()
+}
+
+// flagSet is the subset of *cli.Context used to configure a storage provider
+type flagSet interface {
+	String(name string) string
+	Int(name string) int
+	Bool(name string) bool
+}
+
+func getStorage(c flagSet, provider string, logger *log.Logger) server.Storage {
 	switch provider {
 	case "s3":
 		if accessKey := c.String("aws-access-key"); accessKey == "" {
@@ -477,7 +1006,13 @@ func getStorage(c *cli.Context, provider string, logger *log.Logger) server.Stor
 			panic("secret-key not set.")
 		} else if bucket := c.String("bucket"); bucket == "" {
 			panic("bucket not set.")
-		} else if storage, err := server.NewS3Storage(accessKey, secretKey, bucket, c.String("s3-region"), c.String("s3-endpoint"), logger, c.Bool("s3-no-multipart"), c.Bool("s3-path-style")); err != nil {
+		} else if storage, err := server.NewS3Storage(accessKey, secretKey, bucket, c.String("s3-region"), c.String("s3-endpoint"), logger, c.Bool("s3-no-multipart"), c.Bool("s3-path-style"), server.S3Options{
+			ServerSideEncryption: c.String("s3-sse"),
+			SSEKMSKeyId:          c.String("s3-sse-kms-key-id"),
+			StorageClass:         c.String("s3-storage-class"),
+			EmbedMetadata:        c.Bool("s3-embed-metadata"),
+			LifecycleTags:        c.Bool("s3-lifecycle-tags"),
+		}); err != nil {
 			panic(err)
 		} else {
 			return storage
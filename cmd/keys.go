@@ -0,0 +1,186 @@
+package cmd
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/dutchcoders/transfer.sh/server"
+	"github.com/fatih/color"
+	"github.com/urfave/cli"
+)
+
+var keysCreateFlags = []cli.Flag{
+	cli.StringFlag{
+		Name:  "name",
+		Usage: "name of the key, logged as the user of its uploads",
+	},
+	cli.StringSliceFlag{
+		Name:  "scope",
+		Usage: "scope granted to the key: upload, download, delete-any or admin (repeatable, default upload)",
+	},
+	cli.StringFlag{
+		Name:  "namespace",
+		Usage: "namespace of the files the key uploads and may access, all files when not set",
+	},
+	cli.DurationFlag{
+		Name:  "expires",
+		Usage: "lifetime of the key, 0 for a key that doesn't expire",
+	},
+	cli.Int64Flag{
+		Name:  "quota",
+		Usage: "number of bytes the key may upload, 0 for no limit",
+	},
+}
+
+var keysCommand = cli.Command{
+	Name:  "keys",
+	Usage: "manage the api keys stored in the metadata provider",
+	Subcommands: []cli.Command{
+		{
+			Name:      "create",
+			Usage:     "mint a new api key",
+			ArgsUsage: " ",
+			Flags:     keysCreateFlags,
+			Action:    KeysCreateAction,
+		},
+		{
+			Name:      "list",
+			Usage:     "list the api keys",
+			ArgsUsage: " ",
+			Action:    KeysListAction,
+		},
+		{
+			Name:      "revoke",
+			Usage:     "revoke an api key",
+			ArgsUsage: "<id>",
+			Action:    KeysRevokeAction,
+		},
+	},
+}
+
+// configuredKeyStore returns the key store of the configured metadata provider
+func configuredKeyStore(c *cli.Context) (*server.KeyStore, error) {
+	logger := log.New(os.Stderr, "[transfer.sh]", log.LstdFlags)
+
+	_, metaStorage, err := configuredStorage(c, logger)
+	if err != nil {
+		return nil, err
+	}
+
+	return server.NewKeyStore(metaStorage), nil
+}
+
+func KeysCreateAction(c *cli.Context) error {
+	key := server.APIKey{
+		Name:      c.String("name"),
+		Namespace: c.String("namespace"),
+		Quota:     c.Int64("quota"),
+	}
+
+	if key.Name == "" {
+		return cli.NewExitError("--name is required", 1)
+	}
+
+	scopes := c.StringSlice("scope")
+	if len(scopes) == 0 {
+		scopes = []string{string(server.ScopeUpload)}
+	}
+
+	for _, s := range scopes {
+		scope, err := server.ParseScope(s)
+		if err != nil {
+			return cli.NewExitError(err.Error(), 1)
+		}
+
+		key.Scopes = append(key.Scopes, scope)
+	}
+
+	if expires := c.Duration("expires"); expires > 0 {
+		key.Expires = time.Now().Add(expires).UTC()
+	}
+
+	keys, err := configuredKeyStore(c)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := interruptContext()
+	defer cancel()
+
+	secret, key, err := keys.Create(ctx, key)
+	if err != nil {
+		return cli.NewExitError(color.RedString("Could not create key: %s", err.Error()), 1)
+	}
+
+	fmt.Fprintf(os.Stderr, "created key %s, it is not shown again\n", key.ID)
+	fmt.Println(secret)
+	return nil
+}
+
+func KeysListAction(c *cli.Context) error {
+	keys, err := configuredKeyStore(c)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := interruptContext()
+	defer cancel()
+
+	list, err := keys.List(ctx)
+	if err != nil {
+		return cli.NewExitError(color.RedString("Could not list keys: %s", err.Error()), 1)
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tNAME\tSCOPES\tNAMESPACE\tEXPIRES\tUSED\tQUOTA")
+
+	for _, key := range list {
+		scopes := make([]string, len(key.Scopes))
+		for i, scope := range key.Scopes {
+			scopes[i] = string(scope)
+		}
+
+		expires := "never"
+		if !key.Expires.IsZero() {
+			expires = key.Expires.Format(time.RFC3339)
+			if key.Expired() {
+				expires += " (expired)"
+			}
+		}
+
+		quota := "-"
+		if key.Quota > 0 {
+			quota = fmt.Sprint(key.Quota)
+		}
+
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%d\t%s\n", key.ID, key.Name, strings.Join(scopes, ","), key.Namespace, expires, key.Used, quota)
+	}
+
+	return w.Flush()
+}
+
+func KeysRevokeAction(c *cli.Context) error {
+	id := c.Args().First()
+	if id == "" {
+		return cli.NewExitError("the id of the key is required", 1)
+	}
+
+	keys, err := configuredKeyStore(c)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := interruptContext()
+	defer cancel()
+
+	if err := keys.Revoke(ctx, id); err != nil {
+		return cli.NewExitError(color.RedString("Could not revoke key %s: %s", id, err.Error()), 1)
+	}
+
+	fmt.Fprintf(os.Stderr, "revoked key %s\n", id)
+	return nil
+}
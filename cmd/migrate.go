@@ -0,0 +1,168 @@
+package cmd
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/dutchcoders/transfer.sh/server"
+	"github.com/fatih/color"
+	"github.com/urfave/cli"
+)
+
+var migrateFlags = []cli.Flag{
+	cli.StringFlag{
+		Name:  "from",
+		Usage: "source provider config, e.g. local,basedir=./files",
+	},
+	cli.StringFlag{
+		Name:  "to",
+		Usage: "destination provider config, e.g. s3,bucket=transfersh,s3-region=eu-west-1",
+	},
+	cli.StringFlag{
+		Name:  "from-meta",
+		Usage: "source metadata provider config (defaults to --from)",
+	},
+	cli.StringFlag{
+		Name:  "to-meta",
+		Usage: "destination metadata provider config (defaults to --to)",
+	},
+	cli.StringFlag{
+		Name:  "state-file",
+		Usage: "journal of migrated files used to resume an interrupted migration",
+		Value: "transfersh-migrate.state",
+	},
+	cli.BoolFlag{
+		Name:  "dry-run",
+		Usage: "only report the files that would be copied",
+	},
+}
+
+// providerConfig resolves storage flags from a provider config of the form
+// "provider,flag=value,...", flags that are not set in the config fall back
+// to the global flags.
+type providerConfig struct {
+	provider string
+	values   map[string]string
+	global   *cli.Context
+}
+
+func parseProviderConfig(c *cli.Context, config string) (*providerConfig, error) {
+	parts := strings.Split(config, ",")
+
+	pc := &providerConfig{
+		provider: strings.TrimSpace(parts[0]),
+		values:   map[string]string{},
+		global:   c,
+	}
+
+	if pc.provider == "" {
+		return nil, fmt.Errorf("provider not set in %q", config)
+	}
+
+	for _, part := range parts[1:] {
+		pair := strings.SplitN(strings.TrimSpace(part), "=", 2)
+		if len(pair) != 2 {
+			return nil, fmt.Errorf("invalid provider option %q", part)
+		}
+
+		pc.values[pair[0]] = pair[1]
+	}
+
+	return pc, nil
+}
+
+func (pc *providerConfig) String(name string) string {
+	if v, ok := pc.values[name]; ok {
+		return v
+	}
+
+	return pc.global.GlobalString(name)
+}
+
+func (pc *providerConfig) Int(name string) int {
+	if v, ok := pc.values[name]; !ok {
+	} else if i, err := strconv.Atoi(v); err == nil {
+		return i
+	}
+
+	return pc.global.GlobalInt(name)
+}
+
+func (pc *providerConfig) Bool(name string) bool {
+	if v, ok := pc.values[name]; !ok {
+	} else if b, err := strconv.ParseBool(v); err == nil {
+		return b
+	}
+
+	return pc.global.GlobalBool(name)
+}
+
+func storageFromConfig(c *cli.Context, config string, logger *log.Logger) (server.Storage, error) {
+	pc, err := parseProviderConfig(c, config)
+	if err != nil {
+		return nil, err
+	}
+
+	storage := getStorage(pc, pc.provider, logger)
+	if storage == nil {
+		return nil, fmt.Errorf("provider %q not set or invalid", pc.provider)
+	}
+
+	return storage, nil
+}
+
+func MigrateAction(c *cli.Context) error {
+	logger := log.New(os.Stdout, "[transfer.sh]", log.LstdFlags)
+
+	from, to := c.String("from"), c.String("to")
+	if from == "" || to == "" {
+		return cli.NewExitError("both --from and --to are required", 1)
+	}
+
+	fromMeta, toMeta := c.String("from-meta"), c.String("to-meta")
+	if fromMeta == "" {
+		fromMeta = from
+	}
+
+	if toMeta == "" {
+		toMeta = to
+	}
+
+	var storages [4]server.Storage
+
+	configured := map[string]server.Storage{}
+	for i, config := range []string{from, fromMeta, to, toMeta} {
+		if storage, ok := configured[config]; ok {
+			storages[i] = storage
+			continue
+		}
+
+		storage, err := storageFromConfig(c, config, logger)
+		if err != nil {
+			return cli.NewExitError(err.Error(), 1)
+		}
+
+		configured[config] = storage
+		storages[i] = storage
+	}
+
+	ctx, cancel := interruptContext()
+	defer cancel()
+
+	stats, err := server.Migrate(ctx, storages[0], storages[1], storages[2], storages[3], server.MigrateOptions{
+		DryRun:    c.Bool("dry-run"),
+		StatePath: c.String("state-file"),
+		Logger:    logger,
+	})
+
+	logger.Printf("%d files, %d copied, %d skipped, %d failed, %d bytes", stats.Total, stats.Copied, stats.Skipped, stats.Failed, stats.Bytes)
+
+	if err != nil {
+		return cli.NewExitError(color.RedString("Migration failed: %s", err.Error()), 1)
+	}
+
+	return nil
+}
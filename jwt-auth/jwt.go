@@ -0,0 +1,495 @@
+package jwtauth
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Config configures the verification of bearer tokens
+type Config struct {
+	// JWKSFile is the path of a JSON Web Key Set with the verification keys
+	JWKSFile string
+	// JWKSURL is the url of a JSON Web Key Set, e.g. the jwks_uri of an
+	// OpenID Connect provider
+	JWKSURL string
+	// Secret is the key of HS256 tokens
+	Secret []byte
+
+	// Issuer is the required iss claim, if set
+	Issuer string
+	// Audience is the required aud claim, if set
+	Audience string
+	// UserClaim is the claim holding the user name, nested claims are
+	// separated by dots. Defaults to sub.
+	UserClaim string
+	// Leeway is the allowed clock skew of the exp, nbf and iat claims
+	Leeway time.Duration
+
+	// RefreshInterval is the maximum age of a key set fetched from JWKSURL.
+	// Defaults to an hour.
+	RefreshInterval time.Duration
+	// Client fetches JWKSURL, defaults to a client with a 10 second timeout
+	Client *http.Client
+}
+
+// ValidationError is returned for tokens that are malformed, not signed by
+// a known key or whose claims aren't valid
+type ValidationError struct {
+	Reason string
+}
+
+func (e *ValidationError) Error() string {
+	return "invalid token: " + e.Reason
+}
+
+func invalid(format string, args ...interface{}) error {
+	return &ValidationError{Reason: fmt.Sprintf(format, args...)}
+}
+
+// Claims are the claims of a verified token
+type Claims map[string]interface{}
+
+// minRefreshInterval limits the refreshes of a key set triggered by tokens
+// signed with an unknown key
+const minRefreshInterval = time.Minute
+
+type Verifier struct {
+	config Config
+
+	mutex     sync.Mutex
+	keys      map[string]interface{}
+	fetchedAt time.Time
+}
+
+// New returns a verifier of RS256, ES256 and HS256 signed tokens, the keys
+// are loaded from the configured key set and secret
+func New(cfg Config) (*Verifier, error) {
+	if cfg.JWKSFile == "" && cfg.JWKSURL == "" && len(cfg.Secret) == 0 {
+		return nil, fmt.Errorf("no jwks or secret configured")
+	}
+
+	if cfg.UserClaim == "" {
+		cfg.UserClaim = "sub"
+	}
+
+	if cfg.RefreshInterval <= 0 {
+		cfg.RefreshInterval = time.Hour
+	}
+
+	if cfg.Client == nil {
+		cfg.Client = &http.Client{Timeout: 10 * time.Second}
+	}
+
+	v := &Verifier{config: cfg, keys: map[string]interface{}{}}
+
+	if cfg.JWKSFile != "" || cfg.JWKSURL != "" {
+		if err := v.refresh(); err != nil {
+			return nil, err
+		}
+	}
+
+	return v, nil
+}
+
+// refresh loads the key set, the caller must not hold the mutex
+func (v *Verifier) refresh() error {
+	var data []byte
+	var err error
+
+	if v.config.JWKSFile != "" {
+		data, err = ioutil.ReadFile(v.config.JWKSFile)
+	} else {
+		data, err = v.fetch()
+	}
+
+	if err != nil {
+		return err
+	}
+
+	keys, err := parseJWKS(data)
+	if err != nil {
+		return err
+	}
+
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+
+	v.keys = keys
+	v.fetchedAt = time.Now()
+	return nil
+}
+
+func (v *Verifier) fetch() ([]byte, error) {
+	resp, err := v.config.Client.Get(v.config.JWKSURL)
+	if err != nil {
+		return nil, err
+	}
+
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("could not fetch jwks: %s", resp.Status)
+	}
+
+	return ioutil.ReadAll(resp.Body)
+}
+
+// key returns the verification key of a token, the key set is refreshed when
+// it is outdated or doesn't have the key
+func (v *Verifier) key(kid string, alg string) (interface{}, error) {
+	if alg == "HS256" {
+		if len(v.config.Secret) != 0 {
+			return v.config.Secret, nil
+		}
+	}
+
+	hasKeySet := v.config.JWKSFile != "" || v.config.JWKSURL != ""
+
+	v.mutex.Lock()
+	key, ok := v.lookup(kid, alg)
+	age := time.Since(v.fetchedAt)
+	v.mutex.Unlock()
+
+	if hasKeySet && ((!ok && age > minRefreshInterval) || (v.config.JWKSURL != "" && age > v.config.RefreshInterval)) {
+		if err := v.refresh(); err != nil {
+			if !ok {
+				return nil, err
+			}
+		} else {
+			v.mutex.Lock()
+			key, ok = v.lookup(kid, alg)
+			v.mutex.Unlock()
+		}
+	}
+
+	if !ok {
+		return nil, invalid("unknown key %q", kid)
+	}
+
+	return key, nil
+}
+
+// lookup finds the key of a token, a token without kid is verified with the
+// only key of its type
+func (v *Verifier) lookup(kid string, alg string) (interface{}, bool) {
+	if kid != "" {
+		key, ok := v.keys[kid]
+		return key, ok && keyMatches(key, alg)
+	}
+
+	var found interface{}
+	for _, key := range v.keys {
+		if !keyMatches(key, alg) {
+			continue
+		} else if found != nil {
+			return nil, false
+		}
+
+		found = key
+	}
+
+	return found, found != nil
+}
+
+func keyMatches(key interface{}, alg string) bool {
+	switch key.(type) {
+	case *rsa.PublicKey:
+		return alg == "RS256"
+	case *ecdsa.PublicKey:
+		return alg == "ES256"
+	case []byte:
+		return alg == "HS256"
+	}
+
+	return false
+}
+
+// Verify checks the signature and the registered claims of a token
+func (v *Verifier) Verify(token string) (Claims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, invalid("malformed token")
+	}
+
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return nil, invalid("malformed header")
+	}
+
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, invalid("malformed signature")
+	}
+
+	switch header.Alg {
+	case "RS256", "ES256", "HS256":
+	default:
+		return nil, invalid("unsupported algorithm %q", header.Alg)
+	}
+
+	key, err := v.key(header.Kid, header.Alg)
+	if err != nil {
+		return nil, err
+	}
+
+	if !verifySignature(header.Alg, key, parts[0]+"."+parts[1], signature) {
+		return nil, invalid("signature mismatch")
+	}
+
+	var claims Claims
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return nil, invalid("malformed claims")
+	}
+
+	if err := v.validate(claims); err != nil {
+		return nil, err
+	}
+
+	return claims, nil
+}
+
+func verifySignature(alg string, key interface{}, signingInput string, signature []byte) bool {
+	sum := sha256.Sum256([]byte(signingInput))
+
+	switch alg {
+	case "RS256":
+		return rsa.VerifyPKCS1v15(key.(*rsa.PublicKey), crypto.SHA256, sum[:], signature) == nil
+	case "ES256":
+		if len(signature) != 64 {
+			return false
+		}
+
+		r := new(big.Int).SetBytes(signature[:32])
+		s := new(big.Int).SetBytes(signature[32:])
+		return ecdsa.Verify(key.(*ecdsa.PublicKey), sum[:], r, s)
+	case "HS256":
+		mac := hmac.New(sha256.New, key.([]byte))
+		mac.Write([]byte(signingInput))
+		return hmac.Equal(mac.Sum(nil), signature)
+	}
+
+	return false
+}
+
+func (v *Verifier) validate(claims Claims) error {
+	now := time.Now()
+
+	exp, ok := claims.time("exp")
+	if !ok {
+		return invalid("missing exp claim")
+	} else if now.After(exp.Add(v.config.Leeway)) {
+		return invalid("token expired")
+	}
+
+	if nbf, ok := claims.time("nbf"); ok && now.Add(v.config.Leeway).Before(nbf) {
+		return invalid("token not valid yet")
+	}
+
+	if iat, ok := claims.time("iat"); ok && now.Add(v.config.Leeway).Before(iat) {
+		return invalid("token issued in the future")
+	}
+
+	if v.config.Issuer != "" {
+		if iss, _ := claims["iss"].(string); iss != v.config.Issuer {
+			return invalid("issuer mismatch")
+		}
+	}
+
+	if v.config.Audience != "" && !claims.hasAudience(v.config.Audience) {
+		return invalid("audience mismatch")
+	}
+
+	return nil
+}
+
+func (c Claims) time(name string) (time.Time, bool) {
+	switch v := c[name].(type) {
+	case float64:
+		return time.Unix(int64(v), 0), true
+	case json.Number:
+		n, err := v.Int64()
+		return time.Unix(n, 0), err == nil
+	}
+
+	return time.Time{}, false
+}
+
+func (c Claims) hasAudience(audience string) bool {
+	switch aud := c["aud"].(type) {
+	case string:
+		return aud == audience
+	case []interface{}:
+		for _, v := range aud {
+			if s, ok := v.(string); ok && s == audience {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// User returns the value of a claim, nested claims are separated by dots
+func (c Claims) User(claim string) string {
+	var value interface{} = map[string]interface{}(c)
+
+	for _, name := range strings.Split(claim, ".") {
+		m, ok := value.(map[string]interface{})
+		if !ok {
+			return ""
+		}
+
+		value = m[name]
+	}
+
+	switch v := value.(type) {
+	case string:
+		return v
+	case float64:
+		return fmt.Sprintf("%.0f", v)
+	}
+
+	return ""
+}
+
+// AuthenticateToken verifies a bearer token and returns the user it was
+// issued to, invalid tokens are reported as not ok without an error
+func (v *Verifier) AuthenticateToken(token string) (string, bool, error) {
+	claims, err := v.Verify(token)
+	if _, ok := err.(*ValidationError); ok {
+		return "", false, nil
+	} else if err != nil {
+		return "", false, err
+	}
+
+	user := claims.User(v.config.UserClaim)
+	if user == "" {
+		return "", false, nil
+	}
+
+	return user, true, nil
+}
+
+// Authenticate accepts a token as the password of Basic auth, for clients
+// that can't send bearer tokens. The user must be empty or match the token.
+func (v *Verifier) Authenticate(user, password string) (bool, error) {
+	tokenUser, ok, err := v.AuthenticateToken(password)
+	if err != nil || !ok {
+		return false, err
+	}
+
+	return user == "" || user == tokenUser, nil
+}
+
+func decodeSegment(segment string, v interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return err
+	}
+
+	return json.Unmarshal(data, v)
+}
+
+// parseJWKS returns the RSA, P-256 and symmetric keys of a key set by key id
+func parseJWKS(data []byte) (map[string]interface{}, error) {
+	var set struct {
+		Keys []struct {
+			Kty string `json:"kty"`
+			Kid string `json:"kid"`
+			Use string `json:"use"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+			Crv string `json:"crv"`
+			X   string `json:"x"`
+			Y   string `json:"y"`
+			K   string `json:"k"`
+		} `json:"keys"`
+	}
+
+	if err := json.Unmarshal(data, &set); err != nil {
+		return nil, fmt.Errorf("could not parse jwks: %s", err.Error())
+	}
+
+	keys := map[string]interface{}{}
+
+	for i, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+
+		kid := k.Kid
+		if kid == "" {
+			kid = fmt.Sprintf("#%d", i)
+		}
+
+		switch k.Kty {
+		case "RSA":
+			n, err := decodeBigInt(k.N)
+			if err != nil {
+				return nil, err
+			}
+
+			e, err := decodeBigInt(k.E)
+			if err != nil {
+				return nil, err
+			}
+
+			keys[kid] = &rsa.PublicKey{N: n, E: int(e.Int64())}
+		case "EC":
+			if k.Crv != "P-256" {
+				continue
+			}
+
+			x, err := decodeBigInt(k.X)
+			if err != nil {
+				return nil, err
+			}
+
+			y, err := decodeBigInt(k.Y)
+			if err != nil {
+				return nil, err
+			}
+
+			if !elliptic.P256().IsOnCurve(x, y) {
+				return nil, fmt.Errorf("key %s is not on the P-256 curve", kid)
+			}
+
+			keys[kid] = &ecdsa.PublicKey{Curve: elliptic.P256(), X: x, Y: y}
+		case "oct":
+			secret, err := base64.RawURLEncoding.DecodeString(k.K)
+			if err != nil {
+				return nil, err
+			}
+
+			keys[kid] = secret
+		}
+	}
+
+	return keys, nil
+}
+
+func decodeBigInt(s string) (*big.Int, error) {
+	data, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+
+	return new(big.Int).SetBytes(data), nil
+}
@@ -0,0 +1,164 @@
+package jwtauth_test
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	jwtauth "github.com/dutchcoders/transfer.sh/jwt-auth"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func encode(v interface{}) string {
+	data, _ := json.Marshal(v)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+func sign(t *testing.T, alg, kid string, key interface{}, claims map[string]interface{}) string {
+	signingInput := encode(map[string]string{"alg": alg, "kid": kid, "typ": "JWT"}) + "." + encode(claims)
+	sum := sha256.Sum256([]byte(signingInput))
+
+	var signature []byte
+	switch k := key.(type) {
+	case *rsa.PrivateKey:
+		var err error
+		signature, err = rsa.SignPKCS1v15(rand.Reader, k, crypto.SHA256, sum[:])
+		require.NoError(t, err)
+	case *ecdsa.PrivateKey:
+		r, s, err := ecdsa.Sign(rand.Reader, k, sum[:])
+		require.NoError(t, err)
+		signature = append(r.FillBytes(make([]byte, 32)), s.FillBytes(make([]byte, 32))...)
+	case []byte:
+		mac := hmac.New(sha256.New, k)
+		mac.Write([]byte(signingInput))
+		signature = mac.Sum(nil)
+	}
+
+	return signingInput + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+func claims(overrides map[string]interface{}) map[string]interface{} {
+	c := map[string]interface{}{
+		"iss": "https://sso.example.com",
+		"aud": "transfer.sh",
+		"sub": "alice",
+		"exp": time.Now().Add(time.Hour).Unix(),
+		"iat": time.Now().Unix(),
+	}
+
+	for k, v := range overrides {
+		c[k] = v
+	}
+
+	return c
+}
+
+func TestVerifier(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	jwks := map[string]interface{}{
+		"keys": []map[string]string{
+			{
+				"kty": "RSA",
+				"kid": "rsa",
+				"n":   base64.RawURLEncoding.EncodeToString(rsaKey.N.Bytes()),
+				"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(rsaKey.E)).Bytes()),
+			},
+			{
+				"kty": "EC",
+				"kid": "ec",
+				"crv": "P-256",
+				"x":   base64.RawURLEncoding.EncodeToString(ecKey.X.FillBytes(make([]byte, 32))),
+				"y":   base64.RawURLEncoding.EncodeToString(ecKey.Y.FillBytes(make([]byte, 32))),
+			},
+		},
+	}
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(jwks)
+	}))
+	defer ts.Close()
+
+	secret := []byte("secret")
+
+	verifier, err := jwtauth.New(jwtauth.Config{
+		JWKSURL:   ts.URL,
+		Secret:    secret,
+		Issuer:    "https://sso.example.com",
+		Audience:  "transfer.sh",
+		UserClaim: "profile.name",
+	})
+	require.NoError(t, err)
+
+	profile := map[string]interface{}{"profile": map[string]string{"name": "Alice"}}
+
+	t.Run("valid", func(t *testing.T) {
+		for _, token := range []string{
+			sign(t, "RS256", "rsa", rsaKey, claims(profile)),
+			sign(t, "ES256", "ec", ecKey, claims(profile)),
+			sign(t, "HS256", "", secret, claims(profile)),
+		} {
+			user, ok, err := verifier.AuthenticateToken(token)
+			assert.NoError(t, err)
+			assert.True(t, ok)
+			assert.Equal(t, "Alice", user)
+		}
+	})
+
+	t.Run("basic", func(t *testing.T) {
+		token := sign(t, "RS256", "rsa", rsaKey, claims(profile))
+
+		ok, err := verifier.Authenticate("Alice", token)
+		assert.NoError(t, err)
+		assert.True(t, ok)
+
+		ok, err = verifier.Authenticate("Bob", token)
+		assert.NoError(t, err)
+		assert.False(t, ok)
+	})
+
+	t.Run("invalid", func(t *testing.T) {
+		otherKey, err := rsa.GenerateKey(rand.Reader, 2048)
+		require.NoError(t, err)
+
+		for name, token := range map[string]string{
+			"expired":   sign(t, "RS256", "rsa", rsaKey, claims(map[string]interface{}{"exp": time.Now().Add(-time.Hour).Unix()})),
+			"no exp":    sign(t, "RS256", "rsa", rsaKey, claims(map[string]interface{}{"exp": nil})),
+			"issuer":    sign(t, "RS256", "rsa", rsaKey, claims(map[string]interface{}{"iss": "https://evil.example.com"})),
+			"audience":  sign(t, "RS256", "rsa", rsaKey, claims(map[string]interface{}{"aud": []string{"other"}})),
+			"signature": sign(t, "RS256", "rsa", otherKey, claims(profile)),
+			"key type":  sign(t, "HS256", "rsa", rsaKey.N.Bytes(), claims(profile)),
+			"no user":   sign(t, "RS256", "rsa", rsaKey, claims(nil)),
+			"malformed": "not-a-token",
+		} {
+			_, ok, err := verifier.AuthenticateToken(token)
+			assert.NoError(t, err, name)
+			assert.False(t, ok, name)
+		}
+
+		none := encode(map[string]string{"alg": "none"}) + "." + encode(claims(profile)) + "."
+		_, err = verifier.Verify(none)
+		assert.Error(t, err)
+	})
+}
+
+func TestVerifierWithoutKeys(t *testing.T) {
+	_, err := jwtauth.New(jwtauth.Config{})
+	assert.Error(t, err)
+}
@@ -2,9 +2,11 @@ package redis_storage
 
 import (
 	"bytes"
+	"context"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"strings"
 
 	"github.com/dutchcoders/transfer.sh/server"
 	"github.com/go-redis/redis/v7"
@@ -26,39 +28,64 @@ func New(addr, password string) server.Storage {
 	}
 }
 
-func (r *RedisStorage) Get(token string, filename string) (reader io.ReadCloser, contentLength uint64, err error) {
+func (r *RedisStorage) Get(ctx context.Context, token string, filename string) (reader io.ReadCloser, contentLength uint64, err error) {
 	var val []byte
-	if val, err = r.client.Get(formRedisKey(token, filename)).Bytes(); err != nil {
+	if val, err = r.client.WithContext(ctx).Get(formRedisKey(token, filename)).Bytes(); err != nil {
 		return
 	}
-	if contentLength, err = r.Head(token, filename); err != nil {
+	if contentLength, err = r.Head(ctx, token, filename); err != nil {
 		return
 	}
 	reader = ioutil.NopCloser(bytes.NewReader(val))
 	return
 }
 
-func (r *RedisStorage) Head(token string, filename string) (contentLength uint64, err error) {
-	return r.client.Get(fmt.Sprintf("%s:%s", formRedisKey(token, filename), redisLengthSubKey)).Uint64()
+func (r *RedisStorage) Head(ctx context.Context, token string, filename string) (contentLength uint64, err error) {
+	return r.client.WithContext(ctx).Get(fmt.Sprintf("%s:%s", formRedisKey(token, filename), redisLengthSubKey)).Uint64()
 }
 
-func (r *RedisStorage) Put(token string, filename string, reader io.Reader, contentType string, contentLength uint64) error {
+func (r *RedisStorage) Put(ctx context.Context, token string, filename string, reader io.Reader, contentType string, contentLength uint64) error {
+	client := r.client.WithContext(ctx)
 	key := formRedisKey(token, filename)
-	r.client.Set(key+":"+redisTypeSubKey, contentType, 0)
-	r.client.Set(key+":"+redisLengthSubKey, contentLength, 0)
+	client.Set(key+":"+redisTypeSubKey, contentType, 0)
+	client.Set(key+":"+redisLengthSubKey, contentLength, 0)
 	if data, err := ioutil.ReadAll(reader); err != nil {
 		return err
 	} else {
-		if err := r.client.Set(key, string(data), 0).Err(); err != nil {
+		if err := client.Set(key, string(data), 0).Err(); err != nil {
 			return err
 		}
 	}
 	return nil
 }
-func (r *RedisStorage) Delete(token string, filename string) error {
+func (r *RedisStorage) Delete(ctx context.Context, token string, filename string) error {
 	key := formRedisKey(token, filename)
-	return r.client.Del(key, key+":"+redisTypeSubKey, key+":"+redisLengthSubKey).Err()
+	return r.client.WithContext(ctx).Del(key, key+":"+redisTypeSubKey, key+":"+redisLengthSubKey).Err()
 }
+func (r *RedisStorage) List(ctx context.Context) (objects []server.ObjectInfo, err error) {
+	suffix := ":" + redisLengthSubKey
+
+	iter := r.client.WithContext(ctx).Scan(0, formRedisKey("*", "*")+suffix, 0).Iterator()
+	for iter.Next() {
+		key := strings.TrimSuffix(strings.TrimPrefix(iter.Val(), "storage:"), suffix)
+
+		parts := strings.SplitN(key, ":", 2)
+		if len(parts) != 2 {
+			continue
+		}
+
+		var contentLength uint64
+		if contentLength, err = r.Head(ctx, parts[0], parts[1]); err != nil {
+			return
+		}
+
+		objects = append(objects, server.ObjectInfo{Token: parts[0], Filename: parts[1], ContentLength: contentLength})
+	}
+
+	err = iter.Err()
+	return
+}
+
 func (r *RedisStorage) IsNotExist(err error) bool {
 	if err == redis.Nil {
 		return true
@@ -2,6 +2,7 @@ package redis_storage_test
 
 import (
 	"bytes"
+	"context"
 	"io/ioutil"
 	"testing"
 
@@ -20,10 +21,10 @@ func TestRedisStorage(t *testing.T) {
 	r := bytes.NewReader([]byte(content))
 	size := uint64(r.Size())
 
-	err := storage.Put(token, filename, r, "text", size)
+	err := storage.Put(context.Background(), token, filename, r, "text", size)
 	assert.NoError(t, err)
 
-	rc, s, err := storage.Get(token, filename)
+	rc, s, err := storage.Get(context.Background(), token, filename)
 	assert.NoError(t, err)
 
 	if rc == nil {
@@ -0,0 +1,583 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// defaultAdminListLimit is the number of files listed when no limit is requested
+const defaultAdminListLimit = 1000
+
+var (
+	errAdminNotFound = errors.New("no such file")
+	errFileOnHold    = errors.New("file is on hold")
+)
+
+// AdminUsers grants the admin api to users, besides the identities with the
+// admin scope
+func AdminUsers(users ...string) OptionFn {
+	return func(srvr *Server) {
+		srvr.adminUsers = users
+	}
+}
+
+// isAdmin reports whether identity may use the admin api, identities without
+// scopes are granted every scope but the admin api
+func (s *Server) isAdmin(identity Identity) bool {
+	if containsString(s.adminUsers, identity.User) {
+		return true
+	}
+
+	for _, scope := range identity.Scopes {
+		if scope == ScopeAdmin {
+			return true
+		}
+	}
+
+	return false
+}
+
+// AdminHandler serves the admin api to admins only
+func (s *Server) AdminHandler(h http.Handler) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		identity, ok := s.requireIdentity(w, r)
+		if !ok {
+			return
+		} else if !s.isAdmin(identity) {
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+
+		h.ServeHTTP(w, r.WithContext(WithIdentity(r.Context(), identity)))
+	}
+}
+
+// checkHold refuses to delete files on hold, it writes the response and
+// returns false when the file is on hold
+func (s *Server) checkHold(w http.ResponseWriter, r *http.Request, token, filename string) bool {
+	if s.onHold(r.Context(), token, filename) {
+		http.Error(w, errFileOnHold.Error(), http.StatusLocked)
+		return false
+	}
+
+	return true
+}
+
+// onHold reports whether a file is on hold
+func (s *Server) onHold(ctx context.Context, token, filename string) bool {
+	metadata, err := s.GetMetadata(ctx, token, filename)
+	return err == nil && metadata.Hold
+}
+
+// expired reports whether the limits of the file ran out
+func (m Metadata) expired() bool {
+	if m.MaxDownloads != -1 && m.Downloads >= m.MaxDownloads {
+		return true
+	}
+
+	return !m.MaxDate.IsZero() && time.Now().After(m.MaxDate) && !m.Hold
+}
+
+// adminFile is a stored file as listed by the admin api
+type adminFile struct {
+	Token         string     `json:"token"`
+	Filename      string     `json:"filename"`
+	ContentLength uint64     `json:"content_length"`
+	ContentType   string     `json:"content_type"`
+	Owner         string     `json:"owner,omitempty"`
+	Namespace     string     `json:"namespace,omitempty"`
+	Created       *time.Time `json:"created,omitempty"`
+	Expires       *time.Time `json:"expires,omitempty"`
+	Downloads     int        `json:"downloads"`
+	MaxDownloads  int        `json:"max_downloads"`
+	Expired       bool       `json:"expired"`
+	Blocked       bool       `json:"blocked"`
+	Hold          bool       `json:"hold"`
+}
+
+func newAdminFile(object ObjectInfo, metadata Metadata) adminFile {
+	file := adminFile{
+		Token:         object.Token,
+		Filename:      object.Filename,
+		ContentLength: object.ContentLength,
+		ContentType:   metadata.ContentType,
+		Owner:         metadata.Owner,
+		Namespace:     metadata.Namespace,
+		Downloads:     metadata.Downloads,
+		MaxDownloads:  metadata.MaxDownloads,
+		Expired:       metadata.expired(),
+		Blocked:       metadata.Blocked,
+		Hold:          metadata.Hold,
+	}
+
+	if !metadata.Created.IsZero() {
+		created := metadata.Created.UTC()
+		file.Created = &created
+	}
+
+	if !metadata.MaxDate.IsZero() {
+		expires := metadata.MaxDate.UTC()
+		file.Expires = &expires
+	}
+
+	return file
+}
+
+// adminFiles returns the stored files with their metadata, it only uses List
+// and the metadata storage so it works with every storage provider
+func (s *Server) adminFiles(ctx context.Context, token string) ([]adminFile, error) {
+	objects, err := s.storedFiles(ctx, "")
+	if err != nil {
+		return nil, err
+	}
+
+	var files []adminFile
+
+	for _, object := range objects {
+		if token != "" && object.Token != token {
+			continue
+		}
+
+		metadata, err := s.GetMetadata(ctx, object.Token, object.Filename)
+		if err != nil {
+			log.Printf("Error metadata of %s/%s: %s", object.Token, object.Filename, err.Error())
+			continue
+		}
+
+		files = append(files, newAdminFile(object, metadata))
+	}
+
+	return files, nil
+}
+
+// adminFilesPage returns the files following the token/filename key after,
+// reading the metadata of at most limit files. next is the key to continue
+// after, empty on the last page.
+func (s *Server) adminFilesPage(ctx context.Context, after string, limit int) (files []adminFile, next string, err error) {
+	objects, err := s.storedFiles(ctx, after)
+	if err != nil {
+		return nil, "", err
+	}
+
+	if len(objects) > limit {
+		objects = objects[:limit]
+		next = path.Join(objects[limit-1].Token, objects[limit-1].Filename)
+	}
+
+	for _, object := range objects {
+		metadata, err := s.GetMetadata(ctx, object.Token, object.Filename)
+		if err != nil {
+			log.Printf("Error metadata of %s/%s: %s", object.Token, object.Filename, err.Error())
+			continue
+		}
+
+		files = append(files, newAdminFile(object, metadata))
+	}
+
+	return files, next, nil
+}
+
+// storedFiles lists the uploaded files with a token/filename key greater
+// than after, ordered by their keys. Metadata objects and reserved tokens
+// are left out.
+func (s *Server) storedFiles(ctx context.Context, after string) ([]ObjectInfo, error) {
+	objects, err := s.storage.List(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("could not list %s storage: %s", s.storage.Type(), err.Error())
+	}
+
+	var files []ObjectInfo
+	for _, object := range objects {
+		if !isUploadedFile(object.Token, object.Filename) {
+			continue
+		} else if path.Join(object.Token, object.Filename) > after {
+			files = append(files, object)
+		}
+	}
+
+	sort.Slice(files, func(i, j int) bool {
+		return path.Join(files[i].Token, files[i].Filename) < path.Join(files[j].Token, files[j].Filename)
+	})
+
+	return files, nil
+}
+
+// adminFilter selects files by the query of a search
+type adminFilter struct {
+	token    string
+	filename string
+	owner    string
+	minSize  uint64
+	maxSize  uint64
+	minAge   time.Duration
+	maxAge   time.Duration
+	limit    int
+}
+
+func parseAdminFilter(query map[string][]string) (adminFilter, error) {
+	get := func(key string) string {
+		if v := query[key]; len(v) != 0 {
+			return v[0]
+		}
+
+		return ""
+	}
+
+	filter := adminFilter{
+		token:    get("token"),
+		filename: strings.ToLower(get("filename")),
+		owner:    get("owner"),
+		limit:    defaultAdminListLimit,
+	}
+
+	for key, size := range map[string]*uint64{"min_size": &filter.minSize, "max_size": &filter.maxSize} {
+		if v := get(key); v == "" {
+		} else if n, err := strconv.ParseUint(v, 10, 64); err != nil {
+			return filter, fmt.Errorf("invalid %s: %s", key, v)
+		} else {
+			*size = n
+		}
+	}
+
+	for key, age := range map[string]*time.Duration{"min_age": &filter.minAge, "max_age": &filter.maxAge} {
+		if v := get(key); v == "" {
+		} else if d, err := time.ParseDuration(v); err != nil || d < 0 {
+			return filter, fmt.Errorf("invalid %s: %s", key, v)
+		} else {
+			*age = d
+		}
+	}
+
+	if v := get("limit"); v == "" {
+	} else if n, err := strconv.Atoi(v); err != nil || n < 1 {
+		return filter, fmt.Errorf("invalid limit: %s", v)
+	} else {
+		filter.limit = n
+	}
+
+	return filter, nil
+}
+
+// matches reports whether file matches the filter, files uploaded before
+// their upload time was recorded don't match an age
+func (f adminFilter) matches(file adminFile) bool {
+	if f.token != "" && file.Token != f.token {
+		return false
+	} else if f.filename != "" && !strings.Contains(strings.ToLower(file.Filename), f.filename) {
+		return false
+	} else if f.owner != "" && file.Owner != f.owner {
+		return false
+	} else if f.minSize != 0 && file.ContentLength < f.minSize {
+		return false
+	} else if f.maxSize != 0 && file.ContentLength > f.maxSize {
+		return false
+	}
+
+	if f.minAge == 0 && f.maxAge == 0 {
+		return true
+	} else if file.Created == nil {
+		return false
+	}
+
+	age := time.Since(*file.Created)
+	return (f.minAge == 0 || age >= f.minAge) && (f.maxAge == 0 || age <= f.maxAge)
+}
+
+func writeAdminJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Printf("%s", err.Error())
+	}
+}
+
+// adminFilesHandler searches the stored files by token, filename, owner,
+// size and age
+func (s *Server) adminFilesHandler(w http.ResponseWriter, r *http.Request) {
+	filter, err := parseAdminFilter(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	files, err := s.adminFiles(r.Context(), filter.token)
+	if err != nil {
+		log.Printf("%s", err.Error())
+		http.Error(w, "Could not list files", http.StatusInternalServerError)
+		return
+	}
+
+	matches := []adminFile{}
+	for _, file := range files {
+		if len(matches) == filter.limit {
+			break
+		} else if filter.matches(file) {
+			matches = append(matches, file)
+		}
+	}
+
+	writeAdminJSON(w, matches)
+}
+
+// adminFileHandler returns the full metadata of a file
+func (s *Server) adminFileHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+
+	metadata, err := s.GetMetadata(r.Context(), vars["token"], vars["filename"])
+	if err != nil {
+		log.Printf("Error metadata: %s", err.Error())
+		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		return
+	}
+
+	writeAdminJSON(w, metadata)
+}
+
+// adminDeleteHandler deletes a file, or every file of a token when no
+// filename is given. Files on hold are kept.
+func (s *Server) adminDeleteHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	token := vars["token"]
+
+	if filename, ok := vars["filename"]; ok {
+		if !s.checkHold(w, r, token, filename) {
+			return
+		}
+
+		err := s.deleteFile(r.Context(), token, filename)
+		if s.storage.IsNotExist(err) {
+			http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+			return
+		} else if err != nil {
+			log.Printf("%s", err.Error())
+			http.Error(w, "Could not delete file.", http.StatusInternalServerError)
+			return
+		}
+
+		log.Printf("Admin %s deleted %s/%s", adminUser(r), token, filename)
+		return
+	}
+
+	files, err := s.adminFiles(r.Context(), token)
+	if err != nil {
+		log.Printf("%s", err.Error())
+		http.Error(w, "Could not list files", http.StatusInternalServerError)
+		return
+	} else if len(files) == 0 {
+		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		return
+	}
+
+	writeAdminJSON(w, s.adminDelete(r, files, func(adminFile) bool { return true }))
+}
+
+// adminPurgeHandler deletes the files whose limits ran out, with dry_run set
+// it only lists them
+func (s *Server) adminPurgeHandler(w http.ResponseWriter, r *http.Request) {
+	files, err := s.adminFiles(r.Context(), "")
+	if err != nil {
+		log.Printf("%s", err.Error())
+		http.Error(w, "Could not list files", http.StatusInternalServerError)
+		return
+	}
+
+	expired := func(file adminFile) bool { return file.Expired }
+
+	if dryRun, _ := strconv.ParseBool(r.FormValue("dry_run")); dryRun {
+		matches := []adminFile{}
+		for _, file := range files {
+			if expired(file) && !file.Hold {
+				matches = append(matches, file)
+			}
+		}
+
+		writeAdminJSON(w, matches)
+		return
+	}
+
+	writeAdminJSON(w, s.adminDelete(r, files, expired))
+}
+
+// adminDelete deletes the files selected by fn that are not on hold, it
+// returns the deleted files
+func (s *Server) adminDelete(r *http.Request, files []adminFile, fn func(adminFile) bool) []adminFile {
+	deleted := []adminFile{}
+
+	for _, file := range files {
+		if !fn(file) || file.Hold {
+			continue
+		}
+
+		if err := s.deleteFile(r.Context(), file.Token, file.Filename); err != nil && !s.storage.IsNotExist(err) {
+			log.Printf("Error deleting %s/%s: %s", file.Token, file.Filename, err.Error())
+			continue
+		}
+
+		log.Printf("Admin %s deleted %s/%s", adminUser(r), file.Token, file.Filename)
+		deleted = append(deleted, file)
+	}
+
+	return deleted
+}
+
+// blockToken blocks or unblocks the files of a token
+func (s *Server) blockToken(ctx context.Context, token string, blocked bool) ([]adminFile, error) {
+	files, err := s.adminFiles(ctx, token)
+	if err != nil {
+		return nil, err
+	} else if len(files) == 0 {
+		return nil, errAdminNotFound
+	}
+
+	for i, file := range files {
+		metadata, err := s.updateMetadata(ctx, file.Token, file.Filename, func(metadata *Metadata) error {
+			metadata.Blocked = blocked
+			return nil
+		})
+
+		if err != nil {
+			return nil, err
+		}
+
+		files[i] = newAdminFile(ObjectInfo{Token: file.Token, Filename: file.Filename, ContentLength: file.ContentLength}, metadata)
+	}
+
+	return files, nil
+}
+
+// holdFile puts a file on hold or releases it
+func (s *Server) holdFile(ctx context.Context, token, filename string, hold bool) (adminFile, error) {
+	contentLength, err := s.storage.Head(ctx, token, filename)
+	if s.storage.IsNotExist(err) {
+		return adminFile{}, errAdminNotFound
+	} else if err != nil {
+		return adminFile{}, err
+	}
+
+	metadata, err := s.updateMetadata(ctx, token, filename, func(metadata *Metadata) error {
+		metadata.Hold = hold
+		return nil
+	})
+
+	if err != nil {
+		return adminFile{}, err
+	}
+
+	return newAdminFile(ObjectInfo{Token: token, Filename: filename, ContentLength: contentLength}, metadata), nil
+}
+
+// adminError writes the response of an error of an admin operation
+func adminError(w http.ResponseWriter, err error, message string) {
+	if err == errAdminNotFound {
+		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		return
+	}
+
+	log.Printf("%s", err.Error())
+	http.Error(w, message, http.StatusInternalServerError)
+}
+
+// adminBlockHandler blocks or, with DELETE, unblocks the files of a token.
+// Blocked files are kept but not served.
+func (s *Server) adminBlockHandler(w http.ResponseWriter, r *http.Request) {
+	token := mux.Vars(r)["token"]
+	blocked := r.Method != http.MethodDelete
+
+	files, err := s.blockToken(r.Context(), token, blocked)
+	if err != nil {
+		adminError(w, err, "Could not block token")
+		return
+	}
+
+	log.Printf("Admin %s set blocked=%t on token %s", adminUser(r), blocked, token)
+	writeAdminJSON(w, files)
+}
+
+// adminHoldHandler puts a file on hold or, with DELETE, releases it
+func (s *Server) adminHoldHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	token := vars["token"]
+	filename := vars["filename"]
+	hold := r.Method != http.MethodDelete
+
+	file, err := s.holdFile(r.Context(), token, filename, hold)
+	if err != nil {
+		adminError(w, err, "Could not hold file")
+		return
+	}
+
+	log.Printf("Admin %s set hold=%t on %s/%s", adminUser(r), hold, token, filename)
+	writeAdminJSON(w, file)
+}
+
+// adminStats are the aggregate statistics of the stored files
+type adminStats struct {
+	Storage         string `json:"storage"`
+	MetadataStorage string `json:"metadata_storage"`
+	Files           int    `json:"files"`
+	Bytes           uint64 `json:"bytes"`
+	Owners          int    `json:"owners"`
+	Expired         int    `json:"expired"`
+	ExpiredBytes    uint64 `json:"expired_bytes"`
+	Blocked         int    `json:"blocked"`
+	Held            int    `json:"held"`
+}
+
+// adminStatsHandler returns the aggregate statistics of the stored files
+func (s *Server) adminStatsHandler(w http.ResponseWriter, r *http.Request) {
+	files, err := s.adminFiles(r.Context(), "")
+	if err != nil {
+		log.Printf("%s", err.Error())
+		http.Error(w, "Could not list files", http.StatusInternalServerError)
+		return
+	}
+
+	writeAdminJSON(w, s.adminStats(files))
+}
+
+// adminStats aggregates the statistics of files
+func (s *Server) adminStats(files []adminFile) adminStats {
+	stats := adminStats{Storage: s.storage.Type(), MetadataStorage: s.metadataStorage.Type()}
+	owners := map[string]bool{}
+
+	for _, file := range files {
+		stats.Files++
+		stats.Bytes += file.ContentLength
+
+		if file.Owner != "" {
+			owners[file.Owner] = true
+		}
+
+		if file.Expired {
+			stats.Expired++
+			stats.ExpiredBytes += file.ContentLength
+		}
+
+		if file.Blocked {
+			stats.Blocked++
+		}
+
+		if file.Hold {
+			stats.Held++
+		}
+	}
+
+	stats.Owners = len(owners)
+	return stats
+}
+
+// adminUser returns the admin of a request, for the log
+func adminUser(r *http.Request) string {
+	identity, _ := IdentityFromContext(r.Context())
+	return identity.User
+}
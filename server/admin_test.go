@@ -0,0 +1,140 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"time"
+
+	. "gopkg.in/check.v1"
+)
+
+var _ = Suite(&SuiteAdmin{})
+
+type SuiteAdmin struct {
+	server *Server
+}
+
+func (s *SuiteAdmin) SetUpTest(c *C) {
+	s.server = testServer(c, AdminUsers("admin"))
+}
+
+func (s *SuiteAdmin) putFile(c *C, token, filename string, metadata Metadata) {
+	content := []byte("content")
+	c.Assert(s.server.storage.Put(context.Background(), token, filename, bytes.NewReader(content), "text/plain", uint64(len(content))), IsNil)
+	c.Assert(s.server.putMetadata(context.Background(), token, filename, metadata), IsNil)
+}
+
+func (s *SuiteAdmin) request(c *C, user, method, target string, v interface{}) int {
+	w := serveRoute(s.server, user, httptest.NewRequest(method, target, nil))
+
+	if w.Code == http.StatusOK && v != nil {
+		c.Assert(json.NewDecoder(w.Body).Decode(v), IsNil)
+	}
+
+	return w.Code
+}
+
+func (s *SuiteAdmin) TestAuthorization(c *C) {
+	c.Assert(s.request(c, "", "GET", "/admin/api/stats", nil), Equals, http.StatusUnauthorized)
+	c.Assert(s.request(c, "user", "GET", "/admin/api/stats", nil), Equals, http.StatusForbidden)
+	c.Assert(s.request(c, "admin", "GET", "/admin/api/stats", nil), Equals, http.StatusOK)
+
+	c.Assert(s.server.isAdmin(Identity{User: "key", Scopes: []Scope{ScopeAdmin}}), Equals, true)
+	c.Assert(s.server.isAdmin(Identity{User: "key", Scopes: []Scope{ScopeDeleteAny}}), Equals, false)
+
+	// keys and certificates named like an admin user aren't admins
+	c.Assert(s.server.isAdmin(keyIdentity(APIKey{Name: "admin", Scopes: []Scope{ScopeUpload}})), Equals, false)
+	c.Assert(s.server.isAdmin(certificateIdentity("admin")), Equals, false)
+}
+
+func (s *SuiteAdmin) TestSearch(c *C) {
+	s.putFile(c, "aaaaa", "report.pdf", Metadata{MaxDownloads: -1, Owner: "user", Created: time.Now().Add(-48 * time.Hour)})
+	s.putFile(c, "bbbbb", "photo.jpg", Metadata{MaxDownloads: -1, Owner: "other", Created: time.Now()})
+	s.putFile(c, "ccccc", "notes.txt", Metadata{MaxDownloads: -1})
+
+	var files []adminFile
+	c.Assert(s.request(c, "admin", "GET", "/admin/api/files", &files), Equals, http.StatusOK)
+	c.Assert(files, HasLen, 3)
+
+	c.Assert(s.request(c, "admin", "GET", "/admin/api/files?owner=user", &files), Equals, http.StatusOK)
+	c.Assert(files, HasLen, 1)
+	c.Assert(files[0].Filename, Equals, "report.pdf")
+
+	c.Assert(s.request(c, "admin", "GET", "/admin/api/files?filename=PHOTO", &files), Equals, http.StatusOK)
+	c.Assert(files, HasLen, 1)
+	c.Assert(files[0].Token, Equals, "bbbbb")
+
+	c.Assert(s.request(c, "admin", "GET", "/admin/api/files?min_age=24h", &files), Equals, http.StatusOK)
+	c.Assert(files, HasLen, 1)
+	c.Assert(files[0].Token, Equals, "aaaaa")
+
+	c.Assert(s.request(c, "admin", "GET", "/admin/api/files?min_size=8", &files), Equals, http.StatusOK)
+	c.Assert(files, HasLen, 0)
+
+	c.Assert(s.request(c, "admin", "GET", "/admin/api/files?max_age=soon", nil), Equals, http.StatusBadRequest)
+
+	var metadata Metadata
+	c.Assert(s.request(c, "admin", "GET", "/admin/api/files/aaaaa/report.pdf", &metadata), Equals, http.StatusOK)
+	c.Assert(metadata.Owner, Equals, "user")
+	c.Assert(s.request(c, "admin", "GET", "/admin/api/files/aaaaa/missing.pdf", nil), Equals, http.StatusNotFound)
+}
+
+func (s *SuiteAdmin) TestBlock(c *C) {
+	s.putFile(c, "aaaaa", "file.txt", Metadata{MaxDownloads: -1})
+
+	var files []adminFile
+	c.Assert(s.request(c, "admin", "POST", "/admin/api/tokens/aaaaa/block", &files), Equals, http.StatusOK)
+	c.Assert(files, HasLen, 1)
+	c.Assert(files[0].Blocked, Equals, true)
+
+	_, err := s.server.CheckMetadata(context.Background(), "aaaaa", "file.txt", false)
+	c.Assert(err, NotNil)
+
+	c.Assert(s.request(c, "admin", "DELETE", "/admin/api/tokens/aaaaa/block", nil), Equals, http.StatusOK)
+	_, err = s.server.CheckMetadata(context.Background(), "aaaaa", "file.txt", false)
+	c.Assert(err, IsNil)
+
+	c.Assert(s.request(c, "admin", "POST", "/admin/api/tokens/zzzzz/block", nil), Equals, http.StatusNotFound)
+}
+
+func (s *SuiteAdmin) TestHoldAndPurge(c *C) {
+	expired := time.Now().Add(-time.Hour)
+	s.putFile(c, "aaaaa", "held.txt", Metadata{MaxDownloads: -1, MaxDate: expired})
+	s.putFile(c, "aaaaa", "expired.txt", Metadata{MaxDownloads: -1, MaxDate: expired})
+	s.putFile(c, "bbbbb", "used.txt", Metadata{MaxDownloads: 1, Downloads: 1})
+	s.putFile(c, "ccccc", "kept.txt", Metadata{MaxDownloads: -1})
+
+	var file adminFile
+	c.Assert(s.request(c, "admin", "POST", "/admin/api/files/aaaaa/held.txt/hold", &file), Equals, http.StatusOK)
+	c.Assert(file.Hold, Equals, true)
+	c.Assert(file.Expired, Equals, false)
+
+	// held files stay available past their expiry and can't be deleted
+	_, err := s.server.CheckMetadata(context.Background(), "aaaaa", "held.txt", false)
+	c.Assert(err, IsNil)
+	c.Assert(s.request(c, "admin", "DELETE", "/admin/api/files/aaaaa/held.txt", nil), Equals, http.StatusLocked)
+
+	var stats adminStats
+	c.Assert(s.request(c, "admin", "GET", "/admin/api/stats", &stats), Equals, http.StatusOK)
+	c.Assert(stats, DeepEquals, adminStats{Storage: "local", MetadataStorage: "local", Files: 4, Bytes: 28, Expired: 2, ExpiredBytes: 14, Held: 1})
+
+	var files []adminFile
+	c.Assert(s.request(c, "admin", "POST", "/admin/api/purge?dry_run=true", &files), Equals, http.StatusOK)
+	c.Assert(files, HasLen, 2)
+
+	c.Assert(s.request(c, "admin", "POST", "/admin/api/purge", &files), Equals, http.StatusOK)
+	c.Assert(files, HasLen, 2)
+	c.Assert(files[0].Filename, Equals, "expired.txt")
+	c.Assert(files[1].Filename, Equals, "used.txt")
+
+	c.Assert(s.request(c, "admin", "DELETE", "/admin/api/files/aaaaa", &files), Equals, http.StatusOK)
+	c.Assert(files, HasLen, 0)
+
+	c.Assert(s.request(c, "admin", "DELETE", "/admin/api/files/ccccc/kept.txt", nil), Equals, http.StatusOK)
+	c.Assert(s.request(c, "admin", "GET", "/admin/api/files", &files), Equals, http.StatusOK)
+	c.Assert(files, HasLen, 1)
+	c.Assert(files[0].Filename, Equals, "held.txt")
+}
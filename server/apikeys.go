@@ -0,0 +1,355 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Scope is a permission granted to an API key
+type Scope string
+
+const (
+	// ScopeUpload allows uploads, tagged with the namespace of the key
+	ScopeUpload Scope = "upload"
+	// ScopeDownload allows downloads of restricted files in the namespace of the key
+	ScopeDownload Scope = "download"
+	// ScopeDeleteAny allows deleting files in the namespace of the key without their deletion token
+	ScopeDeleteAny Scope = "delete-any"
+	// ScopeAdmin grants all scopes
+	ScopeAdmin Scope = "admin"
+)
+
+// Scopes are all the scopes an API key can be granted
+var Scopes = []Scope{ScopeUpload, ScopeDownload, ScopeDeleteAny, ScopeAdmin}
+
+const (
+	// apiKeysToken is the reserved token the keys are stored under
+	apiKeysToken = "_apikeys"
+	// apiKeyPrefix tells API keys apart from other bearer tokens
+	apiKeyPrefix = "tsh_"
+)
+
+var (
+	errInvalidAPIKey = errors.New("invalid api key")
+	errQuotaExceeded = errors.New("api key quota exceeded")
+	errNoAPIKey      = errors.New("no api key")
+)
+
+// isReservedToken reports whether token holds server data instead of
+// uploaded files, tokens of uploads never start with an underscore
+func isReservedToken(token string) bool {
+	return strings.HasPrefix(token, "_")
+}
+
+// ParseScope returns the scope named s
+func ParseScope(s string) (Scope, error) {
+	for _, scope := range Scopes {
+		if string(scope) == s {
+			return scope, nil
+		}
+	}
+
+	return "", fmt.Errorf("unknown scope %q", s)
+}
+
+// APIKey is a stored API key, only the hash of the secret is kept
+type APIKey struct {
+	ID        string    `json:"id"`
+	Name      string    `json:"name"`
+	Hash      string    `json:"hash"`
+	Scopes    []Scope   `json:"scopes"`
+	Namespace string    `json:"namespace,omitempty"`
+	Created   time.Time `json:"created"`
+	// Expires is zero for keys that don't expire
+	Expires time.Time `json:"expires"`
+	// Quota is the number of bytes the key may upload, 0 is unlimited
+	Quota int64 `json:"quota,omitempty"`
+	// Used is the number of bytes uploaded with the key
+	Used int64 `json:"used"`
+}
+
+// HasScope reports whether the key is granted scope
+func (k APIKey) HasScope(scope Scope) bool {
+	for _, s := range k.Scopes {
+		if s == scope || s == ScopeAdmin {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Expired reports whether the key expired
+func (k APIKey) Expired() bool {
+	return !k.Expires.IsZero() && time.Now().After(k.Expires)
+}
+
+// InNamespace reports whether the key may access files of namespace, only
+// admin keys without a namespace access all files
+func (k APIKey) InNamespace(namespace string) bool {
+	if k.Namespace == "" {
+		return k.HasScope(ScopeAdmin)
+	}
+
+	return k.Namespace == namespace
+}
+
+// KeyStore keeps API keys in a storage provider, the server uses the
+// metadata provider
+type KeyStore struct {
+	storage Storage
+	mutex   sync.Mutex
+}
+
+func NewKeyStore(storage Storage) *KeyStore {
+	return &KeyStore{storage: storage}
+}
+
+func hashAPIKey(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+func randomHex(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(b), nil
+}
+
+// Create stores a new key with the name, scopes, namespace, expiry and quota
+// of key. It returns the key to hand out, which can't be recovered later.
+func (ks *KeyStore) Create(ctx context.Context, key APIKey) (string, APIKey, error) {
+	if len(key.Scopes) == 0 {
+		return "", key, errors.New("api key without scopes")
+	}
+
+	id, err := randomHex(8)
+	if err != nil {
+		return "", key, err
+	}
+
+	secret, err := randomHex(24)
+	if err != nil {
+		return "", key, err
+	}
+
+	key.ID = id
+	key.Hash = hashAPIKey(secret)
+	key.Created = time.Now().UTC()
+	key.Used = 0
+
+	if err := ks.put(ctx, key); err != nil {
+		return "", key, err
+	}
+
+	return apiKeyPrefix + id + "_" + secret, key, nil
+}
+
+func (ks *KeyStore) put(ctx context.Context, key APIKey) error {
+	data, err := json.Marshal(key)
+	if err != nil {
+		return err
+	}
+
+	return ks.storage.Put(ctx, apiKeysToken, key.ID+".json", bytes.NewReader(data), "text/json", uint64(len(data)))
+}
+
+// Get returns the key with id
+func (ks *KeyStore) Get(ctx context.Context, id string) (APIKey, error) {
+	var key APIKey
+
+	reader, _, err := ks.storage.Get(ctx, apiKeysToken, id+".json")
+	if err != nil {
+		return key, err
+	}
+
+	defer reader.Close()
+
+	data, err := ioutil.ReadAll(reader)
+	if err != nil {
+		return key, err
+	}
+
+	err = json.Unmarshal(data, &key)
+	return key, err
+}
+
+// List returns all keys ordered by creation
+func (ks *KeyStore) List(ctx context.Context) ([]APIKey, error) {
+	objects, err := ks.storage.List(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	keys := []APIKey{}
+	for _, object := range objects {
+		if object.Token != apiKeysToken || !strings.HasSuffix(object.Filename, ".json") {
+			continue
+		}
+
+		key, err := ks.Get(ctx, strings.TrimSuffix(object.Filename, ".json"))
+		if ks.storage.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+
+		keys = append(keys, key)
+	}
+
+	sort.Slice(keys, func(i, j int) bool {
+		return keys[i].Created.Before(keys[j].Created)
+	})
+
+	return keys, nil
+}
+
+// Revoke removes the key with id
+func (ks *KeyStore) Revoke(ctx context.Context, id string) error {
+	return ks.storage.Delete(ctx, apiKeysToken, id+".json")
+}
+
+// Lookup returns the stored key of secret, unknown and expired keys are
+// reported as errInvalidAPIKey
+func (ks *KeyStore) Lookup(ctx context.Context, secret string) (APIKey, error) {
+	parts := strings.SplitN(strings.TrimPrefix(secret, apiKeyPrefix), "_", 2)
+	if !strings.HasPrefix(secret, apiKeyPrefix) || len(parts) != 2 {
+		return APIKey{}, errInvalidAPIKey
+	}
+
+	if _, err := hex.DecodeString(parts[0]); err != nil {
+		return APIKey{}, errInvalidAPIKey
+	}
+
+	key, err := ks.Get(ctx, parts[0])
+	if ks.storage.IsNotExist(err) {
+		return APIKey{}, errInvalidAPIKey
+	} else if err != nil {
+		return APIKey{}, err
+	}
+
+	if subtle.ConstantTimeCompare([]byte(key.Hash), []byte(hashAPIKey(parts[1]))) != 1 || key.Expired() {
+		return APIKey{}, errInvalidAPIKey
+	}
+
+	return key, nil
+}
+
+// AddUsage adds n uploaded bytes to the key with id, it returns
+// errQuotaExceeded and leaves the usage as is when n exceeds the quota
+func (ks *KeyStore) AddUsage(ctx context.Context, id string, n int64) error {
+	ks.mutex.Lock()
+	defer ks.mutex.Unlock()
+
+	key, err := ks.Get(ctx, id)
+	if err != nil {
+		return err
+	}
+
+	if n > 0 && key.Quota > 0 && key.Used+n > key.Quota {
+		return errQuotaExceeded
+	}
+
+	key.Used += n
+	if key.Used < 0 {
+		key.Used = 0
+	}
+
+	return ks.put(ctx, key)
+}
+
+// apiKeyFromRequest returns the API key of an X-Api-Key header or of a
+// bearer token with the API key prefix
+func apiKeyFromRequest(r *http.Request) string {
+	if key := r.Header.Get("X-Api-Key"); key != "" {
+		return key
+	}
+
+	if token := bearerToken(r); strings.HasPrefix(token, apiKeyPrefix) {
+		return token
+	}
+
+	return ""
+}
+
+// requestAPIKey looks up the API key of the request, it returns errNoAPIKey
+// when the request has none or API keys aren't enabled
+func (s *Server) requestAPIKey(r *http.Request) (APIKey, error) {
+	secret := apiKeyFromRequest(r)
+	if s.keys == nil || secret == "" {
+		return APIKey{}, errNoAPIKey
+	}
+
+	return s.keys.Lookup(r.Context(), secret)
+}
+
+// apiKeyError writes the response of a failed API key lookup
+func apiKeyError(w http.ResponseWriter, err error) {
+	if err == errInvalidAPIKey {
+		http.Error(w, "Not authorized", http.StatusUnauthorized)
+		return
+	}
+
+	log.Printf("Error looking up api key: %s", err.Error())
+	http.Error(w, "Could not verify api key", http.StatusInternalServerError)
+}
+
+// reserveQuota charges an upload to the API key of the request, it writes
+// the response and returns false when the quota is exceeded. The quota
+// returned by the api authenticator limits the size of each upload.
+func (s *Server) reserveQuota(w http.ResponseWriter, r *http.Request, contentLength int64) bool {
+	identity, ok := IdentityFromContext(r.Context())
+	if !ok {
+		return true
+	} else if identity.Key == nil {
+		if identity.Quota > 0 && contentLength > identity.Quota {
+			http.Error(w, errQuotaExceeded.Error(), http.StatusForbidden)
+			return false
+		}
+
+		return true
+	}
+
+	if err := s.keys.AddUsage(r.Context(), identity.Key.ID, contentLength); err == errQuotaExceeded {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return false
+	} else if err != nil {
+		log.Printf("Error updating api key usage: %s", err.Error())
+		http.Error(w, "Could not update api key usage", http.StatusInternalServerError)
+		return false
+	}
+
+	return true
+}
+
+// releaseQuota returns the bytes of a failed upload to the API key of the request
+func (s *Server) releaseQuota(r *http.Request, contentLength int64) {
+	identity, ok := IdentityFromContext(r.Context())
+	if !ok || identity.Key == nil {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), abortUploadTimeout)
+	defer cancel()
+
+	if err := s.keys.AddUsage(ctx, identity.Key.ID, -contentLength); err != nil {
+		log.Printf("Error updating api key usage: %s", err.Error())
+	}
+}
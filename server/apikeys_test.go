@@ -0,0 +1,205 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"time"
+
+	"github.com/gorilla/mux"
+	. "gopkg.in/check.v1"
+)
+
+var _ = Suite(&SuiteAPIKeys{})
+
+type SuiteAPIKeys struct {
+	server *Server
+}
+
+func (s *SuiteAPIKeys) SetUpTest(c *C) {
+	storage, err := NewLocalStorage(c.MkDir(), log.New(ioutil.Discard, "", 0))
+	c.Assert(err, IsNil)
+
+	var authenticator DefaultServAuthenticator
+	authenticator.Set("user", "secret")
+
+	s.server, err = New(UseStorage(storage), UseMetaStorage(storage), AuthCredential(ServerAuthKey, &authenticator), EnableAPIKeys())
+	c.Assert(err, IsNil)
+}
+
+func (s *SuiteAPIKeys) createKey(c *C, key APIKey) (string, APIKey) {
+	secret, key, err := s.server.keys.Create(context.Background(), key)
+	c.Assert(err, IsNil)
+
+	return secret, key
+}
+
+func (s *SuiteAPIKeys) upload(c *C, secret string, content string) *http.Response {
+	req := httptest.NewRequest("PUT", "/file.txt", bytes.NewBufferString(content))
+	req = mux.SetURLVars(req, map[string]string{"filename": "file.txt"})
+	req.Header.Set("X-Api-Key", secret)
+
+	w := httptest.NewRecorder()
+	s.server.BasicAuthHandler(http.HandlerFunc(s.server.putHandler))(w, req)
+
+	return w.Result()
+}
+
+func (s *SuiteAPIKeys) TestKeyStore(c *C) {
+	ctx := context.Background()
+
+	_, _, err := s.server.keys.Create(ctx, APIKey{Name: "none"})
+	c.Assert(err, NotNil)
+
+	secret, key := s.createKey(c, APIKey{Name: "ci", Scopes: []Scope{ScopeUpload}})
+	c.Assert(key.Hash, Not(Equals), "")
+
+	found, err := s.server.keys.Lookup(ctx, secret)
+	c.Assert(err, IsNil)
+	c.Assert(found.ID, Equals, key.ID)
+
+	for _, invalid := range []string{"", "tsh_", "tsh_" + key.ID + "_wrong", secret + "0", "tsh_zz_" + secret} {
+		_, err = s.server.keys.Lookup(ctx, invalid)
+		c.Assert(err, Equals, errInvalidAPIKey, Commentf(invalid))
+	}
+
+	expired, _ := s.createKey(c, APIKey{Name: "expired", Scopes: []Scope{ScopeUpload}, Expires: time.Now().Add(-time.Minute)})
+	_, err = s.server.keys.Lookup(ctx, expired)
+	c.Assert(err, Equals, errInvalidAPIKey)
+
+	keys, err := s.server.keys.List(ctx)
+	c.Assert(err, IsNil)
+	c.Assert(keys, HasLen, 2)
+
+	c.Assert(s.server.keys.Revoke(ctx, key.ID), IsNil)
+
+	_, err = s.server.keys.Lookup(ctx, secret)
+	c.Assert(err, Equals, errInvalidAPIKey)
+}
+
+func (s *SuiteAPIKeys) TestScopes(c *C) {
+	key := APIKey{Scopes: []Scope{ScopeUpload}, Namespace: "ci"}
+	c.Assert(key.HasScope(ScopeUpload), Equals, true)
+	c.Assert(key.HasScope(ScopeDownload), Equals, false)
+	c.Assert(key.InNamespace("ci"), Equals, true)
+	c.Assert(key.InNamespace(""), Equals, false)
+
+	admin := APIKey{Scopes: []Scope{ScopeAdmin}}
+	c.Assert(admin.HasScope(ScopeDeleteAny), Equals, true)
+	c.Assert(admin.InNamespace("ci"), Equals, true)
+
+	// keys without a namespace don't access the files of every namespace
+	download := APIKey{Scopes: []Scope{ScopeDownload}}
+	c.Assert(download.InNamespace("ci"), Equals, false)
+	c.Assert(download.InNamespace(""), Equals, false)
+}
+
+func (s *SuiteAPIKeys) TestUpload(c *C) {
+	secret, _ := s.createKey(c, APIKey{Name: "ci", Scopes: []Scope{ScopeUpload}, Namespace: "ci"})
+
+	resp := s.upload(c, secret, "content")
+	c.Assert(resp.StatusCode, Equals, http.StatusOK)
+
+	files, err := s.server.metadataStorage.List(context.Background())
+	c.Assert(err, IsNil)
+
+	for _, file := range files {
+		if file.Filename == "file.txt" {
+			metadata, err := s.server.readMetadata(context.Background(), file.Token, file.Filename)
+			c.Assert(err, IsNil)
+			c.Assert(metadata.Namespace, Equals, "ci")
+			c.Assert(metadata.Owner, Equals, "key:ci")
+		}
+	}
+
+	c.Assert(s.upload(c, "tsh_invalid_key", "content").StatusCode, Equals, http.StatusUnauthorized)
+
+	download, _ := s.createKey(c, APIKey{Name: "download", Scopes: []Scope{ScopeDownload}})
+	c.Assert(s.upload(c, download, "content").StatusCode, Equals, http.StatusForbidden)
+}
+
+func (s *SuiteAPIKeys) TestBearer(c *C) {
+	secret, _ := s.createKey(c, APIKey{Name: "ci", Scopes: []Scope{ScopeUpload}})
+
+	req := httptest.NewRequest("PUT", "/file.txt", bytes.NewBufferString("content"))
+	req = mux.SetURLVars(req, map[string]string{"filename": "file.txt"})
+	req.Header.Set("Authorization", "Bearer "+secret)
+
+	w := httptest.NewRecorder()
+	s.server.BasicAuthHandler(http.HandlerFunc(s.server.putHandler))(w, req)
+	c.Assert(w.Result().StatusCode, Equals, http.StatusOK)
+}
+
+func (s *SuiteAPIKeys) TestQuota(c *C) {
+	secret, key := s.createKey(c, APIKey{Name: "ci", Scopes: []Scope{ScopeUpload}, Quota: 10})
+
+	c.Assert(s.upload(c, secret, "12345678").StatusCode, Equals, http.StatusOK)
+	c.Assert(s.upload(c, secret, "12345678").StatusCode, Equals, http.StatusForbidden)
+	c.Assert(s.upload(c, secret, "12").StatusCode, Equals, http.StatusOK)
+	c.Assert(s.upload(c, secret, "1").StatusCode, Equals, http.StatusForbidden)
+
+	key, err := s.server.keys.Get(context.Background(), key.ID)
+	c.Assert(err, IsNil)
+	c.Assert(key.Used, Equals, int64(10))
+}
+
+func (s *SuiteAPIKeys) TestDownload(c *C) {
+	s.putMetadata(c, "protected", Metadata{MaxDownloads: -1, AuthTypes: []AuthType{METADATA}, User: "user", Password: cryptoPwd("secret", "protected"), Namespace: "ci"})
+
+	serve := func(secret string) int {
+		req := httptest.NewRequest("GET", "/protected/file.txt", nil)
+		req = mux.SetURLVars(req, map[string]string{"token": "protected", "filename": "file.txt"})
+		req.Header.Set("X-Api-Key", secret)
+
+		w := httptest.NewRecorder()
+		s.server.AuthorizeFile(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))(w, req)
+		return w.Result().StatusCode
+	}
+
+	download, _ := s.createKey(c, APIKey{Name: "download", Scopes: []Scope{ScopeDownload}, Namespace: "ci"})
+	c.Assert(serve(download), Equals, http.StatusOK)
+
+	other, _ := s.createKey(c, APIKey{Name: "other", Scopes: []Scope{ScopeDownload}, Namespace: "other"})
+	c.Assert(serve(other), Equals, http.StatusForbidden)
+
+	upload, _ := s.createKey(c, APIKey{Name: "upload", Scopes: []Scope{ScopeUpload}})
+	c.Assert(serve(upload), Equals, http.StatusForbidden)
+
+	global, _ := s.createKey(c, APIKey{Name: "global", Scopes: []Scope{ScopeDownload}})
+	c.Assert(serve(global), Equals, http.StatusForbidden)
+}
+
+func (s *SuiteAPIKeys) TestDeleteAny(c *C) {
+	s.putMetadata(c, "ci", Metadata{MaxDownloads: -1, Namespace: "ci"})
+	s.putMetadata(c, "other", Metadata{MaxDownloads: -1, Namespace: "other"})
+
+	remove := func(token, secret string) int {
+		req := httptest.NewRequest("DELETE", "/"+token+"/file.txt", nil)
+		req = mux.SetURLVars(req, map[string]string{"token": token, "filename": "file.txt"})
+		if secret != "" {
+			req.Header.Set("X-Api-Key", secret)
+		}
+
+		w := httptest.NewRecorder()
+		s.server.deleteHandler(w, req)
+		return w.Result().StatusCode
+	}
+
+	upload, _ := s.createKey(c, APIKey{Name: "upload", Scopes: []Scope{ScopeUpload}})
+	deleteAny, _ := s.createKey(c, APIKey{Name: "delete", Scopes: []Scope{ScopeDeleteAny}, Namespace: "ci"})
+
+	c.Assert(remove("ci", ""), Equals, http.StatusUnauthorized)
+	c.Assert(remove("ci", upload), Equals, http.StatusForbidden)
+	c.Assert(remove("other", deleteAny), Equals, http.StatusForbidden)
+	c.Assert(remove("ci", deleteAny), Equals, http.StatusOK)
+	c.Assert(remove("ci", deleteAny), Equals, http.StatusNotFound)
+}
+
+func (s *SuiteAPIKeys) putMetadata(c *C, token string, metadata Metadata) {
+	content := []byte("content")
+	c.Assert(s.server.storage.Put(context.Background(), token, "file.txt", bytes.NewReader(content), "text/plain", uint64(len(content))), IsNil)
+	c.Assert(s.server.putMetadata(context.Background(), token, "file.txt", metadata), IsNil)
+}
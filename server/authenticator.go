@@ -1,5 +1,192 @@
 package server
 
+import (
+	"context"
+	"log"
+	"net/http"
+	"strings"
+
+	apiauth "github.com/dutchcoders/transfer.sh/api-auth"
+)
+
 type Authenticator interface {
 	Authenticate(user, password string) (bool, error)
 }
+
+// IdentityAuthenticator is implemented by authenticators that resolve the
+// user, scopes and quota of the credentials
+type IdentityAuthenticator interface {
+	AuthenticateIdentity(user, password string) (Identity, bool, error)
+}
+
+// ContextAuthenticator is implemented by authenticators that check the
+// credentials for the request of a context, e.g. to propagate its trace
+type ContextAuthenticator interface {
+	AuthenticateContext(ctx context.Context, user, password string) (Identity, bool, error)
+}
+
+// authenticate checks the credentials with authenticator for the request of
+// ctx and returns the identity they resolve to
+func authenticate(ctx context.Context, authenticator Authenticator, user, password string) (Identity, bool, error) {
+	if a, ok := authenticator.(ContextAuthenticator); ok {
+		return a.AuthenticateContext(ctx, user, password)
+	} else if a, ok := authenticator.(IdentityAuthenticator); ok {
+		return a.AuthenticateIdentity(user, password)
+	}
+
+	ok, err := authenticator.Authenticate(user, password)
+	return Identity{User: user}, ok, err
+}
+
+// isUnavailable reports whether err means the credentials couldn't be checked
+// because an authentication service is unavailable
+func isUnavailable(err error) bool {
+	e, ok := err.(interface{ Unavailable() bool })
+	return ok && e.Unavailable()
+}
+
+// anyAuthenticator accepts the credentials accepted by any of its authenticators
+type anyAuthenticator []Authenticator
+
+func (a anyAuthenticator) Authenticate(user, password string) (bool, error) {
+	_, ok, err := a.AuthenticateIdentity(user, password)
+	return ok, err
+}
+
+func (a anyAuthenticator) AuthenticateIdentity(user, password string) (Identity, bool, error) {
+	return a.AuthenticateContext(context.Background(), user, password)
+}
+
+func (a anyAuthenticator) AuthenticateContext(ctx context.Context, user, password string) (Identity, bool, error) {
+	var lastErr error
+
+	for _, authenticator := range a {
+		identity, ok, err := authenticate(ctx, authenticator, user, password)
+		if ok {
+			return identity, true, nil
+		} else if err != nil {
+			lastErr = err
+		}
+	}
+
+	return Identity{}, false, lastErr
+}
+
+// apiAuthenticator applies the user, scopes and quota returned by the api
+// authenticator
+type apiAuthenticator struct {
+	*apiauth.APIAuthenticator
+}
+
+func (a apiAuthenticator) AuthenticateIdentity(user, password string) (Identity, bool, error) {
+	return a.AuthenticateContext(context.Background(), user, password)
+}
+
+func (a apiAuthenticator) AuthenticateContext(ctx context.Context, user, password string) (Identity, bool, error) {
+	ctx, span := startSpan(ctx, "apiauth.authenticate", spanKindClient)
+	result, ok, err := a.AuthenticateResultContext(ctx, user, password)
+	span.setAttribute("auth.ok", ok)
+	span.end(err)
+
+	if !ok || err != nil {
+		return Identity{}, false, err
+	}
+
+	identity := Identity{User: result.User, Quota: result.Quota}
+	for _, s := range result.Scopes {
+		scope, err := ParseScope(s)
+		if err != nil {
+			log.Printf("Ignoring scope of api authenticator: %s", err.Error())
+			continue
+		}
+
+		identity.Scopes = append(identity.Scopes, scope)
+	}
+
+	if len(result.Scopes) != 0 && len(identity.Scopes) == 0 {
+		// none of the scopes is known, grant none instead of all
+		return Identity{}, false, nil
+	}
+
+	return identity, true, nil
+}
+
+// TokenAuthenticator verifies the bearer tokens of requests, it returns the
+// user the token was issued to. Invalid tokens are reported as not ok, an
+// error means the token couldn't be verified.
+type TokenAuthenticator interface {
+	AuthenticateToken(token string) (user string, ok bool, err error)
+}
+
+// bearerToken returns the token of an Authorization: Bearer header
+func bearerToken(r *http.Request) string {
+	const prefix = "bearer "
+
+	if auth := r.Header.Get("Authorization"); len(auth) > len(prefix) && strings.EqualFold(auth[:len(prefix)], prefix) {
+		return strings.TrimSpace(auth[len(prefix):])
+	}
+
+	return ""
+}
+
+// authenticateToken returns the user of the first authenticator that accepts the token
+func authenticateToken(authenticators []TokenAuthenticator, token string) (string, bool) {
+	for _, authenticator := range authenticators {
+		user, ok, err := authenticator.AuthenticateToken(token)
+		if err != nil {
+			log.Printf("Error checkAuth: %s", err.Error())
+		}
+
+		if ok {
+			return user, true
+		}
+	}
+
+	return "", false
+}
+
+// Identity is the authenticated user of a request
+type Identity struct {
+	User string
+	// Scopes granted to the user, all scopes when empty
+	Scopes []Scope
+	// Quota is the number of bytes an upload may have, 0 is unlimited. It is
+	// a total over all uploads for API keys only.
+	Quota int64
+	// Key is the API key of the request, nil for other credentials
+	Key *APIKey
+}
+
+// keyIdentity returns the identity of an API key, its user is qualified so
+// the key isn't taken for a user or certificate of the same name
+func keyIdentity(key APIKey) Identity {
+	return Identity{User: "key:" + key.Name, Scopes: key.Scopes, Key: &key}
+}
+
+// certificateIdentity returns the identity of the common name of a client
+// certificate, qualified like the identities of API keys
+func certificateIdentity(user string) Identity {
+	return Identity{User: "cert:" + user}
+}
+
+// HasScope reports whether the user is granted scope
+func (i Identity) HasScope(scope Scope) bool {
+	if len(i.Scopes) == 0 {
+		return true
+	}
+
+	return APIKey{Scopes: i.Scopes}.HasScope(scope)
+}
+
+type identityContextKey struct{}
+
+// WithIdentity returns a copy of ctx carrying the authenticated user
+func WithIdentity(ctx context.Context, identity Identity) context.Context {
+	return context.WithValue(ctx, identityContextKey{}, identity)
+}
+
+// IdentityFromContext returns the authenticated user of a request, if any
+func IdentityFromContext(ctx context.Context) (Identity, bool) {
+	identity, ok := ctx.Value(identityContextKey{}).(Identity)
+	return identity, ok
+}
@@ -0,0 +1,365 @@
+package server
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+// AuthorizeFile enforces the per-file restrictions of the requested file
+// before calling h, it is applied to every route that reads a stored file
+func (s *Server) AuthorizeFile(h http.Handler) http.HandlerFunc {
+	return s.AssignMetadata(MetadataAllowedIP(s.MetadataBasicAuth(h)))
+}
+
+// AssignMetadata loads the metadata of the requested file, it is available to
+// the next handlers through MetadataFromContext
+func (s *Server) AssignMetadata(h http.Handler) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		token := vars["token"]
+		filename := vars["filename"]
+
+		// reserved tokens hold server records, like the drop boxes and api
+		// keys, that are never served as files
+		if !isUploadedFile(token, filename) {
+			http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+			return
+		}
+
+		metadata, err := s.GetMetadata(r.Context(), token, filename)
+		if err != nil {
+			s.metadataError(w, err)
+			return
+		}
+
+		h.ServeHTTP(w, r.WithContext(WithMetadata(r.Context(), metadata)))
+	}
+}
+
+func MetadataAllowedIP(h http.Handler) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		metadata, ok := MetadataFromContext(r.Context())
+		if !ok {
+			http.Error(w, "failed to get metadata", http.StatusBadRequest)
+			return
+		}
+
+		if !metadata.AllowedIP(r.RemoteAddr) {
+			http.Error(w, "Not authorized", http.StatusUnauthorized)
+			return
+		}
+
+		h.ServeHTTP(w, r)
+	}
+}
+
+func (s *Server) MetadataBasicAuth(h http.Handler) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		metadata, ok := MetadataFromContext(r.Context())
+		if !ok {
+			http.Error(w, "failed to get metadata", http.StatusBadRequest)
+			return
+		}
+
+		vars := mux.Vars(r)
+		if !s.authorizeCredentials(w, r, vars["token"], vars["filename"], metadata) {
+			return
+		}
+
+		h.ServeHTTP(w, r)
+	}
+}
+
+// authorize enforces all per-file restrictions of metadata, it writes the
+// response and returns false when the request is denied
+func (s *Server) authorize(w http.ResponseWriter, r *http.Request, token, filename string, metadata Metadata) bool {
+	if !metadata.AllowedIP(r.RemoteAddr) {
+		http.Error(w, "Not authorized", http.StatusUnauthorized)
+		return false
+	}
+
+	return s.authorizeCredentials(w, r, token, filename, metadata)
+}
+
+// authorizeCredentials checks the credentials of the request against the
+// authenticators required by metadata, the credentials are accepted when any
+// of them accepts them. Browsers are asked for the credentials of a password
+// protected file with the password form, other clients with Basic auth.
+func (s *Server) authorizeCredentials(w http.ResponseWriter, r *http.Request, token, filename string, metadata Metadata) bool {
+	authenticators, ok := s.credentialAuthenticators(w, &metadata)
+	if !ok {
+		return false
+	}
+
+	tokenAuthenticators, ok := s.tokenAuthenticators(w, metadata)
+	if !ok {
+		return false
+	} else if len(authenticators) == 0 && len(tokenAuthenticators) == 0 && !metadata.CertificateRequired() && !metadata.SignedRequired() && !metadata.OwnerRequired() && !metadata.LinksRequired() {
+		return true
+	}
+
+	if metadata.SignedRequired() {
+		if present, valid := s.checkSignedURL(r, token, filename); valid {
+			return true
+		} else if present {
+			http.Error(w, "Invalid or expired link", http.StatusForbidden)
+			return false
+		}
+	}
+
+	if metadata.LinksRequired() {
+		if present, valid := checkLink(r, metadata); valid {
+			return true
+		} else if present {
+			http.Error(w, errLinkUnavailable.Error(), http.StatusForbidden)
+			return false
+		}
+	}
+
+	if metadata.CertificateRequired() && metadata.AllowedCertificate(s.certificateUser(r)) {
+		return true
+	}
+
+	if s.validPasswordCookie(r, token, filename, metadata) {
+		return true
+	}
+
+	if metadata.OwnerRequired() {
+		if identity, ok, err := s.requestIdentity(r); isUnavailable(err) {
+			http.Error(w, "Authentication service unavailable", http.StatusServiceUnavailable)
+			return false
+		} else if ok && identity.User == metadata.Owner {
+			return true
+		}
+	}
+
+	if key, err := s.requestAPIKey(r); err == errNoAPIKey {
+	} else if err != nil {
+		apiKeyError(w, err)
+		return false
+	} else if key.HasScope(ScopeDownload) && key.InNamespace(metadata.Namespace) {
+		return true
+	} else {
+		http.Error(w, "api key not allowed to download", http.StatusForbidden)
+		return false
+	}
+
+	if bearer := bearerToken(r); bearer != "" && len(tokenAuthenticators) != 0 {
+		if _, ok := authenticateToken(tokenAuthenticators, bearer); ok {
+			return true
+		}
+
+		w.Header().Set("WWW-Authenticate", "Bearer error=\"invalid_token\"")
+		http.Error(w, "Not authorized", http.StatusUnauthorized)
+		return false
+	} else if len(authenticators) == 0 {
+		if len(tokenAuthenticators) != 0 {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+		} else if metadata.OwnerRequired() {
+			s.challenge(w)
+		}
+
+		http.Error(w, "Not authorized", http.StatusUnauthorized)
+		return false
+	}
+
+	username, password, authOK := r.BasicAuth()
+	if !authOK && wantsPasswordForm(r, metadata) {
+		s.renderPasswordForm(w, filename, "")
+		return false
+	}
+
+	if authOK {
+		if ok, err := s.checkCredentials(r, token, filename, &metadata, authenticators, username, password); ok {
+			return true
+		} else if err != nil {
+			http.Error(w, "Authentication service unavailable", http.StatusServiceUnavailable)
+			return false
+		}
+	}
+
+	w.Header().Set("WWW-Authenticate", "Basic realm=\"Restricted\"")
+	http.Error(w, "Not authorized", http.StatusUnauthorized)
+	return false
+}
+
+// credentialAuthenticators returns the authenticators required by metadata,
+// it writes the response and returns false when one isn't available
+func (s *Server) credentialAuthenticators(w http.ResponseWriter, metadata *Metadata) ([]Authenticator, bool) {
+	var authenticators []Authenticator
+
+	for _, authType := range metadata.AuthTypes {
+		switch authType {
+		case API:
+			authenticator, ok := s.auths[string(API)]
+			if !ok {
+				http.Error(w, "the api authenticator does not set up", http.StatusInternalServerError)
+				return nil, false
+			}
+
+			authenticators = append(authenticators, authenticator)
+		case METADATA:
+			authenticators = append(authenticators, metadata)
+		}
+	}
+
+	return authenticators, true
+}
+
+// tokenAuthenticators returns the bearer token authenticators required by
+// metadata, it writes the response and returns false when one isn't available
+func (s *Server) tokenAuthenticators(w http.ResponseWriter, metadata Metadata) ([]TokenAuthenticator, bool) {
+	var authenticators []TokenAuthenticator
+
+	for _, authType := range metadata.AuthTypes {
+		switch authType {
+		case JWT:
+			authenticator, ok := s.tokenAuths[string(JWT)]
+			if !ok {
+				http.Error(w, "the jwt authenticator does not set up", http.StatusInternalServerError)
+				return nil, false
+			}
+
+			authenticators = append(authenticators, authenticator)
+		}
+	}
+
+	return authenticators, true
+}
+
+// checkCredentials reports whether any of the authenticators accepts the
+// credentials for downloading, an outdated password hash in metadata is
+// upgraded. It returns an error when no authenticator accepts them and an
+// authentication service was unavailable.
+func (s *Server) checkCredentials(r *http.Request, token, filename string, metadata *Metadata, authenticators []Authenticator, username, password string) (bool, error) {
+	var unavailable error
+
+	for _, authenticator := range authenticators {
+		identity, ok, err := authenticate(r.Context(), authenticator, username, password)
+		if err != nil {
+			log.Printf("Error checkAuth: %s", err.Error())
+
+			if isUnavailable(err) {
+				unavailable = err
+			}
+		}
+
+		if !ok || !identity.HasScope(ScopeDownload) {
+			continue
+		}
+
+		if authenticator == Authenticator(metadata) && needsRehash(metadata.Password) {
+			s.upgradePassword(r.Context(), token, filename, metadata, password)
+		}
+
+		return true, nil
+	}
+
+	return false, unavailable
+}
+
+// upgradePassword replaces a legacy or outdated password hash of a file after
+// the password has been verified
+func (s *Server) upgradePassword(ctx context.Context, token, filename string, metadata *Metadata, password string) {
+	hash, err := hashPassword(password)
+	if err != nil {
+		log.Printf("Error hashing password: %s", err.Error())
+		return
+	}
+
+	if _, err := s.updateMetadata(ctx, token, filename, func(metadata *Metadata) error {
+		metadata.Password = hash
+		return nil
+	}); err != nil {
+		log.Printf("Error upgrading password hash of %s/%s: %s", token, filename, err.Error())
+		return
+	}
+
+	metadata.Password = hash
+}
+
+// authorizeDeleteAny checks that the API key of the request may delete the
+// file without its deletion token, it writes the response and returns false
+// when it may not
+func (s *Server) authorizeDeleteAny(w http.ResponseWriter, r *http.Request, token, filename string) bool {
+	key, err := s.requestAPIKey(r)
+	if err == errNoAPIKey {
+		http.Error(w, "Not authorized", http.StatusUnauthorized)
+		return false
+	} else if err != nil {
+		apiKeyError(w, err)
+		return false
+	} else if !key.HasScope(ScopeDeleteAny) {
+		http.Error(w, "api key not allowed to delete", http.StatusForbidden)
+		return false
+	}
+
+	metadata, err := s.readMetadata(r.Context(), token, filename)
+	if err != nil {
+		log.Printf("Error metadata: %s", err.Error())
+		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		return false
+	} else if !key.InNamespace(metadata.Namespace) {
+		http.Error(w, "api key not allowed to delete", http.StatusForbidden)
+		return false
+	}
+
+	return true
+}
+
+// archiveFile is a stored file requested as part of an archive
+type archiveFile struct {
+	token    string
+	filename string
+}
+
+// authorizeArchive resolves the files of an archive request and enforces the
+// restrictions of every file before anything of the archive is written
+func (s *Server) authorizeArchive(w http.ResponseWriter, r *http.Request) ([]archiveFile, bool) {
+	var files []archiveFile
+
+	for _, key := range strings.Split(mux.Vars(r)["files"], ",") {
+		key = resolveKey(key, s.proxyPath)
+
+		parts := strings.Split(key, "/")
+		if len(parts) < 2 {
+			http.Error(w, "File not found", http.StatusNotFound)
+			return nil, false
+		}
+
+		file := archiveFile{token: parts[0], filename: sanitize(parts[1])}
+		if !isUploadedFile(file.token, file.filename) {
+			http.Error(w, "File not found", http.StatusNotFound)
+			return nil, false
+		}
+
+		// every upload stores metadata, blocked or expired files are left out
+		// of the archive
+		metadata, err := s.CheckMetadata(r.Context(), file.token, file.filename, false)
+		if err == errBlocked || err == errMaxDownloads || err == errMaxDate {
+			continue
+		} else if s.metadataStorage.IsNotExist(err) {
+			http.Error(w, "File not found", http.StatusNotFound)
+			return nil, false
+		} else if err != nil {
+			log.Printf("%s", err.Error())
+			http.Error(w, "Could not retrieve file.", http.StatusInternalServerError)
+			return nil, false
+		} else if !s.authorize(w, r, file.token, file.filename, metadata) {
+			return nil, false
+		}
+
+		files = append(files, file)
+	}
+
+	if len(files) == 0 {
+		http.Error(w, "File not found", http.StatusNotFound)
+		return nil, false
+	}
+
+	return files, true
+}
@@ -0,0 +1,474 @@
+package server
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"mime/multipart"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+
+	apiauth "github.com/dutchcoders/transfer.sh/api-auth"
+	"github.com/gorilla/mux"
+	. "gopkg.in/check.v1"
+)
+
+var _ = Suite(&SuiteAuthorization{})
+
+type SuiteAuthorization struct {
+	server *Server
+}
+
+func (s *SuiteAuthorization) SetUpTest(c *C) {
+	storage, err := NewLocalStorage(c.MkDir(), log.New(ioutil.Discard, "", 0))
+	c.Assert(err, IsNil)
+
+	s.server, err = New(UseStorage(storage), UseMetaStorage(storage))
+	c.Assert(err, IsNil)
+
+	s.putFile(c, "public", Metadata{MaxDownloads: -1})
+	s.putFile(c, "protected", Metadata{
+		MaxDownloads: -1,
+		AuthTypes:    []AuthType{METADATA},
+		User:         "user",
+		Password:     cryptoPwd("secret", "protected"),
+	})
+	s.putFile(c, "restricted", Metadata{
+		MaxDownloads: -1,
+		AuthTypes:    []AuthType{IP},
+		IP:           []net.IP{net.ParseIP("10.0.0.1")},
+	})
+}
+
+func (s *SuiteAuthorization) putFile(c *C, token string, metadata Metadata) {
+	content := []byte("content")
+	c.Assert(s.server.storage.Put(context.Background(), token, "file.txt", bytes.NewReader(content), "text/plain", uint64(len(content))), IsNil)
+
+	data, err := json.Marshal(metadata)
+	c.Assert(err, IsNil)
+	c.Assert(s.server.metadataStorage.Put(context.Background(), token, "file.txt.metadata", bytes.NewReader(data), "text/json", uint64(len(data))), IsNil)
+}
+
+func (s *SuiteAuthorization) serveFile(token string, req *http.Request) *http.Response {
+	filename := "file.txt"
+	if parts := strings.Split(req.URL.Path, "/"); len(parts) == 3 {
+		filename = parts[2]
+	}
+
+	req = mux.SetURLVars(req, map[string]string{"token": token, "filename": filename})
+
+	w := httptest.NewRecorder()
+	s.server.AuthorizeFile(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))(w, req)
+
+	return w.Result()
+}
+
+func (s *SuiteAuthorization) TestPublic(c *C) {
+	resp := s.serveFile("public", httptest.NewRequest("GET", "/public/file.txt", nil))
+	c.Assert(resp.StatusCode, Equals, http.StatusOK)
+}
+
+func (s *SuiteAuthorization) TestMissingMetadata(c *C) {
+	resp := s.serveFile("missing", httptest.NewRequest("GET", "/missing/file.txt", nil))
+	c.Assert(resp.StatusCode, Equals, http.StatusNotFound)
+}
+
+func (s *SuiteAuthorization) TestBasicAuth(c *C) {
+	req := httptest.NewRequest("HEAD", "/protected/file.txt", nil)
+	resp := s.serveFile("protected", req)
+	c.Assert(resp.StatusCode, Equals, http.StatusUnauthorized)
+	c.Assert(resp.Header.Get("WWW-Authenticate"), Not(Equals), "")
+
+	req = httptest.NewRequest("HEAD", "/protected/file.txt", nil)
+	req.SetBasicAuth("user", "wrong")
+	resp = s.serveFile("protected", req)
+	c.Assert(resp.StatusCode, Equals, http.StatusUnauthorized)
+
+	req = httptest.NewRequest("HEAD", "/protected/file.txt", nil)
+	req.SetBasicAuth("user", "secret")
+	resp = s.serveFile("protected", req)
+	c.Assert(resp.StatusCode, Equals, http.StatusOK)
+
+	// the legacy hash is upgraded on a successful login
+	metadata, err := s.server.GetMetadata(context.Background(), "protected", "file.txt")
+	c.Assert(err, IsNil)
+	c.Assert(needsRehash(metadata.Password), Equals, false)
+
+	req = httptest.NewRequest("HEAD", "/protected/file.txt", nil)
+	req.SetBasicAuth("user", "secret")
+	resp = s.serveFile("protected", req)
+	c.Assert(resp.StatusCode, Equals, http.StatusOK)
+}
+
+func (s *SuiteAuthorization) TestAllowedIP(c *C) {
+	req := httptest.NewRequest("GET", "/restricted/file.txt", nil)
+	req.RemoteAddr = "10.0.0.2:1234"
+	c.Assert(s.serveFile("restricted", req).StatusCode, Equals, http.StatusUnauthorized)
+
+	req = httptest.NewRequest("GET", "/restricted/file.txt", nil)
+	req.RemoteAddr = "10.0.0.1:1234"
+	c.Assert(s.serveFile("restricted", req).StatusCode, Equals, http.StatusOK)
+}
+
+func (s *SuiteAuthorization) TestArchive(c *C) {
+	req := httptest.NewRequest("GET", "/(public/file.txt,protected/file.txt).zip", nil)
+	req = mux.SetURLVars(req, map[string]string{"files": "public/file.txt,protected/file.txt"})
+
+	w := httptest.NewRecorder()
+	s.server.zipHandler(w, req)
+
+	resp := w.Result()
+	c.Assert(resp.StatusCode, Equals, http.StatusUnauthorized)
+	c.Assert(resp.Header.Get("Content-Type"), Not(Equals), "application/zip")
+
+	req = httptest.NewRequest("GET", "/(public/file.txt,protected/file.txt).tar", nil)
+	req = mux.SetURLVars(req, map[string]string{"files": "public/file.txt,protected/file.txt"})
+	req.SetBasicAuth("user", "secret")
+
+	w = httptest.NewRecorder()
+	s.server.tarHandler(w, req)
+
+	resp = w.Result()
+	c.Assert(resp.StatusCode, Equals, http.StatusOK)
+	c.Assert(resp.Header.Get("Content-Type"), Equals, "application/x-tar")
+}
+
+func (s *SuiteAuthorization) TestArchiveMetadataFiles(c *C) {
+	archive := func(files string) int {
+		req := mux.SetURLVars(httptest.NewRequest("GET", "/("+files+").zip", nil), map[string]string{"files": files})
+		w := httptest.NewRecorder()
+		s.server.zipHandler(w, req)
+		return w.Code
+	}
+
+	// the metadata of a file isn't a file of its own
+	c.Assert(archive("protected/file.txt.metadata"), Equals, http.StatusNotFound)
+	c.Assert(archive("public/file.txt,protected/file.txt.metadata"), Equals, http.StatusNotFound)
+
+	// every upload has metadata, files without it aren't served
+	content := []byte("content")
+	c.Assert(s.server.storage.Put(context.Background(), "orphan", "file.txt", bytes.NewReader(content), "text/plain", uint64(len(content))), IsNil)
+	c.Assert(archive("orphan/file.txt"), Equals, http.StatusNotFound)
+}
+
+func (s *SuiteAuthorization) TestArchiveMetadata(c *C) {
+	s.putFile(c, "expired", Metadata{MaxDownloads: 1, Downloads: 1})
+
+	req := httptest.NewRequest("GET", "/(public/file.txt,expired/file.txt).zip", nil)
+	req = mux.SetURLVars(req, map[string]string{"files": "public/file.txt,expired/file.txt"})
+
+	w := httptest.NewRecorder()
+	s.server.zipHandler(w, req)
+	c.Assert(w.Code, Equals, http.StatusOK)
+
+	// expired files are left out of the archive
+	archive, err := zip.NewReader(bytes.NewReader(w.Body.Bytes()), int64(w.Body.Len()))
+	c.Assert(err, IsNil)
+	c.Assert(archive.File, HasLen, 1)
+
+	req = mux.SetURLVars(httptest.NewRequest("GET", "/(expired/file.txt).zip", nil), map[string]string{"files": "expired/file.txt"})
+	w = httptest.NewRecorder()
+	s.server.zipHandler(w, req)
+	c.Assert(w.Code, Equals, http.StatusNotFound)
+
+	// unreadable metadata doesn't lift the restrictions
+	s.server.metadataStorage = failingGetStorage{s.server.metadataStorage}
+
+	req = mux.SetURLVars(httptest.NewRequest("GET", "/(protected/file.txt).zip", nil), map[string]string{"files": "protected/file.txt"})
+	w = httptest.NewRecorder()
+	s.server.zipHandler(w, req)
+	c.Assert(w.Code, Equals, http.StatusInternalServerError)
+}
+
+func (s *SuiteAuthorization) TestPostRestrictions(c *C) {
+	body := &bytes.Buffer{}
+	writer := multipart.NewWriter(body)
+	for _, filename := range []string{"a.txt", "b.txt"} {
+		part, err := writer.CreateFormFile("file", filename)
+		c.Assert(err, IsNil)
+		part.Write([]byte("content"))
+	}
+	writer.WriteField("user", "user")
+	writer.WriteField("password", "secret")
+	writer.WriteField("ip", "10.0.0.1")
+	writer.Close()
+
+	req := httptest.NewRequest("POST", "/", body)
+	req.Header.Set("Content-Type", writer.FormDataContentType())
+
+	w := httptest.NewRecorder()
+	s.server.postHandler(w, req)
+
+	resp := w.Result()
+	c.Assert(resp.StatusCode, Equals, http.StatusOK)
+	c.Assert(resp.Header["X-Download-User"], DeepEquals, []string{"user"})
+	c.Assert(resp.Header.Get("X-Allowed-IPs"), Equals, "10.0.0.1")
+	c.Assert(strings.Count(w.Body.String(), "\n"), Equals, 2)
+}
+
+func (s *SuiteAuthorization) TestPutRestrictions(c *C) {
+	req := httptest.NewRequest("PUT", "/upload.txt", bytes.NewBufferString("content"))
+	req = mux.SetURLVars(req, map[string]string{"filename": "upload.txt"})
+	req.Header.Set("X-Download-User", "user")
+	req.Header.Set("X-Download-Password", "secret")
+	req.Header.Set("X-Allowed-IPs", "10.0.0.1, 192.168.0.0/16")
+
+	w := httptest.NewRecorder()
+	s.server.putHandler(w, req)
+
+	resp := w.Result()
+	c.Assert(resp.StatusCode, Equals, http.StatusOK)
+	c.Assert(resp.Header.Get("X-Download-User"), Equals, "user")
+	c.Assert(resp.Header.Get("X-Allowed-IPs"), Equals, "10.0.0.1,192.168.0.0/16")
+
+	body, _ := ioutil.ReadAll(resp.Body)
+	u, err := url.Parse(string(body))
+	c.Assert(err, IsNil)
+
+	token := strings.Split(strings.TrimPrefix(u.Path, "/"), "/")[0]
+
+	metadata, err := s.server.GetMetadata(context.Background(), token, "upload.txt")
+	c.Assert(err, IsNil)
+	c.Assert(metadata.AuthTypes, DeepEquals, []AuthType{METADATA, IP})
+
+	req = httptest.NewRequest("GET", u.Path, nil)
+	req.RemoteAddr = "192.168.1.1:1234"
+	req.SetBasicAuth("user", "secret")
+	c.Assert(s.serveFile(token, req).StatusCode, Equals, http.StatusOK)
+}
+
+func (s *SuiteAuthorization) TestPutInvalidRestrictions(c *C) {
+	req := httptest.NewRequest("PUT", "/upload.txt", bytes.NewBufferString("content"))
+	req = mux.SetURLVars(req, map[string]string{"filename": "upload.txt"})
+	req.Header.Set("X-Download-Password", "secret")
+
+	w := httptest.NewRecorder()
+	s.server.putHandler(w, req)
+
+	c.Assert(w.Result().StatusCode, Equals, http.StatusBadRequest)
+}
+
+func (s *SuiteAuthorization) TestPasswordForm(c *C) {
+	req := httptest.NewRequest("GET", "/protected/file.txt", nil)
+	req.Header.Set("Accept", "text/html")
+	resp := s.serveFile("protected", req)
+	c.Assert(resp.StatusCode, Equals, http.StatusUnauthorized)
+	c.Assert(resp.Header.Get("WWW-Authenticate"), Equals, "")
+	c.Assert(resp.Header.Get("Content-Type"), Equals, "text/html; charset=utf-8")
+
+	post := func(password string) *http.Response {
+		req := httptest.NewRequest("POST", "/protected/file.txt", strings.NewReader(url.Values{"user": {"user"}, "password": {password}}.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req = mux.SetURLVars(req, map[string]string{"token": "protected", "filename": "file.txt"})
+
+		w := httptest.NewRecorder()
+		s.server.AssignMetadata(http.HandlerFunc(s.server.passwordHandler))(w, req)
+		return w.Result()
+	}
+
+	resp = post("wrong")
+	c.Assert(resp.StatusCode, Equals, http.StatusUnauthorized)
+	c.Assert(resp.Cookies(), HasLen, 0)
+
+	resp = post("secret")
+	c.Assert(resp.StatusCode, Equals, http.StatusSeeOther)
+	c.Assert(resp.Header.Get("Location"), Equals, "file.txt")
+	c.Assert(resp.Cookies(), HasLen, 1)
+
+	cookie := resp.Cookies()[0]
+
+	req = httptest.NewRequest("GET", "/protected/file.txt", nil)
+	req.AddCookie(cookie)
+	c.Assert(s.serveFile("protected", req).StatusCode, Equals, http.StatusOK)
+
+	// the cookie is scoped to the file
+	s.putFile(c, "other", Metadata{
+		MaxDownloads: -1,
+		AuthTypes:    []AuthType{METADATA},
+		User:         "user",
+		Password:     cryptoPwd("secret", "other"),
+	})
+
+	req = httptest.NewRequest("GET", "/other/file.txt", nil)
+	req.AddCookie(&http.Cookie{Name: passwordCookieName("other", "file.txt"), Value: cookie.Value})
+	c.Assert(s.serveFile("other", req).StatusCode, Equals, http.StatusUnauthorized)
+}
+
+// staticTokenAuthenticator accepts the tokens of its map
+type staticTokenAuthenticator map[string]string
+
+func (a staticTokenAuthenticator) AuthenticateToken(token string) (string, bool, error) {
+	user, ok := a[token]
+	return user, ok, nil
+}
+
+func (s *SuiteAuthorization) TestBearerToken(c *C) {
+	s.server.tokenAuths[string(JWT)] = staticTokenAuthenticator{"valid": "alice"}
+	s.putFile(c, "jwt", Metadata{MaxDownloads: -1, AuthTypes: []AuthType{JWT}})
+
+	resp := s.serveFile("jwt", httptest.NewRequest("GET", "/jwt/file.txt", nil))
+	c.Assert(resp.StatusCode, Equals, http.StatusUnauthorized)
+	c.Assert(resp.Header.Get("WWW-Authenticate"), Equals, "Bearer")
+
+	req := httptest.NewRequest("GET", "/jwt/file.txt", nil)
+	req.Header.Set("Authorization", "Bearer invalid")
+	c.Assert(s.serveFile("jwt", req).StatusCode, Equals, http.StatusUnauthorized)
+
+	req = httptest.NewRequest("GET", "/jwt/file.txt", nil)
+	req.Header.Set("Authorization", "Bearer valid")
+	c.Assert(s.serveFile("jwt", req).StatusCode, Equals, http.StatusOK)
+
+	// either the password or a token is accepted
+	s.putFile(c, "either", Metadata{
+		MaxDownloads: -1,
+		AuthTypes:    []AuthType{METADATA, JWT},
+		User:         "user",
+		Password:     cryptoPwd("secret", "either"),
+	})
+
+	req = httptest.NewRequest("GET", "/either/file.txt", nil)
+	req.SetBasicAuth("user", "secret")
+	c.Assert(s.serveFile("either", req).StatusCode, Equals, http.StatusOK)
+
+	req = httptest.NewRequest("GET", "/either/file.txt", nil)
+	req.Header.Set("Authorization", "Bearer valid")
+	c.Assert(s.serveFile("either", req).StatusCode, Equals, http.StatusOK)
+}
+
+func (s *SuiteAuthorization) TestBearerTokenNotSetUp(c *C) {
+	s.putFile(c, "jwt", Metadata{MaxDownloads: -1, AuthTypes: []AuthType{JWT}})
+
+	req := httptest.NewRequest("GET", "/jwt/file.txt", nil)
+	req.Header.Set("Authorization", "Bearer valid")
+	c.Assert(s.serveFile("jwt", req).StatusCode, Equals, http.StatusInternalServerError)
+}
+
+func (s *SuiteAuthorization) TestBearerUploads(c *C) {
+	srvr, err := New(AuthToken(ServerAuthKey, staticTokenAuthenticator{"valid": "alice"}))
+	c.Assert(err, IsNil)
+
+	var identity Identity
+	handler := srvr.BasicAuthHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		identity, _ = IdentityFromContext(r.Context())
+	}))
+
+	w := httptest.NewRecorder()
+	handler(w, httptest.NewRequest("PUT", "/file.txt", nil))
+	c.Assert(w.Result().StatusCode, Equals, http.StatusUnauthorized)
+	c.Assert(w.Result().Header.Get("WWW-Authenticate"), Equals, "Bearer")
+
+	req := httptest.NewRequest("PUT", "/file.txt", nil)
+	req.Header.Set("Authorization", "Bearer invalid")
+
+	w = httptest.NewRecorder()
+	handler(w, req)
+	c.Assert(w.Result().StatusCode, Equals, http.StatusUnauthorized)
+
+	req = httptest.NewRequest("PUT", "/file.txt", nil)
+	req.Header.Set("Authorization", "Bearer valid")
+
+	w = httptest.NewRecorder()
+	handler(w, req)
+	c.Assert(w.Result().StatusCode, Equals, http.StatusOK)
+	c.Assert(identity.User, Equals, "alice")
+}
+
+func (s *SuiteAuthorization) TestPutJWTRestriction(c *C) {
+	req := httptest.NewRequest("PUT", "/upload.txt", bytes.NewBufferString("content"))
+	req = mux.SetURLVars(req, map[string]string{"filename": "upload.txt"})
+	req.Header.Set("X-Download-Auth", "jwt")
+
+	w := httptest.NewRecorder()
+	s.server.putHandler(w, req)
+
+	resp := w.Result()
+	c.Assert(resp.StatusCode, Equals, http.StatusOK)
+	c.Assert(resp.Header.Get("X-Download-Auth"), Equals, "jwt")
+}
+
+// apiEndpoint serves the api authenticator responses of users
+func apiEndpoint(results map[string]apiauth.Result) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var credentials map[string]string
+		json.NewDecoder(r.Body).Decode(&credentials)
+
+		switch result, ok := results[credentials["username"]]; {
+		case credentials["username"] == "down":
+			w.WriteHeader(http.StatusServiceUnavailable)
+		case !ok || credentials["password"] != "secret":
+			w.WriteHeader(http.StatusUnauthorized)
+		default:
+			json.NewEncoder(w).Encode(result)
+		}
+	}))
+}
+
+func (s *SuiteAuthorization) TestAPIAuthenticator(c *C) {
+	ts := apiEndpoint(map[string]apiauth.Result{
+		"reader":   {User: "1", Scopes: []string{"download"}},
+		"uploader": {User: "2", Scopes: []string{"upload"}},
+	})
+	defer ts.Close()
+
+	UseAPIAuthenticator(apiauth.APIConfig{Endpoint: ts.URL})(s.server)
+	s.putFile(c, "api", Metadata{MaxDownloads: -1, AuthTypes: []AuthType{API}})
+
+	for user, status := range map[string]int{
+		"reader":   http.StatusOK,
+		"uploader": http.StatusUnauthorized,
+		"unknown":  http.StatusUnauthorized,
+		"down":     http.StatusServiceUnavailable,
+	} {
+		req := httptest.NewRequest("GET", "/api/file.txt", nil)
+		req.SetBasicAuth(user, "secret")
+		c.Assert(s.serveFile("api", req).StatusCode, Equals, status, Commentf(user))
+	}
+}
+
+func (s *SuiteAuthorization) TestAPIAuthenticatorUploads(c *C) {
+	ts := apiEndpoint(map[string]apiauth.Result{
+		"reader":   {User: "1", Scopes: []string{"download"}},
+		"uploader": {User: "2", Scopes: []string{"upload"}, Quota: 10},
+	})
+	defer ts.Close()
+
+	var authenticator DefaultServAuthenticator
+	authenticator.Set("user", "secret")
+
+	srvr, err := New(AuthCredential(ServerAuthKey, &authenticator), UseAPIAuthenticator(apiauth.APIConfig{Endpoint: ts.URL}), APIAuthUploads())
+	c.Assert(err, IsNil)
+
+	var identity Identity
+	handler := srvr.BasicAuthHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		identity, _ = IdentityFromContext(r.Context())
+	}))
+
+	upload := func(user, content string) int {
+		req := httptest.NewRequest("PUT", "/file.txt", bytes.NewBufferString(content))
+		req.SetBasicAuth(user, "secret")
+
+		w := httptest.NewRecorder()
+		handler(w, req)
+		return w.Result().StatusCode
+	}
+
+	c.Assert(upload("user", "content"), Equals, http.StatusOK)
+	c.Assert(identity.User, Equals, "user")
+
+	c.Assert(upload("uploader", "content"), Equals, http.StatusOK)
+	c.Assert(identity.User, Equals, "2")
+	c.Assert(identity.Quota, Equals, int64(10))
+
+	c.Assert(upload("uploader", "more than ten bytes"), Equals, http.StatusForbidden)
+	c.Assert(upload("reader", "content"), Equals, http.StatusForbidden)
+	c.Assert(upload("unknown", "content"), Equals, http.StatusUnauthorized)
+	c.Assert(upload("down", "content"), Equals, http.StatusServiceUnavailable)
+}
@@ -0,0 +1,324 @@
+package server
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"path"
+	"strings"
+	"time"
+)
+
+const (
+	backupVersion      = 1
+	backupManifestName = "manifest.json"
+)
+
+// BackupManifest is the first entry of a backup archive and lists every file
+// that is contained in it
+type BackupManifest struct {
+	Version         int
+	Created         time.Time
+	Storage         string
+	MetadataStorage string
+	Files           []BackupFile
+}
+
+// BackupFile describes a single file in a backup archive
+type BackupFile struct {
+	Token         string
+	Filename      string
+	ContentLength uint64
+	// MD5 is only set when the source storage reports checksums
+	MD5 string `json:",omitempty"`
+	// Metadata is the name of the metadata entry, empty if the file has no metadata
+	Metadata string `json:",omitempty"`
+	// Data is the name of the file entry
+	Data string
+}
+
+// ImportOptions configures an import
+type ImportOptions struct {
+	// RestoreReserved allows the archive to restore reserved tokens, e.g.
+	// the api keys, otherwise an archive containing them is rejected
+	RestoreReserved bool
+
+	Logger *log.Logger
+}
+
+// Export writes a tar archive with a manifest, every file and its metadata
+// and the objects of the reserved tokens
+func Export(ctx context.Context, w io.Writer, storage Storage, metadataStorage Storage, logger *log.Logger) (BackupManifest, error) {
+	if logger == nil {
+		logger = log.New(ioutil.Discard, "", 0)
+	}
+
+	manifest := BackupManifest{
+		Version:         backupVersion,
+		Created:         time.Now().UTC(),
+		Storage:         storage.Type(),
+		MetadataStorage: metadataStorage.Type(),
+	}
+
+	objects, err := storage.List(ctx)
+	if err != nil {
+		return manifest, fmt.Errorf("could not list %s storage: %s", storage.Type(), err.Error())
+	}
+
+	// reserved tokens, e.g. the api keys, are kept in the metadata provider
+	reserved, err := metadataStorage.List(ctx)
+	if err != nil {
+		return manifest, fmt.Errorf("could not list %s storage: %s", metadataStorage.Type(), err.Error())
+	}
+
+	for _, object := range reserved {
+		if isReservedToken(object.Token) {
+			manifest.Files = append(manifest.Files, BackupFile{
+				Token:         object.Token,
+				Filename:      object.Filename,
+				ContentLength: object.ContentLength,
+				Data:          path.Join("files", object.Token, object.Filename),
+			})
+		}
+	}
+
+	metadata := map[string][]byte{}
+
+	for _, object := range objects {
+		if strings.HasSuffix(object.Filename, ".metadata") || isReservedToken(object.Token) {
+			continue
+		}
+
+		file := BackupFile{
+			Token:         object.Token,
+			Filename:      object.Filename,
+			ContentLength: object.ContentLength,
+			Data:          path.Join("files", object.Token, object.Filename),
+		}
+
+		if file.MD5, err = checksum(ctx, storage, object); err != nil {
+			return manifest, err
+		}
+
+		// metadata is read up front, so the archive reflects the state at the time of the export
+		reader, _, err := metadataStorage.Get(ctx, object.Token, fmt.Sprintf("%s.metadata", object.Filename))
+		if metadataStorage.IsNotExist(err) {
+		} else if err != nil {
+			return manifest, err
+		} else {
+			data, err := ioutil.ReadAll(reader)
+			reader.Close()
+			if err != nil {
+				return manifest, err
+			}
+
+			file.Metadata = path.Join("metadata", object.Token, object.Filename+".json")
+			metadata[file.Metadata] = data
+		}
+
+		manifest.Files = append(manifest.Files, file)
+	}
+
+	tw := tar.NewWriter(w)
+
+	data, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return manifest, err
+	}
+
+	if err := writeTarEntry(tw, backupManifestName, bytes.NewReader(data), uint64(len(data))); err != nil {
+		return manifest, err
+	}
+
+	for i, file := range manifest.Files {
+		if file.Metadata != "" {
+			data := metadata[file.Metadata]
+			if err := writeTarEntry(tw, file.Metadata, bytes.NewReader(data), uint64(len(data))); err != nil {
+				return manifest, err
+			}
+		}
+
+		source := storage
+		if isReservedToken(file.Token) {
+			source = metadataStorage
+		}
+
+		reader, contentLength, err := source.Get(ctx, file.Token, file.Filename)
+		if err != nil {
+			return manifest, err
+		}
+
+		if contentLength != file.ContentLength {
+			reader.Close()
+			return manifest, fmt.Errorf("%s/%s changed during export", file.Token, file.Filename)
+		}
+
+		err = writeTarEntry(tw, file.Data, reader, contentLength)
+		reader.Close()
+		if err != nil {
+			return manifest, err
+		}
+
+		logger.Printf("[%d/%d] exported %s/%s (%d bytes)", i+1, len(manifest.Files), file.Token, file.Filename, contentLength)
+	}
+
+	return manifest, tw.Close()
+}
+
+// Import restores the files and metadata of an archive written by Export,
+// verifying the size (and md5 checksum when known) of every file
+func Import(ctx context.Context, r io.Reader, storage Storage, metadataStorage Storage, options ImportOptions) (BackupManifest, error) {
+	var manifest BackupManifest
+
+	logger := options.Logger
+	if logger == nil {
+		logger = log.New(ioutil.Discard, "", 0)
+	}
+
+	tr := tar.NewReader(r)
+
+	header, err := tr.Next()
+	if err != nil {
+		return manifest, err
+	} else if header.Name != backupManifestName {
+		return manifest, errors.New("archive does not start with a manifest")
+	}
+
+	if err := json.NewDecoder(tr).Decode(&manifest); err != nil {
+		return manifest, fmt.Errorf("could not decode manifest: %s", err.Error())
+	} else if manifest.Version != backupVersion {
+		return manifest, fmt.Errorf("unsupported backup version %d", manifest.Version)
+	}
+
+	entries := map[string]BackupFile{}
+	for _, file := range manifest.Files {
+		if err := validBackupFile(file, options.RestoreReserved); err != nil {
+			return manifest, err
+		}
+
+		if file.Metadata != "" {
+			entries[file.Metadata] = file
+		}
+
+		entries[file.Data] = file
+	}
+
+	metadata := map[string][]byte{}
+	imported := 0
+
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return manifest, err
+		}
+
+		file, ok := entries[header.Name]
+		if !ok {
+			return manifest, fmt.Errorf("unexpected entry %s", header.Name)
+		}
+
+		if header.Name == file.Metadata {
+			if metadata[file.Metadata], err = ioutil.ReadAll(tr); err != nil {
+				return manifest, err
+			}
+
+			continue
+		}
+
+		if uint64(header.Size) != file.ContentLength {
+			return manifest, fmt.Errorf("size mismatch for %s: expected %d, got %d", header.Name, file.ContentLength, header.Size)
+		}
+
+		var md Metadata
+
+		putCtx := ctx
+		if data, ok := metadata[file.Metadata]; ok {
+			if err := json.Unmarshal(data, &md); err != nil {
+				return manifest, fmt.Errorf("could not decode metadata of %s: %s", header.Name, err.Error())
+			}
+
+			putCtx = WithMetadata(ctx, md)
+		}
+
+		target := storage
+		if isReservedToken(file.Token) {
+			target = metadataStorage
+		}
+
+		h := md5.New()
+		if err := target.Put(putCtx, file.Token, file.Filename, io.TeeReader(tr, h), md.ContentType, file.ContentLength); err != nil {
+			return manifest, err
+		}
+
+		if actual := hex.EncodeToString(h.Sum(nil)); file.MD5 != "" && file.MD5 != actual {
+			target.Delete(ctx, file.Token, file.Filename)
+			return manifest, fmt.Errorf("checksum mismatch for %s: expected %s, got %s", header.Name, file.MD5, actual)
+		}
+
+		if data, ok := metadata[file.Metadata]; ok {
+			if err := metadataStorage.Put(ctx, file.Token, fmt.Sprintf("%s.metadata", file.Filename), bytes.NewReader(data), "text/json", uint64(len(data))); err != nil {
+				return manifest, err
+			}
+
+			delete(metadata, file.Metadata)
+		}
+
+		imported++
+		logger.Printf("[%d/%d] imported %s/%s (%d bytes)", imported, len(manifest.Files), file.Token, file.Filename, file.ContentLength)
+	}
+
+	if imported != len(manifest.Files) {
+		return manifest, fmt.Errorf("archive is incomplete: %d of %d files imported", imported, len(manifest.Files))
+	}
+
+	return manifest, nil
+}
+
+// validBackupFile reports an error when the token or filename of a file in
+// a manifest isn't one the server could have created
+func validBackupFile(file BackupFile, restoreReserved bool) error {
+	token := file.Token
+	if isReservedToken(token) {
+		if !restoreReserved {
+			return fmt.Errorf("archive contains reserved token %s, use --restore-reserved to restore it", token)
+		}
+
+		token = strings.TrimPrefix(token, "_")
+	}
+
+	if token == "" || strings.Trim(token, SYMBOLS) != "" {
+		return fmt.Errorf("invalid token %q", file.Token)
+	}
+
+	if file.Filename == "" || file.Filename == "." || file.Filename == ".." || sanitize(file.Filename) != file.Filename || strings.HasSuffix(file.Filename, ".metadata") {
+		return fmt.Errorf("invalid filename %q", file.Filename)
+	}
+
+	return nil
+}
+
+func writeTarEntry(tw *tar.Writer, name string, reader io.Reader, contentLength uint64) error {
+	header := &tar.Header{
+		Name:    name,
+		Mode:    0600,
+		Size:    int64(contentLength),
+		ModTime: time.Now(),
+	}
+
+	if err := tw.WriteHeader(header); err != nil {
+		return err
+	}
+
+	_, err := io.Copy(tw, reader)
+	return err
+}
@@ -0,0 +1,124 @@
+package server
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"path/filepath"
+
+	. "gopkg.in/check.v1"
+)
+
+var _ = Suite(&SuiteBackup{})
+
+type SuiteBackup struct{}
+
+func (s *SuiteBackup) TestExportImport(c *C) {
+	dir := c.MkDir()
+
+	logger := log.New(ioutil.Discard, "", 0)
+	from, _ := NewLocalStorage(filepath.Join(dir, "from"), logger)
+	to, _ := NewLocalStorage(filepath.Join(dir, "to"), logger)
+
+	content := []byte("hello backup")
+	metadata := []byte(`{"ContentType":"text/plain"}`)
+	c.Assert(from.Put(context.Background(), "token", "a.txt", bytes.NewReader(content), "text/plain", uint64(len(content))), IsNil)
+	c.Assert(from.Put(context.Background(), "token", "a.txt.metadata", bytes.NewReader(metadata), "text/json", uint64(len(metadata))), IsNil)
+
+	var archive bytes.Buffer
+	manifest, err := Export(context.Background(), &archive, from, from, nil)
+	c.Assert(err, IsNil)
+	c.Assert(manifest.Files, HasLen, 1)
+	c.Assert(manifest.Files[0].MD5, Not(Equals), "")
+
+	manifest, err = Import(context.Background(), &archive, to, to, ImportOptions{})
+	c.Assert(err, IsNil)
+	c.Assert(manifest.Files, HasLen, 1)
+
+	reader, _, err := to.Get(context.Background(), "token", "a.txt")
+	c.Assert(err, IsNil)
+	defer reader.Close()
+
+	data, _ := ioutil.ReadAll(reader)
+	c.Assert(string(data), Equals, string(content))
+
+	reader, _, err = to.Get(context.Background(), "token", "a.txt.metadata")
+	c.Assert(err, IsNil)
+	defer reader.Close()
+
+	data, _ = ioutil.ReadAll(reader)
+	c.Assert(string(data), Equals, string(metadata))
+}
+
+func (s *SuiteBackup) TestExportReserved(c *C) {
+	logger := log.New(ioutil.Discard, "", 0)
+	from, _ := NewLocalStorage(c.MkDir(), logger)
+	fromMeta, _ := NewLocalStorage(c.MkDir(), logger)
+	to, _ := NewLocalStorage(c.MkDir(), logger)
+	toMeta, _ := NewLocalStorage(c.MkDir(), logger)
+
+	key := []byte(`{"id":"key"}`)
+	c.Assert(fromMeta.Put(context.Background(), apiKeysToken, "key.json", bytes.NewReader(key), "text/json", uint64(len(key))), IsNil)
+
+	var archive bytes.Buffer
+	manifest, err := Export(context.Background(), &archive, from, fromMeta, nil)
+	c.Assert(err, IsNil)
+	c.Assert(manifest.Files, HasLen, 1)
+
+	data := archive.Bytes()
+	_, err = Import(context.Background(), bytes.NewReader(data), to, toMeta, ImportOptions{})
+	c.Assert(err, NotNil)
+
+	// reserved tokens are restored to the metadata provider
+	_, err = Import(context.Background(), bytes.NewReader(data), to, toMeta, ImportOptions{RestoreReserved: true})
+	c.Assert(err, IsNil)
+
+	contentLength, err := toMeta.Head(context.Background(), apiKeysToken, "key.json")
+	c.Assert(err, IsNil)
+	c.Assert(contentLength, Equals, uint64(len(key)))
+}
+
+func (s *SuiteBackup) TestImportValidation(c *C) {
+	to, _ := NewLocalStorage(c.MkDir(), log.New(ioutil.Discard, "", 0))
+
+	archive := func(file BackupFile) *bytes.Buffer {
+		var b bytes.Buffer
+		tw := tar.NewWriter(&b)
+
+		data, err := json.Marshal(BackupManifest{Version: backupVersion, Files: []BackupFile{file}})
+		c.Assert(err, IsNil)
+		c.Assert(writeTarEntry(tw, backupManifestName, bytes.NewReader(data), uint64(len(data))), IsNil)
+		c.Assert(writeTarEntry(tw, file.Data, bytes.NewReader([]byte("{}")), 2), IsNil)
+		c.Assert(tw.Close(), IsNil)
+		return &b
+	}
+
+	for _, file := range []BackupFile{
+		{Token: "..", Filename: "a.txt"},
+		{Token: "token/..", Filename: "a.txt"},
+		{Token: "token", Filename: "../../a.txt"},
+		{Token: "token", Filename: ".."},
+		{Token: "token", Filename: "a.txt.metadata"},
+		{Token: "_apikeys", Filename: "key.json"},
+	} {
+		file.Data, file.ContentLength = "files/entry", 2
+
+		_, err := Import(context.Background(), archive(file), to, to, ImportOptions{})
+		c.Assert(err, NotNil, Commentf("%s/%s", file.Token, file.Filename))
+	}
+
+	objects, err := to.List(context.Background())
+	c.Assert(err, IsNil)
+	c.Assert(objects, HasLen, 0)
+
+	// reserved tokens are only restored on request
+	file := BackupFile{Token: "_apikeys", Filename: "key.json", Data: "files/entry", ContentLength: 2}
+	_, err = Import(context.Background(), archive(file), to, to, ImportOptions{RestoreReserved: true})
+	c.Assert(err, IsNil)
+
+	_, err = to.Head(context.Background(), "_apikeys", "key.json")
+	c.Assert(err, IsNil)
+}
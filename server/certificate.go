@@ -0,0 +1,115 @@
+package server
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net/http"
+)
+
+// CertificateUserField is the field of a client certificate that names its user
+type CertificateUserField string
+
+const (
+	// CertificateCN is the common name of the certificate subject
+	CertificateCN CertificateUserField = "cn"
+	// CertificateEmail is the first email address SAN
+	CertificateEmail CertificateUserField = "email"
+	// CertificateDNS is the first DNS name SAN
+	CertificateDNS CertificateUserField = "dns"
+	// CertificateURI is the first URI SAN
+	CertificateURI CertificateUserField = "uri"
+)
+
+// ParseCertificateUserField returns the certificate user field named s
+func ParseCertificateUserField(s string) (CertificateUserField, error) {
+	switch field := CertificateUserField(s); field {
+	case CertificateCN, CertificateEmail, CertificateDNS, CertificateURI:
+		return field, nil
+	}
+
+	return "", fmt.Errorf("unknown certificate user field %q", s)
+}
+
+// user returns the user named by field of the certificate, if any
+func (field CertificateUserField) user(certificate *x509.Certificate) string {
+	switch field {
+	case CertificateEmail:
+		if len(certificate.EmailAddresses) != 0 {
+			return certificate.EmailAddresses[0]
+		}
+	case CertificateDNS:
+		if len(certificate.DNSNames) != 0 {
+			return certificate.DNSNames[0]
+		}
+	case CertificateURI:
+		if len(certificate.URIs) != 0 {
+			return certificate.URIs[0].String()
+		}
+	default:
+		return certificate.Subject.CommonName
+	}
+
+	return ""
+}
+
+// ClientCertificates verifies the client certificates of the TLS listener
+// against pool, with required connections without a valid certificate are
+// refused. The user of a certificate is read from field.
+func ClientCertificates(pool *x509.CertPool, required bool, field CertificateUserField) OptionFn {
+	return func(srvr *Server) {
+		srvr.clientCAs = pool
+		srvr.clientAuth = tls.VerifyClientCertIfGiven
+		srvr.certificateUserField = field
+
+		if required {
+			srvr.clientAuth = tls.RequireAndVerifyClientCert
+		}
+	}
+}
+
+// CertificateUploads accepts uploads of clients with a verified certificate,
+// next to the server-wide credentials
+func CertificateUploads() OptionFn {
+	return func(srvr *Server) {
+		srvr.certificateUploads = true
+	}
+}
+
+// certificateUser returns the user of the verified client certificate of the
+// request, it is empty without one
+func (s *Server) certificateUser(r *http.Request) string {
+	if s.clientCAs == nil || r.TLS == nil || len(r.TLS.VerifiedChains) == 0 || len(r.TLS.VerifiedChains[0]) == 0 {
+		return ""
+	}
+
+	return s.certificateUserField.user(r.TLS.VerifiedChains[0][0])
+}
+
+// CertificateRequired reports whether downloads are restricted to the users
+// of client certificates
+func (m *Metadata) CertificateRequired() bool {
+	for _, v := range m.AuthTypes {
+		if v == CERT {
+			return true
+		}
+	}
+
+	return false
+}
+
+// AllowedCertificate reports whether the user of a client certificate may
+// download the file
+func (m *Metadata) AllowedCertificate(user string) bool {
+	if user == "" {
+		return false
+	}
+
+	for _, u := range m.CertificateUsers {
+		if u == user {
+			return true
+		}
+	}
+
+	return false
+}
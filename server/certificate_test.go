@@ -0,0 +1,179 @@
+package server
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"io/ioutil"
+	"log"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"time"
+
+	"github.com/gorilla/mux"
+	. "gopkg.in/check.v1"
+)
+
+var _ = Suite(&SuiteCertificate{})
+
+type SuiteCertificate struct {
+	ca     *x509.Certificate
+	caKey  *ecdsa.PrivateKey
+	pool   *x509.CertPool
+	server *Server
+}
+
+func (s *SuiteCertificate) SetUpTest(c *C) {
+	var err error
+
+	s.caKey, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	c.Assert(err, IsNil)
+
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &s.caKey.PublicKey, s.caKey)
+	c.Assert(err, IsNil)
+
+	s.ca, err = x509.ParseCertificate(der)
+	c.Assert(err, IsNil)
+
+	s.pool = x509.NewCertPool()
+	s.pool.AddCert(s.ca)
+
+	storage, err := NewLocalStorage(c.MkDir(), log.New(ioutil.Discard, "", 0))
+	c.Assert(err, IsNil)
+
+	s.server, err = New(UseStorage(storage), UseMetaStorage(storage), ClientCertificates(s.pool, false, CertificateCN), CertificateUploads())
+	c.Assert(err, IsNil)
+}
+
+// clientCertificate returns a client certificate issued by the test CA
+func (s *SuiteCertificate) clientCertificate(c *C, cn string) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	c.Assert(err, IsNil)
+
+	template := &x509.Certificate{
+		SerialNumber:   big.NewInt(time.Now().UnixNano()),
+		Subject:        pkix.Name{CommonName: cn},
+		EmailAddresses: []string{cn + "@example.com"},
+		NotBefore:      time.Now().Add(-time.Hour),
+		NotAfter:       time.Now().Add(time.Hour),
+		KeyUsage:       x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:    []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, s.ca, &key.PublicKey, s.caKey)
+	c.Assert(err, IsNil)
+
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+// tlsServer serves h with the TLS config of the server
+func (s *SuiteCertificate) tlsServer(h http.Handler) *httptest.Server {
+	ts := httptest.NewUnstartedServer(h)
+	ts.TLS = s.server.tlsConfig.Clone()
+	ts.StartTLS()
+
+	return ts
+}
+
+func (s *SuiteCertificate) client(ts *httptest.Server, certificates ...tls.Certificate) *http.Client {
+	transport := ts.Client().Transport.(*http.Transport).Clone()
+	transport.TLSClientConfig.Certificates = certificates
+
+	return &http.Client{Transport: transport}
+}
+
+func (s *SuiteCertificate) TestUserField(c *C) {
+	certificate, err := x509.ParseCertificate(s.clientCertificate(c, "alice").Certificate[0])
+	c.Assert(err, IsNil)
+
+	c.Assert(CertificateCN.user(certificate), Equals, "alice")
+	c.Assert(CertificateEmail.user(certificate), Equals, "alice@example.com")
+	c.Assert(CertificateDNS.user(certificate), Equals, "")
+
+	_, err = ParseCertificateUserField("serial")
+	c.Assert(err, NotNil)
+}
+
+func (s *SuiteCertificate) TestUploads(c *C) {
+	var identity Identity
+	ts := s.tlsServer(s.server.BasicAuthHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		identity, _ = IdentityFromContext(r.Context())
+	})))
+	defer ts.Close()
+
+	resp, err := s.client(ts).Post(ts.URL, "text/plain", bytes.NewBufferString("content"))
+	c.Assert(err, IsNil)
+	c.Assert(resp.StatusCode, Equals, http.StatusUnauthorized)
+
+	resp, err = s.client(ts, s.clientCertificate(c, "alice")).Post(ts.URL, "text/plain", bytes.NewBufferString("content"))
+	c.Assert(err, IsNil)
+	c.Assert(resp.StatusCode, Equals, http.StatusOK)
+	c.Assert(identity.User, Equals, "cert:alice")
+}
+
+func (s *SuiteCertificate) TestUntrustedCertificate(c *C) {
+	ts := s.tlsServer(s.server.BasicAuthHandler(http.NotFoundHandler()))
+	defer ts.Close()
+
+	other := &SuiteCertificate{}
+	other.SetUpTest(c)
+
+	_, err := s.client(ts, other.clientCertificate(c, "alice")).Get(ts.URL)
+	c.Assert(err, NotNil)
+}
+
+func (s *SuiteCertificate) TestDownloadRestriction(c *C) {
+	req := httptest.NewRequest("PUT", "/upload.txt", bytes.NewBufferString("content"))
+	req = mux.SetURLVars(req, map[string]string{"filename": "upload.txt"})
+	req.Header.Set("X-Download-Cert", "alice, bob")
+
+	w := httptest.NewRecorder()
+	s.server.putHandler(w, req)
+	c.Assert(w.Result().StatusCode, Equals, http.StatusOK)
+	c.Assert(w.Result().Header.Get("X-Download-Cert"), Equals, "alice,bob")
+
+	body, _ := ioutil.ReadAll(w.Result().Body)
+	path := string(bytes.TrimSpace(body))[len("http://example.com"):]
+
+	router := mux.NewRouter()
+	router.HandleFunc("/{token}/{filename}", s.server.AuthorizeFile(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})))
+
+	ts := s.tlsServer(router)
+	defer ts.Close()
+
+	for cn, status := range map[string]int{
+		"alice":   http.StatusOK,
+		"bob":     http.StatusOK,
+		"mallory": http.StatusUnauthorized,
+	} {
+		resp, err := s.client(ts, s.clientCertificate(c, cn)).Get(ts.URL + path)
+		c.Assert(err, IsNil)
+		c.Assert(resp.StatusCode, Equals, status, Commentf(cn))
+	}
+
+	resp, err := s.client(ts).Get(ts.URL + path)
+	c.Assert(err, IsNil)
+	c.Assert(resp.StatusCode, Equals, http.StatusUnauthorized)
+}
+
+func (s *SuiteCertificate) TestRequired(c *C) {
+	srvr, err := New(ClientCertificates(s.pool, true, CertificateCN))
+	c.Assert(err, IsNil)
+	c.Assert(srvr.tlsConfig.ClientAuth, Equals, tls.RequireAndVerifyClientCert)
+	c.Assert(srvr.tlsConfig.ClientCAs, Equals, s.pool)
+}
@@ -28,10 +28,12 @@ import (
 	// _ "transfer.sh/app/handlers"
 	// _ "transfer.sh/app/utils"
 
+	"errors"
 	"fmt"
 	"io"
 	"log"
 	"net/http"
+	"strings"
 	"time"
 
 	clamd "github.com/dutchcoders/go-clamd"
@@ -55,18 +57,27 @@ func (s *Server) scanHandler(w http.ResponseWriter, r *http.Request) {
 
 	c := clamd.NewClamd(s.ClamAVDaemonHost)
 
+	_, span := startSpan(r.Context(), "clamav.scan", spanKindClient)
+
 	abort := make(chan bool)
 	response, err := c.ScanStream(reader, abort)
 	if err != nil {
 		log.Printf("%s", err.Error())
+		scansTotal.inc("clamav", "error")
+		span.end(err)
 		http.Error(w, err.Error(), 500)
 		return
 	}
 
 	select {
 	case s := <-response:
+		scansTotal.inc("clamav", strings.ToLower(s.Status))
+		span.setAttribute("scan.status", s.Status)
+		span.end(nil)
 		w.Write([]byte(fmt.Sprintf("%v\n", s.Status)))
 	case <-time.After(time.Second * 60):
+		scansTotal.inc("clamav", "timeout")
+		span.end(errors.New("scan timed out"))
 		abort <- true
 	}
 
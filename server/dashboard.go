@@ -0,0 +1,506 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	html_template "html/template"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	// adminSessionCookie is the cookie of a dashboard session
+	adminSessionCookie = "transfersh_admin"
+	// adminSessionTTL is the lifetime of a dashboard session
+	adminSessionTTL = 8 * time.Hour
+	// adminSessionToken is the reserved token ended dashboard sessions are
+	// stored under
+	adminSessionToken = "_sessions"
+	// dashboardListLimit is the number of files of each dashboard list
+	dashboardListLimit = 20
+	// dashboardPageSize is the number of files the statistics and lists of a
+	// dashboard page are computed from
+	dashboardPageSize = 1000
+	// defaultExtendDays is the number of days a file is extended by
+	defaultExtendDays = 7
+)
+
+var (
+	errNoExpiry      = errors.New("file does not expire")
+	errUnknownAction = errors.New("unknown action")
+)
+
+// defaultDashboardTemplate renders the dashboard and its login form
+var defaultDashboardTemplate = html_template.Must(html_template.New("admin.html").Funcs(html_template.FuncMap{"format": formatNumber}).Parse(`<!DOCTYPE html>
+<html>
+<head>
+	<meta charset="utf-8">
+	<meta name="viewport" content="width=device-width, initial-scale=1">
+	<title>Admin - transfer.sh</title>
+	<style>
+		body { font-family: sans-serif; background: #2d2d2d; color: #eee; margin: 2em; }
+		table { border-collapse: collapse; width: 100%; margin-bottom: 2em; }
+		th, td { text-align: left; padding: 4px 8px; border-bottom: 1px solid #444; }
+		form { display: inline; }
+		.login { display: block; max-width: 320px; margin: 15vh auto; }
+		.login input { display: block; width: 100%; margin: 8px 0; padding: 8px; box-sizing: border-box; }
+		.error { color: #f66; }
+		.message { color: #6f6; }
+	</style>
+</head>
+<body>
+{{ if not .User }}
+	<form class="login" method="post">
+		<input type="hidden" name="action" value="login">
+		<h2>transfer.sh admin</h2>
+		{{ if .Error }}<p class="error">{{ .Error }}</p>{{ end }}
+		<input type="text" name="user" placeholder="User" autocomplete="username" required autofocus>
+		<input type="password" name="password" placeholder="Password" autocomplete="current-password" required>
+		<input type="submit" value="Log in">
+	</form>
+{{ else }}
+	<form method="post" style="float: right">
+		<input type="hidden" name="csrf" value="{{ .CSRF }}">
+		<input type="hidden" name="action" value="logout">
+		{{ .User }} <input type="submit" value="Log out">
+	</form>
+	<h1>transfer.sh admin</h1>
+	{{ if .Error }}<p class="error">{{ .Error }}</p>{{ end }}
+	{{ if .Message }}<p class="message">{{ .Message }}</p>{{ end }}
+
+	<h2>Storage</h2>
+	<table>
+		<tr><th>Storage</th><th>Metadata</th><th>Files</th><th>Bytes</th><th>Owners</th><th>Expired</th><th>Blocked</th><th>Held</th></tr>
+		{{ with .Stats }}<tr><td>{{ .Storage }}</td><td>{{ .MetadataStorage }}</td><td>{{ .Files }}</td><td>{{ format "#,###." .Bytes }}</td><td>{{ .Owners }}</td><td>{{ .Expired }} ({{ format "#,###." .ExpiredBytes }} bytes)</td><td>{{ .Blocked }}</td><td>{{ .Held }}</td></tr>{{ end }}
+	</table>
+	{{ if or .After .Next }}<p>
+		Statistics and lists of the files {{ if .After }}after {{ .After }}{{ else }}from the start{{ end }}.
+		{{ if .After }}<a href="?">First page</a>{{ end }}
+		{{ if .Next }}<a href="?after={{ .Next }}">Next page</a>{{ end }}
+	</p>{{ end }}
+
+	<h2>Recent uploads</h2>
+	{{ template "files" .Recent }}
+
+	<h2>Top downloads</h2>
+	{{ template "files" .TopDownloads }}
+
+	<h2>Blocked and held files</h2>
+	{{ template "files" .Flagged }}
+
+	<h2>Blocked IPs</h2>
+	<ul>
+		{{ range .BlockedIPs }}<li>{{ . }}</li>{{ else }}<li>None</li>{{ end }}
+	</ul>
+{{ end }}
+</body>
+</html>
+	{{ define "files" }}
+	{{ $csrf := .CSRF }}
+	<table>
+		<tr><th>File</th><th>Owner</th><th>Bytes</th><th>Uploaded</th><th>Expires</th><th>Downloads</th><th></th></tr>
+		{{ range .Files }}
+		<tr>
+			<td>{{ .Token }}/{{ .Filename }}{{ if .Blocked }} (blocked){{ end }}{{ if .Hold }} (hold){{ end }}</td>
+			<td>{{ .Owner }}</td>
+			<td>{{ format "#,###." .ContentLength }}</td>
+			<td>{{ with .Created }}{{ .Format "2006-01-02 15:04" }}{{ end }}</td>
+			<td>{{ with .Expires }}{{ .Format "2006-01-02 15:04" }}{{ end }}</td>
+			<td>{{ .Downloads }}{{ if ne .MaxDownloads -1 }} / {{ .MaxDownloads }}{{ end }}</td>
+			<td>
+				{{ $file := . }}
+				{{ range $action := $file.Actions }}
+				<form method="post">
+					<input type="hidden" name="csrf" value="{{ $csrf }}">
+					<input type="hidden" name="token" value="{{ $file.Token }}">
+					<input type="hidden" name="filename" value="{{ $file.Filename }}">
+					<input type="submit" name="action" value="{{ $action }}">
+				</form>
+				{{ end }}
+			</td>
+		</tr>
+		{{ else }}
+		<tr><td colspan="7">No files</td></tr>
+		{{ end }}
+	</table>
+	{{ end }}
+`))
+
+// adminSession is a dashboard session, it is signed into the session cookie
+type adminSession struct {
+	ID      string
+	User    string
+	Scopes  []Scope `json:",omitempty"`
+	Expires int64
+}
+
+// signAdminSession signs the encoded session
+func (s *Server) signAdminSession(session string) string {
+	mac := hmac.New(sha256.New, s.secret)
+	mac.Write([]byte("admin\n" + session))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// adminSession returns the dashboard session of the request. The admin is
+// checked again on every request, and sessions ended by a logout are
+// recorded in the metadata provider.
+func (s *Server) adminSession(r *http.Request) (adminSession, bool) {
+	var session adminSession
+
+	cookie, err := r.Cookie(adminSessionCookie)
+	if err != nil {
+		return session, false
+	}
+
+	parts := strings.SplitN(cookie.Value, ".", 2)
+	if len(parts) != 2 || !hmac.Equal([]byte(parts[1]), []byte(s.signAdminSession(parts[0]))) {
+		return session, false
+	}
+
+	data, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil || json.Unmarshal(data, &session) != nil {
+		return adminSession{}, false
+	} else if time.Now().Unix() > session.Expires || !s.isAdmin(Identity{User: session.User, Scopes: session.Scopes}) {
+		return adminSession{}, false
+	}
+
+	if _, err := s.metadataStorage.Head(r.Context(), adminSessionToken, session.ID+".json"); !s.metadataStorage.IsNotExist(err) {
+		if err != nil {
+			log.Printf("Error admin session: %s", err.Error())
+		}
+
+		return adminSession{}, false
+	}
+
+	return session, true
+}
+
+// setAdminSession starts a dashboard session of identity, or ends the
+// session of the request when identity is nil
+func (s *Server) setAdminSession(w http.ResponseWriter, r *http.Request, identity *Identity) error {
+	ttl, value := time.Duration(0), ""
+
+	if identity != nil {
+		id, err := randomHex(16)
+		if err != nil {
+			return err
+		}
+
+		ttl = adminSessionTTL
+		data, err := json.Marshal(adminSession{ID: id, User: identity.User, Scopes: identity.Scopes, Expires: time.Now().Add(ttl).Unix()})
+		if err != nil {
+			return err
+		}
+
+		session := base64.RawURLEncoding.EncodeToString(data)
+		value = session + "." + s.signAdminSession(session)
+	} else if session, ok := s.adminSession(r); ok {
+		data, err := json.Marshal(session)
+		if err != nil {
+			return err
+		}
+
+		if err := s.metadataStorage.Put(r.Context(), adminSessionToken, session.ID+".json", bytes.NewReader(data), "text/json", uint64(len(data))); err != nil {
+			return err
+		}
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     adminSessionCookie,
+		Value:    value,
+		Path:     "/",
+		Expires:  time.Now().Add(ttl),
+		MaxAge:   int(ttl.Seconds()),
+		Secure:   r.TLS != nil || r.Header.Get("X-Forwarded-Proto") == "https",
+		HttpOnly: true,
+		SameSite: http.SameSiteStrictMode,
+	})
+
+	return nil
+}
+
+// adminCSRF returns the token the dashboard forms post with, it is bound to
+// the session
+func (s *Server) adminCSRF(r *http.Request) string {
+	cookie, err := r.Cookie(adminSessionCookie)
+	if err != nil {
+		return ""
+	}
+
+	mac := hmac.New(sha256.New, s.secret)
+	mac.Write([]byte("csrf\n" + cookie.Value))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// dashboardFile is a file listed on the dashboard with the actions on it
+type dashboardFile struct {
+	adminFile
+	Actions []string
+}
+
+// dashboardList is a list of files of the dashboard, with the token its
+// forms post
+type dashboardList struct {
+	CSRF  string
+	Files []dashboardFile
+}
+
+func dashboardFiles(csrf string, files []adminFile) dashboardList {
+	list := dashboardList{CSRF: csrf}
+
+	for _, file := range files {
+		actions := []string{"extend", "block", "hold"}
+		if file.Blocked {
+			actions[1] = "unblock"
+		}
+
+		if file.Hold {
+			actions[2] = "release"
+		} else {
+			actions = append(actions, "delete")
+		}
+
+		list.Files = append(list.Files, dashboardFile{file, actions})
+	}
+
+	return list
+}
+
+func (s *Server) renderDashboard(w http.ResponseWriter, r *http.Request, status int, user, message string, actionErr error) {
+	data := struct {
+		User         string
+		CSRF         string
+		Message      string
+		Error        string
+		Stats        adminStats
+		Recent       dashboardList
+		TopDownloads dashboardList
+		Flagged      dashboardList
+		BlockedIPs   []string
+		After        string
+		Next         string
+	}{
+		User:    user,
+		Message: message,
+		After:   r.URL.Query().Get("after"),
+	}
+
+	if actionErr != nil {
+		data.Error = actionErr.Error()
+	}
+
+	if user != "" {
+		files, next, err := s.adminFilesPage(r.Context(), data.After, dashboardPageSize)
+		if err != nil {
+			log.Printf("%s", err.Error())
+			http.Error(w, "Could not list files", http.StatusInternalServerError)
+			return
+		}
+
+		data.Next = next
+		data.CSRF = s.adminCSRF(r)
+		data.Stats = s.adminStats(files)
+		data.Recent, data.TopDownloads, data.Flagged = dashboardLists(data.CSRF, files)
+
+		if s.ipFilterOptions != nil {
+			data.BlockedIPs = s.ipFilterOptions.BlockedIPs
+		}
+	}
+
+	t := lookupTemplate("admin.html")
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(status)
+
+	if err := t.Execute(w, data); err != nil {
+		log.Printf("%s", err.Error())
+	}
+}
+
+// dashboardLists returns the most recent uploads, the most downloaded files
+// and the blocked and held files
+func dashboardLists(csrf string, files []adminFile) (recent, top, flagged dashboardList) {
+	sorted := append([]adminFile{}, files...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		if sorted[j].Created == nil {
+			return sorted[i].Created != nil
+		}
+
+		return sorted[i].Created != nil && sorted[i].Created.After(*sorted[j].Created)
+	})
+
+	if len(sorted) > dashboardListLimit {
+		sorted = sorted[:dashboardListLimit]
+	}
+
+	var downloaded []adminFile
+	for _, file := range files {
+		if file.Downloads > 0 {
+			downloaded = append(downloaded, file)
+		}
+	}
+
+	sort.SliceStable(downloaded, func(i, j int) bool {
+		return downloaded[i].Downloads > downloaded[j].Downloads
+	})
+
+	if len(downloaded) > dashboardListLimit {
+		downloaded = downloaded[:dashboardListLimit]
+	}
+
+	var blocked []adminFile
+	for _, file := range files {
+		if file.Blocked || file.Hold {
+			blocked = append(blocked, file)
+		}
+	}
+
+	return dashboardFiles(csrf, sorted), dashboardFiles(csrf, downloaded), dashboardFiles(csrf, blocked)
+}
+
+// dashboardHandler renders the admin dashboard, or the login form without a
+// session
+func (s *Server) dashboardHandler(w http.ResponseWriter, r *http.Request) {
+	session, _ := s.adminSession(r)
+	s.renderDashboard(w, r, http.StatusOK, session.User, "", nil)
+}
+
+// dashboardPostHandler handles the forms of the dashboard, the login form
+// starts a session for admins, the other forms need the session and its
+// csrf token
+func (s *Server) dashboardPostHandler(w http.ResponseWriter, r *http.Request) {
+	action := r.PostFormValue("action")
+	if action == "login" {
+		s.dashboardLogin(w, r)
+		return
+	}
+
+	session, ok := s.adminSession(r)
+	if !ok {
+		s.renderDashboard(w, r, http.StatusUnauthorized, "", "", errors.New("The session expired, log in again."))
+		return
+	} else if csrf := r.PostFormValue("csrf"); csrf == "" || !hmac.Equal([]byte(csrf), []byte(s.adminCSRF(r))) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	if action == "logout" {
+		if err := s.setAdminSession(w, r, nil); err != nil {
+			log.Printf("%s", err.Error())
+			http.Error(w, "Could not log out", http.StatusInternalServerError)
+			return
+		}
+
+		// relative to the requested url, so it works behind a proxy path
+		w.Header().Set("Location", "admin")
+		w.WriteHeader(http.StatusSeeOther)
+		return
+	}
+
+	token, filename := r.PostFormValue("token"), r.PostFormValue("filename")
+	if token == "" || filename == "" {
+		http.Error(w, "token and filename are required", http.StatusBadRequest)
+		return
+	}
+
+	err := s.dashboardAction(r.Context(), action, token, filename)
+	if err == errAdminNotFound || err == errFileOnHold || err == errNoExpiry || err == errUnknownAction {
+		s.renderDashboard(w, r, http.StatusOK, session.User, "", fmt.Errorf("Could not %s %s/%s: %s.", action, token, filename, err.Error()))
+		return
+	} else if err != nil {
+		log.Printf("%s", err.Error())
+		s.renderDashboard(w, r, http.StatusInternalServerError, session.User, "", fmt.Errorf("Could not %s %s/%s.", action, token, filename))
+		return
+	}
+
+	log.Printf("Admin %s did %s on %s/%s", session.User, action, token, filename)
+	s.renderDashboard(w, r, http.StatusOK, session.User, fmt.Sprintf("Did %s on %s/%s.", action, token, filename), nil)
+}
+
+// dashboardLogin checks the credentials posted by the login form with the
+// configured authenticator
+func (s *Server) dashboardLogin(w http.ResponseWriter, r *http.Request) {
+	authenticator, ok := s.auths[ServerAuthKey]
+	if !ok {
+		s.renderDashboard(w, r, http.StatusUnauthorized, "", "", errors.New("No authenticator is configured."))
+		return
+	}
+
+	identity, ok, err := authenticate(r.Context(), authenticator, r.PostFormValue("user"), r.PostFormValue("password"))
+	if err != nil && !isUnavailable(err) {
+		log.Printf("Error checkAuth: %s", err.Error())
+	}
+
+	if isUnavailable(err) {
+		s.renderDashboard(w, r, http.StatusServiceUnavailable, "", "", errors.New("Authentication service unavailable."))
+		return
+	} else if !ok || !s.isAdmin(identity) {
+		s.renderDashboard(w, r, http.StatusUnauthorized, "", "", errors.New("The user or password is incorrect."))
+		return
+	}
+
+	if err := s.setAdminSession(w, r, &identity); err != nil {
+		log.Printf("%s", err.Error())
+		s.renderDashboard(w, r, http.StatusInternalServerError, "", "", errors.New("Could not start a session."))
+		return
+	}
+
+	// relative to the requested url, so it works behind a proxy path
+	w.Header().Set("Location", "admin")
+	w.WriteHeader(http.StatusSeeOther)
+}
+
+func (s *Server) dashboardAction(ctx context.Context, action, token, filename string) error {
+	var err error
+
+	switch action {
+	case "delete":
+		if s.onHold(ctx, token, filename) {
+			return errFileOnHold
+		} else if err = s.deleteFile(ctx, token, filename); s.storage.IsNotExist(err) {
+			return errAdminNotFound
+		}
+	case "extend":
+		err = s.extendFile(ctx, token, filename, defaultExtendDays)
+	case "block", "unblock":
+		_, err = s.blockToken(ctx, token, action == "block")
+	case "hold", "release":
+		_, err = s.holdFile(ctx, token, filename, action == "hold")
+	default:
+		return errUnknownAction
+	}
+
+	return err
+}
+
+// extendFile moves the expiry of a file days into the future, from now when
+// it already expired
+func (s *Server) extendFile(ctx context.Context, token, filename string, days int) error {
+	if _, err := s.GetMetadata(ctx, token, filename); err != nil {
+		return errAdminNotFound
+	}
+
+	_, err := s.updateMetadata(ctx, token, filename, func(metadata *Metadata) error {
+		if metadata.MaxDate.IsZero() {
+			return errNoExpiry
+		}
+
+		if now := time.Now(); metadata.MaxDate.Before(now) {
+			metadata.MaxDate = now
+		}
+
+		metadata.MaxDate = metadata.MaxDate.Add(time.Hour * 24 * time.Duration(days))
+		return nil
+	})
+
+	return err
+}
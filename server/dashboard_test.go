@@ -0,0 +1,147 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"time"
+
+	. "gopkg.in/check.v1"
+)
+
+func (s *SuiteAdmin) dashboard(c *C, cookie *http.Cookie, form url.Values) *httptest.ResponseRecorder {
+	req := httptest.NewRequest("GET", "/admin", nil)
+	if form != nil {
+		req = httptest.NewRequest("POST", "/admin", strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	}
+
+	if cookie != nil {
+		req.AddCookie(cookie)
+	}
+
+	return serveRoute(s.server, "", req)
+}
+
+func (s *SuiteAdmin) login(c *C) (*http.Cookie, string) {
+	w := s.dashboard(c, nil, url.Values{"action": {"login"}, "user": {"admin"}, "password": {"secret"}})
+	c.Assert(w.Code, Equals, http.StatusSeeOther)
+	c.Assert(w.Header().Get("Location"), Equals, "admin")
+
+	cookie := w.Result().Cookies()[0]
+	c.Assert(cookie.Name, Equals, adminSessionCookie)
+
+	req := httptest.NewRequest("GET", "/admin", nil)
+	req.AddCookie(cookie)
+	return cookie, s.server.adminCSRF(req)
+}
+
+func (s *SuiteAdmin) TestDashboardLogin(c *C) {
+	w := s.dashboard(c, nil, nil)
+	c.Assert(w.Code, Equals, http.StatusOK)
+	c.Assert(w.Body.String(), Matches, `(?s).*name="password".*`)
+
+	w = s.dashboard(c, nil, url.Values{"action": {"login"}, "user": {"user"}, "password": {"secret"}})
+	c.Assert(w.Code, Equals, http.StatusUnauthorized)
+	c.Assert(w.Result().Cookies(), HasLen, 0)
+
+	s.putFile(c, "aaaaa", "report.pdf", Metadata{MaxDownloads: -1, Owner: "user", Created: time.Now()})
+
+	cookie, _ := s.login(c)
+	w = s.dashboard(c, cookie, nil)
+	c.Assert(w.Code, Equals, http.StatusOK)
+	c.Assert(w.Body.String(), Matches, `(?s).*aaaaa/report.pdf.*`)
+
+	forged := *cookie
+	forged.Value = strings.Replace(cookie.Value, ".", "0.", 1)
+	c.Assert(s.dashboard(c, &forged, nil).Body.String(), Matches, `(?s).*name="password".*`)
+}
+
+func (s *SuiteAdmin) TestDashboardActions(c *C) {
+	expires := time.Now().Add(time.Hour)
+	s.putFile(c, "aaaaa", "file.txt", Metadata{MaxDownloads: -1, MaxDate: expires})
+	s.putFile(c, "bbbbb", "forever.txt", Metadata{MaxDownloads: -1})
+
+	cookie, csrf := s.login(c)
+
+	action := func(action, token, filename string) *httptest.ResponseRecorder {
+		return s.dashboard(c, cookie, url.Values{"action": {action}, "token": {token}, "filename": {filename}, "csrf": {csrf}})
+	}
+
+	w := s.dashboard(c, cookie, url.Values{"action": {"delete"}, "token": {"aaaaa"}, "filename": {"file.txt"}})
+	c.Assert(w.Code, Equals, http.StatusForbidden)
+	w = s.dashboard(c, nil, url.Values{"action": {"delete"}, "token": {"aaaaa"}, "filename": {"file.txt"}, "csrf": {csrf}})
+	c.Assert(w.Code, Equals, http.StatusUnauthorized)
+
+	c.Assert(action("extend", "aaaaa", "file.txt").Code, Equals, http.StatusOK)
+	metadata, err := s.server.GetMetadata(context.Background(), "aaaaa", "file.txt")
+	c.Assert(err, IsNil)
+	c.Assert(metadata.MaxDate.Sub(expires) > 6*24*time.Hour, Equals, true)
+
+	c.Assert(action("extend", "bbbbb", "forever.txt").Body.String(), Matches, `(?s).*file does not expire.*`)
+
+	c.Assert(action("block", "aaaaa", "file.txt").Code, Equals, http.StatusOK)
+	c.Assert(action("hold", "aaaaa", "file.txt").Code, Equals, http.StatusOK)
+	metadata, _ = s.server.GetMetadata(context.Background(), "aaaaa", "file.txt")
+	c.Assert(metadata.Blocked, Equals, true)
+	c.Assert(metadata.Hold, Equals, true)
+
+	c.Assert(action("delete", "aaaaa", "file.txt").Body.String(), Matches, `(?s).*file is on hold.*`)
+	c.Assert(action("release", "aaaaa", "file.txt").Code, Equals, http.StatusOK)
+	c.Assert(action("delete", "aaaaa", "file.txt").Code, Equals, http.StatusOK)
+	_, err = s.server.GetMetadata(context.Background(), "aaaaa", "file.txt")
+	c.Assert(err, NotNil)
+
+	w = action("logout", "", "")
+	c.Assert(w.Code, Equals, http.StatusSeeOther)
+	c.Assert(w.Result().Cookies()[0].Value, Equals, "")
+}
+
+func (s *SuiteAdmin) TestDashboardSessions(c *C) {
+	loggedIn := func(cookie *http.Cookie) bool {
+		return !strings.Contains(s.dashboard(c, cookie, nil).Body.String(), `name="password"`)
+	}
+
+	cookie, csrf := s.login(c)
+	c.Assert(loggedIn(cookie), Equals, true)
+
+	// a logout ends the session on the server, not just in the browser
+	w := s.dashboard(c, cookie, url.Values{"action": {"logout"}, "csrf": {csrf}})
+	c.Assert(w.Code, Equals, http.StatusSeeOther)
+	c.Assert(loggedIn(cookie), Equals, false)
+
+	// admins removed from the configuration lose their sessions
+	cookie, _ = s.login(c)
+	s.server.adminUsers = nil
+	c.Assert(loggedIn(cookie), Equals, false)
+}
+
+func (s *SuiteAdmin) TestDashboardPages(c *C) {
+	for _, key := range []string{"bbbbb/a.txt", "aaaaa/b.txt", "aaaaa/a.txt"} {
+		parts := strings.Split(key, "/")
+		s.putFile(c, parts[0], parts[1], Metadata{MaxDownloads: -1})
+	}
+
+	files, next, err := s.server.adminFilesPage(context.Background(), "", 2)
+	c.Assert(err, IsNil)
+	c.Assert(files, HasLen, 2)
+	c.Assert(files[0].Filename, Equals, "a.txt")
+	c.Assert(files[1].Filename, Equals, "b.txt")
+	c.Assert(next, Equals, "aaaaa/b.txt")
+
+	files, next, err = s.server.adminFilesPage(context.Background(), next, 2)
+	c.Assert(err, IsNil)
+	c.Assert(files, HasLen, 1)
+	c.Assert(files[0].Token, Equals, "bbbbb")
+	c.Assert(next, Equals, "")
+
+	cookie, _ := s.login(c)
+	req := httptest.NewRequest("GET", "/admin?after=aaaaa%2Fb.txt", nil)
+	req.AddCookie(cookie)
+
+	w := serveRoute(s.server, "", req)
+	c.Assert(w.Body.String(), Matches, `(?s).*after aaaaa/b.txt.*First page.*`)
+	c.Assert(strings.Contains(w.Body.String(), "Next page"), Equals, false)
+}
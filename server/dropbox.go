@@ -0,0 +1,474 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	html_template "html/template"
+	"io/ioutil"
+	"log"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+const (
+	// dropboxToken is the reserved token the drop boxes are stored under
+	dropboxToken = "_dropbox"
+	// defaultDropboxExpiry is the lifetime of a drop box when none is requested
+	defaultDropboxExpiry = 7 * 24 * time.Hour
+)
+
+var errDropboxNotFound = errors.New("drop box not found")
+
+// defaultDropboxTemplate renders the upload page of a drop box
+var defaultDropboxTemplate = html_template.Must(html_template.New("dropbox.html").Parse(`<!DOCTYPE html>
+<html>
+<head>
+	<meta charset="utf-8">
+	<meta name="viewport" content="width=device-width, initial-scale=1">
+	<title>{{ .Title }} - transfer.sh</title>
+	<style>
+		body { font-family: sans-serif; background: #2d2d2d; color: #eee; }
+		form { max-width: 420px; margin: 15vh auto; }
+		input { display: block; width: 100%; margin: 8px 0; padding: 8px; box-sizing: border-box; }
+		.error { color: #f66; }
+	</style>
+</head>
+<body>
+	<form method="post" action="" enctype="multipart/form-data">
+		<h2>{{ .Title }}</h2>
+		<p>{{ .User }} requests files until {{ .Expires.Format "2 Jan 2006 15:04 MST" }}.</p>
+		{{ if .Error }}<p class="error">{{ .Error }}</p>{{ end }}
+		{{ range .Received }}<p>Received {{ . }}</p>{{ end }}
+		<input type="file" name="file" multiple required>
+		{{ if .Password }}<input type="password" name="password" placeholder="Password" required>{{ end }}
+		<input type="submit" value="Upload">
+	</form>
+</body>
+</html>
+`))
+
+// DropboxFile is a file uploaded to a drop box
+type DropboxFile struct {
+	Filename      string    `json:"filename"`
+	ContentLength int64     `json:"content_length"`
+	Uploaded      time.Time `json:"uploaded"`
+}
+
+// Dropbox collects the uploads of people without an account for the user who
+// created it, the files are stored under one token and only their owner can
+// download them
+type Dropbox struct {
+	ID        string    `json:"id"`
+	Token     string    `json:"token"`
+	Title     string    `json:"title"`
+	User      string    `json:"user,omitempty"`
+	Namespace string    `json:"namespace,omitempty"`
+	Created   time.Time `json:"created"`
+	Expires   time.Time `json:"expires"`
+	// Password is the hash of the password of the upload page, if any
+	Password string        `json:"password,omitempty"`
+	Files    []DropboxFile `json:"files"`
+}
+
+// Expired reports whether the drop box stopped accepting uploads
+func (d Dropbox) Expired() bool {
+	return time.Now().After(d.Expires)
+}
+
+// apply makes the file of metadata owned by the creator of the drop box
+func (d Dropbox) apply(metadata *Metadata) {
+	metadata.AuthTypes = []AuthType{OWNER}
+	metadata.Owner = d.User
+	metadata.Namespace = d.Namespace
+	metadata.MaxDownloads = -1
+	metadata.MaxDate = time.Time{}
+}
+
+// uniqueFilename returns filename, numbered when the drop box already holds
+// a file with that name
+func (d Dropbox) uniqueFilename(filename string) string {
+	taken := map[string]bool{}
+	for _, file := range d.Files {
+		taken[file.Filename] = true
+	}
+
+	ext := filepath.Ext(filename)
+	base := strings.TrimSuffix(filename, ext)
+
+	for i := 1; taken[filename]; i++ {
+		filename = fmt.Sprintf("%s-%d%s", base, i, ext)
+	}
+
+	return filename
+}
+
+// OwnerRequired reports whether downloads are restricted to the owner of the file
+func (m *Metadata) OwnerRequired() bool {
+	for _, v := range m.AuthTypes {
+		if v == OWNER {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (s *Server) getDropbox(ctx context.Context, id string) (Dropbox, error) {
+	var dropbox Dropbox
+
+	if _, err := hex.DecodeString(id); err != nil || id == "" {
+		return dropbox, errDropboxNotFound
+	}
+
+	reader, _, err := s.metadataStorage.Get(ctx, dropboxToken, id+".json")
+	if s.metadataStorage.IsNotExist(err) {
+		return dropbox, errDropboxNotFound
+	} else if err != nil {
+		return dropbox, err
+	}
+
+	defer reader.Close()
+
+	data, err := ioutil.ReadAll(reader)
+	if err != nil {
+		return dropbox, err
+	}
+
+	err = json.Unmarshal(data, &dropbox)
+	return dropbox, err
+}
+
+func (s *Server) putDropbox(ctx context.Context, dropbox Dropbox) error {
+	data, err := json.Marshal(dropbox)
+	if err != nil {
+		return err
+	}
+
+	return s.metadataStorage.Put(ctx, dropboxToken, dropbox.ID+".json", bytes.NewReader(data), "text/json", uint64(len(data)))
+}
+
+// updateDropbox applies fn to the stored drop box with id and stores the
+// result, it isn't stored when fn returns an error
+func (s *Server) updateDropbox(ctx context.Context, id string, fn func(*Dropbox) error) error {
+	s.Lock(dropboxToken, id)
+	defer s.Unlock(dropboxToken, id)
+
+	dropbox, err := s.getDropbox(ctx, id)
+	if err != nil {
+		return err
+	}
+
+	if err := fn(&dropbox); err != nil {
+		return err
+	}
+
+	return s.putDropbox(ctx, dropbox)
+}
+
+type dropboxContextKey struct{}
+
+// dropboxFromContext returns the drop box the request uploads to
+func dropboxFromContext(ctx context.Context) (Dropbox, bool) {
+	dropbox, ok := ctx.Value(dropboxContextKey{}).(Dropbox)
+	return dropbox, ok
+}
+
+// reserveDropbox adds the upload of filename to the drop box of the request,
+// it returns the name the file is stored under. It writes the response and
+// returns false when the file can't be added.
+func (s *Server) reserveDropbox(w http.ResponseWriter, r *http.Request, filename string, contentLength int64) (string, bool) {
+	dropbox, ok := dropboxFromContext(r.Context())
+	if !ok {
+		return filename, true
+	}
+
+	err := s.updateDropbox(r.Context(), dropbox.ID, func(dropbox *Dropbox) error {
+		if dropbox.Expired() {
+			return errDropboxNotFound
+		}
+
+		filename = dropbox.uniqueFilename(filename)
+		dropbox.Files = append(dropbox.Files, DropboxFile{Filename: filename, ContentLength: contentLength, Uploaded: time.Now().UTC()})
+		return nil
+	})
+
+	if err == errDropboxNotFound {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return filename, false
+	} else if err != nil {
+		log.Printf("Error updating drop box: %s", err.Error())
+		http.Error(w, "Could not update drop box", http.StatusInternalServerError)
+		return filename, false
+	}
+
+	return filename, true
+}
+
+// releaseDropbox removes the failed upload of filename from the drop box of
+// the request
+func (s *Server) releaseDropbox(r *http.Request, filename string) {
+	dropbox, ok := dropboxFromContext(r.Context())
+	if !ok {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), abortUploadTimeout)
+	defer cancel()
+
+	if err := s.updateDropbox(ctx, dropbox.ID, func(dropbox *Dropbox) error {
+		for i, file := range dropbox.Files {
+			if file.Filename == filename {
+				dropbox.Files = append(dropbox.Files[:i], dropbox.Files[i+1:]...)
+				break
+			}
+		}
+
+		return nil
+	}); err != nil {
+		log.Printf("Error updating drop box: %s", err.Error())
+	}
+}
+
+// dropboxFileResponse is a file of a drop box as listed to its owner
+type dropboxFileResponse struct {
+	DropboxFile
+	URL string `json:"url"`
+}
+
+// dropboxResponse is a drop box as reported to its owner
+type dropboxResponse struct {
+	Dropbox
+	URL         string                `json:"url"`
+	HasPassword bool                  `json:"has_password"`
+	Files       []dropboxFileResponse `json:"files"`
+}
+
+func (s *Server) writeDropbox(w http.ResponseWriter, r *http.Request, dropbox Dropbox) {
+	pageURL, _ := url.Parse(path.Join(s.proxyPath, "dropbox", dropbox.ID))
+
+	response := dropboxResponse{
+		Dropbox:     dropbox,
+		URL:         resolveURL(r, pageURL, s.proxyPort),
+		HasPassword: dropbox.Password != "",
+		Files:       []dropboxFileResponse{},
+	}
+
+	response.Password = ""
+
+	for _, file := range dropbox.Files {
+		fileURL, _ := url.Parse(path.Join(s.proxyPath, dropbox.Token, url.PathEscape(file.Filename)))
+		response.Files = append(response.Files, dropboxFileResponse{file, resolveURL(r, fileURL, s.proxyPort)})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		log.Printf("%s", err.Error())
+	}
+}
+
+// createDropboxHandler creates a drop box owned by the authenticated user,
+// it is served behind the upload credentials. The form values title, expires
+// and password set up the drop box.
+func (s *Server) createDropboxHandler(w http.ResponseWriter, r *http.Request) {
+	// the files of the drop box are only downloaded by the identity of its owner
+	identity, ok := IdentityFromContext(r.Context())
+	if !ok || identity.User == "" {
+		http.Error(w, "drop boxes require server credentials", http.StatusForbidden)
+		return
+	}
+
+	id, err := randomHex(16)
+	if err != nil {
+		log.Printf("%s", err.Error())
+		http.Error(w, "Could not create drop box", http.StatusInternalServerError)
+		return
+	}
+
+	dropbox := Dropbox{
+		ID:      id,
+		Token:   Encode(10000000 + int64(rand.Intn(1000000000))),
+		Title:   r.FormValue("title"),
+		Created: time.Now().UTC(),
+		Files:   []DropboxFile{},
+	}
+
+	if dropbox.Title == "" {
+		dropbox.Title = "Upload files"
+	}
+
+	expiry := defaultDropboxExpiry
+	if v := r.FormValue("expires"); v != "" {
+		if expiry, err = time.ParseDuration(v); err != nil || expiry <= 0 {
+			http.Error(w, fmt.Sprintf("invalid expires: %s", v), http.StatusBadRequest)
+			return
+		}
+	}
+
+	dropbox.Expires = dropbox.Created.Add(expiry)
+
+	if password := r.FormValue("password"); password != "" {
+		if dropbox.Password, err = hashPassword(password); err != nil {
+			log.Printf("%s", err.Error())
+			http.Error(w, "Could not create drop box", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	dropbox.User = identity.User
+
+	if identity.Key != nil {
+		dropbox.Namespace = identity.Key.Namespace
+	}
+
+	if err := s.putDropbox(r.Context(), dropbox); err != nil {
+		log.Printf("Error creating drop box: %s", err.Error())
+		http.Error(w, "Could not create drop box", http.StatusInternalServerError)
+		return
+	}
+
+	s.writeDropbox(w, r, dropbox)
+}
+
+// dropboxFilesHandler lists a drop box and its files to its owner
+func (s *Server) dropboxFilesHandler(w http.ResponseWriter, r *http.Request) {
+	dropbox, err := s.getDropbox(r.Context(), mux.Vars(r)["id"])
+	if err == errDropboxNotFound {
+		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		return
+	} else if err != nil {
+		log.Printf("Error reading drop box: %s", err.Error())
+		http.Error(w, "Could not read drop box", http.StatusInternalServerError)
+		return
+	}
+
+	if identity, _ := IdentityFromContext(r.Context()); identity.User != dropbox.User {
+		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		return
+	}
+
+	s.writeDropbox(w, r, dropbox)
+}
+
+func (s *Server) renderDropbox(w http.ResponseWriter, status int, dropbox Dropbox, received []string, message string) {
+	t := lookupTemplate("dropbox.html")
+
+	data := struct {
+		Title    string
+		User     string
+		Expires  time.Time
+		Password bool
+		Received []string
+		Error    string
+	}{
+		dropbox.Title,
+		dropbox.User,
+		dropbox.Expires,
+		dropbox.Password != "",
+		received,
+		message,
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(status)
+
+	if err := t.Execute(w, data); err != nil {
+		log.Printf("%s", err.Error())
+	}
+}
+
+// openDropbox returns the unexpired drop box of the request, it writes the
+// response and returns false when there is none
+func (s *Server) openDropbox(w http.ResponseWriter, r *http.Request) (Dropbox, bool) {
+	dropbox, err := s.getDropbox(r.Context(), mux.Vars(r)["id"])
+	if err == errDropboxNotFound || err == nil && dropbox.Expired() {
+		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		return dropbox, false
+	} else if err != nil {
+		log.Printf("Error reading drop box: %s", err.Error())
+		http.Error(w, "Could not read drop box", http.StatusInternalServerError)
+		return dropbox, false
+	}
+
+	return dropbox, true
+}
+
+// dropboxPageHandler renders the upload page of a drop box
+func (s *Server) dropboxPageHandler(w http.ResponseWriter, r *http.Request) {
+	if dropbox, ok := s.openDropbox(w, r); ok {
+		s.renderDropbox(w, http.StatusOK, dropbox, nil, "")
+	}
+}
+
+// dropboxUploadHandler accepts the uploads of a drop box with postHandler,
+// browsers get the upload page back
+func (s *Server) dropboxUploadHandler(w http.ResponseWriter, r *http.Request) {
+	dropbox, ok := s.openDropbox(w, r)
+	if !ok {
+		return
+	}
+
+	if err := r.ParseMultipartForm(_24K); err != nil {
+		log.Printf("%s", err.Error())
+		http.Error(w, "Error occurred copying to output stream", http.StatusInternalServerError)
+		return
+	}
+
+	if dropbox.Password == "" {
+	} else if ok, err := verifyPassword(dropbox.Password, r.FormValue("password"), dropbox.ID); err != nil || !ok {
+		if acceptsHTML(r.Header) {
+			s.renderDropbox(w, http.StatusUnauthorized, dropbox, nil, "The password is incorrect.")
+		} else {
+			http.Error(w, "Not authorized", http.StatusUnauthorized)
+		}
+
+		return
+	}
+
+	r = r.WithContext(context.WithValue(r.Context(), dropboxContextKey{}, dropbox))
+
+	if !acceptsHTML(r.Header) {
+		s.postHandler(w, r)
+		return
+	}
+
+	recorder := &bytes.Buffer{}
+	rw := &capturingResponseWriter{header: http.Header{}, body: recorder, status: http.StatusOK}
+	s.postHandler(rw, r)
+
+	if rw.status != http.StatusOK {
+		s.renderDropbox(w, rw.status, dropbox, nil, strings.TrimSpace(recorder.String()))
+		return
+	}
+
+	s.renderDropbox(w, http.StatusOK, dropbox, strings.Split(strings.TrimSpace(recorder.String()), "\n"), "")
+}
+
+// capturingResponseWriter keeps the response of a handler to render it in a page
+type capturingResponseWriter struct {
+	header http.Header
+	body   *bytes.Buffer
+	status int
+}
+
+func (w *capturingResponseWriter) Header() http.Header {
+	return w.header
+}
+
+func (w *capturingResponseWriter) Write(b []byte) (int, error) {
+	return w.body.Write(b)
+}
+
+func (w *capturingResponseWriter) WriteHeader(status int) {
+	w.status = status
+}
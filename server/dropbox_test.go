@@ -0,0 +1,149 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+
+	. "gopkg.in/check.v1"
+)
+
+var _ = Suite(&SuiteDropbox{})
+
+type SuiteDropbox struct {
+	server *Server
+}
+
+func (s *SuiteDropbox) SetUpTest(c *C) {
+	s.server = testServer(c)
+}
+
+func (s *SuiteDropbox) create(c *C, user string, form url.Values) (int, dropboxResponse) {
+	req := httptest.NewRequest("POST", "/dropbox", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	w := serveRoute(s.server, user, req)
+
+	var dropbox dropboxResponse
+	if w.Code == http.StatusOK {
+		c.Assert(json.NewDecoder(w.Body).Decode(&dropbox), IsNil)
+	}
+
+	return w.Code, dropbox
+}
+
+func (s *SuiteDropbox) files(c *C, user, id string) (int, dropboxResponse) {
+	w := serveRoute(s.server, user, httptest.NewRequest("GET", "/dropbox/"+id+"/files", nil))
+
+	var dropbox dropboxResponse
+	if w.Code == http.StatusOK {
+		c.Assert(json.NewDecoder(w.Body).Decode(&dropbox), IsNil)
+	}
+
+	return w.Code, dropbox
+}
+
+func (s *SuiteDropbox) upload(c *C, id, password string, html bool, filenames ...string) *httptest.ResponseRecorder {
+	body := &bytes.Buffer{}
+	writer := multipart.NewWriter(body)
+	for _, filename := range filenames {
+		part, err := writer.CreateFormFile("file", filename)
+		c.Assert(err, IsNil)
+		part.Write([]byte("content"))
+	}
+
+	if password != "" {
+		writer.WriteField("password", password)
+	}
+
+	writer.Close()
+
+	req := httptest.NewRequest("POST", "/dropbox/"+id, body)
+	req.Header.Set("Content-Type", writer.FormDataContentType())
+	if html {
+		req.Header.Set("Accept", "text/html")
+	}
+
+	return serveRoute(s.server, "", req)
+}
+
+func (s *SuiteDropbox) download(token, filename, user string) int {
+	return serveRoute(s.server, user, httptest.NewRequest("GET", "/"+token+"/"+filename, nil)).Code
+}
+
+func (s *SuiteDropbox) TestCreate(c *C) {
+	code, _ := s.create(c, "", nil)
+	c.Assert(code, Equals, http.StatusUnauthorized)
+
+	code, _ = s.create(c, "user", url.Values{"expires": {"soon"}})
+	c.Assert(code, Equals, http.StatusBadRequest)
+
+	code, dropbox := s.create(c, "user", url.Values{"title": {"Invoices"}, "password": {"open"}})
+	c.Assert(code, Equals, http.StatusOK)
+	c.Assert(dropbox.URL, Equals, "http://example.com/dropbox/"+dropbox.ID)
+	c.Assert(dropbox.User, Equals, "user")
+	c.Assert(dropbox.HasPassword, Equals, true)
+	c.Assert(dropbox.Password, Equals, "")
+
+	w := serveRoute(s.server, "", httptest.NewRequest("GET", "/dropbox/"+dropbox.ID, nil))
+	c.Assert(w.Code, Equals, http.StatusOK)
+	c.Assert(w.Body.String(), Matches, "(?s).*<h2>Invoices</h2>.*type=\"password\".*")
+}
+
+func (s *SuiteDropbox) TestUpload(c *C) {
+	_, dropbox := s.create(c, "user", url.Values{"password": {"open"}})
+
+	c.Assert(s.upload(c, dropbox.ID, "", false, "a.pdf").Code, Equals, http.StatusUnauthorized)
+	c.Assert(s.upload(c, dropbox.ID, "wrong", true, "a.pdf").Code, Equals, http.StatusUnauthorized)
+
+	w := s.upload(c, dropbox.ID, "open", false, "a.pdf")
+	c.Assert(w.Code, Equals, http.StatusOK)
+	c.Assert(w.Body.String(), Equals, "a.pdf\n")
+
+	w = s.upload(c, dropbox.ID, "open", true, "a.pdf")
+	c.Assert(w.Code, Equals, http.StatusOK)
+	c.Assert(w.Body.String(), Matches, "(?s).*Received a-1.pdf.*")
+
+	code, listed := s.files(c, "user", dropbox.ID)
+	c.Assert(code, Equals, http.StatusOK)
+	c.Assert(listed.Files, HasLen, 2)
+	c.Assert(listed.Files[1].Filename, Equals, "a-1.pdf")
+	c.Assert(listed.Files[1].URL, Equals, "http://example.com/"+dropbox.Token+"/a-1.pdf")
+
+	code, _ = s.files(c, "other", dropbox.ID)
+	c.Assert(code, Equals, http.StatusNotFound)
+
+	c.Assert(s.download(dropbox.Token, "a.pdf", "user"), Equals, http.StatusOK)
+	c.Assert(s.download(dropbox.Token, "a.pdf", "other"), Equals, http.StatusUnauthorized)
+	c.Assert(s.download(dropbox.Token, "a.pdf", ""), Equals, http.StatusUnauthorized)
+}
+
+func (s *SuiteDropbox) TestExpired(c *C) {
+	_, dropbox := s.create(c, "user", url.Values{"expires": {"1ns"}})
+	c.Assert(s.upload(c, dropbox.ID, "", false, "a.pdf").Code, Equals, http.StatusNotFound)
+	c.Assert(s.upload(c, "0011", "", false, "a.pdf").Code, Equals, http.StatusNotFound)
+}
+
+func (s *SuiteDropbox) TestReservedRecords(c *C) {
+	_, dropbox := s.create(c, "user", url.Values{"password": {"open"}})
+
+	_, err := s.server.metadataStorage.Head(context.Background(), dropboxToken, dropbox.ID+".json")
+	c.Assert(err, IsNil)
+
+	// the record of a drop box is kept with the files but never served
+	for _, target := range []string{
+		"/(_dropbox/" + dropbox.ID + ".json).zip",
+		"/(_dropbox/" + dropbox.ID + ".json).tar.gz",
+		"/_dropbox/" + dropbox.ID + ".json",
+		"/download/_dropbox/" + dropbox.ID + ".json",
+	} {
+		w := serveRoute(s.server, "", httptest.NewRequest("GET", target, nil))
+		c.Assert(w.Code, Equals, http.StatusNotFound, Commentf("%s", target))
+		c.Assert(w.Body.String(), Not(Matches), "(?s).*"+dropbox.Token+".*")
+	}
+}
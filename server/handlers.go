@@ -33,7 +33,6 @@ import (
 	"bytes"
 	"compress/gzip"
 	"context"
-	"crypto/sha256"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -57,8 +56,6 @@ import (
 
 	blackfriday "github.com/russross/blackfriday/v2"
 
-	"crypto/hmac"
-	"encoding/hex"
 	"net"
 
 	"encoding/base64"
@@ -71,18 +68,54 @@ import (
 
 const getPathPart = "get"
 
+// abortUploadTimeout bounds the cleanup of a failed upload
+const abortUploadTimeout = 30 * time.Second
+
 var (
 	htmlTemplates = initHTMLTemplates()
 	textTemplates = initTextTemplates()
 )
 
+// builtinTemplates are the pages used when the web assets don't provide them
+var builtinTemplates = map[string]*html_template.Template{
+	"admin.html":    defaultDashboardTemplate,
+	"dropbox.html":  defaultDropboxTemplate,
+	"password.html": defaultPasswordTemplate,
+}
+
+// lookupTemplate returns the html template name of the web assets, or the
+// built-in page when they don't provide one
+func lookupTemplate(name string) *html_template.Template {
+	if t := htmlTemplates.Lookup(name); t != nil {
+		return t
+	}
+
+	return builtinTemplates[name]
+}
+
 type metadataContextKey struct{}
 
+// WithMetadata returns a copy of ctx carrying the metadata of the file a
+// request operates on, storage providers may store it along with the file
+func WithMetadata(ctx context.Context, metadata Metadata) context.Context {
+	return context.WithValue(ctx, metadataContextKey{}, metadata)
+}
+
+// MetadataFromContext returns the metadata carried by ctx, if any
+func MetadataFromContext(ctx context.Context) (Metadata, bool) {
+	metadata, ok := ctx.Value(metadataContextKey{}).(Metadata)
+	return metadata, ok
+}
+
 type uploadParams struct {
 	apiAccount string
+	jwt        bool
+	signed     bool
 	username   string
 	password   string
-	ips        string
+	ips        []net.IP
+	nets       []*net.IPNet
+	certUsers  []string
 }
 
 func stripPrefix(path string) string {
@@ -106,18 +139,174 @@ func initHTMLTemplates() *html_template.Template {
 	return templates
 }
 
-func healthHandler(w http.ResponseWriter, r *http.Request) {
-	fmt.Fprintf(w, "Approaching Neutral Zone, all systems normal and functioning.")
+func (s *Server) healthHandler(w http.ResponseWriter, r *http.Request) {
+	healthy, states := s.storageHealth()
+
+	if !healthy {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		fmt.Fprintf(w, "Storage backend unavailable.")
+	} else {
+		fmt.Fprintf(w, "Approaching Neutral Zone, all systems normal and functioning.")
+	}
+
+	for _, state := range states {
+		fmt.Fprintf(w, "\n%s", state)
+	}
 }
 
-func getUploadParams(r *http.Request) (params uploadParams) {
+// storageHealth reports whether no circuit breaker of the storage backends
+// is open, and the state of every breaker
+func (s *Server) storageHealth() (healthy bool, states []string) {
+	storages := map[string]Storage{"storage": s.storage}
+	if s.metadataStorage != s.storage {
+		storages["metadata storage"] = s.metadataStorage
+	}
+
+	healthy = true
+	for _, name := range []string{"storage", "metadata storage"} {
+		breaker, ok := storages[name].(CircuitBreaker)
+		if !ok {
+			continue
+		}
+
+		state := breaker.CircuitState()
+		healthy = healthy && state != CircuitOpen
+
+		states = append(states, fmt.Sprintf("%s %s: circuit %s", name, storages[name].Type(), state))
+	}
+
+	return healthy, states
+}
+
+// getUploadParams returns the download restrictions of a multipart upload
+func getUploadParams(r *http.Request) (params uploadParams, err error) {
 	params.apiAccount = r.Form.Get("api")
+	params.jwt = r.Form.Get("jwt") != ""
+	params.signed = r.Form.Get("signed") != ""
 	params.username = r.Form.Get("user")
 	params.password = r.Form.Get("password")
-	params.ips = r.Form.Get("ip")
+
+	params.certUsers = splitList(r.Form.Get("cert"))
+
+	if ips := r.Form.Get("ip"); ips != "" {
+		params.ips, params.nets, err = parseIPString(ips)
+	}
+
+	return
+}
+
+// getUploadHeaderParams returns the download restrictions of an upload set by
+// the X-Download-User, X-Download-Password, X-Download-Auth and X-Allowed-IPs
+// request headers
+func getUploadHeaderParams(r *http.Request) (params uploadParams, err error) {
+	params.username = r.Header.Get("X-Download-User")
+	params.password = r.Header.Get("X-Download-Password")
+
+	if (params.username == "") != (params.password == "") {
+		return params, errors.New("X-Download-User and X-Download-Password must be set together")
+	}
+
+	for _, auth := range strings.Split(r.Header.Get("X-Download-Auth"), ",") {
+		switch auth = strings.TrimSpace(auth); strings.ToLower(auth) {
+		case "":
+		case "api":
+			params.apiAccount = auth
+		case "jwt":
+			params.jwt = true
+		case "signed":
+			params.signed = true
+		default:
+			return params, fmt.Errorf("unsupported X-Download-Auth: %s", auth)
+		}
+	}
+
+	params.certUsers = splitList(r.Header.Get("X-Download-Cert"))
+
+	if ips := r.Header.Get("X-Allowed-IPs"); ips != "" {
+		params.ips, params.nets, err = parseIPString(ips)
+	}
+
 	return
 }
 
+// apply adds the download restrictions to the metadata of an upload
+func (params uploadParams) apply(metadata *Metadata) error {
+	if params.username != "" && params.password != "" {
+		hash, err := hashPassword(params.password)
+		if err != nil {
+			return err
+		}
+
+		metadata.AuthTypes = append(metadata.AuthTypes, METADATA)
+		metadata.User = params.username
+		metadata.Password = hash
+	}
+
+	if params.apiAccount != "" {
+		metadata.AuthTypes = append(metadata.AuthTypes, API)
+	}
+
+	if params.jwt {
+		metadata.AuthTypes = append(metadata.AuthTypes, JWT)
+	}
+
+	if params.signed {
+		metadata.AuthTypes = append(metadata.AuthTypes, SIGNED)
+	}
+
+	if len(params.certUsers) != 0 {
+		metadata.AuthTypes = append(metadata.AuthTypes, CERT)
+		metadata.CertificateUsers = params.certUsers
+	}
+
+	if len(params.ips) != 0 || len(params.nets) != 0 {
+		metadata.AuthTypes = append(metadata.AuthTypes, IP)
+		metadata.IP = params.ips
+		metadata.Nets = params.nets
+	}
+
+	return nil
+}
+
+// splitList returns the non-empty elements of a comma separated list
+func splitList(s string) []string {
+	var list []string
+
+	for _, v := range strings.Split(s, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			list = append(list, v)
+		}
+	}
+
+	return list
+}
+
+// setRestrictionHeaders echoes the download restrictions of an upload in the
+// same headers that set them
+func setRestrictionHeaders(w http.ResponseWriter, metadata Metadata) {
+	for _, authType := range metadata.AuthTypes {
+		switch authType {
+		case METADATA:
+			w.Header().Set("X-Download-User", metadata.User)
+		case API, JWT, SIGNED:
+			w.Header().Add("X-Download-Auth", strings.ToLower(string(authType)))
+		case CERT:
+			w.Header().Set("X-Download-Cert", strings.Join(metadata.CertificateUsers, ","))
+		case IP:
+			var allowed []string
+			for _, ip := range metadata.IP {
+				allowed = append(allowed, ip.String())
+			}
+
+			for _, n := range metadata.Nets {
+				allowed = append(allowed, n.String())
+			}
+
+			w.Header().Set("X-Allowed-IPs", strings.Join(allowed, ","))
+		}
+	}
+}
+
 /* The preview handler will show a preview of the content for browsers (accept type text/html), and referer is not transfer.sh */
 func (s *Server) previewHandler(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
@@ -125,16 +314,15 @@ func (s *Server) previewHandler(w http.ResponseWriter, r *http.Request) {
 	token := vars["token"]
 	filename := vars["filename"]
 
-	metadata, err := s.CheckMetadata(token, filename, false)
+	metadata, err := s.CheckMetadata(r.Context(), token, filename, false)
 
 	if err != nil {
-		log.Printf("Error metadata: %s", err.Error())
-		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		s.metadataError(w, err)
 		return
 	}
 
 	contentType := metadata.ContentType
-	contentLength, err := s.storage.Head(token, filename)
+	contentLength, err := s.storage.Head(r.Context(), token, filename)
 	if err != nil {
 		http.Error(w, http.StatusText(404), 404)
 		return
@@ -150,15 +338,19 @@ func (s *Server) previewHandler(w http.ResponseWriter, r *http.Request) {
 		templatePath = "download.video.html"
 	case strings.HasPrefix(contentType, "audio/"):
 		templatePath = "download.audio.html"
-	case strings.HasPrefix(contentType, "text/"):
+	case strings.HasPrefix(contentType, "text/") && !metadata.LinksRequired():
+		// downloads with a recipient link are counted by openFile, a
+		// preview doesn't serve the content of such files
 		templatePath = "download.markdown.html"
 
 		var reader io.ReadCloser
-		if reader, _, err = s.storage.Get(token, filename); err != nil {
+		if reader, _, err = s.storage.Get(r.Context(), token, filename); err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
 
+		defer reader.Close()
+
 		var data []byte
 		data = make([]byte, _5M)
 		if _, err = reader.Read(data); err != io.EOF && err != nil {
@@ -181,8 +373,13 @@ func (s *Server) previewHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	relativeURL, _ := url.Parse(path.Join(s.proxyPath, token, filename))
-	resolvedURL := resolveURL(r, relativeURL, s.proxyPort)
 	relativeURLGet, _ := url.Parse(path.Join(s.proxyPath, getPathPart, token, filename))
+
+	// keep the links of a signed url or recipient link working
+	relativeURL.RawQuery = accessQuery(r)
+	relativeURLGet.RawQuery = relativeURL.RawQuery
+
+	resolvedURL := resolveURL(r, relativeURL, s.proxyPort)
 	resolvedURLGet := resolveURL(r, relativeURLGet, s.proxyPort)
 	var png []byte
 	png, err = qrcode.Encode(resolvedURL, qrcode.High, 150)
@@ -278,23 +475,34 @@ func (s *Server) postHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	params := getUploadParams(r)
+	// the restrictions of uploads to a drop box are set by the drop box
+	dropbox, inDropbox := dropboxFromContext(r.Context())
 
-	var err error
-	var ips []net.IP
-	var nets []*net.IPNet
-	if params.ips != "" {
-		ips, nets, err = parseIPString(params.ips)
-		if err != nil {
+	var params uploadParams
+	if !inDropbox {
+		var err error
+		if params, err = getUploadParams(r); err != nil {
 			http.Error(w, err.Error(), http.StatusBadRequest)
 			return
 		}
 	}
 
+	if _, ok := presignFromContext(r.Context()); ok && countFiles(r.MultipartForm) != 1 {
+		http.Error(w, "upload urls accept a single file", http.StatusBadRequest)
+		return
+	}
+
 	token := Encode(10000000 + int64(rand.Intn(1000000000)))
+	if inDropbox {
+		token = dropbox.Token
+	}
 
 	w.Header().Set("Content-Type", "text/plain")
 
+	// every file of the request gets the same restrictions, their headers are
+	// set with the first file before the body is written
+	restricted := false
+
 	for _, fheaders := range r.MultipartForm.File {
 		for _, fheader := range fheaders {
 			filename := sanitize(fheader.Filename)
@@ -348,21 +556,39 @@ func (s *Server) postHandler(w http.ResponseWriter, r *http.Request) {
 			contentLength := n
 
 			metadata := MetadataForRequest(contentType, r)
+			if err := params.apply(&metadata); err != nil {
+				log.Printf("%s", err.Error())
+				http.Error(w, errors.New("Could not encode metadata").Error(), 500)
+
+				cleanTmpFile(file)
+				return
+			}
+
+			if presign, ok := presignFromContext(r.Context()); ok {
+				presign.apply(&metadata)
+			}
+
+			if inDropbox {
+				dropbox.apply(&metadata)
+			}
 
-			if params.username != "" && params.password != "" {
-				metadata.AuthTypes = append(metadata.AuthTypes, METADATA)
-				metadata.User = params.username
-				metadata.Password = cryptoPwd(params.password, token)
+			var ok bool
+			if filename, ok = s.reserveDropbox(w, r, filename, contentLength); !ok {
+				cleanTmpFile(file)
+				return
 			}
 
-			if params.apiAccount != "" {
-				metadata.AuthTypes = append(metadata.AuthTypes, API)
+			if !s.reservePresign(w, r, filename, contentLength) {
+				s.releaseDropbox(r, filename)
+				cleanTmpFile(file)
+				return
 			}
 
-			if params.ips != "" {
-				metadata.AuthTypes = append(metadata.AuthTypes, IP)
-				metadata.IP = ips
-				metadata.Nets = nets
+			if !s.reserveQuota(w, r, contentLength) {
+				s.releasePresign(r)
+				s.releaseDropbox(r, filename)
+				cleanTmpFile(file)
+				return
 			}
 
 			buffer := &bytes.Buffer{}
@@ -372,25 +598,50 @@ func (s *Server) postHandler(w http.ResponseWriter, r *http.Request) {
 
 				cleanTmpFile(file)
 				return
-			} else if err := s.metadataStorage.Put(token, fmt.Sprintf("%s.metadata", filename), buffer, "text/json", uint64(buffer.Len())); err != nil {
+			} else if err := s.metadataStorage.Put(r.Context(), token, fmt.Sprintf("%s.metadata", filename), buffer, "text/json", uint64(buffer.Len())); err != nil {
 				log.Printf("%s", err.Error())
-				http.Error(w, errors.New("Could not save metadata").Error(), 500)
+				storageError(w, err, "Could not save metadata")
 
+				s.releaseQuota(r, contentLength)
+				s.releasePresign(r)
+				s.releaseDropbox(r, filename)
 				cleanTmpFile(file)
 				return
 			}
 
-			log.Printf("Uploading %s %s %d %s", token, filename, contentLength, contentType)
+			logUpload(r, token, filename, contentLength, contentType)
 
-			if err = s.storage.Put(token, filename, reader, contentType, uint64(contentLength)); err != nil {
+			if err = s.storage.Put(WithMetadata(r.Context(), metadata), token, filename, reader, contentType, uint64(contentLength)); err != nil {
 				log.Printf("Backend storage error: %s", err.Error())
-				http.Error(w, err.Error(), 500)
+				storageError(w, err, "Could not save file")
+
+				s.abortUpload(token, filename)
+				s.releaseQuota(r, contentLength)
+				s.releasePresign(r)
+				s.releaseDropbox(r, filename)
+				cleanTmpFile(file)
 				return
+			}
+
+			uploadSize.observe(float64(contentLength))
 
+			if !restricted {
+				setRestrictionHeaders(w, metadata)
+				restricted = true
+			}
+
+			// only the owner of a drop box can download its files
+			if inDropbox {
+				fmt.Fprintln(w, filename)
+				cleanTmpFile(file)
+				continue
 			}
 
 			filename = url.PathEscape(filename)
 			relativeURL, _ := url.Parse(path.Join(s.proxyPath, token, filename))
+			deleteURL, _ := url.Parse(path.Join(s.proxyPath, token, filename, metadata.DeletionToken))
+			s.completePresign(r, getURL(r, s.proxyPort).ResolveReference(relativeURL).String(), getURL(r, s.proxyPort).ResolveReference(deleteURL).String())
+
 			fmt.Fprintln(w, getURL(r, s.proxyPort).ResolveReference(relativeURL).String())
 
 			cleanTmpFile(file)
@@ -398,6 +649,55 @@ func (s *Server) postHandler(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// storageError writes the response of a failed storage operation, message is
+// the body of errors other than an unavailable or timed out provider
+func storageError(w http.ResponseWriter, err error, message string) {
+	if errors.Is(err, ErrCircuitOpen) {
+		http.Error(w, ErrCircuitOpen.Error(), http.StatusServiceUnavailable)
+	} else if errors.Is(err, context.DeadlineExceeded) {
+		http.Error(w, "storage backend timed out", http.StatusGatewayTimeout)
+	} else {
+		http.Error(w, message, http.StatusInternalServerError)
+	}
+}
+
+// metadataError writes the response of an error reading the metadata of a
+// file, missing files and files that can't be downloaded anymore are not found
+func (s *Server) metadataError(w http.ResponseWriter, err error) {
+	log.Printf("Error metadata: %s", err.Error())
+
+	if err == errBlocked || err == errMaxDownloads || err == errMaxDate || s.metadataStorage.IsNotExist(err) {
+		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+	} else {
+		storageError(w, err, "Could not retrieve metadata.")
+	}
+}
+
+// abortUpload removes the metadata and any partially written data of a
+// failed upload, using a new context as the request may have been canceled
+func (s *Server) abortUpload(token, filename string) {
+	ctx, cancel := context.WithTimeout(context.Background(), abortUploadTimeout)
+	defer cancel()
+
+	if err := s.storage.Delete(ctx, token, filename); err != nil && !s.storage.IsNotExist(err) {
+		log.Printf("Error removing aborted upload %s/%s: %s", token, filename, err.Error())
+	}
+
+	if err := s.metadataStorage.Delete(ctx, token, fmt.Sprintf("%s.metadata", filename)); err != nil && !s.metadataStorage.IsNotExist(err) {
+		log.Printf("Error removing metadata of aborted upload %s/%s: %s", token, filename, err.Error())
+	}
+}
+
+// logUpload logs an upload along with the authenticated user
+func logUpload(r *http.Request, token, filename string, contentLength int64, contentType string) {
+	if identity, ok := IdentityFromContext(r.Context()); ok {
+		log.Printf("Uploading %s %s %d %s by %s", token, filename, contentLength, contentType, identity.User)
+		return
+	}
+
+	log.Printf("Uploading %s %s %d %s", token, filename, contentLength, contentType)
+}
+
 func cleanTmpFile(f *os.File) {
 	if f != nil {
 		err := f.Close()
@@ -418,9 +718,15 @@ func MetadataForRequest(contentType string, r *http.Request) Metadata {
 		MaxDate:       time.Time{},
 		Downloads:     0,
 		MaxDownloads:  -1,
+		Created:       time.Now().UTC(),
 		DeletionToken: Encode(10000000+int64(rand.Intn(1000000000))) + Encode(10000000+int64(rand.Intn(1000000000))),
 	}
 
+	if identity, ok := IdentityFromContext(r.Context()); !ok {
+	} else if metadata.Owner = identity.User; identity.Key != nil {
+		metadata.Namespace = identity.Key.Namespace
+	}
+
 	if v := r.Header.Get("Max-Downloads"); v == "" {
 	} else if v, err := strconv.Atoi(v); err != nil {
 	} else {
@@ -441,6 +747,12 @@ func (s *Server) putHandler(w http.ResponseWriter, r *http.Request) {
 
 	filename := sanitize(vars["filename"])
 
+	params, err := getUploadHeaderParams(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
 	contentLength := r.ContentLength
 
 	var reader io.Reader
@@ -451,7 +763,6 @@ func (s *Server) putHandler(w http.ResponseWriter, r *http.Request) {
 
 	if contentLength == -1 {
 		// queue file to disk, because s3 needs content length
-		var err error
 		var f io.Reader
 
 		f = reader
@@ -507,28 +818,53 @@ func (s *Server) putHandler(w http.ResponseWriter, r *http.Request) {
 	token := Encode(10000000 + int64(rand.Intn(1000000000)))
 
 	metadata := MetadataForRequest(contentType, r)
+	if err := params.apply(&metadata); err != nil {
+		log.Printf("%s", err.Error())
+		http.Error(w, errors.New("Could not encode metadata").Error(), 500)
+		return
+	}
+
+	if presign, ok := presignFromContext(r.Context()); ok {
+		presign.apply(&metadata)
+	}
+
+	if !s.reservePresign(w, r, filename, contentLength) {
+		return
+	}
+
+	if !s.reserveQuota(w, r, contentLength) {
+		s.releasePresign(r)
+		return
+	}
 
 	buffer := &bytes.Buffer{}
 	if err := json.NewEncoder(buffer).Encode(metadata); err != nil {
 		log.Printf("%s", err.Error())
 		http.Error(w, errors.New("Could not encode metadata").Error(), 500)
 		return
-	} else if err := s.metadataStorage.Put(token, fmt.Sprintf("%s.metadata", filename), buffer, "text/json", uint64(buffer.Len())); err != nil {
+	} else if err := s.metadataStorage.Put(r.Context(), token, fmt.Sprintf("%s.metadata", filename), buffer, "text/json", uint64(buffer.Len())); err != nil {
 		log.Printf("%s", err.Error())
-		http.Error(w, errors.New("Could not save metadata").Error(), 500)
+		storageError(w, err, "Could not save metadata")
+
+		s.releaseQuota(r, contentLength)
+		s.releasePresign(r)
 		return
 	}
 
-	log.Printf("Uploading %s %s %d %s", token, filename, contentLength, contentType)
-
-	var err error
+	logUpload(r, token, filename, contentLength, contentType)
 
-	if err = s.storage.Put(token, filename, reader, contentType, uint64(contentLength)); err != nil {
+	if err = s.storage.Put(WithMetadata(r.Context(), metadata), token, filename, reader, contentType, uint64(contentLength)); err != nil {
 		log.Printf("Error putting new file: %s", err.Error())
-		http.Error(w, errors.New("Could not save file").Error(), 500)
+		storageError(w, err, "Could not save file")
+
+		s.abortUpload(token, filename)
+		s.releaseQuota(r, contentLength)
+		s.releasePresign(r)
 		return
 	}
 
+	uploadSize.observe(float64(contentLength))
+
 	// w.Statuscode = 200
 
 	w.Header().Set("Content-Type", "text/plain")
@@ -538,6 +874,9 @@ func (s *Server) putHandler(w http.ResponseWriter, r *http.Request) {
 	deleteURL, _ := url.Parse(path.Join(s.proxyPath, token, filename, metadata.DeletionToken))
 
 	w.Header().Set("X-Url-Delete", resolveURL(r, deleteURL, s.proxyPort))
+	setRestrictionHeaders(w, metadata)
+
+	s.completePresign(r, resolveURL(r, relativeURL, s.proxyPort), resolveURL(r, deleteURL, s.proxyPort))
 
 	fmt.Fprint(w, resolveURL(r, relativeURL, s.proxyPort))
 }
@@ -548,6 +887,12 @@ func resolveURL(r *http.Request, u *url.URL, proxyPort string) string {
 	return getURL(r, proxyPort).ResolveReference(u).String()
 }
 
+// isUploadedFile reports whether token and filename name an uploaded file,
+// rather than the metadata of a file or the records of a reserved token
+func isUploadedFile(token, filename string) bool {
+	return !isReservedToken(token) && !strings.HasSuffix(filename, ".metadata")
+}
+
 func resolveKey(key, proxyPath string) string {
 	if strings.HasPrefix(key, "/") {
 		key = key[1:]
@@ -634,72 +979,160 @@ func (metadata Metadata) remainingLimitHeaderValues() (remainingDownloads, remai
 	return remainingDownloads, remainingDays
 }
 
+// fileLock is the metadata lock of a file, waiters counts the requests
+// holding or waiting for it
+type fileLock struct {
+	sync.Mutex
+	waiters int
+}
+
 func (s *Server) Lock(token, filename string) error {
 	key := path.Join(token, filename)
 
-	if _, ok := s.locks[key]; !ok {
-		s.locks[key] = &sync.Mutex{}
+	s.locksMutex.Lock()
+	lock, ok := s.locks[key]
+	if !ok {
+		lock = &fileLock{}
+		s.locks[key] = lock
 	}
+	lock.waiters++
+	s.locksMutex.Unlock()
 
-	s.locks[key].Lock()
+	lock.Lock()
 
 	return nil
 }
 
+// lockMetadata locks the metadata of a file, tracing the wait for the lock
+func (s *Server) lockMetadata(ctx context.Context, token, filename string) {
+	_, span := startSpan(ctx, "metadata.lock", spanKindInternal)
+	s.Lock(token, filename)
+	span.end(nil)
+}
+
+// Unlock releases the metadata lock of a file, the lock is removed when no
+// other request waits for it
 func (s *Server) Unlock(token, filename string) error {
 	key := path.Join(token, filename)
-	s.locks[key].Unlock()
+
+	s.locksMutex.Lock()
+	lock := s.locks[key]
+	lock.waiters--
+	if lock.waiters == 0 {
+		delete(s.locks, key)
+	}
+	s.locksMutex.Unlock()
+
+	lock.Unlock()
 
 	return nil
 }
 
-func (s *Server) CheckMetadata(token, filename string, increaseDownload bool) (Metadata, error) {
-	s.Lock(token, filename)
-	defer s.Unlock(token, filename)
+var (
+	errBlocked      = errors.New("Blocked.")
+	errMaxDownloads = errors.New("MaxDownloads expired.")
+	errMaxDate      = errors.New("MaxDate expired.")
+)
 
-	var metadata Metadata
+func (s *Server) CheckMetadata(ctx context.Context, token, filename string, increaseDownload bool) (Metadata, error) {
+	s.lockMetadata(ctx, token, filename)
+	defer s.Unlock(token, filename)
 
-	r, _, err := s.metadataStorage.Get(token, fmt.Sprintf("%s.metadata", filename))
-	if s.metadataStorage.IsNotExist(err) {
-		return metadata, nil
-	} else if err != nil {
+	metadata, err := s.readMetadata(ctx, token, filename)
+	if err != nil {
 		return metadata, err
 	}
 
-	defer r.Close()
-
-	if err := json.NewDecoder(r).Decode(&metadata); err != nil {
-		return metadata, err
+	if metadata.Blocked {
+		return metadata, errBlocked
 	} else if metadata.MaxDownloads != -1 && metadata.Downloads >= metadata.MaxDownloads {
-		return metadata, errors.New("MaxDownloads expired.")
-	} else if !metadata.MaxDate.IsZero() && time.Now().After(metadata.MaxDate) {
-		return metadata, errors.New("MaxDate expired.")
+		return metadata, errMaxDownloads
+	} else if !metadata.MaxDate.IsZero() && time.Now().After(metadata.MaxDate) && !metadata.Hold {
+		return metadata, errMaxDate
 	} else {
 		// todo(nl5887): mutex?
 
 		// update number of downloads
-		if increaseDownload {
-			metadata.Downloads++
+		if !increaseDownload {
+			return metadata, nil
 		}
 
-		buffer := &bytes.Buffer{}
-		if err := json.NewEncoder(buffer).Encode(metadata); err != nil {
-			return metadata, errors.New("Could not encode metadata")
-		} else if err := s.metadataStorage.Put(token, fmt.Sprintf("%s.metadata", filename), buffer, "text/json", uint64(buffer.Len())); err != nil {
-			return metadata, errors.New("Could not save metadata")
+		metadata.Downloads++
+
+		if err := s.putMetadata(ctx, token, filename, metadata); err != nil {
+			return metadata, err
 		}
 	}
 
 	return metadata, nil
 }
 
-func (s *Server) CheckDeletionToken(deletionToken, token, filename string) error {
-	s.Lock(token, filename)
+// readMetadata reads the stored metadata of a file, the caller holds the file lock
+func (s *Server) readMetadata(ctx context.Context, token, filename string) (metadata Metadata, err error) {
+	ctx, span := startSpan(ctx, "metadata.read", spanKindInternal)
+	defer func() {
+		if s.metadataStorage.IsNotExist(err) {
+			span.end(nil)
+		} else {
+			span.end(err)
+		}
+	}()
+
+	r, _, err := s.metadataStorage.Get(ctx, token, fmt.Sprintf("%s.metadata", filename))
+	if err != nil {
+		return metadata, err
+	}
+
+	defer r.Close()
+
+	if err := json.NewDecoder(r).Decode(&metadata); err != nil {
+		return metadata, err
+	}
+
+	metadata.token = token
+	return metadata, nil
+}
+
+// putMetadata stores the metadata of a file, the caller holds the file lock
+func (s *Server) putMetadata(ctx context.Context, token, filename string, metadata Metadata) (err error) {
+	ctx, span := startSpan(ctx, "metadata.write", spanKindInternal)
+	defer func() { span.end(err) }()
+
+	buffer := &bytes.Buffer{}
+	if err := json.NewEncoder(buffer).Encode(metadata); err != nil {
+		return errors.New("Could not encode metadata")
+	} else if err := s.metadataStorage.Put(ctx, token, fmt.Sprintf("%s.metadata", filename), buffer, "text/json", uint64(buffer.Len())); err != nil {
+		return fmt.Errorf("Could not save metadata: %w", err)
+	}
+
+	return nil
+}
+
+// updateMetadata applies fn to the stored metadata of a file and stores the
+// result, the metadata isn't stored when fn returns an error
+func (s *Server) updateMetadata(ctx context.Context, token, filename string, fn func(*Metadata) error) (Metadata, error) {
+	s.lockMetadata(ctx, token, filename)
+	defer s.Unlock(token, filename)
+
+	metadata, err := s.readMetadata(ctx, token, filename)
+	if err != nil {
+		return metadata, err
+	}
+
+	if err := fn(&metadata); err != nil {
+		return metadata, err
+	}
+
+	return metadata, s.putMetadata(ctx, token, filename, metadata)
+}
+
+func (s *Server) CheckDeletionToken(ctx context.Context, deletionToken, token, filename string) error {
+	s.lockMetadata(ctx, token, filename)
 	defer s.Unlock(token, filename)
 
 	var metadata Metadata
 
-	r, _, err := s.metadataStorage.Get(token, fmt.Sprintf("%s.metadata", filename))
+	r, _, err := s.metadataStorage.Get(ctx, token, fmt.Sprintf("%s.metadata", filename))
 	if s.storage.IsNotExist(err) {
 		return nil
 	} else if err != nil {
@@ -717,25 +1150,11 @@ func (s *Server) CheckDeletionToken(deletionToken, token, filename string) error
 	return nil
 }
 
-func (s *Server) GetMetadata(token, filename string) (Metadata, error) {
-	s.Lock(token, filename)
+func (s *Server) GetMetadata(ctx context.Context, token, filename string) (Metadata, error) {
+	s.lockMetadata(ctx, token, filename)
 	defer s.Unlock(token, filename)
 
-	var metadata Metadata
-
-	r, _, err := s.metadataStorage.Get(token, fmt.Sprintf("%s.metadata", filename))
-	if s.metadataStorage.IsNotExist(err) {
-		return metadata, fmt.Errorf("failed to find metadata from file %s", filename)
-	} else if err != nil {
-		return metadata, err
-	}
-
-	defer r.Close()
-
-	if err := json.NewDecoder(r).Decode(&metadata); err != nil {
-		return metadata, err
-	}
-	return metadata, nil
+	return s.readMetadata(ctx, token, filename)
 }
 
 func (s *Server) deleteHandler(w http.ResponseWriter, r *http.Request) {
@@ -745,14 +1164,27 @@ func (s *Server) deleteHandler(w http.ResponseWriter, r *http.Request) {
 	filename := vars["filename"]
 	deletionToken := vars["deletionToken"]
 
-	if err := s.CheckDeletionToken(deletionToken, token, filename); err != nil {
+	if deletionToken == "" {
+		// without the deletion token only the owner of the file or an API
+		// key with the delete-any scope may delete it
+		if key, err := s.requestAPIKey(r); err == nil && key.HasScope(ScopeDeleteAny) {
+			if !s.authorizeDeleteAny(w, r, token, filename) {
+				return
+			}
+		} else if !s.authorizeOwner(w, r, token, filename) {
+			return
+		}
+	} else if err := s.CheckDeletionToken(r.Context(), deletionToken, token, filename); err != nil {
 		log.Printf("Error metadata: %s", err.Error())
 		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
 		return
 	}
 
-	err := s.storage.Delete(token, filename)
-	err = s.metadataStorage.Delete(token, filename+".metadata")
+	if !s.checkHold(w, r, token, filename) {
+		return
+	}
+
+	err := s.deleteFile(r.Context(), token, filename)
 	if s.storage.IsNotExist(err) {
 		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
 		return
@@ -763,10 +1195,25 @@ func (s *Server) deleteHandler(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-func (s *Server) zipHandler(w http.ResponseWriter, r *http.Request) {
-	vars := mux.Vars(r)
+// deleteFile deletes a file and its metadata
+func (s *Server) deleteFile(ctx context.Context, token, filename string) error {
+	if err := s.storage.Delete(ctx, token, filename); err != nil {
+		return err
+	}
+
+	// local storage removes the metadata along with the file
+	if err := s.metadataStorage.Delete(ctx, token, filename+".metadata"); err != nil && !s.metadataStorage.IsNotExist(err) {
+		log.Printf("Error removing metadata of %s/%s: %s", token, filename, err.Error())
+	}
 
-	files := vars["files"]
+	return nil
+}
+
+func (s *Server) zipHandler(w http.ResponseWriter, r *http.Request) {
+	files, ok := s.authorizeArchive(w, r)
+	if !ok {
+		return
+	}
 
 	zipfilename := fmt.Sprintf("transfersh-%d.zip", uint16(time.Now().UnixNano()))
 
@@ -776,34 +1223,25 @@ func (s *Server) zipHandler(w http.ResponseWriter, r *http.Request) {
 
 	zw := zip.NewWriter(w)
 
-	for _, key := range strings.Split(files, ",") {
-		key = resolveKey(key, s.proxyPath)
-
-		token := strings.Split(key, "/")[0]
-		filename := sanitize(strings.Split(key, "/")[1])
+	for _, file := range files {
+		token := file.token
+		filename := file.filename
 
-		if _, err := s.CheckMetadata(token, filename, true); err != nil {
+		if _, err := s.CheckMetadata(r.Context(), token, filename, true); err != nil {
 			log.Printf("Error metadata: %s", err.Error())
 			continue
 		}
 
-		reader, _, err := s.storage.Get(token, filename)
-
+		reader, _, err := s.openFile(r, token, filename)
 		if err != nil {
-			if s.storage.IsNotExist(err) {
-				http.Error(w, "File not found", 404)
-				return
-			} else {
-				log.Printf("%s", err.Error())
-				http.Error(w, "Could not retrieve file.", 500)
-				return
-			}
+			s.openFileError(w, err)
+			return
 		}
 
 		defer reader.Close()
 
 		header := &zip.FileHeader{
-			Name:         strings.Split(key, "/")[1],
+			Name:         filename,
 			Method:       zip.Store,
 			ModifiedTime: uint16(time.Now().UnixNano()),
 			ModifiedDate: uint16(time.Now().UnixNano()),
@@ -832,9 +1270,10 @@ func (s *Server) zipHandler(w http.ResponseWriter, r *http.Request) {
 }
 
 func (s *Server) tarGzHandler(w http.ResponseWriter, r *http.Request) {
-	vars := mux.Vars(r)
-
-	files := vars["files"]
+	files, ok := s.authorizeArchive(w, r)
+	if !ok {
+		return
+	}
 
 	tarfilename := fmt.Sprintf("transfersh-%d.tar.gz", uint16(time.Now().UnixNano()))
 
@@ -848,33 +1287,25 @@ func (s *Server) tarGzHandler(w http.ResponseWriter, r *http.Request) {
 	zw := tar.NewWriter(os)
 	defer zw.Close()
 
-	for _, key := range strings.Split(files, ",") {
-		key = resolveKey(key, s.proxyPath)
+	for _, file := range files {
+		token := file.token
+		filename := file.filename
 
-		token := strings.Split(key, "/")[0]
-		filename := sanitize(strings.Split(key, "/")[1])
-
-		if _, err := s.CheckMetadata(token, filename, true); err != nil {
+		if _, err := s.CheckMetadata(r.Context(), token, filename, true); err != nil {
 			log.Printf("Error metadata: %s", err.Error())
 			continue
 		}
 
-		reader, contentLength, err := s.storage.Get(token, filename)
+		reader, contentLength, err := s.openFile(r, token, filename)
 		if err != nil {
-			if s.storage.IsNotExist(err) {
-				http.Error(w, "File not found", 404)
-				return
-			} else {
-				log.Printf("%s", err.Error())
-				http.Error(w, "Could not retrieve file.", 500)
-				return
-			}
+			s.openFileError(w, err)
+			return
 		}
 
 		defer reader.Close()
 
 		header := &tar.Header{
-			Name: strings.Split(key, "/")[1],
+			Name: filename,
 			Size: int64(contentLength),
 		}
 
@@ -894,9 +1325,10 @@ func (s *Server) tarGzHandler(w http.ResponseWriter, r *http.Request) {
 }
 
 func (s *Server) tarHandler(w http.ResponseWriter, r *http.Request) {
-	vars := mux.Vars(r)
-
-	files := vars["files"]
+	files, ok := s.authorizeArchive(w, r)
+	if !ok {
+		return
+	}
 
 	tarfilename := fmt.Sprintf("transfersh-%d.tar", uint16(time.Now().UnixNano()))
 
@@ -907,33 +1339,25 @@ func (s *Server) tarHandler(w http.ResponseWriter, r *http.Request) {
 	zw := tar.NewWriter(w)
 	defer zw.Close()
 
-	for _, key := range strings.Split(files, ",") {
-		key = resolveKey(key, s.proxyPath)
+	for _, file := range files {
+		token := file.token
+		filename := file.filename
 
-		token := strings.Split(key, "/")[0]
-		filename := strings.Split(key, "/")[1]
-
-		if _, err := s.CheckMetadata(token, filename, true); err != nil {
+		if _, err := s.CheckMetadata(r.Context(), token, filename, true); err != nil {
 			log.Printf("Error metadata: %s", err.Error())
 			continue
 		}
 
-		reader, contentLength, err := s.storage.Get(token, filename)
+		reader, contentLength, err := s.openFile(r, token, filename)
 		if err != nil {
-			if s.storage.IsNotExist(err) {
-				http.Error(w, "File not found", 404)
-				return
-			} else {
-				log.Printf("%s", err.Error())
-				http.Error(w, "Could not retrieve file.", 500)
-				return
-			}
+			s.openFileError(w, err)
+			return
 		}
 
 		defer reader.Close()
 
 		header := &tar.Header{
-			Name: strings.Split(key, "/")[1],
+			Name: filename,
 			Size: int64(contentLength),
 		}
 
@@ -958,16 +1382,15 @@ func (s *Server) headHandler(w http.ResponseWriter, r *http.Request) {
 	token := vars["token"]
 	filename := vars["filename"]
 
-	metadata, err := s.CheckMetadata(token, filename, false)
+	metadata, err := s.CheckMetadata(r.Context(), token, filename, false)
 
 	if err != nil {
-		log.Printf("Error metadata: %s", err.Error())
-		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		s.metadataError(w, err)
 		return
 	}
 
 	contentType := metadata.ContentType
-	contentLength, err := s.storage.Head(token, filename)
+	contentLength, err := s.storage.Head(r.Context(), token, filename)
 	if s.storage.IsNotExist(err) {
 		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
 		return
@@ -993,22 +1416,17 @@ func (s *Server) getHandler(w http.ResponseWriter, r *http.Request) {
 	token := vars["token"]
 	filename := vars["filename"]
 
-	metadata, err := s.CheckMetadata(token, filename, true)
+	metadata, err := s.CheckMetadata(r.Context(), token, filename, true)
 
 	if err != nil {
-		log.Printf("Error metadata: %s", err.Error())
-		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		s.metadataError(w, err)
 		return
 	}
 
 	contentType := metadata.ContentType
-	reader, contentLength, err := s.storage.Get(token, filename)
-	if s.storage.IsNotExist(err) {
-		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
-		return
-	} else if err != nil {
-		log.Printf("%s", err.Error())
-		http.Error(w, "Could not retrieve file.", 500)
+	reader, contentLength, err := s.openFile(r, token, filename)
+	if err != nil {
+		s.openFileError(w, err)
 		return
 	}
 
@@ -1113,91 +1531,70 @@ func IPFilterHandler(h http.Handler, ipFilterOptions *IPFilterOptions) http.Hand
 
 func (s *Server) BasicAuthHandler(h http.Handler) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		authenticator, ok := s.auths[ServerAuthKey]
-		if !ok {
-			h.ServeHTTP(w, r)
+		if r.URL.Query().Get("presign") != "" {
+			if req, ok := s.presignAuthorize(w, r); ok {
+				h.ServeHTTP(w, req)
+			}
+
 			return
 		}
 
-		w.Header().Set("WWW-Authenticate", "Basic realm=\"Restricted\"")
+		if policyAuthorized(r.Context()) {
+			if identity, ok := IdentityFromContext(r.Context()); ok && !identity.HasScope(ScopeUpload) {
+				http.Error(w, "not allowed to upload", http.StatusForbidden)
+				return
+			}
 
-		username, password, authOK := r.BasicAuth()
-		if authOK == false {
-			http.Error(w, "Not authorized", 401)
+			h.ServeHTTP(w, r)
 			return
 		}
 
-		if ok, err := authenticator.Authenticate(username, password); !ok || err != nil {
-			http.Error(w, "Not authorized", 401)
+		if key, err := s.requestAPIKey(r); err == errNoAPIKey {
+		} else if err != nil {
+			apiKeyError(w, err)
+			return
+		} else if !key.HasScope(ScopeUpload) {
+			http.Error(w, "api key not allowed to upload", http.StatusForbidden)
+			return
+		} else if key.Quota > 0 && key.Used >= key.Quota {
+			http.Error(w, errQuotaExceeded.Error(), http.StatusForbidden)
+			return
+		} else {
+			h.ServeHTTP(w, r.WithContext(WithIdentity(r.Context(), keyIdentity(key))))
 			return
 		}
 
-		h.ServeHTTP(w, r)
-	}
-}
-
-func (s *Server) AssignMetadata(h http.Handler) http.HandlerFunc {
-	return func(w http.ResponseWriter, r *http.Request) {
-		vars := mux.Vars(r)
-		token := vars["token"]
-		filename := vars["filename"]
-
-		metadata, err := s.GetMetadata(token, filename)
-		if err != nil {
-			errMsg := fmt.Sprintf("failed to get metadata: %s", err.Error())
-			http.Error(w, errMsg, http.StatusBadRequest)
+		authenticator, basicOK := s.auths[ServerAuthKey]
+		tokenAuthenticator, tokenOK := s.tokenAuths[ServerAuthKey]
+		if !basicOK && !tokenOK && !s.certificateUploads {
+			h.ServeHTTP(w, r)
 			return
 		}
-		req := r.WithContext(context.WithValue(r.Context(), metadataContextKey{}, metadata))
-		h.ServeHTTP(w, req)
-	}
-}
 
-func MetadataAllowedIP(h http.Handler) http.HandlerFunc {
-	return func(w http.ResponseWriter, r *http.Request) {
-		v := r.Context().Value(metadataContextKey{})
-		if metadata, ok := v.(Metadata); !ok {
-			http.Error(w, "failed to get metadata", http.StatusBadRequest)
+		if user := s.certificateUser(r); user != "" && s.certificateUploads {
+			h.ServeHTTP(w, r.WithContext(WithIdentity(r.Context(), certificateIdentity(user))))
 			return
-		} else {
-			if !metadata.AllowedIP(r.RemoteAddr) {
-				w.WriteHeader(http.StatusUnauthorized)
-				return
-			}
 		}
-		h.ServeHTTP(w, r)
-	}
-}
 
-func (s *Server) MetadataBasicAuth(h http.Handler) http.HandlerFunc {
-	return func(w http.ResponseWriter, r *http.Request) {
-		v := r.Context().Value(metadataContextKey{})
-		metadata, ok := v.(Metadata)
-		if !ok {
-			http.Error(w, "failed to get metadata", http.StatusBadRequest)
+		if !basicOK && !tokenOK {
+			http.Error(w, "Client certificate required", 401)
 			return
 		}
-		if !metadata.AuthRequired() {
-			h.ServeHTTP(w, r)
-		}
 
-		vars := mux.Vars(r)
-		token := vars["token"]
-
-		var basicAuth Authenticator
-		for _, authType := range metadata.AuthTypes {
-			switch authType {
-			case API:
-				authenticator, ok := s.auths[string(API)]
-				if !ok {
-					http.Error(w, "the api authenticator does not set up", http.StatusInternalServerError)
-					return
-				}
-				basicAuth = authenticator
-			case METADATA:
-				basicAuth = &metadata
-			default:
+		if token := bearerToken(r); token != "" && tokenOK {
+			user, ok := authenticateToken([]TokenAuthenticator{tokenAuthenticator}, token)
+			if !ok {
+				w.Header().Set("WWW-Authenticate", "Bearer error=\"invalid_token\"")
+				http.Error(w, "Not authorized", 401)
+				return
 			}
+
+			h.ServeHTTP(w, r.WithContext(WithIdentity(r.Context(), Identity{User: user})))
+			return
+		} else if !basicOK {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, "Not authorized", 401)
+			return
 		}
 
 		w.Header().Set("WWW-Authenticate", "Basic realm=\"Restricted\"")
@@ -1207,22 +1604,30 @@ func (s *Server) MetadataBasicAuth(h http.Handler) http.HandlerFunc {
 			http.Error(w, "Not authorized", 401)
 			return
 		}
-		ok, err := basicAuth.Authenticate(username, cryptoPwd(password, token))
-		if err != nil {
+
+		identity, ok, err := authenticate(r.Context(), authenticator, username, password)
+		if !ok && isUnavailable(err) {
 			log.Printf("Error checkAuth: %s", err.Error())
+			w.Header().Del("WWW-Authenticate")
+			http.Error(w, "Authentication service unavailable", http.StatusServiceUnavailable)
+			return
+		} else if !ok {
+			http.Error(w, "Not authorized", 401)
+			return
 		}
-		if !ok {
-			http.Error(w, "Not authorized", http.StatusUnauthorized)
+
+		w.Header().Del("WWW-Authenticate")
+
+		if !identity.HasScope(ScopeUpload) {
+			http.Error(w, "not allowed to upload", http.StatusForbidden)
+			return
+		} else if identity.Quota > 0 && r.ContentLength > identity.Quota {
+			http.Error(w, errQuotaExceeded.Error(), http.StatusForbidden)
 			return
 		}
-		h.ServeHTTP(w, r)
-	}
-}
 
-func cryptoPwd(password, token string) string {
-	mac := hmac.New(sha256.New, []byte(token))
-	mac.Write([]byte(password))
-	return hex.EncodeToString(mac.Sum(nil))
+		h.ServeHTTP(w, r.WithContext(WithIdentity(r.Context(), identity)))
+	}
 }
 
 func parseIPString(ipsStr string) ([]net.IP, []*net.IPNet, error) {
@@ -1235,6 +1640,8 @@ func parseIPString(ipsStr string) ([]net.IP, []*net.IPNet, error) {
 	}
 
 	for _, ip := range ips {
+		ip = strings.TrimSpace(ip)
+
 		if parsedIP := net.ParseIP(ip); parsedIP != nil {
 			ipArray = append(ipArray, parsedIP)
 			continue
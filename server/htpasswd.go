@@ -0,0 +1,231 @@
+package server
+
+import (
+	"bufio"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// HtpasswdAuthenticator authenticates the users of an htpasswd file with
+// bcrypt, {SHA} or $apr1$ password hashes. The file is reloaded when it
+// changes or when Reload is called.
+type HtpasswdAuthenticator struct {
+	path   string
+	logger *log.Logger
+
+	mutex   sync.RWMutex
+	users   map[string]string
+	modTime time.Time
+	size    int64
+}
+
+func NewHtpasswdAuthenticator(path string, logger *log.Logger) (*HtpasswdAuthenticator, error) {
+	a := &HtpasswdAuthenticator{path: path, logger: logger}
+	if err := a.Reload(); err != nil {
+		return nil, err
+	}
+
+	return a, nil
+}
+
+// Reload reads the htpasswd file, the users loaded before are kept when the
+// file can't be read
+func (a *HtpasswdAuthenticator) Reload() error {
+	f, err := os.Open(a.path)
+	if err != nil {
+		return err
+	}
+
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	users := map[string]string{}
+
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		entry := strings.TrimSpace(scanner.Text())
+		if entry == "" || strings.HasPrefix(entry, "#") {
+			continue
+		}
+
+		parts := strings.SplitN(entry, ":", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return fmt.Errorf("%s:%d: invalid entry", a.path, line)
+		}
+
+		users[parts[0]] = parts[1]
+	}
+
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	a.users = users
+	a.modTime = fi.ModTime()
+	a.size = fi.Size()
+
+	return nil
+}
+
+// reloadIfChanged reloads the file when its modification time or size changed
+func (a *HtpasswdAuthenticator) reloadIfChanged() {
+	fi, err := os.Stat(a.path)
+	if err != nil {
+		return
+	}
+
+	a.mutex.RLock()
+	changed := !fi.ModTime().Equal(a.modTime) || fi.Size() != a.size
+	a.mutex.RUnlock()
+
+	if !changed {
+		return
+	}
+
+	if err := a.Reload(); err != nil {
+		a.logger.Printf("Error reloading %s: %s", a.path, err.Error())
+	} else {
+		a.logger.Printf("Reloaded %s", a.path)
+	}
+}
+
+func (a *HtpasswdAuthenticator) Authenticate(user, password string) (bool, error) {
+	a.reloadIfChanged()
+
+	a.mutex.RLock()
+	hash, ok := a.users[user]
+	a.mutex.RUnlock()
+
+	if !ok {
+		return false, nil
+	}
+
+	return verifyHtpasswd(hash, password)
+}
+
+// verifyHtpasswd reports whether password matches an htpasswd hash
+func verifyHtpasswd(hash, password string) (bool, error) {
+	switch {
+	case strings.HasPrefix(hash, "$2a$"), strings.HasPrefix(hash, "$2b$"), strings.HasPrefix(hash, "$2y$"):
+		err := bcrypt.CompareHashAndPassword([]byte(hash), []byte(password))
+		if err == bcrypt.ErrMismatchedHashAndPassword {
+			return false, nil
+		}
+
+		return err == nil, err
+	case strings.HasPrefix(hash, "{SHA}"):
+		sum := sha1.Sum([]byte(password))
+		return subtle.ConstantTimeCompare([]byte(hash[5:]), []byte(base64.StdEncoding.EncodeToString(sum[:]))) == 1, nil
+	case strings.HasPrefix(hash, "$apr1$"):
+		parts := strings.SplitN(hash[6:], "$", 2)
+		if len(parts) != 2 {
+			return false, errInvalidHash
+		}
+
+		return subtle.ConstantTimeCompare([]byte(hash), []byte(apr1(password, parts[0]))) == 1, nil
+	default:
+		return false, errInvalidHash
+	}
+}
+
+// apr1 returns the Apache MD5 crypt hash of password
+func apr1(password, salt string) string {
+	const magic = "$apr1$"
+	const itoa64 = "./0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+
+	if len(salt) > 8 {
+		salt = salt[:8]
+	}
+
+	pw := []byte(password)
+
+	alternate := md5.New()
+	alternate.Write(pw)
+	alternate.Write([]byte(salt))
+	alternate.Write(pw)
+	sum := alternate.Sum(nil)
+
+	h := md5.New()
+	h.Write(pw)
+	h.Write([]byte(magic))
+	h.Write([]byte(salt))
+
+	for i := len(pw); i > 0; i -= 16 {
+		if i > 16 {
+			h.Write(sum)
+		} else {
+			h.Write(sum[:i])
+		}
+	}
+
+	for i := len(pw); i > 0; i >>= 1 {
+		if i&1 != 0 {
+			h.Write([]byte{0})
+		} else {
+			h.Write(pw[:1])
+		}
+	}
+
+	sum = h.Sum(nil)
+
+	for i := 0; i < 1000; i++ {
+		h := md5.New()
+
+		if i&1 != 0 {
+			h.Write(pw)
+		} else {
+			h.Write(sum)
+		}
+
+		if i%3 != 0 {
+			h.Write([]byte(salt))
+		}
+
+		if i%7 != 0 {
+			h.Write(pw)
+		}
+
+		if i&1 != 0 {
+			h.Write(sum)
+		} else {
+			h.Write(pw)
+		}
+
+		sum = h.Sum(nil)
+	}
+
+	var out []byte
+	encode := func(a, b, c byte, n int) {
+		v := uint(a)<<16 | uint(b)<<8 | uint(c)
+		for ; n > 0; n-- {
+			out = append(out, itoa64[v&0x3f])
+			v >>= 6
+		}
+	}
+
+	encode(sum[0], sum[6], sum[12], 4)
+	encode(sum[1], sum[7], sum[13], 4)
+	encode(sum[2], sum[8], sum[14], 4)
+	encode(sum[3], sum[9], sum[15], 4)
+	encode(sum[4], sum[10], sum[5], 4)
+	encode(0, 0, sum[11], 2)
+
+	return magic + salt + "$" + string(out)
+}
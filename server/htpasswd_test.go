@@ -0,0 +1,107 @@
+package server
+
+import (
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+	. "gopkg.in/check.v1"
+)
+
+var _ = Suite(&SuiteHtpasswd{})
+
+type SuiteHtpasswd struct {
+	path          string
+	authenticator *HtpasswdAuthenticator
+}
+
+func (s *SuiteHtpasswd) SetUpTest(c *C) {
+	hash, err := bcrypt.GenerateFromPassword([]byte("bcrypt-secret"), bcrypt.MinCost)
+	c.Assert(err, IsNil)
+
+	s.path = filepath.Join(c.MkDir(), "htpasswd")
+	c.Assert(ioutil.WriteFile(s.path, []byte("# users\n"+
+		"bcrypt:"+string(hash)+"\n"+
+		"sha:{SHA}5en6G6MezRroT3XKqkdPOmY/BfQ=\n"+
+		"apr1:$apr1$abcdefgh$h9FWgUz3n9YxylKLlR5SQ/\n"), 0600), IsNil)
+
+	s.authenticator, err = NewHtpasswdAuthenticator(s.path, log.New(ioutil.Discard, "", 0))
+	c.Assert(err, IsNil)
+}
+
+func (s *SuiteHtpasswd) TestAuthenticate(c *C) {
+	for _, test := range []struct {
+		user     string
+		password string
+		ok       bool
+	}{
+		{"bcrypt", "bcrypt-secret", true},
+		{"bcrypt", "secret", false},
+		{"sha", "secret", true},
+		{"sha", "wrong", false},
+		{"apr1", "secret", true},
+		{"apr1", "wrong", false},
+		{"unknown", "secret", false},
+	} {
+		ok, err := s.authenticator.Authenticate(test.user, test.password)
+		c.Assert(err, IsNil)
+		c.Assert(ok, Equals, test.ok, Commentf("%s:%s", test.user, test.password))
+	}
+}
+
+func (s *SuiteHtpasswd) TestReloadOnChange(c *C) {
+	c.Assert(ioutil.WriteFile(s.path, []byte("sha:{SHA}5en6G6MezRroT3XKqkdPOmY/BfQ=\n"), 0600), IsNil)
+
+	// make sure the change is seen on file systems with a coarse mtime
+	later := time.Now().Add(time.Minute)
+	c.Assert(os.Chtimes(s.path, later, later), IsNil)
+
+	ok, err := s.authenticator.Authenticate("apr1", "secret")
+	c.Assert(err, IsNil)
+	c.Assert(ok, Equals, false)
+
+	ok, err = s.authenticator.Authenticate("sha", "secret")
+	c.Assert(err, IsNil)
+	c.Assert(ok, Equals, true)
+}
+
+func (s *SuiteHtpasswd) TestBasicAuthHandler(c *C) {
+	srvr, err := New(AuthCredential(ServerAuthKey, s.authenticator))
+	c.Assert(err, IsNil)
+
+	var identity Identity
+	handler := srvr.BasicAuthHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		identity, _ = IdentityFromContext(r.Context())
+	}))
+
+	req := httptest.NewRequest("PUT", "/file.txt", nil)
+	req.SetBasicAuth("sha", "wrong")
+
+	w := httptest.NewRecorder()
+	handler(w, req)
+	c.Assert(w.Result().StatusCode, Equals, http.StatusUnauthorized)
+
+	req = httptest.NewRequest("PUT", "/file.txt", nil)
+	req.SetBasicAuth("sha", "secret")
+
+	w = httptest.NewRecorder()
+	handler(w, req)
+	c.Assert(w.Result().StatusCode, Equals, http.StatusOK)
+	c.Assert(identity.User, Equals, "sha")
+}
+
+func (s *SuiteHtpasswd) TestDefaultServAuthenticator(c *C) {
+	var authenticator DefaultServAuthenticator
+	authenticator.Set("user", "secret")
+
+	ok, _ := authenticator.Authenticate("user", "wrong")
+	c.Assert(ok, Equals, false)
+
+	ok, _ = authenticator.Authenticate("user", "secret")
+	c.Assert(ok, Equals, true)
+}
@@ -0,0 +1,324 @@
+package server
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// maxLinkRecipients limits the number of links created by one request
+const maxLinkRecipients = 100
+
+var errLinkUnavailable = errors.New("link revoked, expired or used")
+
+// Link is a download link of a file for one recipient, with its own limits.
+// Only the hash of its secret is kept.
+type Link struct {
+	// ID identifies the link when it is listed or revoked
+	ID        string
+	Hash      string `json:",omitempty"`
+	Recipient string
+	Created   time.Time
+	// Expires is zero for links that don't expire
+	Expires      time.Time
+	MaxDownloads int
+	Downloads    int
+	LastDownload time.Time
+	Revoked      bool `json:",omitempty"`
+}
+
+// Valid reports whether the link still grants downloads
+func (l Link) Valid() bool {
+	return !l.Revoked && l.Downloads < l.MaxDownloads && (l.Expires.IsZero() || time.Now().Before(l.Expires))
+}
+
+// LinksRequired reports whether downloads are restricted to recipient links
+func (m *Metadata) LinksRequired() bool {
+	for _, v := range m.AuthTypes {
+		if v == LINK {
+			return true
+		}
+	}
+
+	return false
+}
+
+// link returns the link with id
+func (m *Metadata) link(id string) (*Link, bool) {
+	for i := range m.Links {
+		if m.Links[i].ID == id {
+			return &m.Links[i], true
+		}
+	}
+
+	return nil, false
+}
+
+// linkOf returns the link of secret, the value of the link query parameter
+func (m *Metadata) linkOf(secret string) (*Link, bool) {
+	parts := strings.SplitN(secret, "_", 2)
+	if len(parts) != 2 {
+		return nil, false
+	}
+
+	link, ok := m.link(parts[0])
+	if !ok || subtle.ConstantTimeCompare([]byte(link.Hash), []byte(hashAPIKey(parts[1]))) != 1 {
+		return nil, false
+	}
+
+	return link, true
+}
+
+// checkLink reports whether the request carries a link, and whether it is a
+// valid link of the file
+func checkLink(r *http.Request, metadata Metadata) (present bool, valid bool) {
+	secret := r.URL.Query().Get("link")
+	if secret == "" {
+		return false, false
+	}
+
+	link, ok := metadata.linkOf(secret)
+	return true, ok && link.Valid()
+}
+
+// consumeLink counts a download of a file with the recipient link of the
+// request. The link is checked and counted under the lock of the file, so it
+// serves no more downloads than it allows. It returns errLinkUnavailable when
+// the link was used up in the meantime.
+func (s *Server) consumeLink(r *http.Request, token, filename string) error {
+	secret := r.URL.Query().Get("link")
+	if secret == "" {
+		return nil
+	}
+
+	ctx := r.Context()
+
+	s.lockMetadata(ctx, token, filename)
+	defer s.Unlock(token, filename)
+
+	metadata, err := s.readMetadata(ctx, token, filename)
+	if s.metadataStorage.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	} else if !metadata.LinksRequired() {
+		return nil
+	}
+
+	link, ok := metadata.linkOf(secret)
+	if !ok || !link.Valid() {
+		return errLinkUnavailable
+	}
+
+	link.Downloads++
+	link.LastDownload = time.Now().UTC()
+	return s.putMetadata(ctx, token, filename, metadata)
+}
+
+// openFile opens a stored file to serve it, every route serving file content
+// opens it with openFile. The download is counted with the recipient link of
+// the request only once the file was opened.
+func (s *Server) openFile(r *http.Request, token, filename string) (io.ReadCloser, uint64, error) {
+	reader, contentLength, err := s.storage.Get(r.Context(), token, filename)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	if err := s.consumeLink(r, token, filename); err != nil {
+		reader.Close()
+		return nil, 0, err
+	}
+
+	return reader, contentLength, nil
+}
+
+// openFileError writes the response of an error of openFile
+func (s *Server) openFileError(w http.ResponseWriter, err error) {
+	if s.storage.IsNotExist(err) {
+		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+	} else if err == errLinkUnavailable {
+		http.Error(w, err.Error(), http.StatusForbidden)
+	} else {
+		log.Printf("%s", err.Error())
+		storageError(w, err, "Could not retrieve file.")
+	}
+}
+
+// linkResponse is a link as reported to the uploader, the url of a link is
+// only known when it is created
+type linkResponse struct {
+	Link
+	URL  string `json:",omitempty"`
+	Used bool
+}
+
+// writeLinks writes links, with their urls when secrets holds the secret of
+// each link
+func (s *Server) writeLinks(w http.ResponseWriter, r *http.Request, token, filename string, links []Link, secrets []string) {
+	response := []linkResponse{}
+
+	for i, link := range links {
+		var linkURL string
+		if i < len(secrets) {
+			u, _ := url.Parse(path.Join(s.proxyPath, token, url.PathEscape(filename)))
+			u.RawQuery = url.Values{"link": {secrets[i]}}.Encode()
+			linkURL = resolveURL(r, u, s.proxyPort)
+		}
+
+		link.Hash = ""
+		response = append(response, linkResponse{link, linkURL, link.Downloads >= link.MaxDownloads})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		log.Printf("%s", err.Error())
+	}
+}
+
+// linksHandler lists the recipient links of a file, it is authorized like
+// signHandler
+func (s *Server) linksHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	token := vars["token"]
+	filename := vars["filename"]
+
+	if !s.authorizeSharing(w, r, token, filename) {
+		return
+	}
+
+	metadata, err := s.GetMetadata(r.Context(), token, filename)
+	if err != nil {
+		log.Printf("Error metadata: %s", err.Error())
+		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		return
+	}
+
+	s.writeLinks(w, r, token, filename, metadata.Links, nil)
+}
+
+// createLinksHandler creates a link for each recipient form value, the form
+// values expires and max_downloads set the limits of the links. Once a file
+// has links it is only downloaded with one of them.
+func (s *Server) createLinksHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	token := vars["token"]
+	filename := vars["filename"]
+
+	if !s.authorizeSharing(w, r, token, filename) {
+		return
+	}
+
+	r.ParseForm()
+
+	var recipients []string
+	for _, v := range r.Form["recipient"] {
+		recipients = append(recipients, splitList(v)...)
+	}
+
+	if len(recipients) == 0 || len(recipients) > maxLinkRecipients {
+		http.Error(w, fmt.Sprintf("between 1 and %d recipients are required", maxLinkRecipients), http.StatusBadRequest)
+		return
+	}
+
+	limits := Link{Created: time.Now().UTC(), MaxDownloads: 1}
+
+	if v := r.FormValue("expires"); v == "" {
+	} else if expiry, err := time.ParseDuration(v); err != nil || expiry <= 0 {
+		http.Error(w, fmt.Sprintf("invalid expires: %s", v), http.StatusBadRequest)
+		return
+	} else {
+		limits.Expires = limits.Created.Add(expiry)
+	}
+
+	if v := r.FormValue("max_downloads"); v == "" {
+	} else if n, err := strconv.Atoi(v); err != nil || n < 1 {
+		http.Error(w, fmt.Sprintf("invalid max_downloads: %s", v), http.StatusBadRequest)
+		return
+	} else {
+		limits.MaxDownloads = n
+	}
+
+	var links []Link
+	var secrets []string
+	for _, recipient := range recipients {
+		id, err := randomHex(8)
+		if err != nil {
+			log.Printf("%s", err.Error())
+			http.Error(w, "Could not create links", http.StatusInternalServerError)
+			return
+		}
+
+		secret, err := randomHex(16)
+		if err != nil {
+			log.Printf("%s", err.Error())
+			http.Error(w, "Could not create links", http.StatusInternalServerError)
+			return
+		}
+
+		link := limits
+		link.ID = id
+		link.Hash = hashAPIKey(secret)
+		link.Recipient = recipient
+		links = append(links, link)
+		secrets = append(secrets, id+"_"+secret)
+	}
+
+	if _, err := s.updateMetadata(r.Context(), token, filename, func(metadata *Metadata) error {
+		if !metadata.LinksRequired() {
+			metadata.AuthTypes = append(metadata.AuthTypes, LINK)
+		}
+
+		metadata.Links = append(metadata.Links, links...)
+		return nil
+	}); err != nil {
+		log.Printf("Error metadata: %s", err.Error())
+		http.Error(w, "Could not create links", http.StatusInternalServerError)
+		return
+	}
+
+	s.writeLinks(w, r, token, filename, links, secrets)
+}
+
+// revokeLinkHandler revokes a recipient link of a file
+func (s *Server) revokeLinkHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	token := vars["token"]
+	filename := vars["filename"]
+
+	if !s.authorizeSharing(w, r, token, filename) {
+		return
+	}
+
+	metadata, err := s.updateMetadata(r.Context(), token, filename, func(metadata *Metadata) error {
+		link, ok := metadata.link(vars["id"])
+		if !ok {
+			return errLinkUnavailable
+		}
+
+		link.Revoked = true
+		return nil
+	})
+
+	if err == errLinkUnavailable {
+		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		return
+	} else if err != nil {
+		log.Printf("Error metadata: %s", err.Error())
+		http.Error(w, "Could not revoke link", http.StatusInternalServerError)
+		return
+	}
+
+	link, _ := metadata.link(vars["id"])
+	s.writeLinks(w, r, token, filename, []Link{*link}, nil)
+}
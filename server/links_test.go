@@ -0,0 +1,153 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+
+	"github.com/gorilla/mux"
+	. "gopkg.in/check.v1"
+)
+
+func (s *SuiteAuthorization) links(c *C, method, path, deletionToken string, form url.Values) (int, []linkResponse) {
+	req := httptest.NewRequest(method, path, strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if deletionToken != "" {
+		req.Header.Set("X-Deletion-Token", deletionToken)
+	}
+
+	router := mux.NewRouter()
+	router.HandleFunc("/{token}/{filename}/links", s.server.linksHandler).Methods("GET")
+	router.HandleFunc("/{token}/{filename}/links", s.server.createLinksHandler).Methods("POST")
+	router.HandleFunc("/{token}/{filename}/links/{id}", s.server.revokeLinkHandler).Methods("DELETE")
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+
+	var links []linkResponse
+	if w.Code == http.StatusOK {
+		c.Assert(json.NewDecoder(w.Body).Decode(&links), IsNil)
+	}
+
+	return w.Code, links
+}
+
+func (s *SuiteAuthorization) getFile(c *C, rawurl string) int {
+	u, err := url.Parse(rawurl)
+	c.Assert(err, IsNil)
+
+	router := mux.NewRouter()
+	router.HandleFunc("/{token}/{filename}", s.server.AuthorizeFile(http.HandlerFunc(s.server.getHandler)))
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("GET", u.RequestURI(), nil))
+
+	return w.Code
+}
+
+func (s *SuiteAuthorization) TestLinks(c *C) {
+	s.putFile(c, "shared", Metadata{MaxDownloads: -1, DeletionToken: "deletion"})
+
+	code, _ := s.links(c, "POST", "/shared/file.txt/links", "", url.Values{"recipient": {"alice"}})
+	c.Assert(code, Equals, http.StatusUnauthorized)
+
+	code, _ = s.links(c, "POST", "/shared/file.txt/links", "deletion", nil)
+	c.Assert(code, Equals, http.StatusBadRequest)
+
+	code, links := s.links(c, "POST", "/shared/file.txt/links", "deletion", url.Values{"recipient": {"alice", "bob,carol"}})
+	c.Assert(code, Equals, http.StatusOK)
+	c.Assert(links, HasLen, 3)
+	c.Assert(links[1].Recipient, Equals, "bob")
+	c.Assert(strings.HasPrefix(links[1].URL, "http://example.com/shared/file.txt?link="+links[1].ID+"_"), Equals, true)
+	c.Assert(links[1].Hash, Equals, "")
+
+	// only the hashes of the link secrets are stored
+	metadata, err := s.server.GetMetadata(context.Background(), "shared", "file.txt")
+	c.Assert(err, IsNil)
+	c.Assert(metadata.Links, HasLen, 3)
+	c.Assert(metadata.Links[1].Hash, Equals, hashAPIKey(strings.SplitN(links[1].URL, "_", 2)[1]))
+
+	// the plain link stops working once the file has recipient links
+	c.Assert(s.getFile(c, "http://example.com/shared/file.txt"), Equals, http.StatusUnauthorized)
+
+	c.Assert(s.getFile(c, links[0].URL), Equals, http.StatusOK)
+	c.Assert(s.getFile(c, links[0].URL), Equals, http.StatusForbidden)
+	c.Assert(s.getFile(c, "http://example.com/shared/file.txt?link=unknown"), Equals, http.StatusForbidden)
+	c.Assert(s.getFile(c, "http://example.com/shared/file.txt?link="+links[2].ID), Equals, http.StatusForbidden)
+	c.Assert(s.getFile(c, "http://example.com/shared/file.txt?link="+links[2].ID+"_"+strings.Repeat("0", 32)), Equals, http.StatusForbidden)
+
+	code, _ = s.links(c, "DELETE", "/shared/file.txt/links/"+links[1].ID, "deletion", nil)
+	c.Assert(code, Equals, http.StatusOK)
+	c.Assert(s.getFile(c, links[1].URL), Equals, http.StatusForbidden)
+
+	code, _ = s.links(c, "DELETE", "/shared/file.txt/links/unknown", "deletion", nil)
+	c.Assert(code, Equals, http.StatusNotFound)
+
+	code, listed := s.links(c, "GET", "/shared/file.txt/links", "deletion", nil)
+	c.Assert(code, Equals, http.StatusOK)
+	c.Assert(listed, HasLen, 3)
+	c.Assert(listed[0].Used, Equals, true)
+	c.Assert(listed[0].LastDownload.IsZero(), Equals, false)
+	c.Assert(listed[1].Revoked, Equals, true)
+	c.Assert(listed[2].Used, Equals, false)
+	c.Assert(listed[2].URL, Equals, "")
+	c.Assert(listed[2].Hash, Equals, "")
+}
+
+func (s *SuiteAuthorization) TestLinkLimits(c *C) {
+	s.putFile(c, "shared", Metadata{MaxDownloads: -1, DeletionToken: "deletion"})
+
+	code, _ := s.links(c, "POST", "/shared/file.txt/links", "deletion", url.Values{"recipient": {"alice"}, "max_downloads": {"0"}})
+	c.Assert(code, Equals, http.StatusBadRequest)
+
+	_, links := s.links(c, "POST", "/shared/file.txt/links", "deletion", url.Values{"recipient": {"alice"}, "max_downloads": {"2"}})
+	c.Assert(s.getFile(c, links[0].URL), Equals, http.StatusOK)
+	c.Assert(s.getFile(c, links[0].URL), Equals, http.StatusOK)
+	c.Assert(s.getFile(c, links[0].URL), Equals, http.StatusForbidden)
+
+	_, links = s.links(c, "POST", "/shared/file.txt/links", "deletion", url.Values{"recipient": {"bob"}, "expires": {"1ns"}})
+	c.Assert(s.getFile(c, links[0].URL), Equals, http.StatusForbidden)
+}
+
+// failingGetStorage fails to open the stored files
+type failingGetStorage struct {
+	Storage
+}
+
+func (s failingGetStorage) Get(ctx context.Context, token string, filename string) (io.ReadCloser, uint64, error) {
+	return nil, 0, errFlaky
+}
+
+func (s *SuiteAuthorization) getArchive(c *C, rawurl string) int {
+	u, err := url.Parse(rawurl)
+	c.Assert(err, IsNil)
+
+	router := mux.NewRouter()
+	router.HandleFunc("/({files:.*}).zip", s.server.zipHandler)
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("GET", u.RequestURI(), nil))
+
+	return w.Code
+}
+
+func (s *SuiteAuthorization) TestLinkUse(c *C) {
+	s.putFile(c, "shared", Metadata{MaxDownloads: -1, DeletionToken: "deletion"})
+	_, links := s.links(c, "POST", "/shared/file.txt/links", "deletion", url.Values{"recipient": {"alice"}})
+	c.Assert(links, HasLen, 1)
+
+	// a failed download doesn't use up the link
+	storage := s.server.storage
+	s.server.storage = failingGetStorage{storage}
+	c.Assert(s.getFile(c, links[0].URL), Equals, http.StatusInternalServerError)
+	s.server.storage = storage
+
+	// archives count the link like downloads
+	c.Assert(s.getArchive(c, "http://example.com/(shared/file.txt).zip?"+strings.SplitN(links[0].URL, "?", 2)[1]), Equals, http.StatusOK)
+	c.Assert(s.getArchive(c, "http://example.com/(shared/file.txt).zip?"+strings.SplitN(links[0].URL, "?", 2)[1]), Equals, http.StatusForbidden)
+	c.Assert(s.getFile(c, links[0].URL), Equals, http.StatusForbidden)
+}
@@ -1,6 +1,7 @@
 package server
 
 import (
+	"crypto/subtle"
 	"net"
 	"time"
 )
@@ -11,6 +12,11 @@ const (
 	IP       AuthType = "IP"
 	METADATA AuthType = "METADATA"
 	API      AuthType = "API"
+	JWT      AuthType = "JWT"
+	CERT     AuthType = "CERT"
+	SIGNED   AuthType = "SIGNED"
+	OWNER    AuthType = "OWNER"
+	LINK     AuthType = "LINK"
 )
 
 type Metadata struct {
@@ -30,19 +36,40 @@ type Metadata struct {
 	AuthTypes []AuthType
 	// Basic Auth for downloading
 	User string
-	// Basic Auth for downloading
+	// Basic Auth for downloading, the password hash in the PHC string format
+	// ($argon2id$...) or a legacy HMAC-SHA256 keyed by the token
 	Password string
 	// IP filter
 	IP []net.IP
 	// Network filter
 	Nets []*net.IPNet
+	// Users of the client certificates allowed to download
+	CertificateUsers []string `json:",omitempty"`
+	// Namespace of the API key the file was uploaded with
+	Namespace string `json:",omitempty"`
+	// Owner is the user who uploaded the file, or the user of the drop box
+	// it was uploaded to
+	Owner string `json:",omitempty"`
+	// Links are the download links of recipients
+	Links []Link `json:",omitempty"`
+	// Created is the time of the upload, it is zero for files uploaded
+	// before it was recorded
+	Created time.Time
+	// Blocked files were taken down by an admin and are not served
+	Blocked bool `json:",omitempty"`
+	// Hold pins the file past its Max-Days and keeps it from being deleted
+	Hold bool `json:",omitempty"`
+
+	// token of the file, needed to verify legacy password hashes
+	token string
 }
 
 func (m *Metadata) Authenticate(user, password string) (bool, error) {
-	if user == m.User && m.Password == password {
-		return true, nil
+	if subtle.ConstantTimeCompare([]byte(user), []byte(m.User)) != 1 {
+		return false, nil
 	}
-	return false, nil
+
+	return verifyPassword(m.Password, password, m.token)
 }
 
 func (m *Metadata) AuthRequired() bool {
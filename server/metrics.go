@@ -0,0 +1,394 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// durationBuckets are the histogram buckets of request and storage latencies
+var durationBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10, 30, 60}
+
+// sizeBuckets are the histogram buckets of upload sizes, from 1KiB to 8GiB
+var sizeBuckets = []float64{1 << 10, 1 << 16, 1 << 20, 1 << 24, 1 << 27, 1 << 30, 1 << 33}
+
+var metrics = &metricsRegistry{}
+
+var (
+	requestsTotal = metrics.counter("transfersh_http_requests_total",
+		"Number of http requests by route, method and status code.", "route", "method", "code")
+	requestDuration = metrics.histogram("transfersh_http_request_duration_seconds",
+		"Duration of http requests by route.", durationBuckets, "route")
+	uploadedBytes = metrics.counter("transfersh_uploaded_bytes_total",
+		"Bytes received by upload requests.")
+	downloadedBytes = metrics.counter("transfersh_downloaded_bytes_total",
+		"Bytes sent by download and archive requests.")
+	uploadSize = metrics.histogram("transfersh_upload_size_bytes",
+		"Size of the stored uploads.", sizeBuckets)
+	transfersInFlight = metrics.gauge("transfersh_transfers_in_flight",
+		"Number of uploads and downloads in progress.", "direction")
+	storageDuration = metrics.histogram("transfersh_storage_operation_duration_seconds",
+		"Duration of storage operations by provider and operation.", durationBuckets, "provider", "operation")
+	storageErrors = metrics.counter("transfersh_storage_errors_total",
+		"Number of failed storage operations by provider and operation.", "provider", "operation")
+	scansTotal = metrics.counter("transfersh_scans_total",
+		"Number of scans by scanner and result.", "scanner", "result")
+)
+
+// metricsRegistry collects metrics and writes them in the prometheus text
+// exposition format
+type metricsRegistry struct {
+	mutex   sync.Mutex
+	metrics []*metricVec
+}
+
+func (m *metricsRegistry) register(v *metricVec) *metricVec {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	m.metrics = append(m.metrics, v)
+	return v
+}
+
+func (m *metricsRegistry) counter(name, help string, labels ...string) *metricVec {
+	return m.register(&metricVec{name: name, help: help, kind: "counter", labels: labels, series: map[string]*series{}})
+}
+
+func (m *metricsRegistry) gauge(name, help string, labels ...string) *metricVec {
+	return m.register(&metricVec{name: name, help: help, kind: "gauge", labels: labels, series: map[string]*series{}})
+}
+
+func (m *metricsRegistry) histogram(name, help string, buckets []float64, labels ...string) *metricVec {
+	return m.register(&metricVec{name: name, help: help, kind: "histogram", labels: labels, buckets: buckets, series: map[string]*series{}})
+}
+
+// write writes all metrics of the registry
+func (m *metricsRegistry) write(w io.Writer) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	for _, v := range m.metrics {
+		v.write(w)
+	}
+}
+
+// metricVec is a counter, gauge or histogram partitioned by label values
+type metricVec struct {
+	name    string
+	help    string
+	kind    string
+	labels  []string
+	buckets []float64
+
+	mutex  sync.Mutex
+	series map[string]*series
+}
+
+// series holds the value of a counter or gauge, or the observations of a
+// histogram, for one set of label values
+type series struct {
+	values []string
+
+	value  float64
+	counts []uint64
+	count  uint64
+}
+
+func (v *metricVec) with(values []string) *series {
+	if len(values) != len(v.labels) {
+		panic(fmt.Sprintf("metric %s expects %d label values, got %d", v.name, len(v.labels), len(values)))
+	}
+
+	key := strings.Join(values, "\xff")
+	if s, ok := v.series[key]; ok {
+		return s
+	}
+
+	s := &series{values: values, counts: make([]uint64, len(v.buckets))}
+	v.series[key] = s
+	return s
+}
+
+// add adds delta to the counter or gauge with the label values
+func (v *metricVec) add(delta float64, values ...string) {
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+
+	v.with(values).value += delta
+}
+
+// inc increments the counter or gauge with the label values
+func (v *metricVec) inc(values ...string) {
+	v.add(1, values...)
+}
+
+// observe adds an observation to the histogram with the label values
+func (v *metricVec) observe(value float64, values ...string) {
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+
+	s := v.with(values)
+	for i, bucket := range v.buckets {
+		if value <= bucket {
+			s.counts[i]++
+		}
+	}
+
+	s.value += value
+	s.count++
+}
+
+// since observes the seconds elapsed since start
+func (v *metricVec) since(start time.Time, values ...string) {
+	v.observe(time.Since(start).Seconds(), values...)
+}
+
+func (v *metricVec) write(w io.Writer) {
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+
+	fmt.Fprintf(w, "# HELP %s %s\n", v.name, v.help)
+	fmt.Fprintf(w, "# TYPE %s %s\n", v.name, v.kind)
+
+	keys := make([]string, 0, len(v.series))
+	for key := range v.series {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	// a metric without labels always has a value
+	if len(v.labels) == 0 && len(keys) == 0 {
+		v.with(nil)
+		keys = append(keys, "")
+	}
+
+	for _, key := range keys {
+		s := v.series[key]
+		if v.kind != "histogram" {
+			fmt.Fprintf(w, "%s%s %s\n", v.name, formatLabels(v.labels, s.values), formatValue(s.value))
+			continue
+		}
+
+		for i, bucket := range v.buckets {
+			labels := formatLabels(append(v.labels[:len(v.labels):len(v.labels)], "le"), append(s.values[:len(s.values):len(s.values)], formatValue(bucket)))
+			fmt.Fprintf(w, "%s_bucket%s %d\n", v.name, labels, s.counts[i])
+		}
+
+		labels := formatLabels(append(v.labels[:len(v.labels):len(v.labels)], "le"), append(s.values[:len(s.values):len(s.values)], "+Inf"))
+		fmt.Fprintf(w, "%s_bucket%s %d\n", v.name, labels, s.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", v.name, formatLabels(v.labels, s.values), formatValue(s.value))
+		fmt.Fprintf(w, "%s_count%s %d\n", v.name, formatLabels(v.labels, s.values), s.count)
+	}
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func formatLabels(labels, values []string) string {
+	if len(labels) == 0 {
+		return ""
+	}
+
+	pairs := make([]string, len(labels))
+	for i := range labels {
+		pairs[i] = fmt.Sprintf(`%s="%s"`, labels[i], labelEscaper.Replace(values[i]))
+	}
+
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func formatValue(value float64) string {
+	if math.IsInf(value, 1) {
+		return "+Inf"
+	}
+
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
+
+// metricsHandler writes the metrics in the prometheus text format
+func (s *Server) metricsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+
+	fmt.Fprintf(w, "# HELP transfersh_temp_dir_bytes Bytes of the uploads and ranges buffered in the temp folder.\n")
+	fmt.Fprintf(w, "# TYPE transfersh_temp_dir_bytes gauge\n")
+	fmt.Fprintf(w, "transfersh_temp_dir_bytes %d\n", s.tempDirUsage())
+
+	s.locksMutex.Lock()
+	locks := len(s.locks)
+	s.locksMutex.Unlock()
+
+	fmt.Fprintf(w, "# HELP transfersh_locks Number of files whose metadata is locked or waited for.\n")
+	fmt.Fprintf(w, "# TYPE transfersh_locks gauge\n")
+	fmt.Fprintf(w, "transfersh_locks %d\n", locks)
+
+	metrics.write(w)
+}
+
+// tempDirUsage returns the size of the temporary files of the server
+func (s *Server) tempDirUsage() int64 {
+	files, err := ioutil.ReadDir(s.tempPath)
+	if err != nil {
+		return 0
+	}
+
+	var size int64
+	for _, file := range files {
+		if strings.HasPrefix(file.Name(), "transfer-") || strings.HasPrefix(file.Name(), "range-") {
+			size += file.Size()
+		}
+	}
+
+	return size
+}
+
+// MetricsHandler counts the requests of the routes, their duration and the
+// bytes of uploads and downloads
+func (s *Server) MetricsHandler(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		route := ""
+		if current := mux.CurrentRoute(r); current != nil {
+			route = current.GetName()
+		}
+
+		direction := transferDirection(r, route)
+
+		body := &countingReader{Reader: r.Body}
+		if direction == "upload" && r.Body != nil {
+			r.Body = struct {
+				io.Reader
+				io.Closer
+			}{body, r.Body}
+		}
+
+		if direction != "" {
+			transfersInFlight.inc(direction)
+			defer transfersInFlight.add(-1, direction)
+		}
+
+		rw := &metricsResponseWriter{ResponseWriter: w, status: http.StatusOK}
+		start := time.Now()
+
+		h.ServeHTTP(rw, r)
+
+		requestDuration.since(start, route)
+		requestsTotal.inc(route, r.Method, strconv.Itoa(rw.status))
+
+		switch direction {
+		case "upload":
+			uploadedBytes.add(float64(body.n))
+		case "download":
+			downloadedBytes.add(float64(rw.n))
+		}
+	})
+}
+
+// transferDirection tells whether the request uploads or downloads files
+func transferDirection(r *http.Request, route string) string {
+	switch route {
+	case RouteUpload:
+		return "upload"
+	case RouteDropbox:
+		if r.Method == "POST" && mux.Vars(r)["id"] != "" {
+			return "upload"
+		}
+	case RouteDownload, RouteArchive:
+		return "download"
+	}
+
+	return ""
+}
+
+// metricsResponseWriter records the status and size of a response
+type metricsResponseWriter struct {
+	http.ResponseWriter
+	status      int
+	wroteHeader bool
+	n           int64
+}
+
+func (w *metricsResponseWriter) WriteHeader(status int) {
+	if !w.wroteHeader {
+		w.status = status
+		w.wroteHeader = true
+	}
+
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *metricsResponseWriter) Write(b []byte) (int, error) {
+	w.wroteHeader = true
+
+	n, err := w.ResponseWriter.Write(b)
+	w.n += int64(n)
+	return n, err
+}
+
+// countingReader counts the bytes read from a reader
+type countingReader struct {
+	io.Reader
+	n int64
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	if r.Reader == nil {
+		return 0, io.EOF
+	}
+
+	n, err := r.Reader.Read(p)
+	r.n += int64(n)
+	return n, err
+}
+
+// metricsStorage records the latency and errors of the operations of the
+// wrapped storage
+type metricsStorage struct {
+	Storage
+}
+
+// NewMetricsStorage wraps a storage provider to record the latency and errors
+// of its operations by provider. Errors for missing files aren't counted.
+func NewMetricsStorage(storage Storage) Storage {
+	return &metricsStorage{Storage: storage}
+}
+
+func (s *metricsStorage) record(operation string, start time.Time, err error) {
+	storageDuration.since(start, s.Type(), operation)
+
+	if err != nil && !s.IsNotExist(err) {
+		storageErrors.inc(s.Type(), operation)
+	}
+}
+
+func (s *metricsStorage) Get(ctx context.Context, token string, filename string) (reader io.ReadCloser, contentLength uint64, err error) {
+	defer func(start time.Time) { s.record("get", start, err) }(time.Now())
+	return s.Storage.Get(ctx, token, filename)
+}
+
+func (s *metricsStorage) Head(ctx context.Context, token string, filename string) (contentLength uint64, err error) {
+	defer func(start time.Time) { s.record("head", start, err) }(time.Now())
+	return s.Storage.Head(ctx, token, filename)
+}
+
+func (s *metricsStorage) Put(ctx context.Context, token string, filename string, reader io.Reader, contentType string, contentLength uint64) (err error) {
+	defer func(start time.Time) { s.record("put", start, err) }(time.Now())
+	return s.Storage.Put(ctx, token, filename, reader, contentType, contentLength)
+}
+
+func (s *metricsStorage) Delete(ctx context.Context, token string, filename string) (err error) {
+	defer func(start time.Time) { s.record("delete", start, err) }(time.Now())
+	return s.Storage.Delete(ctx, token, filename)
+}
+
+func (s *metricsStorage) List(ctx context.Context) (objects []ObjectInfo, err error) {
+	defer func(start time.Time) { s.record("list", start, err) }(time.Now())
+	return s.Storage.List(ctx)
+}
@@ -0,0 +1,145 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+
+	"github.com/gorilla/mux"
+	. "gopkg.in/check.v1"
+)
+
+var _ = Suite(&SuiteMetrics{})
+
+type SuiteMetrics struct{}
+
+// value returns the value of the series in the exposition of the metrics
+func (s *SuiteMetrics) value(c *C, srvr *Server, series string) string {
+	w := httptest.NewRecorder()
+	srvr.metricsHandler(w, httptest.NewRequest("GET", "/metrics", nil))
+
+	for _, line := range strings.Split(w.Body.String(), "\n") {
+		if strings.HasPrefix(line, series+" ") {
+			return strings.TrimPrefix(line, series+" ")
+		}
+	}
+
+	return ""
+}
+
+func (s *SuiteMetrics) TestRegistry(c *C) {
+	registry := &metricsRegistry{}
+	requests := registry.counter("requests_total", "Requests.", "route", "code")
+	sizes := registry.histogram("size_bytes", "Sizes.", []float64{10, 100})
+	registry.gauge("idle", "Idle.")
+
+	requests.inc("upload", "200")
+	requests.add(2, "upload", "200")
+	requests.inc(`a"b`, "500")
+	sizes.observe(5)
+	sizes.observe(50)
+	sizes.observe(500)
+
+	var b bytes.Buffer
+	registry.write(&b)
+	c.Assert(b.String(), Equals, `# HELP requests_total Requests.
+# TYPE requests_total counter
+requests_total{route="a\"b",code="500"} 1
+requests_total{route="upload",code="200"} 3
+# HELP size_bytes Sizes.
+# TYPE size_bytes histogram
+size_bytes_bucket{le="10"} 1
+size_bytes_bucket{le="100"} 2
+size_bytes_bucket{le="+Inf"} 3
+size_bytes_sum 555
+size_bytes_count 3
+# HELP idle Idle.
+# TYPE idle gauge
+idle 0
+`)
+}
+
+func (s *SuiteMetrics) TestMetricsHandler(c *C) {
+	storage, err := NewLocalStorage(c.MkDir(), log.New(ioutil.Discard, "", 0))
+	c.Assert(err, IsNil)
+
+	srvr, err := New(UseStorage(storage), UseMetaStorage(storage), TempPath(c.MkDir()))
+	c.Assert(err, IsNil)
+
+	router := mux.NewRouter()
+	router.HandleFunc("/{filename}", func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		w.Write(body)
+	}).Methods("PUT").Name(RouteUpload)
+	router.HandleFunc("/{token}/{filename}", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("content"))
+	}).Methods("GET").Name(RouteDownload)
+	router.HandleFunc("/{token}/{filename}", func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "Not Found", http.StatusNotFound)
+	}).Methods("DELETE").Name(RouteDelete)
+	router.Use(srvr.MetricsHandler)
+
+	uploaded := s.value(c, srvr, "transfersh_uploaded_bytes_total")
+	downloaded := s.value(c, srvr, "transfersh_downloaded_bytes_total")
+
+	for _, req := range []*http.Request{
+		httptest.NewRequest("PUT", "/file.txt", strings.NewReader("hello")),
+		httptest.NewRequest("GET", "/aaaaa/file.txt", nil),
+		httptest.NewRequest("DELETE", "/aaaaa/file.txt", nil),
+	} {
+		router.ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	c.Assert(s.value(c, srvr, `transfersh_http_requests_total{route="delete",method="DELETE",code="404"}`), Not(Equals), "")
+	c.Assert(s.value(c, srvr, `transfersh_http_request_duration_seconds_count{route="upload"}`), Not(Equals), "")
+	c.Assert(s.value(c, srvr, `transfersh_transfers_in_flight{direction="upload"}`), Equals, "0")
+	c.Assert(s.value(c, srvr, "transfersh_uploaded_bytes_total"), Not(Equals), uploaded)
+	c.Assert(s.value(c, srvr, "transfersh_downloaded_bytes_total"), Not(Equals), downloaded)
+
+	c.Assert(ioutil.WriteFile(srvr.tempPath+"transfer-1", []byte("buffered"), 0600), IsNil)
+	c.Assert(s.value(c, srvr, "transfersh_temp_dir_bytes"), Equals, "8")
+
+	srvr.Lock("aaaaa", "file.txt")
+	c.Assert(s.value(c, srvr, "transfersh_locks"), Equals, "1")
+	srvr.Unlock("aaaaa", "file.txt")
+	c.Assert(s.value(c, srvr, "transfersh_locks"), Equals, "0")
+}
+
+func (s *SuiteMetrics) TestMetricsStorage(c *C) {
+	local, err := NewLocalStorage(c.MkDir(), log.New(ioutil.Discard, "", 0))
+	c.Assert(err, IsNil)
+
+	srvr, err := New(UseStorage(local), UseMetaStorage(local))
+	c.Assert(err, IsNil)
+
+	storage := NewMetricsStorage(local)
+	ctx := context.Background()
+
+	c.Assert(storage.Put(ctx, "aaaaa", "file.txt", strings.NewReader("content"), "text/plain", 7), IsNil)
+	_, err = storage.Head(ctx, "aaaaa", "missing.txt")
+	c.Assert(storage.IsNotExist(err), Equals, true)
+
+	cancelled, cancel := context.WithCancel(ctx)
+	cancel()
+	_, _, err = storage.Get(cancelled, "aaaaa", "file.txt")
+	c.Assert(err, NotNil)
+
+	c.Assert(s.value(c, srvr, `transfersh_storage_operation_duration_seconds_count{provider="local",operation="put"}`), Not(Equals), "")
+	c.Assert(s.value(c, srvr, `transfersh_storage_errors_total{provider="local",operation="head"}`), Equals, "")
+	c.Assert(s.value(c, srvr, `transfersh_storage_errors_total{provider="local",operation="get"}`), Not(Equals), "")
+}
+
+func (s *SuiteMetrics) TestOpsMetrics(c *C) {
+	var ops DefaultServAuthenticator
+	ops.Set("ops", "secret")
+
+	srvr, err := New(ProfileListener("127.0.0.1:9090"), OpsAuth(&ops))
+	c.Assert(err, IsNil)
+
+	c.Assert((&SuiteOps{}).serve(srvr, "", "/metrics"), Equals, http.StatusUnauthorized)
+	c.Assert((&SuiteOps{}).serve(srvr, "ops", "/metrics"), Equals, http.StatusOK)
+}
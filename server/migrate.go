@@ -0,0 +1,349 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"strings"
+)
+
+// MigrateOptions configures a migration between two storage providers
+type MigrateOptions struct {
+	// DryRun only reports the objects that would be copied
+	DryRun bool
+	// StatePath is the journal of verified objects, objects found in the
+	// journal are skipped so an interrupted migration can be resumed
+	StatePath string
+
+	Logger *log.Logger
+}
+
+// MigrateStats summarizes the result of a migration
+type MigrateStats struct {
+	Total   int
+	Copied  int
+	Skipped int
+	Failed  int
+	Bytes   uint64
+}
+
+type migrator struct {
+	from     Storage
+	fromMeta Storage
+	to       Storage
+	toMeta   Storage
+
+	options MigrateOptions
+	done    map[string]bool
+	journal *os.File
+}
+
+// Migrate copies every file and its metadata from one storage provider to
+// another, verifying the size (and md5 checksum when both providers support
+// it) of every copied object.
+func Migrate(ctx context.Context, from, fromMeta, to, toMeta Storage, options MigrateOptions) (MigrateStats, error) {
+	var stats MigrateStats
+
+	if options.Logger == nil {
+		options.Logger = log.New(ioutil.Discard, "", 0)
+	}
+
+	m := &migrator{
+		from:     from,
+		fromMeta: fromMeta,
+		to:       to,
+		toMeta:   toMeta,
+		options:  options,
+		done:     map[string]bool{},
+	}
+
+	if err := m.openJournal(); err != nil {
+		return stats, err
+	}
+
+	defer m.closeJournal()
+
+	objects, err := from.List(ctx)
+	if err != nil {
+		return stats, fmt.Errorf("could not list %s storage: %s", from.Type(), err.Error())
+	}
+
+	var files []ObjectInfo
+	for _, object := range objects {
+		if strings.HasSuffix(object.Filename, ".metadata") || isReservedToken(object.Token) {
+			continue
+		}
+
+		files = append(files, object)
+	}
+
+	// reserved tokens, e.g. the api keys, are kept in the metadata provider
+	reserved, err := fromMeta.List(ctx)
+	if err != nil {
+		return stats, fmt.Errorf("could not list %s storage: %s", fromMeta.Type(), err.Error())
+	}
+
+	for _, object := range reserved {
+		if isReservedToken(object.Token) {
+			files = append(files, object)
+		}
+	}
+
+	stats.Total = len(files)
+
+	for i, object := range files {
+		if err := ctx.Err(); err != nil {
+			return stats, err
+		}
+
+		key := path.Join(object.Token, object.Filename)
+		progress := fmt.Sprintf("[%d/%d]", i+1, stats.Total)
+
+		if m.done[key] && !isReservedToken(object.Token) {
+			stats.Skipped++
+			m.options.Logger.Printf("%s skipped %s (already migrated)", progress, key)
+			continue
+		}
+
+		if options.DryRun {
+			stats.Copied++
+			stats.Bytes += object.ContentLength
+			m.options.Logger.Printf("%s would copy %s (%d bytes)", progress, key, object.ContentLength)
+			continue
+		}
+
+		var copied bool
+		if isReservedToken(object.Token) {
+			copied, err = m.migrateReserved(ctx, object)
+		} else {
+			copied, err = m.migrate(ctx, object)
+		}
+
+		if err != nil {
+			stats.Failed++
+			m.options.Logger.Printf("%s failed %s: %s", progress, key, err.Error())
+			continue
+		}
+
+		if err := m.markDone(key); err != nil {
+			return stats, err
+		}
+
+		if copied {
+			stats.Copied++
+			stats.Bytes += object.ContentLength
+			m.options.Logger.Printf("%s copied %s (%d bytes)", progress, key, object.ContentLength)
+		} else {
+			stats.Skipped++
+			m.options.Logger.Printf("%s skipped %s (already present)", progress, key)
+		}
+	}
+
+	if stats.Failed > 0 {
+		return stats, fmt.Errorf("%d of %d files could not be migrated", stats.Failed, stats.Total)
+	}
+
+	return stats, nil
+}
+
+// migrate copies a single file and its metadata, it reports false when the
+// file was already present at the destination
+func (m *migrator) migrate(ctx context.Context, object ObjectInfo) (bool, error) {
+	metadataName := fmt.Sprintf("%s.metadata", object.Filename)
+
+	var metadata []byte
+	var contentType string
+
+	// the metadata is handed to the destination along with the file
+	putCtx := ctx
+
+	reader, _, err := m.fromMeta.Get(ctx, object.Token, metadataName)
+	if m.fromMeta.IsNotExist(err) {
+	} else if err != nil {
+		return false, err
+	} else {
+		metadata, err = ioutil.ReadAll(reader)
+		reader.Close()
+		if err != nil {
+			return false, err
+		}
+
+		var md Metadata
+		if err := json.Unmarshal(metadata, &md); err == nil {
+			contentType = md.ContentType
+			putCtx = WithMetadata(ctx, md)
+		}
+	}
+
+	present, err := m.isPresent(ctx, object)
+	if err != nil {
+		return false, err
+	}
+
+	if !present {
+		if err := m.copy(putCtx, object, contentType); err != nil {
+			return false, err
+		}
+	}
+
+	if metadata != nil {
+		if err := m.toMeta.Put(ctx, object.Token, metadataName, bytes.NewReader(metadata), "text/json", uint64(len(metadata))); err != nil {
+			return false, fmt.Errorf("could not save metadata: %s", err.Error())
+		}
+
+		if contentLength, err := m.toMeta.Head(ctx, object.Token, metadataName); err != nil {
+			return false, fmt.Errorf("could not verify metadata: %s", err.Error())
+		} else if contentLength != uint64(len(metadata)) {
+			return false, fmt.Errorf("metadata size mismatch: expected %d, got %d", len(metadata), contentLength)
+		}
+	}
+
+	return !present, nil
+}
+
+// migrateReserved copies an object of a reserved token between the metadata
+// providers, they change while the server runs and are always copied
+func (m *migrator) migrateReserved(ctx context.Context, object ObjectInfo) (bool, error) {
+	reader, contentLength, err := m.fromMeta.Get(ctx, object.Token, object.Filename)
+	if err != nil {
+		return false, err
+	}
+
+	defer reader.Close()
+
+	if err := m.toMeta.Put(ctx, object.Token, object.Filename, reader, "text/json", contentLength); err != nil {
+		return false, err
+	}
+
+	if actual, err := m.toMeta.Head(ctx, object.Token, object.Filename); err != nil {
+		return false, fmt.Errorf("could not verify file: %s", err.Error())
+	} else if actual != contentLength {
+		return false, fmt.Errorf("size mismatch: expected %d, got %d", contentLength, actual)
+	}
+
+	return true, nil
+}
+
+func (m *migrator) isPresent(ctx context.Context, object ObjectInfo) (bool, error) {
+	contentLength, err := m.to.Head(ctx, object.Token, object.Filename)
+	if m.to.IsNotExist(err) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	} else if contentLength != object.ContentLength {
+		return false, nil
+	}
+
+	expected, err := checksum(ctx, m.from, object)
+	if err != nil {
+		return false, err
+	}
+
+	actual, err := checksum(ctx, m.to, object)
+	if err != nil {
+		return false, err
+	}
+
+	return expected == "" || actual == "" || expected == actual, nil
+}
+
+func (m *migrator) copy(ctx context.Context, object ObjectInfo, contentType string) error {
+	reader, contentLength, err := m.from.Get(ctx, object.Token, object.Filename)
+	if err != nil {
+		return err
+	}
+
+	defer reader.Close()
+
+	h := md5.New()
+	if err := m.to.Put(ctx, object.Token, object.Filename, io.TeeReader(reader, h), contentType, contentLength); err != nil {
+		return err
+	}
+
+	if actual, err := m.to.Head(ctx, object.Token, object.Filename); err != nil {
+		return fmt.Errorf("could not verify file: %s", err.Error())
+	} else if actual != contentLength {
+		return fmt.Errorf("size mismatch: expected %d, got %d", contentLength, actual)
+	}
+
+	if actual, err := checksum(ctx, m.to, object); err != nil {
+		return fmt.Errorf("could not verify file: %s", err.Error())
+	} else if expected := hex.EncodeToString(h.Sum(nil)); actual != "" && actual != expected {
+		return fmt.Errorf("checksum mismatch: expected %s, got %s", expected, actual)
+	}
+
+	return nil
+}
+
+func (m *migrator) openJournal() error {
+	if m.options.StatePath == "" {
+		return nil
+	}
+
+	if f, err := os.Open(m.options.StatePath); os.IsNotExist(err) {
+	} else if err != nil {
+		return err
+	} else {
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			if key := strings.TrimSpace(scanner.Text()); key != "" {
+				m.done[key] = true
+			}
+		}
+
+		f.Close()
+
+		if err := scanner.Err(); err != nil {
+			return err
+		}
+	}
+
+	if m.options.DryRun {
+		return nil
+	}
+
+	f, err := os.OpenFile(m.options.StatePath, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+
+	m.journal = f
+	return nil
+}
+
+func (m *migrator) markDone(key string) error {
+	m.done[key] = true
+
+	if m.journal == nil {
+		return nil
+	}
+
+	if _, err := fmt.Fprintln(m.journal, key); err != nil {
+		return err
+	}
+
+	return m.journal.Sync()
+}
+
+func (m *migrator) closeJournal() {
+	if m.journal != nil {
+		m.journal.Close()
+	}
+}
+
+func checksum(ctx context.Context, storage Storage, object ObjectInfo) (string, error) {
+	if c, ok := storage.(Checksummer); ok {
+		return c.Checksum(ctx, object.Token, object.Filename)
+	}
+
+	return "", nil
+}
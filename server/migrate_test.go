@@ -0,0 +1,91 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+
+	. "gopkg.in/check.v1"
+)
+
+var _ = Suite(&SuiteMigrate{})
+
+type SuiteMigrate struct {
+	dir  string
+	from *LocalStorage
+	to   *LocalStorage
+}
+
+func (s *SuiteMigrate) SetUpTest(c *C) {
+	s.dir = c.MkDir()
+
+	logger := log.New(ioutil.Discard, "", 0)
+	s.from, _ = NewLocalStorage(filepath.Join(s.dir, "from"), logger)
+	s.to, _ = NewLocalStorage(filepath.Join(s.dir, "to"), logger)
+
+	for _, name := range []string{"a.txt", "b.txt"} {
+		content := []byte("content of " + name)
+		metadata := []byte(`{"ContentType":"text/plain"}`)
+
+		c.Assert(s.from.Put(context.Background(), "token", name, bytes.NewReader(content), "text/plain", uint64(len(content))), IsNil)
+		c.Assert(s.from.Put(context.Background(), "token", name+".metadata", bytes.NewReader(metadata), "text/json", uint64(len(metadata))), IsNil)
+	}
+}
+
+func (s *SuiteMigrate) TestMigrate(c *C) {
+	stats, err := Migrate(context.Background(), s.from, s.from, s.to, s.to, MigrateOptions{StatePath: filepath.Join(s.dir, "state")})
+	c.Assert(err, IsNil)
+	c.Assert(stats.Total, Equals, 2)
+	c.Assert(stats.Copied, Equals, 2)
+
+	reader, _, err := s.to.Get(context.Background(), "token", "a.txt")
+	c.Assert(err, IsNil)
+	defer reader.Close()
+
+	content, _ := ioutil.ReadAll(reader)
+	c.Assert(string(content), Equals, "content of a.txt")
+
+	_, err = s.to.Head(context.Background(), "token", "b.txt.metadata")
+	c.Assert(err, IsNil)
+
+	stats, err = Migrate(context.Background(), s.from, s.from, s.to, s.to, MigrateOptions{StatePath: filepath.Join(s.dir, "state")})
+	c.Assert(err, IsNil)
+	c.Assert(stats.Copied, Equals, 0)
+	c.Assert(stats.Skipped, Equals, 2)
+}
+
+func (s *SuiteMigrate) TestMigrateReserved(c *C) {
+	logger := log.New(ioutil.Discard, "", 0)
+	fromMeta, _ := NewLocalStorage(filepath.Join(s.dir, "from-meta"), logger)
+	toMeta, _ := NewLocalStorage(filepath.Join(s.dir, "to-meta"), logger)
+
+	key := []byte(`{"id":"key"}`)
+	c.Assert(fromMeta.Put(context.Background(), apiKeysToken, "key.json", bytes.NewReader(key), "text/json", uint64(len(key))), IsNil)
+
+	// reserved tokens are copied between the metadata providers on every run
+	for i := 0; i < 2; i++ {
+		stats, err := Migrate(context.Background(), s.from, fromMeta, s.to, toMeta, MigrateOptions{StatePath: filepath.Join(s.dir, "state")})
+		c.Assert(err, IsNil)
+		c.Assert(stats.Total, Equals, 3)
+		c.Assert(stats.Copied, Not(Equals), 0)
+	}
+
+	contentLength, err := toMeta.Head(context.Background(), apiKeysToken, "key.json")
+	c.Assert(err, IsNil)
+	c.Assert(contentLength, Equals, uint64(len(key)))
+}
+
+func (s *SuiteMigrate) TestDryRun(c *C) {
+	stats, err := Migrate(context.Background(), s.from, s.from, s.to, s.to, MigrateOptions{DryRun: true, StatePath: filepath.Join(s.dir, "state")})
+	c.Assert(err, IsNil)
+	c.Assert(stats.Copied, Equals, 2)
+
+	_, err = os.Stat(filepath.Join(s.dir, "to"))
+	c.Assert(os.IsNotExist(err), Equals, true)
+
+	_, err = os.Stat(filepath.Join(s.dir, "state"))
+	c.Assert(os.IsNotExist(err), Equals, true)
+}
@@ -0,0 +1,158 @@
+package server
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net/http"
+	"net/http/pprof"
+
+	"github.com/PuerkitoBio/ghost/handlers"
+	"github.com/gorilla/mux"
+)
+
+// defaultProfileListener is the ops listener of --profiler when no
+// --profile-listener is set
+const defaultProfileListener = "127.0.0.1:6060"
+
+// OpsAuth requires the credentials of auth for pprof and metrics on the ops
+// listener, health probes stay open and the admin routes keep their own
+// authorization
+func OpsAuth(auth Authenticator) OptionFn {
+	return func(srvr *Server) {
+		srvr.opsAuth = auth
+	}
+}
+
+// OpsTLS serves the ops listener with tls, with clientCAs set it only accepts
+// clients with a certificate they verify
+func OpsTLS(cert, pk string, clientCAs *x509.CertPool) OptionFn {
+	certificate, err := tls.LoadX509KeyPair(cert, pk)
+	return func(srvr *Server) {
+		srvr.opsTLSConfig = &tls.Config{
+			GetCertificate: func(clientHello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+				return &certificate, err
+			},
+		}
+
+		if clientCAs != nil {
+			srvr.opsTLSConfig.ClientCAs = clientCAs
+			srvr.opsTLSConfig.ClientAuth = tls.RequireAndVerifyClientCert
+		}
+	}
+}
+
+// opsListener returns the address of the ops listener, if any
+func (s *Server) opsListener() string {
+	if s.ProfileListenerString == "" && s.profilerEnabled {
+		return defaultProfileListener
+	}
+
+	return s.ProfileListenerString
+}
+
+// OpsAuthHandler requires the ops credentials, when configured
+func (s *Server) OpsAuthHandler(h http.Handler) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if s.opsAuth == nil {
+			h.ServeHTTP(w, r)
+			return
+		}
+
+		username, password, ok := r.BasicAuth()
+		if ok {
+			ok, _ = s.opsAuth.Authenticate(username, password)
+		}
+
+		if !ok {
+			w.Header().Set("WWW-Authenticate", "Basic realm=\"Restricted\"")
+			http.Error(w, "Not authorized", http.StatusUnauthorized)
+			return
+		}
+
+		h.ServeHTTP(w, r)
+	}
+}
+
+// opsRouter routes the ops listener: health probes, metrics, pprof when
+// profiling is enabled and the admin routes
+func (s *Server) opsRouter() *mux.Router {
+	r := mux.NewRouter()
+
+	r.HandleFunc("/livez", s.liveHandler).Methods("GET")
+	r.HandleFunc("/readyz", s.readyHandler).Methods("GET")
+	r.HandleFunc("/metrics", s.OpsAuthHandler(http.HandlerFunc(s.metricsHandler))).Methods("GET")
+
+	if s.profilerEnabled {
+		r.HandleFunc("/debug/pprof/cmdline", s.OpsAuthHandler(http.HandlerFunc(pprof.Cmdline)))
+		r.HandleFunc("/debug/pprof/profile", s.OpsAuthHandler(http.HandlerFunc(pprof.Profile)))
+		r.HandleFunc("/debug/pprof/symbol", s.OpsAuthHandler(http.HandlerFunc(pprof.Symbol)))
+		r.HandleFunc("/debug/pprof/trace", s.OpsAuthHandler(http.HandlerFunc(pprof.Trace)))
+		r.PathPrefix("/debug/pprof/").Handler(s.OpsAuthHandler(http.HandlerFunc(pprof.Index)))
+	}
+
+	s.adminRoutes(r)
+
+	r.NotFoundHandler = http.HandlerFunc(s.notFoundHandler)
+	return r
+}
+
+// serveOps runs the ops listener
+func (s *Server) serveOps(addr string) {
+	srvr := &http.Server{
+		Addr: addr,
+		Handler: handlers.PanicHandler(
+			handlers.LogHandler(s.opsRouter(), handlers.NewLogOptions(s.logger.Printf, "_default_")),
+			nil,
+		),
+		TLSConfig: s.opsTLSConfig,
+	}
+
+	s.logger.Printf("ops listening on port: %v\n", addr)
+
+	var err error
+	if s.opsTLSConfig != nil {
+		err = srvr.ListenAndServeTLS("", "")
+	} else {
+		err = srvr.ListenAndServe()
+	}
+
+	if err != nil {
+		panic(err)
+	}
+}
+
+// adminRoutes routes the admin dashboard and api
+func (s *Server) adminRoutes(r *mux.Router) {
+	r.HandleFunc("/admin", s.dashboardHandler).Methods("GET").Name(RouteAdmin)
+	r.HandleFunc("/admin", s.dashboardPostHandler).Methods("POST").Name(RouteAdmin)
+	r.HandleFunc("/admin/api/files", s.AdminHandler(http.HandlerFunc(s.adminFilesHandler))).Methods("GET").Name(RouteAdmin)
+	r.HandleFunc("/admin/api/files/{token}/{filename}", s.AdminHandler(http.HandlerFunc(s.adminFileHandler))).Methods("GET").Name(RouteAdmin)
+	r.HandleFunc("/admin/api/files/{token}/{filename}", s.AdminHandler(http.HandlerFunc(s.adminDeleteHandler))).Methods("DELETE").Name(RouteAdmin)
+	r.HandleFunc("/admin/api/files/{token}", s.AdminHandler(http.HandlerFunc(s.adminDeleteHandler))).Methods("DELETE").Name(RouteAdmin)
+	r.HandleFunc("/admin/api/files/{token}/{filename}/hold", s.AdminHandler(http.HandlerFunc(s.adminHoldHandler))).Methods("POST", "DELETE").Name(RouteAdmin)
+	r.HandleFunc("/admin/api/tokens/{token}/block", s.AdminHandler(http.HandlerFunc(s.adminBlockHandler))).Methods("POST", "DELETE").Name(RouteAdmin)
+	r.HandleFunc("/admin/api/purge", s.AdminHandler(http.HandlerFunc(s.adminPurgeHandler))).Methods("POST").Name(RouteAdmin)
+	r.HandleFunc("/admin/api/stats", s.AdminHandler(http.HandlerFunc(s.adminStatsHandler))).Methods("GET").Name(RouteAdmin)
+}
+
+// liveHandler tells the process is up
+func (s *Server) liveHandler(w http.ResponseWriter, r *http.Request) {
+	fmt.Fprintln(w, "ok")
+}
+
+// readyHandler tells the storage backends are available, like /health.html
+func (s *Server) readyHandler(w http.ResponseWriter, r *http.Request) {
+	healthy, states := s.storageHealth()
+	if !healthy {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+
+	for _, state := range states {
+		fmt.Fprintln(w, state)
+	}
+
+	if healthy {
+		fmt.Fprintln(w, "ok")
+	}
+}
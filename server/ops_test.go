@@ -0,0 +1,59 @@
+package server
+
+import (
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+
+	. "gopkg.in/check.v1"
+)
+
+var _ = Suite(&SuiteOps{})
+
+type SuiteOps struct{}
+
+func (s *SuiteOps) serve(srvr *Server, user, target string) int {
+	req := httptest.NewRequest("GET", target, nil)
+	if user != "" {
+		req.SetBasicAuth(user, "secret")
+	}
+
+	w := httptest.NewRecorder()
+	srvr.opsRouter().ServeHTTP(w, req)
+	return w.Code
+}
+
+func (s *SuiteOps) TestOpsRoutes(c *C) {
+	storage, err := NewLocalStorage(c.MkDir(), log.New(ioutil.Discard, "", 0))
+	c.Assert(err, IsNil)
+
+	var ops DefaultServAuthenticator
+	ops.Set("ops", "secret")
+
+	srvr, err := New(UseStorage(storage), UseMetaStorage(storage), EnableProfiler(), OpsAuth(&ops))
+	c.Assert(err, IsNil)
+	c.Assert(srvr.opsListener(), Equals, defaultProfileListener)
+
+	c.Assert(s.serve(srvr, "", "/livez"), Equals, http.StatusOK)
+	c.Assert(s.serve(srvr, "", "/readyz"), Equals, http.StatusOK)
+
+	c.Assert(s.serve(srvr, "", "/debug/pprof/"), Equals, http.StatusUnauthorized)
+	c.Assert(s.serve(srvr, "other", "/debug/pprof/"), Equals, http.StatusUnauthorized)
+	c.Assert(s.serve(srvr, "ops", "/debug/pprof/"), Equals, http.StatusOK)
+	c.Assert(s.serve(srvr, "ops", "/debug/pprof/cmdline"), Equals, http.StatusOK)
+
+	// the admin routes have their own authorization
+	c.Assert(s.serve(srvr, "", "/admin"), Equals, http.StatusOK)
+}
+
+func (s *SuiteOps) TestOpsWithoutProfiler(c *C) {
+	srvr, err := New(ProfileListener("127.0.0.1:9090"))
+	c.Assert(err, IsNil)
+	c.Assert(srvr.opsListener(), Equals, "127.0.0.1:9090")
+	c.Assert(s.serve(srvr, "", "/debug/pprof/"), Equals, http.StatusNotFound)
+
+	srvr, err = New()
+	c.Assert(err, IsNil)
+	c.Assert(srvr.opsListener(), Equals, "")
+}
@@ -0,0 +1,259 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"text/tabwriter"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// requireIdentity returns the identity of the request, resolved by the
+// policy or with requestIdentity. It writes the response and returns false
+// when the request has no valid credentials.
+func (s *Server) requireIdentity(w http.ResponseWriter, r *http.Request) (Identity, bool) {
+	if identity, ok := IdentityFromContext(r.Context()); ok {
+		return identity, true
+	}
+
+	identity, ok, err := s.requestIdentity(r)
+	if err != nil && err != errInvalidAPIKey && !isUnavailable(err) {
+		log.Printf("Error checkAuth: %s", err.Error())
+	}
+
+	if isUnavailable(err) {
+		http.Error(w, "Authentication service unavailable", http.StatusServiceUnavailable)
+		return identity, false
+	} else if !ok {
+		s.challenge(w)
+		http.Error(w, "Not authorized", http.StatusUnauthorized)
+		return identity, false
+	}
+
+	return identity, true
+}
+
+// authorizeOwner checks that the identity of the request uploaded the file,
+// it writes the response and returns false when it didn't
+func (s *Server) authorizeOwner(w http.ResponseWriter, r *http.Request, token, filename string) bool {
+	identity, ok := s.requireIdentity(w, r)
+	if !ok {
+		return false
+	}
+
+	metadata, err := s.GetMetadata(r.Context(), token, filename)
+	if err != nil {
+		log.Printf("Error metadata: %s", err.Error())
+		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		return false
+	} else if metadata.Owner == "" || metadata.Owner != identity.User {
+		http.Error(w, "not the owner of the file", http.StatusForbidden)
+		return false
+	}
+
+	return true
+}
+
+// ownedFile is a file as listed to its owner
+type ownedFile struct {
+	URL           string `json:"url"`
+	Token         string `json:"token"`
+	Filename      string `json:"filename"`
+	ContentType   string `json:"content_type"`
+	ContentLength uint64 `json:"content_length"`
+	Downloads     int    `json:"downloads"`
+	MaxDownloads  int    `json:"max_downloads"`
+	// RemainingDownloads is -1 for files without a download limit
+	RemainingDownloads int `json:"remaining_downloads"`
+	// Expires is nil for files that don't expire
+	Expires *time.Time `json:"expires,omitempty"`
+}
+
+func (s *Server) ownedFile(r *http.Request, token, filename string, contentLength uint64, metadata Metadata) ownedFile {
+	fileURL, _ := url.Parse(path.Join(s.proxyPath, token, url.PathEscape(filename)))
+
+	file := ownedFile{
+		URL:                resolveURL(r, fileURL, s.proxyPort),
+		Token:              token,
+		Filename:           filename,
+		ContentType:        metadata.ContentType,
+		ContentLength:      contentLength,
+		Downloads:          metadata.Downloads,
+		MaxDownloads:       metadata.MaxDownloads,
+		RemainingDownloads: -1,
+	}
+
+	if metadata.MaxDownloads != -1 {
+		file.RemainingDownloads = metadata.MaxDownloads - metadata.Downloads
+	}
+
+	if !metadata.MaxDate.IsZero() {
+		expires := metadata.MaxDate.UTC()
+		file.Expires = &expires
+	}
+
+	return file
+}
+
+func writeOwnedFiles(w http.ResponseWriter, r *http.Request, files []ownedFile) {
+	if !acceptsJSON(r.Header) {
+		w.Header().Set("Content-Type", "text/plain")
+
+		tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(tw, "URL\tSIZE\tEXPIRES\tREMAINING DOWNLOADS")
+		for _, file := range files {
+			expires, remainingDownloads := "n/a", "n/a"
+			if file.Expires != nil {
+				expires = file.Expires.Format(time.RFC3339)
+			}
+
+			if file.RemainingDownloads != -1 {
+				remainingDownloads = strconv.Itoa(file.RemainingDownloads)
+			}
+
+			fmt.Fprintf(tw, "%s\t%d\t%s\t%s\n", file.URL, file.ContentLength, expires, remainingDownloads)
+		}
+
+		tw.Flush()
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(files); err != nil {
+		log.Printf("%s", err.Error())
+	}
+}
+
+const (
+	// defaultOwnerListLimit is the number of files listed per page
+	defaultOwnerListLimit = 100
+	maxOwnerListLimit     = 1000
+	// ownerScanLimit caps the metadata read for a page of files, the
+	// page ends early when it's reached
+	ownerScanLimit = 5000
+	// ownerListRate is the number of pages a client may list per minute
+	ownerListRate = 30
+)
+
+// myFilesHandler lists the files uploaded by the identity of the request,
+// as JSON for clients that accept it and as text otherwise. Files are listed
+// in pages, the Link header points to the next one.
+func (s *Server) myFilesHandler(w http.ResponseWriter, r *http.Request) {
+	identity, ok := s.requireIdentity(w, r)
+	if !ok {
+		return
+	}
+
+	limit, after := defaultOwnerListLimit, r.URL.Query().Get("after")
+	if v := r.URL.Query().Get("limit"); v == "" {
+	} else if n, err := strconv.Atoi(v); err != nil || n < 1 || n > maxOwnerListLimit {
+		http.Error(w, fmt.Sprintf("invalid limit: %s", v), http.StatusBadRequest)
+		return
+	} else {
+		limit = n
+	}
+
+	objects, err := s.storedFiles(r.Context(), after)
+	if err != nil {
+		log.Printf("Error listing files: %s", err.Error())
+		http.Error(w, "Could not list files", http.StatusInternalServerError)
+		return
+	}
+
+	files := []ownedFile{}
+	next := ""
+
+	for i, object := range objects {
+		if len(files) == limit || i == ownerScanLimit {
+			next = path.Join(objects[i-1].Token, objects[i-1].Filename)
+			break
+		}
+
+		metadata, err := s.GetMetadata(r.Context(), object.Token, object.Filename)
+		if err != nil {
+			continue
+		} else if metadata.Owner == "" || metadata.Owner != identity.User {
+			continue
+		}
+
+		files = append(files, s.ownedFile(r, object.Token, object.Filename, object.ContentLength, metadata))
+	}
+
+	if next != "" {
+		nextURL, _ := url.Parse(path.Join(s.proxyPath, "me/files"))
+		nextURL.RawQuery = url.Values{"after": {next}, "limit": {strconv.Itoa(limit)}}.Encode()
+		w.Header().Set("Link", fmt.Sprintf("<%s>; rel=\"next\"", resolveURL(r, nextURL, s.proxyPort)))
+	}
+
+	writeOwnedFiles(w, r, files)
+}
+
+// editHandler changes the Max-Downloads and Max-Days limits of a file of the
+// identity of the request, -1 and 0 remove the limits
+func (s *Server) editHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	token := vars["token"]
+	filename := vars["filename"]
+
+	if !s.authorizeOwner(w, r, token, filename) {
+		return
+	}
+
+	maxDownloads, maxDays := r.Header.Get("Max-Downloads"), r.Header.Get("Max-Days")
+	if maxDownloads == "" && maxDays == "" {
+		http.Error(w, "Max-Downloads or Max-Days is required", http.StatusBadRequest)
+		return
+	}
+
+	var downloads, days int
+	var err error
+
+	if maxDownloads == "" {
+	} else if downloads, err = strconv.Atoi(maxDownloads); err != nil || downloads < -1 {
+		http.Error(w, fmt.Sprintf("invalid Max-Downloads: %s", maxDownloads), http.StatusBadRequest)
+		return
+	}
+
+	if maxDays == "" {
+	} else if days, err = strconv.Atoi(maxDays); err != nil || days < 0 {
+		http.Error(w, fmt.Sprintf("invalid Max-Days: %s", maxDays), http.StatusBadRequest)
+		return
+	}
+
+	metadata, err := s.updateMetadata(r.Context(), token, filename, func(metadata *Metadata) error {
+		if maxDownloads != "" {
+			metadata.MaxDownloads = downloads
+		}
+
+		if maxDays == "" {
+		} else if days == 0 {
+			metadata.MaxDate = time.Time{}
+		} else {
+			metadata.MaxDate = time.Now().Add(time.Hour * 24 * time.Duration(days))
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		log.Printf("Error metadata: %s", err.Error())
+		http.Error(w, "Could not update file", http.StatusInternalServerError)
+		return
+	}
+
+	contentLength, err := s.storage.Head(r.Context(), token, filename)
+	if err != nil {
+		log.Printf("%s", err.Error())
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(s.ownedFile(r, token, filename, contentLength, metadata)); err != nil {
+		log.Printf("%s", err.Error())
+	}
+}
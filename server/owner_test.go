@@ -0,0 +1,124 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+
+	. "gopkg.in/check.v1"
+)
+
+var _ = Suite(&SuiteOwner{})
+
+type SuiteOwner struct {
+	server *Server
+}
+
+func (s *SuiteOwner) SetUpTest(c *C) {
+	s.server = testServer(c)
+}
+
+func (s *SuiteOwner) request(user, method, target string, header http.Header) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, target, nil)
+	for k, v := range header {
+		req.Header[k] = v
+	}
+
+	return serveRoute(s.server, user, req)
+}
+
+// upload puts file.txt as user and returns its url
+func (s *SuiteOwner) upload(c *C, user string) string {
+	req := httptest.NewRequest("PUT", "/file.txt", bytes.NewBufferString("content"))
+	req.Header.Set("Max-Downloads", "3")
+
+	w := serveRoute(s.server, user, req)
+	c.Assert(w.Code, Equals, http.StatusOK)
+
+	return strings.TrimSpace(w.Body.String())
+}
+
+func (s *SuiteOwner) files(c *C, user string) []ownedFile {
+	w := s.request(user, "GET", "/me/files", http.Header{"Accept": {"application/json"}})
+	c.Assert(w.Code, Equals, http.StatusOK)
+
+	var files []ownedFile
+	c.Assert(json.NewDecoder(w.Body).Decode(&files), IsNil)
+	return files
+}
+
+func (s *SuiteOwner) TestMyFiles(c *C) {
+	fileURL := s.upload(c, "user")
+	s.upload(c, "other")
+
+	c.Assert(s.request("", "GET", "/me/files", nil).Code, Equals, http.StatusUnauthorized)
+
+	files := s.files(c, "user")
+	c.Assert(files, HasLen, 1)
+	c.Assert(files[0].URL, Equals, fileURL)
+	c.Assert(files[0].Filename, Equals, "file.txt")
+	c.Assert(files[0].ContentLength, Equals, uint64(len("content")))
+	c.Assert(files[0].RemainingDownloads, Equals, 3)
+	c.Assert(files[0].Expires, IsNil)
+
+	w := s.request("user", "GET", "/me/files", nil)
+	c.Assert(w.Code, Equals, http.StatusOK)
+	c.Assert(w.Body.String(), Matches, "(?s)URL +SIZE +EXPIRES +REMAINING DOWNLOADS\n"+fileURL+" +7 +n/a +3\n")
+}
+
+func (s *SuiteOwner) TestMyFilesPages(c *C) {
+	for i := 0; i < 3; i++ {
+		s.upload(c, "user")
+	}
+
+	s.upload(c, "other")
+
+	w := s.request("user", "GET", "/me/files?limit=2", http.Header{"Accept": {"application/json"}})
+	c.Assert(w.Code, Equals, http.StatusOK)
+
+	var files []ownedFile
+	c.Assert(json.NewDecoder(w.Body).Decode(&files), IsNil)
+	c.Assert(files, HasLen, 2)
+
+	link := w.Header().Get("Link")
+	c.Assert(link, Matches, `<http://example.com/me/files\?after=.*&limit=2>; rel="next"`)
+
+	next := strings.TrimPrefix(strings.TrimSuffix(link, `>; rel="next"`), "<http://example.com")
+	w = s.request("user", "GET", next, http.Header{"Accept": {"application/json"}})
+	c.Assert(w.Code, Equals, http.StatusOK)
+	c.Assert(json.NewDecoder(w.Body).Decode(&files), IsNil)
+	c.Assert(files, HasLen, 1)
+	c.Assert(w.Header().Get("Link"), Equals, "")
+
+	c.Assert(s.request("user", "GET", "/me/files?limit=0", nil).Code, Equals, http.StatusBadRequest)
+}
+
+func (s *SuiteOwner) TestOwnerDelete(c *C) {
+	path := strings.TrimPrefix(s.upload(c, "user"), "http://example.com")
+
+	c.Assert(s.request("", "DELETE", path, nil).Code, Equals, http.StatusUnauthorized)
+	c.Assert(s.request("other", "DELETE", path, nil).Code, Equals, http.StatusForbidden)
+	c.Assert(s.request("user", "DELETE", path, nil).Code, Equals, http.StatusOK)
+	c.Assert(s.files(c, "user"), HasLen, 0)
+}
+
+func (s *SuiteOwner) TestOwnerEdit(c *C) {
+	path := strings.TrimPrefix(s.upload(c, "user"), "http://example.com")
+
+	c.Assert(s.request("other", "PATCH", path, http.Header{"Max-Days": {"1"}}).Code, Equals, http.StatusForbidden)
+	c.Assert(s.request("user", "PATCH", path, nil).Code, Equals, http.StatusBadRequest)
+	c.Assert(s.request("user", "PATCH", path, http.Header{"Max-Downloads": {"-2"}}).Code, Equals, http.StatusBadRequest)
+
+	w := s.request("user", "PATCH", path, http.Header{"Max-Days": {"1"}, "Max-Downloads": {"-1"}})
+	c.Assert(w.Code, Equals, http.StatusOK)
+
+	var file ownedFile
+	c.Assert(json.NewDecoder(w.Body).Decode(&file), IsNil)
+	c.Assert(file.RemainingDownloads, Equals, -1)
+	c.Assert(file.Expires, NotNil)
+
+	c.Assert(s.request("user", "PATCH", path, http.Header{"Max-Days": {"0"}}).Code, Equals, http.StatusOK)
+	c.Assert(s.files(c, "user")[0].Expires, IsNil)
+}
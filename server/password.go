@@ -0,0 +1,104 @@
+package server
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+)
+
+// argon2id parameters of new password hashes, the parameters are stored with
+// every hash so they can be raised without invalidating existing hashes
+const (
+	argon2Prefix  = "$argon2id$"
+	argon2Time    = 2
+	argon2Memory  = 19 * 1024
+	argon2Threads = 1
+	argon2KeyLen  = 32
+	argon2SaltLen = 16
+)
+
+// bounds of the parameters of stored hashes, hashes outside of them are
+// rejected instead of computed
+const (
+	argon2MaxTime    = 16
+	argon2MaxMemory  = 256 * 1024
+	argon2MaxThreads = 16
+	argon2MaxKeyLen  = 128
+)
+
+var errInvalidHash = errors.New("invalid password hash")
+
+// hashPassword returns the argon2id hash of password in the PHC string format,
+// $argon2id$v=19$m=<memory>,t=<time>,p=<threads>$<salt>$<hash>
+func hashPassword(password string) (string, error) {
+	salt := make([]byte, argon2SaltLen)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+
+	key := argon2.IDKey([]byte(password), salt, argon2Time, argon2Memory, argon2Threads, argon2KeyLen)
+
+	return fmt.Sprintf("%sv=%d$m=%d,t=%d,p=%d$%s$%s", argon2Prefix, argon2.Version, argon2Memory, argon2Time, argon2Threads,
+		base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key)), nil
+}
+
+// verifyPassword reports whether password matches the stored hash, hashes
+// without a $<id>$ prefix are legacy HMAC-SHA256 hashes keyed by the token
+func verifyPassword(hash, password, token string) (bool, error) {
+	if !strings.HasPrefix(hash, "$") {
+		return hmac.Equal([]byte(hash), []byte(cryptoPwd(password, token))), nil
+	}
+
+	if !strings.HasPrefix(hash, argon2Prefix) {
+		return false, errInvalidHash
+	}
+
+	var version, memory, time, threads int
+
+	parts := strings.Split(hash, "$")
+	if len(parts) != 6 {
+		return false, errInvalidHash
+	} else if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return false, errInvalidHash
+	} else if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &memory, &time, &threads); err != nil {
+		return false, errInvalidHash
+	} else if threads < 1 || threads > argon2MaxThreads || time < 1 || time > argon2MaxTime || memory < 8*threads || memory > argon2MaxMemory {
+		return false, errInvalidHash
+	}
+
+	salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return false, errInvalidHash
+	}
+
+	expected, err := base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil || len(expected) == 0 || len(expected) > argon2MaxKeyLen {
+		return false, errInvalidHash
+	}
+
+	key := argon2.IDKey([]byte(password), salt, uint32(time), uint32(memory), uint8(threads), uint32(len(expected)))
+
+	return subtle.ConstantTimeCompare(key, expected) == 1, nil
+}
+
+// needsRehash reports whether a hash should be replaced by a hash with the
+// current parameters after a successful login
+func needsRehash(hash string) bool {
+	return !strings.HasPrefix(hash, fmt.Sprintf("%sv=%d$m=%d,t=%d,p=%d$", argon2Prefix, argon2.Version, argon2Memory, argon2Time, argon2Threads))
+}
+
+// cryptoPwd is the legacy password hash, it is only used to verify passwords
+// stored before argon2id hashes were introduced
+func cryptoPwd(password, token string) string {
+	mac := hmac.New(sha256.New, []byte(token))
+	mac.Write([]byte(password))
+	return hex.EncodeToString(mac.Sum(nil))
+}
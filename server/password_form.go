@@ -0,0 +1,166 @@
+package server
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	html_template "html/template"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// passwordCookieTTL is the lifetime of the cookie set by the password form
+const passwordCookieTTL = time.Hour
+
+// defaultPasswordTemplate renders the form asking for the password of a file
+var defaultPasswordTemplate = html_template.Must(html_template.New("password.html").Parse(`<!DOCTYPE html>
+<html>
+<head>
+	<meta charset="utf-8">
+	<meta name="viewport" content="width=device-width, initial-scale=1">
+	<title>{{ .Filename }} - transfer.sh</title>
+	<style>
+		body { font-family: sans-serif; background: #2d2d2d; color: #eee; }
+		form { max-width: 320px; margin: 15vh auto; }
+		input { display: block; width: 100%; margin: 8px 0; padding: 8px; box-sizing: border-box; }
+		.error { color: #f66; }
+	</style>
+</head>
+<body>
+	<form method="post" action="">
+		<h2>{{ .Filename }}</h2>
+		<p>This file is protected, enter the credentials to download it.</p>
+		{{ if .Error }}<p class="error">{{ .Error }}</p>{{ end }}
+		<input type="text" name="user" placeholder="User" autocomplete="username" required autofocus>
+		<input type="password" name="password" placeholder="Password" autocomplete="current-password" required>
+		<input type="submit" value="Continue">
+	</form>
+</body>
+</html>
+`))
+
+// passwordCookieName returns the name of the cookie that grants access to a file
+func passwordCookieName(token, filename string) string {
+	sum := sha256.Sum256([]byte(token + "/" + filename))
+	return "transfersh_" + hex.EncodeToString(sum[:8])
+}
+
+// signPasswordCookie signs the access to a file until expires, the signature
+// covers the password hash so changing the password revokes the cookie
+func (s *Server) signPasswordCookie(token, filename string, metadata Metadata, expires int64) string {
+	mac := hmac.New(sha256.New, s.secret)
+	mac.Write([]byte(strings.Join([]string{token, filename, strconv.FormatInt(expires, 10), metadata.Password}, "\n")))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// validPasswordCookie reports whether the request carries an unexpired
+// cookie set by the password form for the file
+func (s *Server) validPasswordCookie(r *http.Request, token, filename string, metadata Metadata) bool {
+	cookie, err := r.Cookie(passwordCookieName(token, filename))
+	if err != nil {
+		return false
+	}
+
+	parts := strings.SplitN(cookie.Value, ".", 2)
+	if len(parts) != 2 {
+		return false
+	}
+
+	expires, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil || time.Now().Unix() > expires {
+		return false
+	}
+
+	return hmac.Equal([]byte(parts[1]), []byte(s.signPasswordCookie(token, filename, metadata, expires)))
+}
+
+func (s *Server) setPasswordCookie(w http.ResponseWriter, r *http.Request, token, filename string, metadata Metadata) {
+	expires := time.Now().Add(passwordCookieTTL)
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     passwordCookieName(token, filename),
+		Value:    strconv.FormatInt(expires.Unix(), 10) + "." + s.signPasswordCookie(token, filename, metadata, expires.Unix()),
+		Path:     "/",
+		Expires:  expires,
+		MaxAge:   int(passwordCookieTTL.Seconds()),
+		Secure:   r.TLS != nil || r.Header.Get("X-Forwarded-Proto") == "https",
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+// wantsPasswordForm reports whether the credentials of a request should be
+// asked with the password form instead of a Basic auth prompt
+func wantsPasswordForm(r *http.Request, metadata Metadata) bool {
+	if r.Method != http.MethodGet || !acceptsHTML(r.Header) {
+		return false
+	}
+
+	for _, authType := range metadata.AuthTypes {
+		if authType == METADATA {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (s *Server) renderPasswordForm(w http.ResponseWriter, filename string, message string) {
+	t := lookupTemplate("password.html")
+
+	data := struct {
+		Filename string
+		Error    string
+	}{
+		filename,
+		message,
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(http.StatusUnauthorized)
+
+	if err := t.Execute(w, data); err != nil {
+		log.Printf("%s", err.Error())
+	}
+}
+
+// passwordHandler checks the credentials posted by the password form and
+// redirects back to the file with a cookie that grants access to it
+func (s *Server) passwordHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	token := vars["token"]
+	filename := vars["filename"]
+
+	metadata, ok := MetadataFromContext(r.Context())
+	if !ok {
+		http.Error(w, "failed to get metadata", http.StatusBadRequest)
+		return
+	}
+
+	authenticators, ok := s.credentialAuthenticators(w, &metadata)
+	if !ok {
+		return
+	}
+
+	if len(authenticators) == 0 {
+	} else if ok, err := s.checkCredentials(r, token, filename, &metadata, authenticators, r.PostFormValue("user"), r.PostFormValue("password")); err != nil {
+		http.Error(w, "Authentication service unavailable", http.StatusServiceUnavailable)
+		return
+	} else if !ok {
+		s.renderPasswordForm(w, filename, "The user or password is incorrect.")
+		return
+	}
+
+	s.setPasswordCookie(w, r, token, filename, metadata)
+
+	// relative to the requested url, so it works behind a proxy path
+	w.Header().Set("Location", url.PathEscape(filename))
+	w.WriteHeader(http.StatusSeeOther)
+}
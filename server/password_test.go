@@ -0,0 +1,58 @@
+package server
+
+import (
+	"strings"
+
+	. "gopkg.in/check.v1"
+)
+
+var _ = Suite(&SuitePassword{})
+
+type SuitePassword struct{}
+
+func (s *SuitePassword) TestHash(c *C) {
+	hash, err := hashPassword("secret")
+	c.Assert(err, IsNil)
+	c.Assert(strings.HasPrefix(hash, "$argon2id$v=19$"), Equals, true)
+	c.Assert(needsRehash(hash), Equals, false)
+
+	other, err := hashPassword("secret")
+	c.Assert(err, IsNil)
+	c.Assert(other, Not(Equals), hash)
+
+	ok, err := verifyPassword(hash, "secret", "token")
+	c.Assert(err, IsNil)
+	c.Assert(ok, Equals, true)
+
+	ok, err = verifyPassword(hash, "wrong", "token")
+	c.Assert(err, IsNil)
+	c.Assert(ok, Equals, false)
+}
+
+func (s *SuitePassword) TestLegacyHash(c *C) {
+	hash := cryptoPwd("secret", "token")
+	c.Assert(needsRehash(hash), Equals, true)
+
+	ok, err := verifyPassword(hash, "secret", "token")
+	c.Assert(err, IsNil)
+	c.Assert(ok, Equals, true)
+
+	ok, err = verifyPassword(hash, "secret", "other")
+	c.Assert(err, IsNil)
+	c.Assert(ok, Equals, false)
+}
+
+func (s *SuitePassword) TestInvalidHash(c *C) {
+	_, err := verifyPassword("$bcrypt$invalid", "secret", "token")
+	c.Assert(err, NotNil)
+
+	_, err = verifyPassword("$argon2id$v=19$m=1,t=1,p=1$$", "secret", "token")
+	c.Assert(err, NotNil)
+
+	// parameters that would panic or exhaust the server are rejected
+	for _, params := range []string{"m=19456,t=2,p=0", "m=19456,t=0,p=1", "m=4,t=2,p=1", "m=4194304,t=2,p=1", "m=19456,t=1000,p=1", "m=19456,t=2,p=255"} {
+		ok, err := verifyPassword("$argon2id$v=19$"+params+"$c2FsdHNhbHQ$a2V5a2V5a2V5a2V5", "secret", "token")
+		c.Assert(err, Equals, errInvalidHash, Commentf("%s", params))
+		c.Assert(ok, Equals, false)
+	}
+}
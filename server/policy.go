@@ -0,0 +1,292 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+// The names of the routes registered in Server.Run, policy rules select
+// routes by these names
+const (
+	RouteStatic   = "static"
+	RouteHealth   = "health"
+	RouteView     = "view"
+	RouteArchive  = "archive"
+	RouteHead     = "head"
+	RoutePreview  = "preview"
+	RouteDownload = "download"
+	RoutePassword = "password"
+	RouteScan     = "scan"
+	RouteUpload   = "upload"
+	RouteDelete   = "delete"
+	RouteSign     = "sign"
+	RoutePresign  = "presign"
+	RouteDropbox  = "dropbox"
+	RouteLinks    = "links"
+	RouteFiles    = "files"
+	RouteEdit     = "edit"
+	RouteAdmin    = "admin"
+)
+
+var policyRoutes = []string{RouteStatic, RouteHealth, RouteView, RouteArchive, RouteHead, RoutePreview, RouteDownload, RoutePassword, RouteScan, RouteUpload, RouteDelete, RouteSign, RoutePresign, RouteDropbox, RouteLinks, RouteFiles, RouteEdit, RouteAdmin}
+
+// PolicyEffect is what a matching policy rule does with a request
+type PolicyEffect string
+
+const (
+	// PolicyAllow passes the request without credentials, it skips the
+	// server-wide upload credentials but not the restrictions of a file
+	PolicyAllow PolicyEffect = "allow"
+	// PolicyDeny refuses the request
+	PolicyDeny PolicyEffect = "deny"
+	// PolicyAuthenticate requires credentials of the server-wide
+	// authenticators, an API key or a client certificate, with any of the
+	// scopes of the rule
+	PolicyAuthenticate PolicyEffect = "authenticate"
+)
+
+// PolicyRule applies its effect to the requests it matches, a rule matches
+// the requests that match all of its conditions
+type PolicyRule struct {
+	// Routes are the names of the routes, "*" matches all routes
+	Routes []string `json:"routes"`
+	// Methods match all methods when empty
+	Methods []string `json:"methods,omitempty"`
+	// Networks are the IPs or CIDRs of the client, all clients when empty
+	Networks []string `json:"networks,omitempty"`
+
+	Effect PolicyEffect `json:"effect"`
+	// Scopes of which the identity needs one, with the authenticate effect
+	Scopes []Scope `json:"scopes,omitempty"`
+
+	ips  []net.IP
+	nets []*net.IPNet
+}
+
+// Policy is a list of rules of which the first matching rule decides,
+// requests that no rule matches pass
+type Policy struct {
+	Rules []*PolicyRule `json:"rules"`
+}
+
+// LoadPolicy reads a JSON policy file
+func LoadPolicy(path string) (*Policy, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	defer f.Close()
+
+	var policy Policy
+
+	decoder := json.NewDecoder(f)
+	decoder.DisallowUnknownFields()
+
+	if err := decoder.Decode(&policy); err != nil {
+		return nil, fmt.Errorf("%s: %s", path, err.Error())
+	}
+
+	if err := policy.compile(); err != nil {
+		return nil, fmt.Errorf("%s: %s", path, err.Error())
+	}
+
+	return &policy, nil
+}
+
+// compile validates the rules and parses their networks
+func (p *Policy) compile() error {
+	for i, rule := range p.Rules {
+		switch rule.Effect {
+		case PolicyAllow, PolicyDeny, PolicyAuthenticate:
+		default:
+			return fmt.Errorf("rule %d: unknown effect %q", i, rule.Effect)
+		}
+
+		if len(rule.Routes) == 0 {
+			return fmt.Errorf("rule %d: no routes", i)
+		}
+
+		for _, route := range rule.Routes {
+			if route != "*" && !containsString(policyRoutes, route) {
+				return fmt.Errorf("rule %d: unknown route %q", i, route)
+			}
+		}
+
+		for _, scope := range rule.Scopes {
+			if _, err := ParseScope(string(scope)); err != nil {
+				return fmt.Errorf("rule %d: %s", i, err.Error())
+			}
+		}
+
+		if len(rule.Networks) != 0 {
+			var err error
+			if rule.ips, rule.nets, err = parseIPString(strings.Join(rule.Networks, ",")); err != nil {
+				return fmt.Errorf("rule %d: %s", i, err.Error())
+			}
+		}
+	}
+
+	return nil
+}
+
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+
+	return false
+}
+
+// matches reports whether the rule matches a request of route
+func (rule *PolicyRule) matches(r *http.Request, route string) bool {
+	if !containsString(rule.Routes, "*") && !containsString(rule.Routes, route) {
+		return false
+	}
+
+	if len(rule.Methods) != 0 {
+		matched := false
+		for _, method := range rule.Methods {
+			matched = matched || strings.EqualFold(method, r.Method)
+		}
+
+		if !matched {
+			return false
+		}
+	}
+
+	if len(rule.Networks) != 0 {
+		metadata := Metadata{AuthTypes: []AuthType{IP}, IP: rule.ips, Nets: rule.nets}
+		if !metadata.AllowedIP(r.RemoteAddr) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// match returns the first rule that matches a request of route, if any
+func (p *Policy) match(r *http.Request, route string) *PolicyRule {
+	for _, rule := range p.Rules {
+		if rule.matches(r, route) {
+			return rule
+		}
+	}
+
+	return nil
+}
+
+// UsePolicy evaluates the rules of policy ahead of the handlers
+func UsePolicy(policy *Policy) OptionFn {
+	return func(srvr *Server) {
+		srvr.policy = policy
+	}
+}
+
+type policyContextKey struct{}
+
+// policyAuthorized reports whether the policy authorized the request, the
+// server-wide upload credentials are then not checked again
+func policyAuthorized(ctx context.Context) bool {
+	authorized, _ := ctx.Value(policyContextKey{}).(bool)
+	return authorized
+}
+
+// PolicyHandler applies the policy rule that matches the route of the request
+func (s *Server) PolicyHandler(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var route string
+		if current := mux.CurrentRoute(r); current != nil {
+			route = current.GetName()
+		}
+
+		rule := s.policy.match(r, route)
+		if rule == nil {
+			h.ServeHTTP(w, r)
+			return
+		}
+
+		switch rule.Effect {
+		case PolicyDeny:
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		case PolicyAllow:
+			h.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), policyContextKey{}, true)))
+			return
+		}
+
+		// presigned upload urls stand in for the credentials of their minter,
+		// they are verified by BasicAuthHandler
+		if route == RouteUpload && r.URL.Query().Get("presign") != "" {
+			h.ServeHTTP(w, r)
+			return
+		}
+
+		identity, ok := s.requireIdentity(w, r)
+		if !ok {
+			return
+		}
+
+		if len(rule.Scopes) != 0 {
+			allowed := false
+			for _, scope := range rule.Scopes {
+				allowed = allowed || identity.HasScope(scope)
+			}
+
+			if !allowed {
+				http.Error(w, "Forbidden", http.StatusForbidden)
+				return
+			}
+		}
+
+		ctx := context.WithValue(WithIdentity(r.Context(), identity), policyContextKey{}, true)
+		h.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// requestIdentity resolves the identity of the request with its API key,
+// client certificate, bearer token or Basic auth credentials, in that order
+func (s *Server) requestIdentity(r *http.Request) (Identity, bool, error) {
+	if key, err := s.requestAPIKey(r); err == nil {
+		return keyIdentity(key), true, nil
+	} else if err != errNoAPIKey {
+		return Identity{}, false, err
+	}
+
+	if user := s.certificateUser(r); user != "" {
+		return certificateIdentity(user), true, nil
+	}
+
+	if token := bearerToken(r); token != "" {
+		if authenticator, ok := s.tokenAuths[ServerAuthKey]; ok {
+			user, ok := authenticateToken([]TokenAuthenticator{authenticator}, token)
+			return Identity{User: user}, ok, nil
+		}
+	}
+
+	if username, password, ok := r.BasicAuth(); ok {
+		if authenticator, ok := s.auths[ServerAuthKey]; ok {
+			return authenticate(r.Context(), authenticator, username, password)
+		}
+	}
+
+	return Identity{}, false, nil
+}
+
+// challenge asks for the credentials of the server-wide authenticators
+func (s *Server) challenge(w http.ResponseWriter) {
+	if _, ok := s.auths[ServerAuthKey]; ok {
+		w.Header().Set("WWW-Authenticate", "Basic realm=\"Restricted\"")
+	} else if _, ok := s.tokenAuths[ServerAuthKey]; ok {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+	}
+}
@@ -0,0 +1,118 @@
+package server
+
+import (
+	"bytes"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+
+	apiauth "github.com/dutchcoders/transfer.sh/api-auth"
+	"github.com/gorilla/mux"
+	. "gopkg.in/check.v1"
+)
+
+var _ = Suite(&SuitePolicy{})
+
+type SuitePolicy struct {
+	api    *httptest.Server
+	server *Server
+	router *mux.Router
+}
+
+const testPolicy = `{
+	"rules": [
+		{"routes": ["upload"], "networks": ["10.0.0.0/8"], "effect": "allow"},
+		{"routes": ["delete"], "effect": "authenticate", "scopes": ["admin"]},
+		{"routes": ["archive"], "effect": "authenticate"},
+		{"routes": ["scan"], "effect": "deny"}
+	]
+}`
+
+func (s *SuitePolicy) loadPolicy(c *C, data string) (*Policy, error) {
+	path := filepath.Join(c.MkDir(), "policy.json")
+	c.Assert(ioutil.WriteFile(path, []byte(data), 0600), IsNil)
+
+	return LoadPolicy(path)
+}
+
+func (s *SuitePolicy) SetUpTest(c *C) {
+	policy, err := s.loadPolicy(c, testPolicy)
+	c.Assert(err, IsNil)
+
+	s.api = apiEndpoint(map[string]apiauth.Result{
+		"admin":    {User: "admin", Scopes: []string{"admin"}},
+		"uploader": {User: "uploader", Scopes: []string{"upload"}},
+	})
+
+	storage, err := NewLocalStorage(c.MkDir(), log.New(ioutil.Discard, "", 0))
+	c.Assert(err, IsNil)
+
+	s.server, err = New(UseStorage(storage), UseMetaStorage(storage), UsePolicy(policy), UseAPIAuthenticator(apiauth.APIConfig{Endpoint: s.api.URL}), APIAuthUploads())
+	c.Assert(err, IsNil)
+
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+
+	s.router = mux.NewRouter()
+	s.router.HandleFunc("/({files:.*}).zip", ok).Methods("GET").Name(RouteArchive)
+	s.router.HandleFunc("/{filename}/scan", ok).Methods("PUT").Name(RouteScan)
+	s.router.HandleFunc("/{filename}", s.server.BasicAuthHandler(ok)).Methods("PUT").Name(RouteUpload)
+	s.router.HandleFunc("/{token}/{filename}", ok).Methods("GET").Name(RouteDownload)
+	s.router.HandleFunc("/{token}/{filename}", ok).Methods("DELETE").Name(RouteDelete)
+	s.router.Use(s.server.PolicyHandler)
+}
+
+func (s *SuitePolicy) TearDownTest(c *C) {
+	s.api.Close()
+}
+
+func (s *SuitePolicy) serve(method, path, remoteAddr, user string) int {
+	req := httptest.NewRequest(method, path, bytes.NewBufferString("content"))
+	req.RemoteAddr = remoteAddr
+	if user != "" {
+		req.SetBasicAuth(user, "secret")
+	}
+
+	w := httptest.NewRecorder()
+	s.router.ServeHTTP(w, req)
+
+	return w.Result().StatusCode
+}
+
+func (s *SuitePolicy) TestLoadPolicy(c *C) {
+	for _, invalid := range []string{
+		`{"rules": [{"routes": ["upload"], "effect": "maybe"}]}`,
+		`{"rules": [{"routes": ["uploads"], "effect": "allow"}]}`,
+		`{"rules": [{"effect": "allow"}]}`,
+		`{"rules": [{"routes": ["*"], "effect": "authenticate", "scopes": ["root"]}]}`,
+		`{"rules": [{"routes": ["*"], "effect": "allow", "networks": ["10.0.0.0/33"]}]}`,
+		`{"rules": [{"routes": ["*"], "effect": "allow", "network": "10.0.0.0/8"}]}`,
+	} {
+		_, err := s.loadPolicy(c, invalid)
+		c.Assert(err, NotNil, Commentf(invalid))
+	}
+}
+
+func (s *SuitePolicy) TestUploads(c *C) {
+	c.Assert(s.serve("PUT", "/file.txt", "10.1.2.3:1234", ""), Equals, http.StatusOK)
+	c.Assert(s.serve("PUT", "/file.txt", "192.168.1.1:1234", ""), Equals, http.StatusUnauthorized)
+	c.Assert(s.serve("PUT", "/file.txt", "192.168.1.1:1234", "uploader"), Equals, http.StatusOK)
+	c.Assert(s.serve("PUT", "/file.txt?presign=0011223344556677_00", "192.168.1.1:1234", ""), Equals, http.StatusForbidden)
+}
+
+func (s *SuitePolicy) TestDeletes(c *C) {
+	c.Assert(s.serve("DELETE", "/token/file.txt", "10.1.2.3:1234", ""), Equals, http.StatusUnauthorized)
+	c.Assert(s.serve("DELETE", "/token/file.txt", "10.1.2.3:1234", "uploader"), Equals, http.StatusForbidden)
+	c.Assert(s.serve("DELETE", "/token/file.txt", "10.1.2.3:1234", "admin"), Equals, http.StatusOK)
+}
+
+func (s *SuitePolicy) TestArchivesAndDownloads(c *C) {
+	c.Assert(s.serve("GET", "/(token/file.txt).zip", "10.1.2.3:1234", ""), Equals, http.StatusUnauthorized)
+	c.Assert(s.serve("GET", "/(token/file.txt).zip", "10.1.2.3:1234", "uploader"), Equals, http.StatusOK)
+	c.Assert(s.serve("GET", "/token/file.txt", "10.1.2.3:1234", ""), Equals, http.StatusOK)
+}
+
+func (s *SuitePolicy) TestDeny(c *C) {
+	c.Assert(s.serve("PUT", "/file.txt/scan", "10.1.2.3:1234", "admin"), Equals, http.StatusForbidden)
+}
@@ -0,0 +1,409 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+const (
+	// presignToken is the reserved token the presigned uploads are stored under
+	presignToken = "_presign"
+	// defaultPresignExpiry is the lifetime of a presigned upload url when
+	// none is requested
+	defaultPresignExpiry = 24 * time.Hour
+)
+
+var (
+	errInvalidPresign = errors.New("invalid or expired upload url")
+	errPresignUsed    = errors.New("upload url already used")
+)
+
+// PresignedUpload is an upload url minted by an authenticated user, it
+// accepts a single upload without credentials. Only the hash of its secret
+// is kept.
+type PresignedUpload struct {
+	ID        string    `json:"id"`
+	Hash      string    `json:"hash,omitempty"`
+	User      string    `json:"user,omitempty"`
+	Namespace string    `json:"namespace,omitempty"`
+	Created   time.Time `json:"created"`
+	Expires   time.Time `json:"expires"`
+	// MaxSize is the size limit of the upload in bytes, 0 is unlimited
+	MaxSize int64 `json:"max_size,omitempty"`
+	// Filename is a path.Match pattern the filename of the upload must match
+	Filename string `json:"filename,omitempty"`
+	// MaxDays and MaxDownloads replace the limits requested by the uploader,
+	// 0 is unlimited
+	MaxDays      int `json:"max_days,omitempty"`
+	MaxDownloads int `json:"max_downloads,omitempty"`
+	// Claimed is set from the start of the upload
+	Claimed bool `json:"claimed"`
+	// Uploaded, URL and DeleteURL report the upload to the minter
+	Uploaded  time.Time `json:"uploaded"`
+	URL       string    `json:"url,omitempty"`
+	DeleteURL string    `json:"delete_url,omitempty"`
+}
+
+// Expired reports whether the upload url expired
+func (p PresignedUpload) Expired() bool {
+	return time.Now().After(p.Expires)
+}
+
+// apply replaces the limits of metadata by those of the upload url
+func (p PresignedUpload) apply(metadata *Metadata) {
+	metadata.Namespace = p.Namespace
+	metadata.Owner = p.User
+	metadata.MaxDownloads = -1
+	metadata.MaxDate = time.Time{}
+
+	if p.MaxDownloads > 0 {
+		metadata.MaxDownloads = p.MaxDownloads
+	}
+
+	if p.MaxDays > 0 {
+		metadata.MaxDate = time.Now().Add(time.Hour * 24 * time.Duration(p.MaxDays))
+	}
+}
+
+func (s *Server) getPresign(ctx context.Context, id string) (PresignedUpload, error) {
+	var presign PresignedUpload
+
+	reader, _, err := s.metadataStorage.Get(ctx, presignToken, id+".json")
+	if err != nil {
+		return presign, err
+	}
+
+	defer reader.Close()
+
+	data, err := ioutil.ReadAll(reader)
+	if err != nil {
+		return presign, err
+	}
+
+	err = json.Unmarshal(data, &presign)
+	return presign, err
+}
+
+func (s *Server) putPresign(ctx context.Context, presign PresignedUpload) error {
+	data, err := json.Marshal(presign)
+	if err != nil {
+		return err
+	}
+
+	return s.metadataStorage.Put(ctx, presignToken, presign.ID+".json", bytes.NewReader(data), "text/json", uint64(len(data)))
+}
+
+// updatePresign applies fn to the stored upload url with id and stores the
+// result, it isn't stored when fn returns an error
+func (s *Server) updatePresign(ctx context.Context, id string, fn func(*PresignedUpload) error) error {
+	s.Lock(presignToken, id)
+	defer s.Unlock(presignToken, id)
+
+	presign, err := s.getPresign(ctx, id)
+	if err != nil {
+		return err
+	}
+
+	if err := fn(&presign); err != nil {
+		return err
+	}
+
+	return s.putPresign(ctx, presign)
+}
+
+// createPresign stores the upload url presign, it returns the secret of the url
+func (s *Server) createPresign(ctx context.Context, presign PresignedUpload) (string, PresignedUpload, error) {
+	id, err := randomHex(8)
+	if err != nil {
+		return "", presign, err
+	}
+
+	secret, err := randomHex(24)
+	if err != nil {
+		return "", presign, err
+	}
+
+	presign.ID = id
+	presign.Hash = hashAPIKey(secret)
+	presign.Created = time.Now().UTC()
+
+	if err := s.putPresign(ctx, presign); err != nil {
+		return "", presign, err
+	}
+
+	return id + "_" + secret, presign, nil
+}
+
+// lookupPresign returns the stored upload url of secret, unknown and expired
+// urls are reported as errInvalidPresign
+func (s *Server) lookupPresign(ctx context.Context, secret string) (PresignedUpload, error) {
+	parts := strings.SplitN(secret, "_", 2)
+	if len(parts) != 2 {
+		return PresignedUpload{}, errInvalidPresign
+	}
+
+	if _, err := hex.DecodeString(parts[0]); err != nil {
+		return PresignedUpload{}, errInvalidPresign
+	}
+
+	presign, err := s.getPresign(ctx, parts[0])
+	if s.metadataStorage.IsNotExist(err) {
+		return PresignedUpload{}, errInvalidPresign
+	} else if err != nil {
+		return PresignedUpload{}, err
+	}
+
+	if subtle.ConstantTimeCompare([]byte(presign.Hash), []byte(hashAPIKey(parts[1]))) != 1 || presign.Expired() {
+		return PresignedUpload{}, errInvalidPresign
+	} else if presign.Claimed {
+		return PresignedUpload{}, errPresignUsed
+	}
+
+	return presign, nil
+}
+
+type presignContextKey struct{}
+
+func withPresign(ctx context.Context, presign PresignedUpload) context.Context {
+	return context.WithValue(ctx, presignContextKey{}, presign)
+}
+
+// presignFromContext returns the upload url the request is authorized by
+func presignFromContext(ctx context.Context) (PresignedUpload, bool) {
+	presign, ok := ctx.Value(presignContextKey{}).(PresignedUpload)
+	return presign, ok
+}
+
+// presignAuthorize authorizes an upload with the upload url of the presign
+// query parameter, it writes the response and returns false when the url
+// isn't valid
+func (s *Server) presignAuthorize(w http.ResponseWriter, r *http.Request) (*http.Request, bool) {
+	presign, err := s.lookupPresign(r.Context(), r.URL.Query().Get("presign"))
+	if err == errInvalidPresign || err == errPresignUsed {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return r, false
+	} else if err != nil {
+		log.Printf("Error looking up upload url: %s", err.Error())
+		http.Error(w, "Could not verify upload url", http.StatusInternalServerError)
+		return r, false
+	}
+
+	if presign.MaxSize > 0 && r.ContentLength > presign.MaxSize {
+		http.Error(w, "upload too large", http.StatusRequestEntityTooLarge)
+		return r, false
+	}
+
+	return r.WithContext(withPresign(r.Context(), presign)), true
+}
+
+// reservePresign claims the upload url of the request for the upload of
+// filename, it writes the response and returns false when the upload isn't
+// allowed by the url
+func (s *Server) reservePresign(w http.ResponseWriter, r *http.Request, filename string, contentLength int64) bool {
+	presign, ok := presignFromContext(r.Context())
+	if !ok {
+		return true
+	}
+
+	if matched, _ := path.Match(presign.Filename, filename); presign.Filename != "" && !matched {
+		http.Error(w, fmt.Sprintf("filename must match %s", presign.Filename), http.StatusForbidden)
+		return false
+	} else if presign.MaxSize > 0 && contentLength > presign.MaxSize {
+		http.Error(w, "upload too large", http.StatusRequestEntityTooLarge)
+		return false
+	}
+
+	err := s.updatePresign(r.Context(), presign.ID, func(presign *PresignedUpload) error {
+		if presign.Claimed {
+			return errPresignUsed
+		}
+
+		presign.Claimed = true
+		return nil
+	})
+
+	if err == errPresignUsed {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return false
+	} else if err != nil {
+		log.Printf("Error claiming upload url: %s", err.Error())
+		http.Error(w, "Could not claim upload url", http.StatusInternalServerError)
+		return false
+	}
+
+	return true
+}
+
+// releasePresign frees the upload url of a failed upload
+func (s *Server) releasePresign(r *http.Request) {
+	presign, ok := presignFromContext(r.Context())
+	if !ok {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), abortUploadTimeout)
+	defer cancel()
+
+	if err := s.updatePresign(ctx, presign.ID, func(presign *PresignedUpload) error {
+		presign.Claimed = false
+		return nil
+	}); err != nil {
+		log.Printf("Error releasing upload url: %s", err.Error())
+	}
+}
+
+// completePresign reports the links of the upload to the minter of the
+// upload url of the request
+func (s *Server) completePresign(r *http.Request, downloadURL, deleteURL string) {
+	presign, ok := presignFromContext(r.Context())
+	if !ok {
+		return
+	}
+
+	if err := s.updatePresign(r.Context(), presign.ID, func(presign *PresignedUpload) error {
+		presign.Uploaded = time.Now().UTC()
+		presign.URL = downloadURL
+		presign.DeleteURL = deleteURL
+		return nil
+	}); err != nil {
+		log.Printf("Error completing upload url: %s", err.Error())
+	}
+}
+
+// presignResponse is the answer to the minter of an upload url
+type presignResponse struct {
+	PresignedUpload
+	UploadURL string `json:"upload_url,omitempty"`
+}
+
+func writePresign(w http.ResponseWriter, presign PresignedUpload, uploadURL string) {
+	presign.Hash = ""
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(presignResponse{presign, uploadURL}); err != nil {
+		log.Printf("%s", err.Error())
+	}
+}
+
+// presignHandler mints an upload url, it is served behind the upload
+// credentials. The form values expires, max_size, filename, max_days and
+// max_downloads set the limits of the url.
+func (s *Server) presignHandler(w http.ResponseWriter, r *http.Request) {
+	if _, ok := presignFromContext(r.Context()); ok {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	presign := PresignedUpload{Filename: r.FormValue("filename")}
+
+	expiry := defaultPresignExpiry
+	if v := r.FormValue("expires"); v != "" {
+		var err error
+		if expiry, err = time.ParseDuration(v); err != nil || expiry <= 0 {
+			http.Error(w, fmt.Sprintf("invalid expires: %s", v), http.StatusBadRequest)
+			return
+		}
+	}
+
+	presign.Expires = time.Now().Add(expiry).UTC()
+
+	if _, err := path.Match(presign.Filename, ""); err != nil {
+		http.Error(w, fmt.Sprintf("invalid filename: %s", presign.Filename), http.StatusBadRequest)
+		return
+	}
+
+	for name, v := range map[string]*int{"max_days": &presign.MaxDays, "max_downloads": &presign.MaxDownloads} {
+		if value := r.FormValue(name); value == "" {
+		} else if n, err := strconv.Atoi(value); err != nil || n < 0 {
+			http.Error(w, fmt.Sprintf("invalid %s: %s", name, value), http.StatusBadRequest)
+			return
+		} else {
+			*v = n
+		}
+	}
+
+	if v := r.FormValue("max_size"); v == "" {
+	} else if n, err := strconv.ParseInt(v, 10, 64); err != nil || n < 0 {
+		http.Error(w, fmt.Sprintf("invalid max_size: %s", v), http.StatusBadRequest)
+		return
+	} else {
+		presign.MaxSize = n
+	}
+
+	if identity, ok := IdentityFromContext(r.Context()); ok {
+		presign.User = identity.User
+
+		if identity.Key != nil {
+			presign.Namespace = identity.Key.Namespace
+		}
+	}
+
+	secret, presign, err := s.createPresign(r.Context(), presign)
+	if err != nil {
+		log.Printf("Error creating upload url: %s", err.Error())
+		http.Error(w, "Could not create upload url", http.StatusInternalServerError)
+		return
+	}
+
+	uploadURL, _ := url.Parse(s.proxyPath + "/")
+	uploadURL.RawQuery = url.Values{"presign": {secret}}.Encode()
+
+	writePresign(w, presign, resolveURL(r, uploadURL, s.proxyPort))
+}
+
+// presignStatusHandler reports an upload url and its upload to its minter
+func (s *Server) presignStatusHandler(w http.ResponseWriter, r *http.Request) {
+	if _, ok := presignFromContext(r.Context()); ok {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	id := mux.Vars(r)["id"]
+	if _, err := hex.DecodeString(id); err != nil {
+		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		return
+	}
+
+	presign, err := s.getPresign(r.Context(), id)
+	if s.metadataStorage.IsNotExist(err) {
+		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		return
+	} else if err != nil {
+		log.Printf("Error reading upload url: %s", err.Error())
+		http.Error(w, "Could not read upload url", http.StatusInternalServerError)
+		return
+	}
+
+	if identity, _ := IdentityFromContext(r.Context()); identity.User != presign.User {
+		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		return
+	}
+
+	writePresign(w, presign, "")
+}
+
+// countFiles returns the number of files of a multipart form
+func countFiles(form *multipart.Form) int {
+	n := 0
+	for _, fheaders := range form.File {
+		n += len(fheaders)
+	}
+
+	return n
+}
@@ -0,0 +1,143 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+
+	. "gopkg.in/check.v1"
+)
+
+var _ = Suite(&SuitePresign{})
+
+type SuitePresign struct {
+	server *Server
+}
+
+func (s *SuitePresign) SetUpTest(c *C) {
+	s.server = testServer(c)
+}
+
+func (s *SuitePresign) mint(c *C, user string, form url.Values) (*http.Response, presignResponse) {
+	req := httptest.NewRequest("POST", "/presign", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	w := serveRoute(s.server, user, req)
+
+	var presign presignResponse
+	if w.Code == http.StatusOK {
+		c.Assert(json.NewDecoder(w.Body).Decode(&presign), IsNil)
+	}
+
+	return w.Result(), presign
+}
+
+func (s *SuitePresign) status(c *C, user, id string) (int, presignResponse) {
+	w := serveRoute(s.server, user, httptest.NewRequest("GET", "/presign/"+id, nil))
+
+	var presign presignResponse
+	if w.Code == http.StatusOK {
+		c.Assert(json.NewDecoder(w.Body).Decode(&presign), IsNil)
+	}
+
+	return w.Code, presign
+}
+
+func (s *SuitePresign) put(c *C, uploadURL, filename, content string) *http.Response {
+	u, err := url.Parse(uploadURL)
+	c.Assert(err, IsNil)
+
+	req := httptest.NewRequest("PUT", "/"+filename+"?"+u.RawQuery, bytes.NewBufferString(content))
+	req.Header.Set("Max-Downloads", "100")
+
+	return serveRoute(s.server, "", req).Result()
+}
+
+func (s *SuitePresign) TestMint(c *C) {
+	resp, _ := s.mint(c, "", nil)
+	c.Assert(resp.StatusCode, Equals, http.StatusUnauthorized)
+
+	for _, invalid := range []url.Values{
+		{"expires": {"tomorrow"}},
+		{"max_size": {"-1"}},
+		{"max_days": {"x"}},
+		{"filename": {"[.pdf"}},
+	} {
+		resp, _ := s.mint(c, "user", invalid)
+		c.Assert(resp.StatusCode, Equals, http.StatusBadRequest, Commentf("%v", invalid))
+	}
+
+	resp, presign := s.mint(c, "user", url.Values{"filename": {"*.pdf"}, "max_size": {"10"}})
+	c.Assert(resp.StatusCode, Equals, http.StatusOK)
+	c.Assert(presign.UploadURL, Matches, "http://example.com/\\?presign="+presign.ID+"_[0-9a-f]+")
+	c.Assert(presign.Hash, Equals, "")
+	c.Assert(presign.User, Equals, "user")
+}
+
+func (s *SuitePresign) TestUpload(c *C) {
+	_, presign := s.mint(c, "user", url.Values{"filename": {"*.pdf"}, "max_size": {"10"}, "max_days": {"2"}, "max_downloads": {"1"}})
+
+	c.Assert(s.put(c, presign.UploadURL, "report.txt", "content").StatusCode, Equals, http.StatusForbidden)
+	c.Assert(s.put(c, presign.UploadURL, "report.pdf", "too much content").StatusCode, Equals, http.StatusRequestEntityTooLarge)
+
+	resp := s.put(c, presign.UploadURL, "report.pdf", "content")
+	c.Assert(resp.StatusCode, Equals, http.StatusOK)
+
+	body, _ := ioutil.ReadAll(resp.Body)
+	token := strings.Split(string(body), "/")[3]
+
+	metadata, err := s.server.readMetadata(context.Background(), token, "report.pdf")
+	c.Assert(err, IsNil)
+	c.Assert(metadata.MaxDownloads, Equals, 1)
+	c.Assert(metadata.MaxDate.IsZero(), Equals, false)
+
+	// the url accepts a single upload
+	c.Assert(s.put(c, presign.UploadURL, "report.pdf", "content").StatusCode, Equals, http.StatusForbidden)
+
+	code, status := s.status(c, "user", presign.ID)
+	c.Assert(code, Equals, http.StatusOK)
+	c.Assert(status.URL, Equals, string(body))
+	c.Assert(status.DeleteURL, Equals, resp.Header.Get("X-Url-Delete"))
+	c.Assert(status.Uploaded.IsZero(), Equals, false)
+
+	code, _ = s.status(c, "other", presign.ID)
+	c.Assert(code, Equals, http.StatusNotFound)
+}
+
+func (s *SuitePresign) TestPost(c *C) {
+	_, presign := s.mint(c, "user", nil)
+
+	post := func(filenames ...string) int {
+		body := &bytes.Buffer{}
+		writer := multipart.NewWriter(body)
+		for _, filename := range filenames {
+			part, err := writer.CreateFormFile("file", filename)
+			c.Assert(err, IsNil)
+			part.Write([]byte("content"))
+		}
+		writer.Close()
+
+		u, _ := url.Parse(presign.UploadURL)
+		req := httptest.NewRequest("POST", "/?"+u.RawQuery, body)
+		req.Header.Set("Content-Type", writer.FormDataContentType())
+
+		return serveRoute(s.server, "", req).Code
+	}
+
+	c.Assert(post("a.txt", "b.txt"), Equals, http.StatusBadRequest)
+	c.Assert(post("a.txt"), Equals, http.StatusOK)
+	c.Assert(post("a.txt"), Equals, http.StatusForbidden)
+}
+
+func (s *SuitePresign) TestInvalid(c *C) {
+	c.Assert(s.put(c, "http://example.com/?presign=0011223344556677_00", "file.txt", "content").StatusCode, Equals, http.StatusForbidden)
+
+	_, presign := s.mint(c, "user", url.Values{"expires": {"1ns"}})
+	c.Assert(s.put(c, presign.UploadURL, "file.txt", "content").StatusCode, Equals, http.StatusForbidden)
+}
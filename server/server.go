@@ -26,6 +26,7 @@ package server
 
 import (
 	crypto_rand "crypto/rand"
+	"crypto/subtle"
 	"encoding/binary"
 	"log"
 	"math/rand"
@@ -46,9 +47,8 @@ import (
 	"github.com/VojtechVitek/ratelimit/memory"
 	"github.com/gorilla/mux"
 
-	_ "net/http/pprof"
-
 	"crypto/tls"
+	"crypto/x509"
 
 	web "github.com/dutchcoders/transfer.sh-web"
 	assetfs "github.com/elazarl/go-bindata-assetfs"
@@ -64,18 +64,43 @@ const _24K = (1 << 3) * 24
 const _5M = (1 << 20) * 5
 
 type Server struct {
-	auths map[string]Authenticator
+	auths      map[string]Authenticator
+	tokenAuths map[string]TokenAuthenticator
 
 	logger *log.Logger
 
+	opsAuth      Authenticator
+	opsTLSConfig *tls.Config
+
 	tlsConfig *tls.Config
 
+	clientCAs            *x509.CertPool
+	clientAuth           tls.ClientAuthType
+	certificateUserField CertificateUserField
+	certificateUploads   bool
+
 	profilerEnabled bool
 
-	locks map[string]*sync.Mutex
+	locks      map[string]*fileLock
+	locksMutex sync.Mutex
+
+	tracer           *Tracer
+	traceSampleRatio float64
 
 	rateLimitRequests int
 
+	// secret signs the cookies and links issued by the server
+	secret []byte
+
+	apiKeysEnabled bool
+	keys           *KeyStore
+
+	apiAuthUploads bool
+
+	policy *Policy
+
+	adminUsers []string
+
 	storage         Storage
 	metadataStorage Storage
 
@@ -113,14 +138,45 @@ type DefaultServAuthenticator struct {
 
 func New(options ...OptionFn) (*Server, error) {
 	s := &Server{
-		auths: make(map[string]Authenticator),
-		locks: map[string]*sync.Mutex{},
+		auths:      make(map[string]Authenticator),
+		tokenAuths: make(map[string]TokenAuthenticator),
+		locks:      map[string]*fileLock{},
+
+		traceSampleRatio: 1,
 	}
 
 	for _, optionFn := range options {
 		optionFn(s)
 	}
 
+	if api, ok := s.auths[string(API)]; !s.apiAuthUploads || !ok {
+	} else if authenticator, ok := s.auths[ServerAuthKey]; ok {
+		s.auths[ServerAuthKey] = anyAuthenticator{authenticator, api}
+	} else {
+		s.auths[ServerAuthKey] = api
+	}
+
+	if s.clientCAs != nil {
+		if s.tlsConfig == nil {
+			s.tlsConfig = &tls.Config{}
+		}
+
+		s.tlsConfig.ClientCAs = s.clientCAs
+		s.tlsConfig.ClientAuth = s.clientAuth
+	}
+
+	if s.apiKeysEnabled {
+		s.keys = NewKeyStore(s.metadataStorage)
+	}
+
+	if len(s.secret) == 0 {
+		// signatures won't survive a restart
+		s.secret = make([]byte, 32)
+		if _, err := crypto_rand.Read(s.secret); err != nil {
+			return nil, err
+		}
+	}
+
 	return s, nil
 }
 
@@ -135,18 +191,13 @@ func init() {
 func (s *Server) Run() {
 	listening := false
 
-	if s.profilerEnabled {
+	// the admin routes are only served by the ops listener
+	if opsListener := s.opsListener(); opsListener != "" {
 		listening = true
 
-		go func() {
-			s.logger.Println("Profiled listening at: :6060")
-
-			http.ListenAndServe(":6060", nil)
-		}()
+		go s.serveOps(opsListener)
 	}
 
-	r := mux.NewRouter()
-
 	var fs http.FileSystem
 
 	if s.webPath != "" {
@@ -177,73 +228,7 @@ func (s *Server) Run() {
 		}
 	}
 
-	staticHandler := http.FileServer(fs)
-
-	r.PathPrefix("/images/").Handler(staticHandler).Methods("GET")
-	r.PathPrefix("/styles/").Handler(staticHandler).Methods("GET")
-	r.PathPrefix("/scripts/").Handler(staticHandler).Methods("GET")
-	r.PathPrefix("/fonts/").Handler(staticHandler).Methods("GET")
-	r.PathPrefix("/ico/").Handler(staticHandler).Methods("GET")
-	r.HandleFunc("/favicon.ico", staticHandler.ServeHTTP).Methods("GET")
-	r.HandleFunc("/robots.txt", staticHandler.ServeHTTP).Methods("GET")
-
-	r.HandleFunc("/{filename:(?:favicon\\.ico|robots\\.txt|health\\.html)}", s.BasicAuthHandler(http.HandlerFunc(s.putHandler))).Methods("PUT")
-
-	r.HandleFunc("/health.html", healthHandler).Methods("GET")
-	r.HandleFunc("/", s.viewHandler).Methods("GET")
-
-	r.HandleFunc("/({files:.*}).zip", s.zipHandler).Methods("GET")
-	r.HandleFunc("/({files:.*}).tar", s.tarHandler).Methods("GET")
-	r.HandleFunc("/({files:.*}).tar.gz", s.tarGzHandler).Methods("GET")
-
-	r.HandleFunc("/{token}/{filename}", s.headHandler).Methods("HEAD")
-	r.HandleFunc("/{action:(?:download|get|inline)}/{token}/{filename}", s.headHandler).Methods("HEAD")
-
-	r.HandleFunc("/{token}/{filename}", s.previewHandler).MatcherFunc(func(r *http.Request, rm *mux.RouteMatch) (match bool) {
-		match = false
-
-		// The file will show a preview page when opening the link in browser directly or
-		// from external link. If the referer url path and current path are the same it will be
-		// downloaded.
-		if !acceptsHTML(r.Header) {
-			return false
-		}
-
-		match = (r.Referer() == "")
-
-		u, err := url.Parse(r.Referer())
-		if err != nil {
-			s.logger.Fatal(err)
-			return
-		}
-
-		match = match || (u.Path != r.URL.Path)
-		return
-	}).Methods("GET")
-
-	getHandlerFn := s.getHandler
-	if s.rateLimitRequests > 0 {
-		getHandlerFn = ratelimit.Request(ratelimit.IP).Rate(s.rateLimitRequests, 60*time.Second).LimitBy(memory.New())(http.HandlerFunc(getHandlerFn)).ServeHTTP
-	}
-
-	r.HandleFunc("/{token}/{filename}",
-		s.AssignMetadata(MetadataAllowedIP(s.MetadataBasicAuth(http.HandlerFunc(getHandlerFn)))),
-	).Methods("GET")
-	r.HandleFunc("/{action:(?:download|get|inline)}/{token}/{filename}",
-		s.AssignMetadata(MetadataAllowedIP(s.MetadataBasicAuth(http.HandlerFunc(getHandlerFn)))),
-	).Methods("GET")
-
-	r.HandleFunc("/{filename}/virustotal", s.virusTotalHandler).Methods("PUT")
-	r.HandleFunc("/{filename}/scan", s.scanHandler).Methods("PUT")
-	r.HandleFunc("/put/{filename}", s.BasicAuthHandler(http.HandlerFunc(s.putHandler))).Methods("PUT")
-	r.HandleFunc("/upload/{filename}", s.BasicAuthHandler(http.HandlerFunc(s.putHandler))).Methods("PUT")
-	r.HandleFunc("/{filename}", s.BasicAuthHandler(http.HandlerFunc(s.putHandler))).Methods("PUT")
-	r.HandleFunc("/", s.BasicAuthHandler(http.HandlerFunc(s.postHandler))).Methods("POST")
-	// r.HandleFunc("/{page}", viewHandler).Methods("GET")
-
-	r.HandleFunc("/{token}/{filename}/{deletionToken}", s.deleteHandler).Methods("DELETE")
-
-	r.NotFoundHandler = http.HandlerFunc(s.notFoundHandler)
+	r := s.router(http.FileServer(fs))
 
 	mime.AddExtensionType(".md", "text/x-markdown")
 
@@ -317,17 +302,120 @@ func (s *Server) Run() {
 		s.logger.Printf("No listener active.")
 	}
 
+	if s.tracer != nil {
+		s.tracer.Close()
+	}
+
 	s.logger.Printf("Server stopped.")
 }
 
+// router returns the routes of the public listeners, staticHandler serves the
+// files of the web frontend
+func (s *Server) router(staticHandler http.Handler) *mux.Router {
+	r := mux.NewRouter()
+
+	r.PathPrefix("/images/").Handler(staticHandler).Methods("GET").Name(RouteStatic)
+	r.PathPrefix("/styles/").Handler(staticHandler).Methods("GET").Name(RouteStatic)
+	r.PathPrefix("/scripts/").Handler(staticHandler).Methods("GET").Name(RouteStatic)
+	r.PathPrefix("/fonts/").Handler(staticHandler).Methods("GET").Name(RouteStatic)
+	r.PathPrefix("/ico/").Handler(staticHandler).Methods("GET").Name(RouteStatic)
+	r.HandleFunc("/favicon.ico", staticHandler.ServeHTTP).Methods("GET").Name(RouteStatic)
+	r.HandleFunc("/robots.txt", staticHandler.ServeHTTP).Methods("GET").Name(RouteStatic)
+
+	r.HandleFunc("/{filename:(?:favicon\\.ico|robots\\.txt|health\\.html)}", s.BasicAuthHandler(http.HandlerFunc(s.putHandler))).Methods("PUT").Name(RouteUpload)
+
+	r.HandleFunc("/health.html", s.healthHandler).Methods("GET").Name(RouteHealth)
+	r.HandleFunc("/", s.viewHandler).Methods("GET").Name(RouteView)
+
+	r.HandleFunc("/({files:.*}).zip", s.zipHandler).Methods("GET").Name(RouteArchive)
+	r.HandleFunc("/({files:.*}).tar", s.tarHandler).Methods("GET").Name(RouteArchive)
+	r.HandleFunc("/({files:.*}).tar.gz", s.tarGzHandler).Methods("GET").Name(RouteArchive)
+
+	r.HandleFunc("/presign", s.BasicAuthHandler(http.HandlerFunc(s.presignHandler))).Methods("POST").Name(RoutePresign)
+	r.HandleFunc("/presign/{id}", s.BasicAuthHandler(http.HandlerFunc(s.presignStatusHandler))).Methods("GET").Name(RoutePresign)
+
+	r.HandleFunc("/dropbox", s.BasicAuthHandler(http.HandlerFunc(s.createDropboxHandler))).Methods("POST").Name(RouteDropbox)
+	r.HandleFunc("/dropbox/{id}/files", s.BasicAuthHandler(http.HandlerFunc(s.dropboxFilesHandler))).Methods("GET").Name(RouteDropbox)
+	r.HandleFunc("/dropbox/{id}", s.dropboxPageHandler).Methods("GET").Name(RouteDropbox)
+	r.HandleFunc("/dropbox/{id}", s.dropboxUploadHandler).Methods("POST").Name(RouteDropbox)
+
+	r.Handle("/me/files", ratelimit.Request(ratelimit.IP).Rate(ownerListRate, 60*time.Second).LimitBy(memory.New())(http.HandlerFunc(s.myFilesHandler))).Methods("GET").Name(RouteFiles)
+
+	r.HandleFunc("/{token}/{filename}", s.AuthorizeFile(http.HandlerFunc(s.headHandler))).Methods("HEAD").Name(RouteHead)
+	r.HandleFunc("/{action:(?:download|get|inline)}/{token}/{filename}", s.AuthorizeFile(http.HandlerFunc(s.headHandler))).Methods("HEAD").Name(RouteHead)
+
+	r.HandleFunc("/{token}/{filename}", s.AuthorizeFile(http.HandlerFunc(s.previewHandler))).MatcherFunc(func(r *http.Request, rm *mux.RouteMatch) (match bool) {
+		match = false
+
+		// The file will show a preview page when opening the link in browser directly or
+		// from external link. If the referer url path and current path are the same it will be
+		// downloaded.
+		if !acceptsHTML(r.Header) {
+			return false
+		}
+
+		match = (r.Referer() == "")
+
+		u, err := url.Parse(r.Referer())
+		if err != nil {
+			s.logger.Fatal(err)
+			return
+		}
+
+		match = match || (u.Path != r.URL.Path)
+		return
+	}).Methods("GET").Name(RoutePreview)
+
+	getHandlerFn := s.getHandler
+	if s.rateLimitRequests > 0 {
+		getHandlerFn = ratelimit.Request(ratelimit.IP).Rate(s.rateLimitRequests, 60*time.Second).LimitBy(memory.New())(http.HandlerFunc(getHandlerFn)).ServeHTTP
+	}
+
+	r.HandleFunc("/{token}/{filename}",
+		s.AuthorizeFile(http.HandlerFunc(getHandlerFn)),
+	).Methods("GET").Name(RouteDownload)
+	r.HandleFunc("/{action:(?:download|get|inline)}/{token}/{filename}",
+		s.AuthorizeFile(http.HandlerFunc(getHandlerFn)),
+	).Methods("GET").Name(RouteDownload)
+
+	r.HandleFunc("/{token}/{filename}/sign", s.signHandler).Methods("POST").Name(RouteSign)
+	r.HandleFunc("/{token}/{filename}/links", s.linksHandler).Methods("GET").Name(RouteLinks)
+	r.HandleFunc("/{token}/{filename}/links", s.createLinksHandler).Methods("POST").Name(RouteLinks)
+	r.HandleFunc("/{token}/{filename}/links/{id}", s.revokeLinkHandler).Methods("DELETE").Name(RouteLinks)
+	r.HandleFunc("/{token}/{filename}", s.AssignMetadata(MetadataAllowedIP(http.HandlerFunc(s.passwordHandler)))).Methods("POST").Name(RoutePassword)
+	r.HandleFunc("/{action:(?:download|get|inline)}/{token}/{filename}", s.AssignMetadata(MetadataAllowedIP(http.HandlerFunc(s.passwordHandler)))).Methods("POST").Name(RoutePassword)
+
+	r.HandleFunc("/{filename}/virustotal", s.virusTotalHandler).Methods("PUT").Name(RouteScan)
+	r.HandleFunc("/{filename}/scan", s.scanHandler).Methods("PUT").Name(RouteScan)
+	r.HandleFunc("/put/{filename}", s.BasicAuthHandler(http.HandlerFunc(s.putHandler))).Methods("PUT").Name(RouteUpload)
+	r.HandleFunc("/upload/{filename}", s.BasicAuthHandler(http.HandlerFunc(s.putHandler))).Methods("PUT").Name(RouteUpload)
+	r.HandleFunc("/{filename}", s.BasicAuthHandler(http.HandlerFunc(s.putHandler))).Methods("PUT").Name(RouteUpload)
+	r.HandleFunc("/", s.BasicAuthHandler(http.HandlerFunc(s.postHandler))).Methods("POST").Name(RouteUpload)
+	// r.HandleFunc("/{page}", viewHandler).Methods("GET")
+
+	r.HandleFunc("/{token}/{filename}/{deletionToken}", s.deleteHandler).Methods("DELETE").Name(RouteDelete)
+	r.HandleFunc("/{token}/{filename}", s.deleteHandler).Methods("DELETE").Name(RouteDelete)
+	r.HandleFunc("/{token}/{filename}", s.editHandler).Methods("PATCH").Name(RouteEdit)
+
+	r.Use(s.TracingHandler)
+	r.Use(s.MetricsHandler)
+
+	if s.policy != nil {
+		r.Use(s.PolicyHandler)
+	}
+
+	r.NotFoundHandler = http.HandlerFunc(s.notFoundHandler)
+	return r
+}
+
 func (d *DefaultServAuthenticator) Set(user, password string) {
 	d.user = user
 	d.password = password
 }
 
 func (d *DefaultServAuthenticator) Authenticate(user, password string) (bool, error) {
-	if d.user == user && password == password {
-		return true, nil
-	}
-	return false, nil
+	userOK := subtle.ConstantTimeCompare([]byte(d.user), []byte(user)) == 1
+	passwordOK := subtle.ConstantTimeCompare([]byte(d.password), []byte(password)) == 1
+
+	return userOK && passwordOK, nil
 }
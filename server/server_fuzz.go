@@ -4,6 +4,7 @@ package server
 
 import (
 	"bytes"
+	"context"
 	"io"
 	"math/rand"
 	"reflect"
@@ -23,16 +24,18 @@ func FuzzLocalStorage(fuzz []byte) int {
 		panic("unable to create local storage")
 	}
 
+	ctx := context.Background()
+
 	token := Encode(10000000 + int64(rand.Intn(1000000000)))
 	filename := Encode(10000000+int64(rand.Intn(1000000000))) + ".bin"
 
 	input := bytes.NewReader(fuzz)
-	err = storage.Put(token, filename, input, applicationOctetStream, fuzzLength)
+	err = storage.Put(ctx, token, filename, input, applicationOctetStream, fuzzLength)
 	if err != nil {
 		panic("unable to save file")
 	}
 
-	contentLength, err := storage.Head(token, filename)
+	contentLength, err := storage.Head(ctx, token, filename)
 	if err != nil {
 		panic("not visible through head")
 	}
@@ -41,7 +44,7 @@ func FuzzLocalStorage(fuzz []byte) int {
 		panic("incorrect content length")
 	}
 
-	output, contentLength, err := storage.Get(token, filename)
+	output, contentLength, err := storage.Get(ctx, token, filename)
 	if err != nil {
 		panic("not visible through get")
 	}
@@ -68,12 +71,12 @@ func FuzzLocalStorage(fuzz []byte) int {
 		panic("incorrect content length")
 	}
 
-	err = storage.Delete(token, filename)
+	err = storage.Delete(ctx, token, filename)
 	if err != nil {
 		panic("unable to delete file")
 	}
 
-	_, err = storage.Head(token, filename)
+	_, err = storage.Head(ctx, token, filename)
 	if !storage.IsNotExist(err) {
 		panic("file not deleted")
 	}
@@ -23,6 +23,14 @@ func ProxyPort(s string) OptionFn {
 	}
 }
 
+// Secret sets the key that signs the cookies and links issued by the server,
+// a random key is used when it isn't set
+func Secret(s string) OptionFn {
+	return func(srvr *Server) {
+		srvr.secret = []byte(s)
+	}
+}
+
 func ClamavHost(s string) OptionFn {
 	return func(srvr *Server) {
 		srvr.ClamAVDaemonHost = s
@@ -193,18 +201,43 @@ func TLSConfig(cert, pk string) OptionFn {
 }
 
 func UseAPIAuthenticator(cfg apiauth.APIConfig) OptionFn {
-	auth := apiauth.New(cfg)
+	cfg.InjectHeaders = injectTraceContext
+	auth := apiAuthenticator{apiauth.New(cfg)}
 	return func(srvr *Server) {
 		srvr.auths[string(API)] = auth
 	}
 }
 
+// APIAuthUploads accepts the credentials of the api authenticator for
+// uploads, next to the server-wide credentials
+func APIAuthUploads() OptionFn {
+	return func(srvr *Server) {
+		srvr.apiAuthUploads = true
+	}
+}
+
 func AuthCredential(key string, auth Authenticator) OptionFn {
 	return func(srvr *Server) {
 		srvr.auths[key] = auth
 	}
 }
 
+// AuthToken registers a bearer token authenticator, under ServerAuthKey it
+// gates uploads and under JWT it verifies downloads of files with the JWT
+// auth type
+func AuthToken(key string, auth TokenAuthenticator) OptionFn {
+	return func(srvr *Server) {
+		srvr.tokenAuths[key] = auth
+	}
+}
+
+// EnableAPIKeys accepts the API keys of the key store in the metadata storage
+func EnableAPIKeys() OptionFn {
+	return func(srvr *Server) {
+		srvr.apiKeysEnabled = true
+	}
+}
+
 func FilterOptions(options IPFilterOptions) OptionFn {
 	for i, allowedIP := range options.AllowedIPs {
 		options.AllowedIPs[i] = strings.TrimSpace(allowedIP)
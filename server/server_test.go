@@ -0,0 +1,49 @@
+package server
+
+import (
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+
+	. "gopkg.in/check.v1"
+)
+
+// testServer returns a server storing its files in a temporary directory,
+// with the users admin, user and other whose password is secret
+func testServer(c *C, options ...OptionFn) *Server {
+	storage, err := NewLocalStorage(c.MkDir(), log.New(ioutil.Discard, "", 0))
+	c.Assert(err, IsNil)
+
+	var admin, user, other DefaultServAuthenticator
+	admin.Set("admin", "secret")
+	user.Set("user", "secret")
+	other.Set("other", "secret")
+
+	options = append([]OptionFn{UseStorage(storage), UseMetaStorage(storage), AuthCredential(ServerAuthKey, anyAuthenticator{&admin, &user, &other})}, options...)
+
+	srvr, err := New(options...)
+	c.Assert(err, IsNil)
+
+	return srvr
+}
+
+// serveRoute sends req as user, no credentials when empty, through the routes
+// and middleware of the public listeners, or of the ops listener for the
+// admin routes
+func serveRoute(srvr *Server, user string, req *http.Request) *httptest.ResponseRecorder {
+	if user != "" {
+		req.SetBasicAuth(user, "secret")
+	}
+
+	var router http.Handler = srvr.router(http.NotFoundHandler())
+	if req.URL.Path == "/admin" || strings.HasPrefix(req.URL.Path, "/admin/") {
+		router = srvr.opsRouter()
+	}
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+
+	return w
+}
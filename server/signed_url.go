@@ -0,0 +1,162 @@
+package server
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// defaultSignedURLExpiry is the lifetime of a signed url when none is requested
+const defaultSignedURLExpiry = time.Hour
+
+// signURL returns the signature of a url of the file that expires at
+// expires, bound to the client ip when it is set
+func (s *Server) signURL(token, filename string, expires int64, ip string) string {
+	mac := hmac.New(sha256.New, s.secret)
+	mac.Write([]byte(strings.Join([]string{"url", token, filename, strconv.FormatInt(expires, 10), ip}, "\n")))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// signedURLQuery returns the query of a signed url of the file
+func (s *Server) signedURLQuery(token, filename string, expires time.Time, ip string) url.Values {
+	query := url.Values{}
+	query.Set("exp", strconv.FormatInt(expires.Unix(), 10))
+
+	if ip != "" {
+		query.Set("ip", ip)
+	}
+
+	query.Set("sig", s.signURL(token, filename, expires.Unix(), ip))
+	return query
+}
+
+// checkSignedURL reports whether the request carries a signature, and
+// whether it is a valid and unexpired signature of the file for the client
+func (s *Server) checkSignedURL(r *http.Request, token, filename string) (present bool, valid bool) {
+	query := r.URL.Query()
+
+	sig := query.Get("sig")
+	if sig == "" {
+		return false, false
+	}
+
+	expires, err := strconv.ParseInt(query.Get("exp"), 10, 64)
+	if err != nil || time.Now().Unix() > expires {
+		return true, false
+	}
+
+	ip := query.Get("ip")
+	if ip != "" {
+		host, _, err := net.SplitHostPort(r.RemoteAddr)
+		if remoteIP, allowedIP := net.ParseIP(host), net.ParseIP(ip); err != nil || remoteIP == nil || !remoteIP.Equal(allowedIP) {
+			return true, false
+		}
+	}
+
+	return true, hmac.Equal([]byte(sig), []byte(s.signURL(token, filename, expires, ip)))
+}
+
+// accessQuery returns the signature and recipient link query of the
+// request, so links derived from a signed url or recipient link keep working
+func accessQuery(r *http.Request) string {
+	query := r.URL.Query()
+	if query.Get("sig") == "" && query.Get("link") == "" {
+		return ""
+	}
+
+	signed := url.Values{}
+	for _, key := range []string{"exp", "ip", "sig", "link"} {
+		if v := query.Get(key); v != "" {
+			signed.Set(key, v)
+		}
+	}
+
+	return signed.Encode()
+}
+
+// SignedRequired reports whether downloads are restricted to signed urls
+func (m *Metadata) SignedRequired() bool {
+	for _, v := range m.AuthTypes {
+		if v == SIGNED {
+			return true
+		}
+	}
+
+	return false
+}
+
+// authorizeSharing authorizes sharing a file with the deletion token of the
+// file in the X-Deletion-Token header or an API key with the download scope,
+// it writes the response and returns false when the request is denied
+func (s *Server) authorizeSharing(w http.ResponseWriter, r *http.Request, token, filename string) bool {
+	if deletionToken := r.Header.Get("X-Deletion-Token"); deletionToken != "" {
+		if err := s.CheckDeletionToken(r.Context(), deletionToken, token, filename); err != nil {
+			log.Printf("Error metadata: %s", err.Error())
+			http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+			return false
+		}
+	} else if key, err := s.requestAPIKey(r); err == errNoAPIKey {
+		http.Error(w, "Not authorized", http.StatusUnauthorized)
+		return false
+	} else if err != nil {
+		apiKeyError(w, err)
+		return false
+	} else if metadata, err := s.readMetadata(r.Context(), token, filename); err != nil {
+		log.Printf("Error metadata: %s", err.Error())
+		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		return false
+	} else if !key.HasScope(ScopeDownload) || !key.InNamespace(metadata.Namespace) {
+		http.Error(w, "api key not allowed to share", http.StatusForbidden)
+		return false
+	}
+
+	return true
+}
+
+// signHandler mints a signed url of a file, it is authorized by
+// authorizeSharing
+func (s *Server) signHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	token := vars["token"]
+	filename := vars["filename"]
+
+	if !s.authorizeSharing(w, r, token, filename) {
+		return
+	}
+
+	expiry := defaultSignedURLExpiry
+	if v := r.FormValue("expires"); v != "" {
+		var err error
+		if expiry, err = time.ParseDuration(v); err != nil || expiry <= 0 {
+			http.Error(w, fmt.Sprintf("invalid expires: %s", v), http.StatusBadRequest)
+			return
+		}
+	}
+
+	ip := r.FormValue("ip")
+	if ip != "" && net.ParseIP(ip) == nil {
+		http.Error(w, fmt.Sprintf("invalid ip: %s", ip), http.StatusBadRequest)
+		return
+	}
+
+	expires := time.Now().Add(expiry)
+
+	relativeURL, _ := url.Parse(path.Join(s.proxyPath, token, url.PathEscape(filename)))
+	relativeURL.RawQuery = s.signedURLQuery(token, filename, expires, ip).Encode()
+
+	w.Header().Set("Content-Type", "text/plain")
+	w.Header().Set("X-Url-Expires", expires.UTC().Format(time.RFC3339))
+
+	fmt.Fprintln(w, resolveURL(r, relativeURL, s.proxyPort))
+}
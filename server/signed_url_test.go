@@ -0,0 +1,92 @@
+package server
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"time"
+
+	"github.com/gorilla/mux"
+	. "gopkg.in/check.v1"
+)
+
+func (s *SuiteAuthorization) sign(c *C, token, deletionToken string, form url.Values) *http.Response {
+	req := httptest.NewRequest("POST", "/"+token+"/file.txt/sign?"+form.Encode(), nil)
+	req = mux.SetURLVars(req, map[string]string{"token": token, "filename": "file.txt"})
+	if deletionToken != "" {
+		req.Header.Set("X-Deletion-Token", deletionToken)
+	}
+
+	w := httptest.NewRecorder()
+	s.server.signHandler(w, req)
+
+	return w.Result()
+}
+
+func (s *SuiteAuthorization) signedRequest(c *C, resp *http.Response) *http.Request {
+	c.Assert(resp.StatusCode, Equals, http.StatusOK)
+
+	body, _ := ioutil.ReadAll(resp.Body)
+	signed, err := url.Parse(string(bytes.TrimSpace(body)))
+	c.Assert(err, IsNil)
+	c.Assert(signed.Path, Matches, "/[^/]+/file.txt")
+
+	return httptest.NewRequest("GET", signed.RequestURI(), nil)
+}
+
+func (s *SuiteAuthorization) TestSignedURL(c *C) {
+	s.putFile(c, "signed", Metadata{MaxDownloads: -1, AuthTypes: []AuthType{SIGNED}, DeletionToken: "deletion"})
+
+	c.Assert(s.sign(c, "signed", "", nil).StatusCode, Equals, http.StatusUnauthorized)
+	c.Assert(s.sign(c, "signed", "wrong", nil).StatusCode, Equals, http.StatusNotFound)
+	c.Assert(s.sign(c, "signed", "deletion", url.Values{"expires": {"-1h"}}).StatusCode, Equals, http.StatusBadRequest)
+
+	resp := s.serveFile("signed", httptest.NewRequest("GET", "/signed/file.txt", nil))
+	c.Assert(resp.StatusCode, Equals, http.StatusUnauthorized)
+
+	req := s.signedRequest(c, s.sign(c, "signed", "deletion", url.Values{"expires": {"10m"}}))
+	c.Assert(s.serveFile("signed", req).StatusCode, Equals, http.StatusOK)
+
+	// the signature does not carry over to other files
+	s.putFile(c, "other", Metadata{MaxDownloads: -1, AuthTypes: []AuthType{SIGNED}})
+	req.URL.Path = "/other/file.txt"
+	c.Assert(s.serveFile("other", req).StatusCode, Equals, http.StatusForbidden)
+}
+
+func (s *SuiteAuthorization) TestSignedURLExpiry(c *C) {
+	s.putFile(c, "signed", Metadata{MaxDownloads: -1, AuthTypes: []AuthType{SIGNED}})
+
+	query := s.server.signedURLQuery("signed", "file.txt", time.Now().Add(-time.Minute), "")
+	resp := s.serveFile("signed", httptest.NewRequest("GET", "/signed/file.txt?"+query.Encode(), nil))
+	c.Assert(resp.StatusCode, Equals, http.StatusForbidden)
+
+	query = s.server.signedURLQuery("signed", "file.txt", time.Now().Add(time.Minute), "")
+	query.Set("exp", query.Get("exp")+"0")
+	resp = s.serveFile("signed", httptest.NewRequest("GET", "/signed/file.txt?"+query.Encode(), nil))
+	c.Assert(resp.StatusCode, Equals, http.StatusForbidden)
+}
+
+func (s *SuiteAuthorization) TestSignedURLClientIP(c *C) {
+	s.putFile(c, "signed", Metadata{MaxDownloads: -1, AuthTypes: []AuthType{SIGNED}, DeletionToken: "deletion"})
+
+	req := s.signedRequest(c, s.sign(c, "signed", "deletion", url.Values{"ip": {"10.0.0.1"}}))
+
+	req.RemoteAddr = "10.0.0.1:1234"
+	c.Assert(s.serveFile("signed", req).StatusCode, Equals, http.StatusOK)
+
+	req.RemoteAddr = "10.0.0.2:1234"
+	c.Assert(s.serveFile("signed", req).StatusCode, Equals, http.StatusForbidden)
+}
+
+func (s *SuiteAuthorization) TestPutSignedRestriction(c *C) {
+	req := httptest.NewRequest("PUT", "/upload.txt", bytes.NewBufferString("content"))
+	req = mux.SetURLVars(req, map[string]string{"filename": "upload.txt"})
+	req.Header.Set("X-Download-Auth", "signed")
+
+	w := httptest.NewRecorder()
+	s.server.putHandler(w, req)
+	c.Assert(w.Result().StatusCode, Equals, http.StatusOK)
+	c.Assert(w.Result().Header.Get("X-Download-Auth"), Equals, "signed")
+}
@@ -1,38 +1,63 @@
 package server
 
 import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"log"
+	"math"
 	"net/http"
+	"net/url"
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/s3"
 	"github.com/aws/aws-sdk-go/service/s3/s3manager"
-	"golang.org/x/net/context"
 	"golang.org/x/oauth2"
 	"golang.org/x/oauth2/google"
 	"google.golang.org/api/drive/v3"
 	"google.golang.org/api/googleapi"
 )
 
+// Storage is implemented by the storage providers, every call is bound to
+// the context it is given: a canceled context aborts the backend request,
+// including the transfer of a reader returned by Get.
 type Storage interface {
-	Get(token string, filename string) (reader io.ReadCloser, contentLength uint64, err error)
-	Head(token string, filename string) (contentLength uint64, err error)
-	Put(token string, filename string, reader io.Reader, contentType string, contentLength uint64) error
-	Delete(token string, filename string) error
+	Get(ctx context.Context, token string, filename string) (reader io.ReadCloser, contentLength uint64, err error)
+	Head(ctx context.Context, token string, filename string) (contentLength uint64, err error)
+	Put(ctx context.Context, token string, filename string, reader io.Reader, contentType string, contentLength uint64) error
+	Delete(ctx context.Context, token string, filename string) error
+	List(ctx context.Context) ([]ObjectInfo, error)
 	IsNotExist(err error) bool
 
 	Type() string
 }
 
+// ObjectInfo describes a single object returned by Storage.List
+type ObjectInfo struct {
+	Token         string
+	Filename      string
+	ContentLength uint64
+}
+
+// Checksummer is implemented by storage providers that can report the md5
+// checksum of an object, it returns an empty string when the checksum is not known
+type Checksummer interface {
+	Checksum(ctx context.Context, token string, filename string) (string, error)
+}
+
 type LocalStorage struct {
 	Storage
 	basedir string
@@ -47,7 +72,11 @@ func (s *LocalStorage) Type() string {
 	return "local"
 }
 
-func (s *LocalStorage) Head(token string, filename string) (contentLength uint64, err error) {
+func (s *LocalStorage) Head(ctx context.Context, token string, filename string) (contentLength uint64, err error) {
+	if err = ctx.Err(); err != nil {
+		return
+	}
+
 	path := filepath.Join(s.basedir, token, filename)
 
 	var fi os.FileInfo
@@ -60,25 +89,36 @@ func (s *LocalStorage) Head(token string, filename string) (contentLength uint64
 	return
 }
 
-func (s *LocalStorage) Get(token string, filename string) (reader io.ReadCloser, contentLength uint64, err error) {
+func (s *LocalStorage) Get(ctx context.Context, token string, filename string) (reader io.ReadCloser, contentLength uint64, err error) {
+	if err = ctx.Err(); err != nil {
+		return
+	}
+
 	path := filepath.Join(s.basedir, token, filename)
 
 	// content type , content length
-	if reader, err = os.Open(path); err != nil {
+	var f *os.File
+	if f, err = os.Open(path); err != nil {
 		return
 	}
 
 	var fi os.FileInfo
-	if fi, err = os.Lstat(path); err != nil {
+	if fi, err = f.Stat(); err != nil {
+		f.Close()
 		return
 	}
 
 	contentLength = uint64(fi.Size())
+	reader = &contextReadCloser{ctx: ctx, Reader: f, Closer: f}
 
 	return
 }
 
-func (s *LocalStorage) Delete(token string, filename string) (err error) {
+func (s *LocalStorage) Delete(ctx context.Context, token string, filename string) (err error) {
+	if err = ctx.Err(); err != nil {
+		return
+	}
+
 	metadata := filepath.Join(s.basedir, token, fmt.Sprintf("%s.metadata", filename))
 	os.Remove(metadata)
 
@@ -87,6 +127,54 @@ func (s *LocalStorage) Delete(token string, filename string) (err error) {
 	return
 }
 
+func (s *LocalStorage) List(ctx context.Context) (objects []ObjectInfo, err error) {
+	var tokens []os.FileInfo
+	if tokens, err = ioutil.ReadDir(s.basedir); err != nil {
+		return
+	}
+
+	for _, token := range tokens {
+		if !token.IsDir() {
+			continue
+		}
+
+		var files []os.FileInfo
+		if files, err = ioutil.ReadDir(filepath.Join(s.basedir, token.Name())); err != nil {
+			return
+		}
+
+		if err = ctx.Err(); err != nil {
+			return
+		}
+
+		for _, fi := range files {
+			if !fi.Mode().IsRegular() {
+				continue
+			}
+
+			objects = append(objects, ObjectInfo{Token: token.Name(), Filename: fi.Name(), ContentLength: uint64(fi.Size())})
+		}
+	}
+
+	return
+}
+
+func (s *LocalStorage) Checksum(ctx context.Context, token string, filename string) (string, error) {
+	f, err := os.Open(filepath.Join(s.basedir, token, filename))
+	if err != nil {
+		return "", err
+	}
+
+	defer f.Close()
+
+	h := md5.New()
+	if _, err := io.Copy(h, &contextReadCloser{ctx: ctx, Reader: f}); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
 func (s *LocalStorage) IsNotExist(err error) bool {
 	if err == nil {
 		return false
@@ -95,7 +183,7 @@ func (s *LocalStorage) IsNotExist(err error) bool {
 	return os.IsNotExist(err)
 }
 
-func (s *LocalStorage) Put(token string, filename string, reader io.Reader, contentType string, contentLength uint64) error {
+func (s *LocalStorage) Put(ctx context.Context, token string, filename string, reader io.Reader, contentType string, contentLength uint64) error {
 	var f io.WriteCloser
 	var err error
 
@@ -109,13 +197,63 @@ func (s *LocalStorage) Put(token string, filename string, reader io.Reader, cont
 		return err
 	}
 
-	defer f.Close()
-
-	if _, err = io.Copy(f, reader); err != nil {
+	if _, err = io.Copy(f, &contextReadCloser{ctx: ctx, Reader: reader}); err != nil {
+		// don't leave a partially written file behind
+		f.Close()
+		os.Remove(filepath.Join(path, filename))
 		return err
 	}
 
-	return nil
+	return f.Close()
+}
+
+// contextReadCloser fails reads once its context is done
+type contextReadCloser struct {
+	ctx context.Context
+	io.Reader
+	io.Closer
+}
+
+func (r *contextReadCloser) Read(p []byte) (int, error) {
+	if err := r.ctx.Err(); err != nil {
+		return 0, err
+	}
+
+	return r.Reader.Read(p)
+}
+
+func (r *contextReadCloser) Close() error {
+	if r.Closer == nil {
+		return nil
+	}
+
+	return r.Closer.Close()
+}
+
+const (
+	// s3MetadataKey is the user metadata key of embedded file metadata
+	s3MetadataKey = "Transfersh-Metadata"
+	// s3MaxDaysTag tags uploads with a Max-Days for bucket lifecycle rules
+	s3MaxDaysTag = "transfersh-max-days"
+	// s3MaxUserMetadata is the size S3 allows for the user metadata of an
+	// object, keys and values
+	s3MaxUserMetadata = 2 << 10
+)
+
+// S3Options configures how files are stored in the bucket
+type S3Options struct {
+	// ServerSideEncryption is the encryption of uploads, AES256 or aws:kms
+	ServerSideEncryption string
+	// SSEKMSKeyId is the KMS key used for aws:kms encryption
+	SSEKMSKeyId string
+	// StorageClass is the storage class of uploads, e.g. STANDARD_IA
+	StorageClass string
+	// EmbedMetadata stores the metadata of a file as user metadata of the
+	// object instead of a separate <file>.metadata object
+	EmbedMetadata bool
+	// LifecycleTags tags uploads with a Max-Days, so a bucket lifecycle
+	// rule can expire them
+	LifecycleTags bool
 }
 
 type S3Storage struct {
@@ -125,19 +263,189 @@ type S3Storage struct {
 	s3          *s3.S3
 	logger      *log.Logger
 	noMultipart bool
+	options     S3Options
 }
 
-func NewS3Storage(accessKey, secretKey, bucketName, region, endpoint string, logger *log.Logger, disableMultipart bool, forcePathStyle bool) (*S3Storage, error) {
+func NewS3Storage(accessKey, secretKey, bucketName, region, endpoint string, logger *log.Logger, disableMultipart bool, forcePathStyle bool, options S3Options) (*S3Storage, error) {
 	sess := getAwsSession(accessKey, secretKey, region, endpoint, forcePathStyle)
 
-	return &S3Storage{bucket: bucketName, s3: s3.New(sess), session: sess, logger: logger, noMultipart: disableMultipart}, nil
+	return &S3Storage{bucket: bucketName, s3: s3.New(sess), session: sess, logger: logger, noMultipart: disableMultipart, options: options}, nil
+}
+
+// embedded reports whether filename refers to metadata embedded in its file object
+func (s *S3Storage) embedded(filename string) bool {
+	return s.options.EmbedMetadata && strings.HasSuffix(filename, ".metadata")
+}
+
+// tagging returns the object tags of a file with the given metadata. Lifecycle
+// rules count days from the creation of an object, so the days are counted
+// from the upload of the file.
+func (s *S3Storage) tagging(metadata Metadata) string {
+	if !s.options.LifecycleTags || metadata.MaxDate.IsZero() || metadata.Hold {
+		return ""
+	}
+
+	created := metadata.Created
+	if created.IsZero() {
+		created = time.Now()
+	}
+
+	days := int(math.Ceil(metadata.MaxDate.Sub(created).Hours() / 24))
+	if days < 1 {
+		days = 1
+	}
+
+	return url.Values{s3MaxDaysTag: {strconv.Itoa(days)}}.Encode()
+}
+
+// getMetadata returns the metadata of a file, metadata updated since the
+// upload is kept in a separate object that takes precedence over the
+// metadata embedded in the file object
+func (s *S3Storage) getMetadata(ctx context.Context, token string, filename string) ([]byte, error) {
+	getResponse, err := s.s3.GetObjectWithContext(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(fmt.Sprintf("%s/%s", token, filename)),
+	})
+	if err == nil {
+		defer getResponse.Body.Close()
+		return ioutil.ReadAll(getResponse.Body)
+	} else if !s.IsNotExist(err) {
+		return nil, err
+	}
+
+	response, err := s.s3.HeadObjectWithContext(ctx, &s3.HeadObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(fmt.Sprintf("%s/%s", token, strings.TrimSuffix(filename, ".metadata"))),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	for k, v := range response.Metadata {
+		if strings.EqualFold(k, s3MetadataKey) {
+			return base64.StdEncoding.DecodeString(aws.StringValue(v))
+		}
+	}
+
+	return nil, awserr.New(s3.ErrCodeNoSuchKey, "the object has no embedded metadata", nil)
+}
+
+// putMetadata stores updated metadata of a file in a separate object, the
+// metadata of an upload is stored by Put
+func (s *S3Storage) putMetadata(ctx context.Context, token string, filename string, reader io.Reader) error {
+	data, err := ioutil.ReadAll(reader)
+	if err != nil {
+		return err
+	}
+
+	_, err = s.s3.HeadObjectWithContext(ctx, &s3.HeadObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(fmt.Sprintf("%s/%s", token, strings.TrimSuffix(filename, ".metadata"))),
+	})
+	if s.IsNotExist(err) {
+		// an upload stores the metadata along with the file
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	var tagging string
+	if s.options.LifecycleTags {
+		if err := s.retag(ctx, token, filename, data); err != nil {
+			return err
+		}
+
+		var metadata Metadata
+		if json.Unmarshal(data, &metadata) == nil {
+			tagging = s.tagging(metadata)
+		}
+	}
+
+	return s.putObject(ctx, fmt.Sprintf("%s/%s", token, filename), data, tagging)
+}
+
+// retag replaces the object tags of a file when a changed Max-Days or hold
+// changes its expiry
+func (s *S3Storage) retag(ctx context.Context, token string, filename string, data []byte) error {
+	var metadata, previous Metadata
+	if err := json.Unmarshal(data, &metadata); err != nil {
+		return nil
+	}
+
+	if data, err := s.getMetadata(ctx, token, filename); err == nil && json.Unmarshal(data, &previous) == nil &&
+		previous.Hold == metadata.Hold && previous.MaxDate.Equal(metadata.MaxDate) {
+		return nil
+	}
+
+	tags, err := url.ParseQuery(s.tagging(metadata))
+	if err != nil {
+		return err
+	}
+
+	tagging := &s3.Tagging{TagSet: []*s3.Tag{}}
+	for k := range tags {
+		tagging.TagSet = append(tagging.TagSet, &s3.Tag{Key: aws.String(k), Value: aws.String(tags.Get(k))})
+	}
+
+	_, err = s.s3.PutObjectTaggingWithContext(ctx, &s3.PutObjectTaggingInput{
+		Bucket:  aws.String(s.bucket),
+		Key:     aws.String(fmt.Sprintf("%s/%s", token, strings.TrimSuffix(filename, ".metadata"))),
+		Tagging: tagging,
+	})
+	return err
+}
+
+// putObject stores a metadata object with the encryption and storage class of
+// uploads, tagging are the object tags of its file
+func (s *S3Storage) putObject(ctx context.Context, key string, data []byte, tagging string) error {
+	input := &s3.PutObjectInput{
+		Bucket:      aws.String(s.bucket),
+		Key:         aws.String(key),
+		Body:        bytes.NewReader(data),
+		ContentType: aws.String("text/json"),
+	}
+
+	if s.options.ServerSideEncryption != "" {
+		input.ServerSideEncryption = aws.String(s.options.ServerSideEncryption)
+	}
+
+	if s.options.SSEKMSKeyId != "" {
+		input.SSEKMSKeyId = aws.String(s.options.SSEKMSKeyId)
+	}
+
+	if s.options.StorageClass != "" {
+		input.StorageClass = aws.String(s.options.StorageClass)
+	}
+
+	if tagging != "" {
+		input.Tagging = aws.String(tagging)
+	}
+
+	_, err := s.s3.PutObjectWithContext(ctx, input)
+	return err
+}
+
+// s3UserMetadata returns the user metadata embedding data, ok is false when
+// it exceeds the size S3 allows for the user metadata of an object
+func s3UserMetadata(data []byte) (userMetadata map[string]*string, ok bool) {
+	encoded := base64.StdEncoding.EncodeToString(data)
+	if len(s3MetadataKey)+len(encoded) > s3MaxUserMetadata {
+		return nil, false
+	}
+
+	return map[string]*string{s3MetadataKey: aws.String(encoded)}, true
 }
 
 func (s *S3Storage) Type() string {
 	return "s3"
 }
 
-func (s *S3Storage) Head(token string, filename string) (contentLength uint64, err error) {
+func (s *S3Storage) Head(ctx context.Context, token string, filename string) (contentLength uint64, err error) {
+	if s.embedded(filename) {
+		data, err := s.getMetadata(ctx, token, filename)
+		return uint64(len(data)), err
+	}
+
 	key := fmt.Sprintf("%s/%s", token, filename)
 
 	headRequest := &s3.HeadObjectInput{
@@ -146,7 +454,7 @@ func (s *S3Storage) Head(token string, filename string) (contentLength uint64, e
 	}
 
 	// content type , content length
-	response, err := s.s3.HeadObject(headRequest)
+	response, err := s.s3.HeadObjectWithContext(ctx, headRequest)
 	if err != nil {
 		return
 	}
@@ -158,6 +466,49 @@ func (s *S3Storage) Head(token string, filename string) (contentLength uint64, e
 	return
 }
 
+func (s *S3Storage) List(ctx context.Context) (objects []ObjectInfo, err error) {
+	listRequest := &s3.ListObjectsV2Input{
+		Bucket: aws.String(s.bucket),
+	}
+
+	err = s.s3.ListObjectsV2PagesWithContext(ctx, listRequest, func(page *s3.ListObjectsV2Output, lastPage bool) bool {
+		for _, object := range page.Contents {
+			parts := strings.SplitN(aws.StringValue(object.Key), "/", 2)
+			if len(parts) != 2 || parts[1] == "" {
+				continue
+			}
+
+			objects = append(objects, ObjectInfo{Token: parts[0], Filename: parts[1], ContentLength: uint64(aws.Int64Value(object.Size))})
+		}
+
+		return true
+	})
+
+	return
+}
+
+func (s *S3Storage) Checksum(ctx context.Context, token string, filename string) (string, error) {
+	key := fmt.Sprintf("%s/%s", token, filename)
+
+	headRequest := &s3.HeadObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(key),
+	}
+
+	response, err := s.s3.HeadObjectWithContext(ctx, headRequest)
+	if err != nil {
+		return "", err
+	}
+
+	// the etag of multipart uploads is not the md5 of the content
+	etag := strings.Trim(aws.StringValue(response.ETag), `"`)
+	if strings.Contains(etag, "-") {
+		return "", nil
+	}
+
+	return etag, nil
+}
+
 func (s *S3Storage) IsNotExist(err error) bool {
 	if err == nil {
 		return false
@@ -165,7 +516,8 @@ func (s *S3Storage) IsNotExist(err error) bool {
 
 	if aerr, ok := err.(awserr.Error); ok {
 		switch aerr.Code() {
-		case s3.ErrCodeNoSuchKey:
+		case s3.ErrCodeNoSuchKey, "NotFound":
+			// HeadObject reports a missing key as NotFound
 			return true
 		}
 	}
@@ -173,7 +525,16 @@ func (s *S3Storage) IsNotExist(err error) bool {
 	return false
 }
 
-func (s *S3Storage) Get(token string, filename string) (reader io.ReadCloser, contentLength uint64, err error) {
+func (s *S3Storage) Get(ctx context.Context, token string, filename string) (reader io.ReadCloser, contentLength uint64, err error) {
+	if s.embedded(filename) {
+		data, err := s.getMetadata(ctx, token, filename)
+		if err != nil {
+			return nil, 0, err
+		}
+
+		return ioutil.NopCloser(bytes.NewReader(data)), uint64(len(data)), nil
+	}
+
 	key := fmt.Sprintf("%s/%s", token, filename)
 
 	getRequest := &s3.GetObjectInput{
@@ -181,7 +542,7 @@ func (s *S3Storage) Get(token string, filename string) (reader io.ReadCloser, co
 		Key:    aws.String(key),
 	}
 
-	response, err := s.s3.GetObject(getRequest)
+	response, err := s.s3.GetObjectWithContext(ctx, getRequest)
 	if err != nil {
 		return
 	}
@@ -194,14 +555,24 @@ func (s *S3Storage) Get(token string, filename string) (reader io.ReadCloser, co
 	return
 }
 
-func (s *S3Storage) Delete(token string, filename string) (err error) {
+func (s *S3Storage) Delete(ctx context.Context, token string, filename string) (err error) {
+	if s.embedded(filename) {
+		// embedded metadata is deleted along with the file, only the
+		// metadata updated since the upload is kept separately
+		_, err = s.s3.DeleteObjectWithContext(ctx, &s3.DeleteObjectInput{
+			Bucket: aws.String(s.bucket),
+			Key:    aws.String(fmt.Sprintf("%s/%s", token, filename)),
+		})
+		return
+	}
+
 	metadata := fmt.Sprintf("%s/%s.metadata", token, filename)
 	deleteRequest := &s3.DeleteObjectInput{
 		Bucket: aws.String(s.bucket),
 		Key:    aws.String(metadata),
 	}
 
-	_, err = s.s3.DeleteObject(deleteRequest)
+	_, err = s.s3.DeleteObjectWithContext(ctx, deleteRequest)
 	if err != nil {
 		return
 	}
@@ -212,12 +583,16 @@ func (s *S3Storage) Delete(token string, filename string) (err error) {
 		Key:    aws.String(key),
 	}
 
-	_, err = s.s3.DeleteObject(deleteRequest)
+	_, err = s.s3.DeleteObjectWithContext(ctx, deleteRequest)
 
 	return
 }
 
-func (s *S3Storage) Put(token string, filename string, reader io.Reader, contentType string, contentLength uint64) (err error) {
+func (s *S3Storage) Put(ctx context.Context, token string, filename string, reader io.Reader, contentType string, contentLength uint64) (err error) {
+	if s.embedded(filename) {
+		return s.putMetadata(ctx, token, filename, reader)
+	}
+
 	key := fmt.Sprintf("%s/%s", token, filename)
 
 	s.logger.Printf("Uploading file %s to S3 Bucket", filename)
@@ -234,11 +609,58 @@ func (s *S3Storage) Put(token string, filename string, reader io.Reader, content
 		u.LeavePartsOnError = false
 	})
 
-	_, err = uploader.Upload(&s3manager.UploadInput{
+	input := &s3manager.UploadInput{
 		Bucket: aws.String(s.bucket),
 		Key:    aws.String(key),
 		Body:   reader,
-	})
+	}
+
+	if contentType != "" {
+		input.ContentType = aws.String(contentType)
+	}
+
+	if s.options.ServerSideEncryption != "" {
+		input.ServerSideEncryption = aws.String(s.options.ServerSideEncryption)
+	}
+
+	if s.options.SSEKMSKeyId != "" {
+		input.SSEKMSKeyId = aws.String(s.options.SSEKMSKeyId)
+	}
+
+	if s.options.StorageClass != "" {
+		input.StorageClass = aws.String(s.options.StorageClass)
+	}
+
+	var separate []byte
+	var tagging string
+	if metadata, ok := MetadataFromContext(ctx); ok {
+		if tagging = s.tagging(metadata); tagging != "" {
+			input.Tagging = aws.String(tagging)
+		}
+
+		if s.options.EmbedMetadata {
+			data, err := json.Marshal(metadata)
+			if err != nil {
+				return err
+			}
+
+			// metadata too large to be embedded, e.g. with many links,
+			// is kept in a separate object
+			if userMetadata, ok := s3UserMetadata(data); ok {
+				input.Metadata = userMetadata
+			} else {
+				separate = data
+			}
+		}
+	}
+
+	if _, err = uploader.UploadWithContext(ctx, input); err != nil {
+		return
+	}
+
+	if separate != nil {
+		err = s.putObject(ctx, fmt.Sprintf("%s.metadata", key), separate, tagging)
+	}
 
 	return
 }
@@ -319,18 +741,18 @@ func (s *GDrive) hasChecksum(f *drive.File) bool {
 	return f.Md5Checksum != ""
 }
 
-func (s *GDrive) list(nextPageToken string, q string) (*drive.FileList, error) {
-	return s.service.Files.List().Fields("nextPageToken, files(id, name, mimeType)").Q(q).PageToken(nextPageToken).Do()
+func (s *GDrive) list(ctx context.Context, nextPageToken string, q string) (*drive.FileList, error) {
+	return s.service.Files.List().Fields("nextPageToken, files(id, name, mimeType)").Q(q).PageToken(nextPageToken).Context(ctx).Do()
 }
 
-func (s *GDrive) findId(filename string, token string) (string, error) {
+func (s *GDrive) findId(ctx context.Context, filename string, token string) (string, error) {
 	filename = strings.Replace(filename, `'`, `\'`, -1)
 	filename = strings.Replace(filename, `"`, `\"`, -1)
 
 	fileId, tokenId, nextPageToken := "", "", ""
 
 	q := fmt.Sprintf("'%s' in parents and name='%s' and mimeType='%s' and trashed=false", s.rootId, token, GDriveDirectoryMimeType)
-	l, err := s.list(nextPageToken, q)
+	l, err := s.list(ctx, nextPageToken, q)
 	if err != nil {
 		return "", err
 	}
@@ -345,7 +767,7 @@ func (s *GDrive) findId(filename string, token string) (string, error) {
 			break
 		}
 
-		l, err = s.list(l.NextPageToken, q)
+		l, err = s.list(ctx, l.NextPageToken, q)
 	}
 
 	if filename == "" {
@@ -355,7 +777,7 @@ func (s *GDrive) findId(filename string, token string) (string, error) {
 	}
 
 	q = fmt.Sprintf("'%s' in parents and name='%s' and mimeType!='%s' and trashed=false", tokenId, filename, GDriveDirectoryMimeType)
-	l, err = s.list(nextPageToken, q)
+	l, err = s.list(ctx, nextPageToken, q)
 	if err != nil {
 		return "", err
 	}
@@ -371,7 +793,7 @@ func (s *GDrive) findId(filename string, token string) (string, error) {
 			break
 		}
 
-		l, err = s.list(l.NextPageToken, q)
+		l, err = s.list(ctx, l.NextPageToken, q)
 	}
 
 	if fileId == "" {
@@ -385,15 +807,15 @@ func (s *GDrive) Type() string {
 	return "gdrive"
 }
 
-func (s *GDrive) Head(token string, filename string) (contentLength uint64, err error) {
+func (s *GDrive) Head(ctx context.Context, token string, filename string) (contentLength uint64, err error) {
 	var fileId string
-	fileId, err = s.findId(filename, token)
+	fileId, err = s.findId(ctx, filename, token)
 	if err != nil {
 		return
 	}
 
 	var fi *drive.File
-	if fi, err = s.service.Files.Get(fileId).Fields("size").Do(); err != nil {
+	if fi, err = s.service.Files.Get(fileId).Fields("size").Context(ctx).Do(); err != nil {
 		return
 	}
 
@@ -402,23 +824,24 @@ func (s *GDrive) Head(token string, filename string) (contentLength uint64, err
 	return
 }
 
-func (s *GDrive) Get(token string, filename string) (reader io.ReadCloser, contentLength uint64, err error) {
+func (s *GDrive) Get(ctx context.Context, token string, filename string) (reader io.ReadCloser, contentLength uint64, err error) {
 	var fileId string
-	fileId, err = s.findId(filename, token)
+	fileId, err = s.findId(ctx, filename, token)
 	if err != nil {
 		return
 	}
 
 	var fi *drive.File
-	fi, err = s.service.Files.Get(fileId).Fields("size", "md5Checksum").Do()
-	if !s.hasChecksum(fi) {
+	fi, err = s.service.Files.Get(fileId).Fields("size", "md5Checksum").Context(ctx).Do()
+	if err != nil {
+		return
+	} else if !s.hasChecksum(fi) {
 		err = fmt.Errorf("Cannot find file %s/%s", token, filename)
 		return
 	}
 
 	contentLength = uint64(fi.Size)
 
-	ctx := context.Background()
 	var res *http.Response
 	res, err = s.service.Files.Get(fileId).Context(ctx).Download()
 	if err != nil {
@@ -430,20 +853,67 @@ func (s *GDrive) Get(token string, filename string) (reader io.ReadCloser, conte
 	return
 }
 
-func (s *GDrive) Delete(token string, filename string) (err error) {
-	metadata, _ := s.findId(fmt.Sprintf("%s.metadata", filename), token)
-	s.service.Files.Delete(metadata).Do()
+func (s *GDrive) Delete(ctx context.Context, token string, filename string) (err error) {
+	metadata, _ := s.findId(ctx, fmt.Sprintf("%s.metadata", filename), token)
+	s.service.Files.Delete(metadata).Context(ctx).Do()
 
 	var fileId string
-	fileId, err = s.findId(filename, token)
+	fileId, err = s.findId(ctx, filename, token)
 	if err != nil {
 		return
 	}
 
-	err = s.service.Files.Delete(fileId).Do()
+	err = s.service.Files.Delete(fileId).Context(ctx).Do()
+	return
+}
+
+func (s *GDrive) List(ctx context.Context) (objects []ObjectInfo, err error) {
+	q := fmt.Sprintf("'%s' in parents and mimeType='%s' and trashed=false", s.rootId, GDriveDirectoryMimeType)
+
+	var tokens []*drive.File
+	if tokens, err = s.listAll(ctx, q); err != nil {
+		return
+	}
+
+	for _, token := range tokens {
+		q = fmt.Sprintf("'%s' in parents and mimeType!='%s' and trashed=false", token.Id, GDriveDirectoryMimeType)
+
+		var files []*drive.File
+		if files, err = s.listAll(ctx, q); err != nil {
+			return
+		}
+
+		for _, fi := range files {
+			objects = append(objects, ObjectInfo{Token: token.Name, Filename: fi.Name, ContentLength: uint64(fi.Size)})
+		}
+	}
+
+	return
+}
+
+func (s *GDrive) listAll(ctx context.Context, q string) (files []*drive.File, err error) {
+	err = s.service.Files.List().Fields("nextPageToken, files(id, name, mimeType, size)").Q(q).Pages(ctx, func(l *drive.FileList) error {
+		files = append(files, l.Files...)
+		return nil
+	})
+
 	return
 }
 
+func (s *GDrive) Checksum(ctx context.Context, token string, filename string) (string, error) {
+	fileId, err := s.findId(ctx, filename, token)
+	if err != nil {
+		return "", err
+	}
+
+	fi, err := s.service.Files.Get(fileId).Fields("md5Checksum").Context(ctx).Do()
+	if err != nil {
+		return "", err
+	}
+
+	return fi.Md5Checksum, nil
+}
+
 func (s *GDrive) IsNotExist(err error) bool {
 	if err != nil {
 		if e, ok := err.(*googleapi.Error); ok {
@@ -454,8 +924,8 @@ func (s *GDrive) IsNotExist(err error) bool {
 	return false
 }
 
-func (s *GDrive) Put(token string, filename string, reader io.Reader, contentType string, contentLength uint64) error {
-	dirId, err := s.findId("", token)
+func (s *GDrive) Put(ctx context.Context, token string, filename string, reader io.Reader, contentType string, contentLength uint64) error {
+	dirId, err := s.findId(ctx, "", token)
 	if err != nil {
 		return err
 	}
@@ -467,7 +937,7 @@ func (s *GDrive) Put(token string, filename string, reader io.Reader, contentTyp
 			MimeType: GDriveDirectoryMimeType,
 		}
 
-		di, err := s.service.Files.Create(dir).Fields("id").Do()
+		di, err := s.service.Files.Create(dir).Fields("id").Context(ctx).Do()
 		if err != nil {
 			return err
 		}
@@ -482,7 +952,6 @@ func (s *GDrive) Put(token string, filename string, reader io.Reader, contentTyp
 		MimeType: contentType,
 	}
 
-	ctx := context.Background()
 	_, err = s.service.Files.Create(dst).Context(ctx).Media(reader, googleapi.ChunkSize(s.chunkSize)).Do()
 
 	if err != nil {
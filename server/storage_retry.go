@@ -0,0 +1,248 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"io"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// ErrCircuitOpen is returned without calling the storage provider while its
+// circuit breaker is open
+var ErrCircuitOpen = errors.New("storage backend unavailable")
+
+const (
+	CircuitClosed   = "closed"
+	CircuitOpen     = "open"
+	CircuitHalfOpen = "half-open"
+)
+
+// RetryOptions configures the retries and circuit breaker of NewRetryStorage
+type RetryOptions struct {
+	// Retries is the number of times a failed idempotent operation is retried
+	Retries int
+	// Delay is the base delay between retries, it doubles on every retry and is jittered
+	Delay time.Duration
+	// MaxDelay caps the delay between retries
+	MaxDelay time.Duration
+	// FailureThreshold is the number of consecutive failures that opens the
+	// circuit, zero disables the circuit breaker
+	FailureThreshold int
+	// Cooldown is the time the circuit stays open before a trial call is allowed
+	Cooldown time.Duration
+}
+
+// CircuitBreaker is implemented by storage providers that guard the backend
+// with a circuit breaker
+type CircuitBreaker interface {
+	CircuitState() string
+}
+
+// retryStorage retries idempotent operations of the wrapped storage and fails
+// fast while the backend keeps failing
+type retryStorage struct {
+	Storage
+	options RetryOptions
+
+	mutex    sync.Mutex
+	state    string
+	failures int
+	openedAt time.Time
+}
+
+// NewRetryStorage wraps a storage provider with bounded, jittered retries of
+// Head, Get, Delete, List and Put (when the reader can be rewound) and a
+// circuit breaker shared by all operations.
+func NewRetryStorage(storage Storage, options RetryOptions) Storage {
+	if options.Retries <= 0 && options.FailureThreshold <= 0 {
+		return storage
+	}
+
+	if options.Delay <= 0 {
+		options.Delay = 100 * time.Millisecond
+	}
+
+	if options.MaxDelay <= 0 {
+		options.MaxDelay = 5 * time.Second
+	}
+
+	if options.Cooldown <= 0 {
+		options.Cooldown = 30 * time.Second
+	}
+
+	return &retryStorage{Storage: storage, options: options, state: CircuitClosed}
+}
+
+func (s *retryStorage) CircuitState() string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.state == CircuitOpen && time.Since(s.openedAt) >= s.options.Cooldown {
+		return CircuitHalfOpen
+	}
+
+	return s.state
+}
+
+// allow reports whether a call may be made to the backend
+func (s *retryStorage) allow() bool {
+	if s.options.FailureThreshold <= 0 {
+		return true
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	switch s.state {
+	case CircuitOpen:
+		if time.Since(s.openedAt) < s.options.Cooldown {
+			return false
+		}
+
+		// let a single trial call through
+		s.state = CircuitHalfOpen
+		return true
+	case CircuitHalfOpen:
+		return false
+	default:
+		return true
+	}
+}
+
+// record updates the circuit breaker with the outcome of a call
+func (s *retryStorage) record(ctx context.Context, err error) {
+	if s.options.FailureThreshold <= 0 {
+		return
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if err == nil || s.Storage.IsNotExist(err) {
+		s.state = CircuitClosed
+		s.failures = 0
+		return
+	}
+
+	if ctx.Err() != nil {
+		// the caller gave up, this says nothing about the backend
+		if s.state == CircuitHalfOpen {
+			s.state = CircuitOpen
+		}
+
+		return
+	}
+
+	s.failures++
+
+	if s.state == CircuitHalfOpen || s.failures >= s.options.FailureThreshold {
+		s.state = CircuitOpen
+		s.openedAt = time.Now()
+	}
+}
+
+// retryable reports whether a failed call should be tried again
+func (s *retryStorage) retryable(ctx context.Context, err error) bool {
+	return err != nil && err != ErrCircuitOpen && !s.Storage.IsNotExist(err) && ctx.Err() == nil
+}
+
+// backoff waits before the given retry, it returns false when the context is done
+func (s *retryStorage) backoff(ctx context.Context, retry int) bool {
+	delay := s.options.Delay << uint(retry)
+	if delay <= 0 || delay > s.options.MaxDelay {
+		delay = s.options.MaxDelay
+	}
+
+	timer := time.NewTimer(time.Duration(rand.Int63n(int64(delay)) + 1))
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// do calls fn until it succeeds, fails permanently or the retries are exhausted
+func (s *retryStorage) do(ctx context.Context, retries int, fn func() error) error {
+	var err error
+
+	for retry := 0; ; retry++ {
+		if !s.allow() {
+			return ErrCircuitOpen
+		}
+
+		err = fn()
+		s.record(ctx, err)
+
+		if retry >= retries || !s.retryable(ctx, err) || !s.backoff(ctx, retry) {
+			return err
+		}
+	}
+}
+
+func (s *retryStorage) Head(ctx context.Context, token string, filename string) (contentLength uint64, err error) {
+	err = s.do(ctx, s.options.Retries, func() (err error) {
+		contentLength, err = s.Storage.Head(ctx, token, filename)
+		return
+	})
+
+	return
+}
+
+func (s *retryStorage) Get(ctx context.Context, token string, filename string) (reader io.ReadCloser, contentLength uint64, err error) {
+	err = s.do(ctx, s.options.Retries, func() (err error) {
+		reader, contentLength, err = s.Storage.Get(ctx, token, filename)
+		return
+	})
+
+	return
+}
+
+func (s *retryStorage) Put(ctx context.Context, token string, filename string, reader io.Reader, contentType string, contentLength uint64) error {
+	// only a reader that can be rewound can be replayed
+	seeker, ok := reader.(io.Seeker)
+
+	var offset int64
+	if ok {
+		var err error
+		if offset, err = seeker.Seek(0, io.SeekCurrent); err != nil {
+			ok = false
+		}
+	}
+
+	retries := 0
+	if ok {
+		retries = s.options.Retries
+	}
+
+	attempt := 0
+
+	return s.do(ctx, retries, func() error {
+		if attempt++; attempt > 1 {
+			if _, err := seeker.Seek(offset, io.SeekStart); err != nil {
+				return err
+			}
+		}
+
+		return s.Storage.Put(ctx, token, filename, reader, contentType, contentLength)
+	})
+}
+
+func (s *retryStorage) Delete(ctx context.Context, token string, filename string) error {
+	return s.do(ctx, s.options.Retries, func() error {
+		return s.Storage.Delete(ctx, token, filename)
+	})
+}
+
+func (s *retryStorage) List(ctx context.Context) (objects []ObjectInfo, err error) {
+	err = s.do(ctx, s.options.Retries, func() (err error) {
+		objects, err = s.Storage.List(ctx)
+		return
+	})
+
+	return
+}
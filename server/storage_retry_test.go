@@ -0,0 +1,158 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"time"
+
+	"github.com/gorilla/mux"
+	. "gopkg.in/check.v1"
+)
+
+var _ = Suite(&SuiteRetryStorage{})
+
+type SuiteRetryStorage struct{}
+
+var errFlaky = errors.New("flaky backend")
+
+// flakyStorage fails the first failures calls
+type flakyStorage struct {
+	Storage
+	failures int
+	calls    int
+	received []string
+}
+
+func (s *flakyStorage) IsNotExist(err error) bool {
+	return false
+}
+
+func (s *flakyStorage) Head(ctx context.Context, token string, filename string) (uint64, error) {
+	if s.calls++; s.calls <= s.failures {
+		return 0, errFlaky
+	}
+
+	return 42, nil
+}
+
+func (s *flakyStorage) Put(ctx context.Context, token string, filename string, reader io.Reader, contentType string, contentLength uint64) error {
+	data, _ := ioutil.ReadAll(reader)
+	s.received = append(s.received, string(data))
+
+	if s.calls++; s.calls <= s.failures {
+		return errFlaky
+	}
+
+	return nil
+}
+
+func (s *SuiteRetryStorage) TestRetry(c *C) {
+	backend := &flakyStorage{failures: 2}
+	storage := NewRetryStorage(backend, RetryOptions{Retries: 2, Delay: time.Millisecond})
+
+	contentLength, err := storage.Head(context.Background(), "token", "filename")
+	c.Assert(err, IsNil)
+	c.Assert(contentLength, Equals, uint64(42))
+	c.Assert(backend.calls, Equals, 3)
+}
+
+func (s *SuiteRetryStorage) TestRetryPut(c *C) {
+	backend := &flakyStorage{failures: 1}
+	storage := NewRetryStorage(backend, RetryOptions{Retries: 2, Delay: time.Millisecond})
+
+	err := storage.Put(context.Background(), "token", "filename", bytes.NewReader([]byte("data")), "text/plain", 4)
+	c.Assert(err, IsNil)
+	c.Assert(backend.received, DeepEquals, []string{"data", "data"})
+
+	// a reader that can't be rewound is not retried
+	backend = &flakyStorage{failures: 1}
+	storage = NewRetryStorage(backend, RetryOptions{Retries: 2, Delay: time.Millisecond})
+
+	err = storage.Put(context.Background(), "token", "filename", ioutil.NopCloser(bytes.NewReader([]byte("data"))), "text/plain", 4)
+	c.Assert(err, Equals, errFlaky)
+	c.Assert(backend.calls, Equals, 1)
+}
+
+func (s *SuiteRetryStorage) TestCircuitBreaker(c *C) {
+	backend := &flakyStorage{failures: 3}
+	storage := NewRetryStorage(backend, RetryOptions{FailureThreshold: 2, Cooldown: 20 * time.Millisecond})
+
+	breaker := storage.(CircuitBreaker)
+
+	_, err := storage.Head(context.Background(), "token", "filename")
+	c.Assert(err, Equals, errFlaky)
+	c.Assert(breaker.CircuitState(), Equals, CircuitClosed)
+
+	_, err = storage.Head(context.Background(), "token", "filename")
+	c.Assert(err, Equals, errFlaky)
+	c.Assert(breaker.CircuitState(), Equals, CircuitOpen)
+
+	// fails fast while open
+	_, err = storage.Head(context.Background(), "token", "filename")
+	c.Assert(err, Equals, ErrCircuitOpen)
+	c.Assert(backend.calls, Equals, 2)
+
+	time.Sleep(25 * time.Millisecond)
+	c.Assert(breaker.CircuitState(), Equals, CircuitHalfOpen)
+
+	// the failing trial opens the circuit again
+	_, err = storage.Head(context.Background(), "token", "filename")
+	c.Assert(err, Equals, errFlaky)
+	c.Assert(breaker.CircuitState(), Equals, CircuitOpen)
+
+	time.Sleep(25 * time.Millisecond)
+
+	_, err = storage.Head(context.Background(), "token", "filename")
+	c.Assert(err, IsNil)
+	c.Assert(breaker.CircuitState(), Equals, CircuitClosed)
+}
+
+func (s *SuiteRetryStorage) TestUploadCircuitOpen(c *C) {
+	storage := NewRetryStorage(&flakyStorage{failures: 1}, RetryOptions{FailureThreshold: 1, Cooldown: time.Minute})
+	_, err := storage.Head(context.Background(), "token", "filename")
+	c.Assert(err, Equals, errFlaky)
+
+	srvr := testServer(c, UseStorage(storage))
+
+	body := &bytes.Buffer{}
+	writer := multipart.NewWriter(body)
+	part, err := writer.CreateFormFile("file", "file.txt")
+	c.Assert(err, IsNil)
+	part.Write([]byte("content"))
+	writer.Close()
+
+	req := httptest.NewRequest("POST", "/", body)
+	req.Header.Set("Content-Type", writer.FormDataContentType())
+	c.Assert(serveRoute(srvr, "user", req).Code, Equals, http.StatusServiceUnavailable)
+
+	req = httptest.NewRequest("PUT", "/file.txt", bytes.NewBufferString("content"))
+	c.Assert(serveRoute(srvr, "user", req).Code, Equals, http.StatusServiceUnavailable)
+}
+
+func (s *SuiteRetryStorage) TestMetadataCircuitOpen(c *C) {
+	storage := NewRetryStorage(&flakyStorage{failures: 1}, RetryOptions{FailureThreshold: 1, Cooldown: time.Minute})
+	_, err := storage.Head(context.Background(), "token", "filename")
+	c.Assert(err, Equals, errFlaky)
+
+	srvr := testServer(c, UseMetaStorage(storage))
+
+	// metadata that can't be read doesn't make the file not found
+	req := httptest.NewRequest("GET", "/token/file.txt", nil)
+	c.Assert(serveRoute(srvr, "", req).Code, Equals, http.StatusServiceUnavailable)
+
+	router := mux.NewRouter()
+	router.HandleFunc("/{token}/{filename}", srvr.previewHandler)
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("GET", "/token/file.txt", nil))
+	c.Assert(w.Code, Equals, http.StatusServiceUnavailable)
+
+	err = srvr.putMetadata(context.Background(), "token", "file.txt", Metadata{})
+	c.Assert(errors.Is(err, ErrCircuitOpen), Equals, true)
+}
@@ -0,0 +1,222 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	. "gopkg.in/check.v1"
+)
+
+var _ = Suite(&SuiteS3Storage{})
+
+type SuiteS3Storage struct {
+	ts *httptest.Server
+}
+
+// s3Object is an object of the fake S3 bucket
+type s3Object struct {
+	data   []byte
+	header http.Header
+	tags   url.Values
+	// size overrides the content length reported by HEAD requests
+	size int64
+}
+
+// fakeS3 serves the subset of the S3 API used by S3Storage from memory
+type fakeS3 struct {
+	mutex   sync.Mutex
+	objects map[string]*s3Object
+	copies  int
+}
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	// path style requests, /bucket/token/filename
+	key := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/"), "/", 2)[1]
+	object, ok := f.objects[key]
+
+	switch {
+	case r.Method == "PUT" && r.Header.Get("X-Amz-Copy-Source") != "":
+		f.copies++
+		w.Write([]byte(`<CopyObjectResult></CopyObjectResult>`))
+	case r.Method == "PUT" && r.URL.Query()["tagging"] != nil:
+		var tagging struct {
+			Tags []struct {
+				Key   string
+				Value string
+			} `xml:"TagSet>Tag"`
+		}
+
+		if err := xml.NewDecoder(r.Body).Decode(&tagging); err != nil || !ok {
+			http.Error(w, "", http.StatusBadRequest)
+			return
+		}
+
+		object.tags = url.Values{}
+		for _, tag := range tagging.Tags {
+			object.tags.Set(tag.Key, tag.Value)
+		}
+	case r.Method == "PUT":
+		data, _ := ioutil.ReadAll(r.Body)
+		tags, _ := url.ParseQuery(r.Header.Get("X-Amz-Tagging"))
+
+		header := http.Header{}
+		for k, v := range r.Header {
+			if strings.HasPrefix(k, "X-Amz-Meta-") {
+				header[k] = v
+			}
+		}
+
+		f.objects[key] = &s3Object{data: data, header: header, tags: tags, size: int64(len(data))}
+	case r.Method == "DELETE":
+		delete(f.objects, key)
+		w.WriteHeader(http.StatusNoContent)
+	case !ok:
+		w.WriteHeader(http.StatusNotFound)
+		if r.Method == "GET" {
+			w.Write([]byte(`<Error><Code>NoSuchKey</Code></Error>`))
+		}
+	default:
+		for k, v := range object.header {
+			w.Header()[k] = v
+		}
+
+		if r.Method == "HEAD" {
+			w.Header().Set("Content-Length", fmt.Sprint(object.size))
+			return
+		}
+
+		w.Write(object.data)
+	}
+}
+
+func (s *SuiteS3Storage) TearDownTest(c *C) {
+	if s.ts != nil {
+		s.ts.Close()
+	}
+}
+
+func (s *SuiteS3Storage) storage(c *C, options S3Options) (*S3Storage, *fakeS3) {
+	fake := &fakeS3{objects: map[string]*s3Object{}}
+	s.ts = httptest.NewServer(fake)
+
+	storage, err := NewS3Storage("key", "secret", "bucket", "us-east-1", s.ts.URL, log.New(ioutil.Discard, "", 0), true, true, options)
+	c.Assert(err, IsNil)
+
+	return storage, fake
+}
+
+// upload stores a file with its metadata the way the upload handlers do
+func (s *SuiteS3Storage) upload(c *C, storage *S3Storage, metadata Metadata) {
+	data, err := json.Marshal(metadata)
+	c.Assert(err, IsNil)
+
+	ctx := context.Background()
+	c.Assert(storage.Put(ctx, "aaaaa", "file.txt.metadata", strings.NewReader(string(data)), "text/json", uint64(len(data))), IsNil)
+	c.Assert(storage.Put(WithMetadata(ctx, metadata), "aaaaa", "file.txt", strings.NewReader("content"), "text/plain", 7), IsNil)
+}
+
+func (s *SuiteS3Storage) metadata(c *C, storage *S3Storage) (metadata Metadata) {
+	reader, _, err := storage.Get(context.Background(), "aaaaa", "file.txt.metadata")
+	c.Assert(err, IsNil)
+	defer reader.Close()
+
+	c.Assert(json.NewDecoder(reader).Decode(&metadata), IsNil)
+	return
+}
+
+func (s *SuiteS3Storage) TestEmbedMetadata(c *C) {
+	storage, fake := s.storage(c, S3Options{EmbedMetadata: true})
+	s.upload(c, storage, Metadata{MaxDownloads: 2})
+
+	c.Assert(fake.objects, HasLen, 1)
+	c.Assert(fake.objects["aaaaa/file.txt"].header.Get("X-Amz-Meta-"+s3MetadataKey), Not(Equals), "")
+	c.Assert(s.metadata(c, storage).MaxDownloads, Equals, 2)
+
+	// updates are stored separately instead of copying the object
+	c.Assert(storage.Put(context.Background(), "aaaaa", "file.txt.metadata", strings.NewReader(`{"MaxDownloads":2,"Downloads":1}`), "text/json", 0), IsNil)
+	c.Assert(fake.copies, Equals, 0)
+	c.Assert(s.metadata(c, storage).Downloads, Equals, 1)
+
+	c.Assert(storage.Delete(context.Background(), "aaaaa", "file.txt.metadata"), IsNil)
+	c.Assert(storage.Delete(context.Background(), "aaaaa", "file.txt"), IsNil)
+	c.Assert(fake.objects, HasLen, 0)
+}
+
+func (s *SuiteS3Storage) TestEmbedMetadataLargeObject(c *C) {
+	storage, fake := s.storage(c, S3Options{EmbedMetadata: true})
+	s.upload(c, storage, Metadata{MaxDownloads: 1, Links: []Link{{ID: "link", MaxDownloads: 1}}})
+
+	// objects larger than 5 GB keep the metadata of their upload
+	fake.objects["aaaaa/file.txt"].size = 6 << 30
+	metadata := s.metadata(c, storage)
+	c.Assert(metadata.MaxDownloads, Equals, 1)
+	c.Assert(metadata.Links, HasLen, 1)
+
+	metadata.Downloads = 1
+	data, err := json.Marshal(metadata)
+	c.Assert(err, IsNil)
+	c.Assert(storage.Put(context.Background(), "aaaaa", "file.txt.metadata", strings.NewReader(string(data)), "text/json", 0), IsNil)
+	c.Assert(fake.copies, Equals, 0)
+	c.Assert(s.metadata(c, storage).Downloads, Equals, 1)
+}
+
+func (s *SuiteS3Storage) TestEmbedMetadataSizeLimit(c *C) {
+	storage, fake := s.storage(c, S3Options{EmbedMetadata: true})
+
+	metadata := Metadata{MaxDownloads: -1}
+	for i := 0; i < 100; i++ {
+		metadata.Links = append(metadata.Links, Link{ID: fmt.Sprintf("link-%d", i), MaxDownloads: 1})
+	}
+
+	s.upload(c, storage, metadata)
+
+	// metadata exceeding the user metadata limit is kept in a separate object
+	c.Assert(fake.objects["aaaaa/file.txt"].header.Get("X-Amz-Meta-"+s3MetadataKey), Equals, "")
+	c.Assert(fake.objects["aaaaa/file.txt.metadata"], NotNil)
+	c.Assert(s.metadata(c, storage).Links, HasLen, 100)
+
+	_, ok := s3UserMetadata(make([]byte, 2<<10))
+	c.Assert(ok, Equals, false)
+	_, ok = s3UserMetadata(make([]byte, 1<<10))
+	c.Assert(ok, Equals, true)
+}
+
+func (s *SuiteS3Storage) TestLifecycleTags(c *C) {
+	storage, fake := s.storage(c, S3Options{EmbedMetadata: true, LifecycleTags: true})
+
+	metadata := Metadata{MaxDownloads: -1, MaxDate: time.Now().Add(36 * time.Hour)}
+	s.upload(c, storage, metadata)
+	c.Assert(fake.objects["aaaaa/file.txt"].tags.Get(s3MaxDaysTag), Equals, "2")
+
+	// lifecycle rules count the days from the upload of the file, and the
+	// separate metadata object expires with its file
+	metadata.Created = time.Now().Add(-48 * time.Hour)
+	metadata.MaxDate = time.Now().Add(60 * time.Hour)
+	data, err := json.Marshal(metadata)
+	c.Assert(err, IsNil)
+	c.Assert(storage.Put(context.Background(), "aaaaa", "file.txt.metadata", strings.NewReader(string(data)), "text/json", 0), IsNil)
+	c.Assert(fake.objects["aaaaa/file.txt"].tags.Get(s3MaxDaysTag), Equals, "5")
+	c.Assert(fake.objects["aaaaa/file.txt.metadata"].tags.Get(s3MaxDaysTag), Equals, "5")
+
+	// a hold removes the expiry tag
+	metadata.Hold = true
+	data, err = json.Marshal(metadata)
+	c.Assert(err, IsNil)
+	c.Assert(storage.Put(context.Background(), "aaaaa", "file.txt.metadata", strings.NewReader(string(data)), "text/json", 0), IsNil)
+	c.Assert(fake.objects["aaaaa/file.txt"].tags, HasLen, 0)
+	c.Assert(fake.objects["aaaaa/file.txt.metadata"].tags, HasLen, 0)
+	c.Assert(fake.copies, Equals, 0)
+}
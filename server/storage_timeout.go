@@ -0,0 +1,114 @@
+package server
+
+import (
+	"context"
+	"io"
+	"time"
+)
+
+// timeoutStorage bounds the duration of every call to the wrapped storage
+type timeoutStorage struct {
+	Storage
+	timeout         time.Duration
+	transferTimeout time.Duration
+}
+
+// NewTimeoutStorage wraps a storage provider with per-operation timeouts.
+// timeout applies to Head, Delete and List and to opening the reader of a
+// Get, transferTimeout applies to the complete transfer of a Get or Put.
+// A zero duration disables the timeout.
+func NewTimeoutStorage(storage Storage, timeout, transferTimeout time.Duration) Storage {
+	if timeout <= 0 && transferTimeout <= 0 {
+		return storage
+	}
+
+	return &timeoutStorage{Storage: storage, timeout: timeout, transferTimeout: transferTimeout}
+}
+
+func (s *timeoutStorage) withTimeout(ctx context.Context, timeout time.Duration) (context.Context, context.CancelFunc) {
+	if timeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+
+	return context.WithTimeout(ctx, timeout)
+}
+
+// deadlineError reports the failures of operations that ran out of time as
+// context.DeadlineExceeded, whatever error the provider returned for them
+func (s *timeoutStorage) deadlineError(ctx context.Context, err error) error {
+	if err != nil && ctx.Err() == context.DeadlineExceeded && !s.IsNotExist(err) {
+		return context.DeadlineExceeded
+	}
+
+	return err
+}
+
+func (s *timeoutStorage) Head(ctx context.Context, token string, filename string) (uint64, error) {
+	ctx, cancel := s.withTimeout(ctx, s.timeout)
+	defer cancel()
+
+	contentLength, err := s.Storage.Head(ctx, token, filename)
+	return contentLength, s.deadlineError(ctx, err)
+}
+
+func (s *timeoutStorage) Get(ctx context.Context, token string, filename string) (io.ReadCloser, uint64, error) {
+	ctx, cancel := s.withTimeout(ctx, s.transferTimeout)
+
+	// the operation timeout only applies until the reader is returned
+	var timer *time.Timer
+	if s.timeout > 0 {
+		timer = time.AfterFunc(s.timeout, cancel)
+	}
+
+	reader, contentLength, err := s.Storage.Get(ctx, token, filename)
+
+	// the reader outlives the operation timeout, so it cancels the context
+	// instead of setting a deadline and the cancellation is reported as one
+	if timer != nil && !timer.Stop() {
+		if err == nil {
+			reader.Close()
+		}
+
+		err = context.DeadlineExceeded
+	}
+
+	if err = s.deadlineError(ctx, err); err != nil {
+		cancel()
+		return nil, 0, err
+	}
+
+	return &cancelReadCloser{ReadCloser: reader, cancel: cancel}, contentLength, nil
+}
+
+func (s *timeoutStorage) Put(ctx context.Context, token string, filename string, reader io.Reader, contentType string, contentLength uint64) error {
+	ctx, cancel := s.withTimeout(ctx, s.transferTimeout)
+	defer cancel()
+
+	return s.deadlineError(ctx, s.Storage.Put(ctx, token, filename, reader, contentType, contentLength))
+}
+
+func (s *timeoutStorage) Delete(ctx context.Context, token string, filename string) error {
+	ctx, cancel := s.withTimeout(ctx, s.timeout)
+	defer cancel()
+
+	return s.deadlineError(ctx, s.Storage.Delete(ctx, token, filename))
+}
+
+func (s *timeoutStorage) List(ctx context.Context) ([]ObjectInfo, error) {
+	ctx, cancel := s.withTimeout(ctx, s.timeout)
+	defer cancel()
+
+	objects, err := s.Storage.List(ctx)
+	return objects, s.deadlineError(ctx, err)
+}
+
+// cancelReadCloser releases the context of a Get once the reader is closed
+type cancelReadCloser struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (r *cancelReadCloser) Close() error {
+	defer r.cancel()
+	return r.ReadCloser.Close()
+}
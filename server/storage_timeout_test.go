@@ -0,0 +1,85 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"time"
+
+	. "gopkg.in/check.v1"
+)
+
+var _ = Suite(&SuiteTimeoutStorage{})
+
+type SuiteTimeoutStorage struct{}
+
+// blockingStorage blocks every call until its context is done
+type blockingStorage struct {
+	Storage
+}
+
+func (s *blockingStorage) IsNotExist(err error) bool {
+	return false
+}
+
+func (s *blockingStorage) Get(ctx context.Context, token string, filename string) (io.ReadCloser, uint64, error) {
+	<-ctx.Done()
+	return nil, 0, ctx.Err()
+}
+
+// Delete fails with an error of its own, like the providers that wrap the
+// error of the context
+func (s *blockingStorage) Delete(ctx context.Context, token string, filename string) error {
+	<-ctx.Done()
+	return errors.New("request canceled")
+}
+
+func (s *blockingStorage) Head(ctx context.Context, token string, filename string) (uint64, error) {
+	<-ctx.Done()
+	return 0, ctx.Err()
+}
+
+func (s *blockingStorage) Put(ctx context.Context, token string, filename string, reader io.Reader, contentType string, contentLength uint64) error {
+	<-ctx.Done()
+	return ctx.Err()
+}
+
+func (s *SuiteTimeoutStorage) TestTimeout(c *C) {
+	storage := NewTimeoutStorage(&blockingStorage{}, 10*time.Millisecond, 20*time.Millisecond)
+
+	_, err := storage.Head(context.Background(), "token", "filename")
+	c.Assert(err, Equals, context.DeadlineExceeded)
+
+	err = storage.Put(context.Background(), "token", "filename", nil, "", 0)
+	c.Assert(err, Equals, context.DeadlineExceeded)
+
+	// opening a reader is canceled by the operation timeout
+	_, _, err = storage.Get(context.Background(), "token", "filename")
+	c.Assert(err, Equals, context.DeadlineExceeded)
+
+	err = storage.Delete(context.Background(), "token", "filename")
+	c.Assert(err, Equals, context.DeadlineExceeded)
+}
+
+func (s *SuiteTimeoutStorage) TestTimeoutStatus(c *C) {
+	w := httptest.NewRecorder()
+	storageError(w, context.DeadlineExceeded, "Could not retrieve file.")
+	c.Assert(w.Code, Equals, http.StatusGatewayTimeout)
+
+	w = httptest.NewRecorder()
+	storageError(w, errors.New("request canceled"), "Could not retrieve file.")
+	c.Assert(w.Code, Equals, http.StatusInternalServerError)
+	c.Assert(w.Body.String(), Equals, "Could not retrieve file.\n")
+}
+
+func (s *SuiteTimeoutStorage) TestCanceled(c *C) {
+	storage := NewTimeoutStorage(&blockingStorage{}, time.Minute, 0)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	_, err := storage.Head(ctx, "token", "filename")
+	c.Assert(err, Equals, context.Canceled)
+}
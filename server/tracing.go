@@ -0,0 +1,546 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+const (
+	// maxSpanBatch is the number of finished spans that triggers an export
+	maxSpanBatch = 512
+	// maxQueuedSpans bounds the finished spans waiting for an export, spans
+	// are dropped while the exporter can't keep up
+	maxQueuedSpans = 8192
+	// spanExportInterval is the interval of exports of the finished spans
+	spanExportInterval = 5 * time.Second
+
+	defaultOTLPEndpoint = "http://localhost:4318/v1/traces"
+	tracingServiceName  = "transfer.sh"
+)
+
+const (
+	spanKindInternal = 1
+	spanKindServer   = 2
+	spanKindClient   = 3
+)
+
+// Tracing records spans of the requests, metadata and storage operations,
+// scanners and the api authenticator and exports them with exporter
+func Tracing(exporter SpanExporter) OptionFn {
+	return func(srvr *Server) {
+		srvr.tracer = NewTracer(exporter)
+	}
+}
+
+// TraceSampling records the ratio of the traces started by the server, from 0
+// for none to 1 for every trace. Traces continued from a traceparent header
+// keep the decision of the caller.
+func TraceSampling(ratio float64) OptionFn {
+	return func(srvr *Server) {
+		srvr.traceSampleRatio = ratio
+	}
+}
+
+// SpanExporter sends finished spans to a tracing backend
+type SpanExporter interface {
+	ExportSpans(spans []*Span) error
+}
+
+// Tracer batches the finished spans for its exporter
+type Tracer struct {
+	exporter SpanExporter
+
+	mutex sync.Mutex
+	spans []*Span
+
+	exporting sync.Mutex
+
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// NewTracer returns a tracer exporting the finished spans every 5 seconds or
+// when a batch is complete, until it is closed
+func NewTracer(exporter SpanExporter) *Tracer {
+	t := &Tracer{exporter: exporter, done: make(chan struct{})}
+	go t.run()
+
+	return t
+}
+
+func (t *Tracer) run() {
+	ticker := time.NewTicker(spanExportInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			t.flush()
+		case <-t.done:
+			return
+		}
+	}
+}
+
+// Close stops the periodic exports and exports the remaining spans
+func (t *Tracer) Close() {
+	t.closeOnce.Do(func() {
+		close(t.done)
+	})
+
+	t.flush()
+}
+
+func (t *Tracer) finish(span *Span) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	if len(t.spans) >= maxQueuedSpans {
+		return
+	}
+
+	t.spans = append(t.spans, span)
+	if len(t.spans) == maxSpanBatch {
+		go t.flush()
+	}
+}
+
+// flush exports the finished spans
+func (t *Tracer) flush() {
+	t.exporting.Lock()
+	defer t.exporting.Unlock()
+
+	t.mutex.Lock()
+	spans := t.spans
+	t.spans = nil
+	t.mutex.Unlock()
+
+	for len(spans) > 0 {
+		n := len(spans)
+		if n > maxSpanBatch {
+			n = maxSpanBatch
+		}
+
+		if err := t.exporter.ExportSpans(spans[:n]); err != nil {
+			log.Printf("Error exporting spans: %s", err.Error())
+		}
+
+		spans = spans[n:]
+	}
+}
+
+// Span is a timed operation of a trace
+type Span struct {
+	tracer *Tracer
+
+	TraceID    string
+	SpanID     string
+	ParentID   string
+	Name       string
+	Kind       int
+	Start      time.Time
+	End        time.Time
+	Attributes map[string]interface{}
+	Error      string
+
+	// sampled is false when the caller asked to not record the trace
+	sampled bool
+}
+
+type spanContextKey struct{}
+
+// spanFromContext returns the current span of ctx, if any
+func spanFromContext(ctx context.Context) *Span {
+	span, _ := ctx.Value(spanContextKey{}).(*Span)
+	return span
+}
+
+// startSpan starts a child span of the current span of ctx. Without a current
+// span nothing is traced and the returned span is nil, the methods of a nil
+// span do nothing.
+func startSpan(ctx context.Context, name string, kind int) (context.Context, *Span) {
+	parent := spanFromContext(ctx)
+	if parent == nil {
+		return ctx, nil
+	}
+
+	span := &Span{
+		tracer:   parent.tracer,
+		TraceID:  parent.TraceID,
+		SpanID:   newID(8),
+		ParentID: parent.SpanID,
+		Name:     name,
+		Kind:     kind,
+		Start:    time.Now(),
+		sampled:  parent.sampled,
+	}
+
+	return context.WithValue(ctx, spanContextKey{}, span), span
+}
+
+// setAttribute sets an attribute of the span, values are strings, bools,
+// integers or floats
+func (s *Span) setAttribute(key string, value interface{}) {
+	if s == nil {
+		return
+	}
+
+	if s.Attributes == nil {
+		s.Attributes = map[string]interface{}{}
+	}
+
+	s.Attributes[key] = value
+}
+
+// end finishes the span, err marks it as failed
+func (s *Span) end(err error) {
+	if s == nil {
+		return
+	}
+
+	s.End = time.Now()
+	if err != nil {
+		s.Error = err.Error()
+	}
+
+	if s.sampled {
+		s.tracer.finish(s)
+	}
+}
+
+// traceparent returns the W3C trace context header of the span
+func (s *Span) traceparent() string {
+	flags := "00"
+	if s.sampled {
+		flags = "01"
+	}
+
+	return fmt.Sprintf("00-%s-%s-%s", s.TraceID, s.SpanID, flags)
+}
+
+// parseTraceparent returns the trace, parent span and sampled flag of a W3C
+// trace context header
+func parseTraceparent(header string) (traceID, parentID string, sampled bool, ok bool) {
+	parts := strings.Split(strings.TrimSpace(header), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" || (parts[0] == "00" && len(parts) != 4) {
+		return "", "", false, false
+	}
+
+	if !isHex(parts[1], 32) || !isHex(parts[2], 16) || !isHex(parts[3], 2) {
+		return "", "", false, false
+	}
+
+	if parts[1] == strings.Repeat("0", 32) || parts[2] == strings.Repeat("0", 16) {
+		return "", "", false, false
+	}
+
+	flags, _ := strconv.ParseUint(parts[3], 16, 8)
+	return parts[1], parts[2], flags&1 == 1, true
+}
+
+func isHex(s string, length int) bool {
+	if len(s) != length {
+		return false
+	}
+
+	for _, c := range s {
+		if !('0' <= c && c <= '9' || 'a' <= c && c <= 'f') {
+			return false
+		}
+	}
+
+	return true
+}
+
+// newID returns a random trace or span id of n bytes
+func newID(n int) string {
+	// crypto/rand doesn't fail on supported platforms
+	id, _ := randomHex(n)
+	return id
+}
+
+// injectTraceContext adds the trace context of the current span of ctx to
+// the headers of an outgoing request
+func injectTraceContext(ctx context.Context, header http.Header) {
+	if span := spanFromContext(ctx); span != nil {
+		header.Set("traceparent", span.traceparent())
+	}
+}
+
+// TracingHandler starts a span for every request, continuing the trace of
+// an inbound W3C trace context
+func (s *Server) TracingHandler(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if s.tracer == nil {
+			h.ServeHTTP(w, r)
+			return
+		}
+
+		route := ""
+		if current := mux.CurrentRoute(r); current != nil {
+			route = current.GetName()
+		}
+
+		span := &Span{
+			tracer:  s.tracer,
+			TraceID: newID(16),
+			SpanID:  newID(8),
+			Name:    fmt.Sprintf("%s %s", r.Method, route),
+			Kind:    spanKindServer,
+			Start:   time.Now(),
+			sampled: rand.Float64() < s.traceSampleRatio,
+		}
+
+		if traceID, parentID, sampled, ok := parseTraceparent(r.Header.Get("traceparent")); ok {
+			span.TraceID, span.ParentID, span.sampled = traceID, parentID, sampled
+		}
+
+		span.setAttribute("http.method", r.Method)
+		span.setAttribute("http.route", route)
+
+		rw := &metricsResponseWriter{ResponseWriter: w, status: http.StatusOK}
+		h.ServeHTTP(rw, r.WithContext(context.WithValue(r.Context(), spanContextKey{}, span)))
+
+		span.setAttribute("http.status_code", rw.status)
+
+		var err error
+		if rw.status >= 500 {
+			err = fmt.Errorf("%d %s", rw.status, http.StatusText(rw.status))
+		}
+
+		span.end(err)
+	})
+}
+
+// tracingStorage records a span for every operation of the wrapped storage
+type tracingStorage struct {
+	Storage
+}
+
+// NewTracingStorage wraps a storage provider to trace its operations, tagged
+// with the provider. Only operations of traced requests are recorded.
+func NewTracingStorage(storage Storage) Storage {
+	return &tracingStorage{Storage: storage}
+}
+
+// start starts the span of an operation. Tokens and filenames are left out,
+// a token grants access to its files.
+func (s *tracingStorage) start(ctx context.Context, operation string) (context.Context, *Span) {
+	ctx, span := startSpan(ctx, "storage."+operation, spanKindClient)
+	span.setAttribute("storage.provider", s.Type())
+
+	return ctx, span
+}
+
+func (s *tracingStorage) finish(span *Span, err error) {
+	if err != nil && s.IsNotExist(err) {
+		span.setAttribute("storage.not_found", true)
+		err = nil
+	}
+
+	span.end(err)
+}
+
+func (s *tracingStorage) Get(ctx context.Context, token string, filename string) (reader io.ReadCloser, contentLength uint64, err error) {
+	ctx, span := s.start(ctx, "get")
+	defer func() { s.finish(span, err) }()
+
+	return s.Storage.Get(ctx, token, filename)
+}
+
+func (s *tracingStorage) Head(ctx context.Context, token string, filename string) (contentLength uint64, err error) {
+	ctx, span := s.start(ctx, "head")
+	defer func() { s.finish(span, err) }()
+
+	return s.Storage.Head(ctx, token, filename)
+}
+
+func (s *tracingStorage) Put(ctx context.Context, token string, filename string, reader io.Reader, contentType string, contentLength uint64) (err error) {
+	ctx, span := s.start(ctx, "put")
+	span.setAttribute("storage.content_length", contentLength)
+	defer func() { s.finish(span, err) }()
+
+	return s.Storage.Put(ctx, token, filename, reader, contentType, contentLength)
+}
+
+func (s *tracingStorage) Delete(ctx context.Context, token string, filename string) (err error) {
+	ctx, span := s.start(ctx, "delete")
+	defer func() { s.finish(span, err) }()
+
+	return s.Storage.Delete(ctx, token, filename)
+}
+
+func (s *tracingStorage) List(ctx context.Context) (objects []ObjectInfo, err error) {
+	ctx, span := s.start(ctx, "list")
+	defer func() { s.finish(span, err) }()
+
+	return s.Storage.List(ctx)
+}
+
+// stdoutExporter writes every span as a json line
+type stdoutExporter struct {
+	mutex sync.Mutex
+	w     io.Writer
+}
+
+// NewStdoutExporter returns an exporter writing the spans as json lines to w
+func NewStdoutExporter(w io.Writer) SpanExporter {
+	return &stdoutExporter{w: w}
+}
+
+func (e *stdoutExporter) ExportSpans(spans []*Span) error {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	encoder := json.NewEncoder(e.w)
+	for _, span := range spans {
+		if err := encoder.Encode(span); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// otlpExporter sends the spans to an OTLP/HTTP collector with the json
+// encoding
+type otlpExporter struct {
+	endpoint string
+	headers  map[string]string
+	client   *http.Client
+}
+
+// NewOTLPExporter returns an exporter sending the spans to the OTLP/HTTP
+// traces endpoint of a collector, http://localhost:4318/v1/traces when empty
+func NewOTLPExporter(endpoint string, headers map[string]string) SpanExporter {
+	if endpoint == "" {
+		endpoint = defaultOTLPEndpoint
+	}
+
+	return &otlpExporter{endpoint: endpoint, headers: headers, client: &http.Client{Timeout: 10 * time.Second}}
+}
+
+type otlpKeyValue struct {
+	Key   string                 `json:"key"`
+	Value map[string]interface{} `json:"value"`
+}
+
+type otlpSpan struct {
+	TraceID           string         `json:"traceId"`
+	SpanID            string         `json:"spanId"`
+	ParentSpanID      string         `json:"parentSpanId,omitempty"`
+	Name              string         `json:"name"`
+	Kind              int            `json:"kind"`
+	StartTimeUnixNano string         `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string         `json:"endTimeUnixNano"`
+	Attributes        []otlpKeyValue `json:"attributes,omitempty"`
+	Status            *otlpStatus    `json:"status,omitempty"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code"`
+	Message string `json:"message,omitempty"`
+}
+
+// otlpValue returns the OTLP AnyValue of an attribute
+func otlpValue(value interface{}) map[string]interface{} {
+	switch v := value.(type) {
+	case bool:
+		return map[string]interface{}{"boolValue": v}
+	case int:
+		return map[string]interface{}{"intValue": strconv.FormatInt(int64(v), 10)}
+	case int64:
+		return map[string]interface{}{"intValue": strconv.FormatInt(v, 10)}
+	case uint64:
+		return map[string]interface{}{"intValue": strconv.FormatUint(v, 10)}
+	case float64:
+		return map[string]interface{}{"doubleValue": v}
+	default:
+		return map[string]interface{}{"stringValue": fmt.Sprint(v)}
+	}
+}
+
+func newOTLPSpan(span *Span) otlpSpan {
+	s := otlpSpan{
+		TraceID:           span.TraceID,
+		SpanID:            span.SpanID,
+		ParentSpanID:      span.ParentID,
+		Name:              span.Name,
+		Kind:              span.Kind,
+		StartTimeUnixNano: strconv.FormatInt(span.Start.UnixNano(), 10),
+		EndTimeUnixNano:   strconv.FormatInt(span.End.UnixNano(), 10),
+	}
+
+	for key, value := range span.Attributes {
+		s.Attributes = append(s.Attributes, otlpKeyValue{Key: key, Value: otlpValue(value)})
+	}
+
+	if span.Error != "" {
+		s.Status = &otlpStatus{Code: 2, Message: span.Error}
+	}
+
+	return s
+}
+
+func (e *otlpExporter) ExportSpans(spans []*Span) error {
+	otlpSpans := make([]otlpSpan, len(spans))
+	for i, span := range spans {
+		otlpSpans[i] = newOTLPSpan(span)
+	}
+
+	request := map[string]interface{}{
+		"resourceSpans": []interface{}{
+			map[string]interface{}{
+				"resource": map[string]interface{}{
+					"attributes": []otlpKeyValue{{Key: "service.name", Value: otlpValue(tracingServiceName)}},
+				},
+				"scopeSpans": []interface{}{
+					map[string]interface{}{
+						"scope": map[string]interface{}{"name": tracingServiceName},
+						"spans": otlpSpans,
+					},
+				},
+			},
+		},
+	}
+
+	data, err := json.Marshal(request)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, e.endpoint, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	for key, value := range e.headers {
+		req.Header.Set(key, value)
+	}
+
+	resp, err := e.client.Do(req)
+	if err != nil {
+		return err
+	}
+
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("unexpected status of otlp export: %s", resp.Status)
+	}
+
+	return nil
+}
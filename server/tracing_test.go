@@ -0,0 +1,209 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+
+	apiauth "github.com/dutchcoders/transfer.sh/api-auth"
+	"github.com/gorilla/mux"
+	. "gopkg.in/check.v1"
+)
+
+var _ = Suite(&SuiteTracing{})
+
+type SuiteTracing struct{}
+
+// recordingExporter keeps the exported spans
+type recordingExporter struct {
+	mutex sync.Mutex
+	spans []*Span
+}
+
+func (e *recordingExporter) ExportSpans(spans []*Span) error {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	e.spans = append(e.spans, spans...)
+	return nil
+}
+
+func (e *recordingExporter) named(name string) *Span {
+	for _, span := range e.spans {
+		if span.Name == name {
+			return span
+		}
+	}
+
+	return nil
+}
+
+func (s *SuiteTracing) TestTraceparent(c *C) {
+	traceID, parentID, sampled, ok := parseTraceparent("00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	c.Assert(ok, Equals, true)
+	c.Assert(traceID, Equals, "4bf92f3577b34da6a3ce929d0e0e4736")
+	c.Assert(parentID, Equals, "00f067aa0ba902b7")
+	c.Assert(sampled, Equals, true)
+
+	for _, header := range []string{
+		"",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7",
+		"00-00000000000000000000000000000000-00f067aa0ba902b7-01",
+		"00-4BF92F3577B34DA6A3CE929D0E0E4736-00f067aa0ba902b7-01",
+		"ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+	} {
+		_, _, _, ok := parseTraceparent(header)
+		c.Assert(ok, Equals, false, Commentf("%s", header))
+	}
+}
+
+func (s *SuiteTracing) TestTracingHandler(c *C) {
+	local, err := NewLocalStorage(c.MkDir(), log.New(ioutil.Discard, "", 0))
+	c.Assert(err, IsNil)
+
+	storage := NewTracingStorage(local)
+	exporter := &recordingExporter{}
+
+	srvr, err := New(UseStorage(storage), UseMetaStorage(storage), Tracing(exporter))
+	c.Assert(err, IsNil)
+	c.Assert(srvr.putMetadata(context.Background(), "aaaaa", "file.txt", Metadata{MaxDownloads: -1}), IsNil)
+
+	router := mux.NewRouter()
+	router.HandleFunc("/{token}/{filename}", func(w http.ResponseWriter, r *http.Request) {
+		if _, err := srvr.CheckMetadata(r.Context(), "aaaaa", "file.txt", true); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+	}).Methods("GET").Name(RouteDownload)
+	router.Use(srvr.TracingHandler)
+
+	req := httptest.NewRequest("GET", "/aaaaa/file.txt", nil)
+	req.Header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	c.Assert(w.Code, Equals, http.StatusOK)
+
+	srvr.tracer.flush()
+
+	root := exporter.named("GET download")
+	c.Assert(root, NotNil)
+	c.Assert(root.TraceID, Equals, "4bf92f3577b34da6a3ce929d0e0e4736")
+	c.Assert(root.ParentID, Equals, "00f067aa0ba902b7")
+	c.Assert(root.Attributes["http.status_code"], Equals, http.StatusOK)
+
+	for _, name := range []string{"metadata.lock", "metadata.read", "metadata.write"} {
+		span := exporter.named(name)
+		c.Assert(span, NotNil, Commentf("%s", name))
+		c.Assert(span.ParentID, Equals, root.SpanID)
+	}
+
+	get := exporter.named("storage.get")
+	c.Assert(get, NotNil)
+	c.Assert(get.ParentID, Equals, exporter.named("metadata.read").SpanID)
+	c.Assert(get.Attributes["storage.provider"], Equals, "local")
+
+	// tokens grant access to their files and are left out of the spans
+	for _, span := range exporter.spans {
+		for _, value := range span.Attributes {
+			c.Assert(fmt.Sprint(value), Not(Matches), ".*aaaaa.*")
+		}
+	}
+
+	// unsampled traces are propagated but not recorded
+	exporter.spans = nil
+	req = httptest.NewRequest("GET", "/aaaaa/file.txt", nil)
+	req.Header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00")
+	router.ServeHTTP(httptest.NewRecorder(), req)
+
+	srvr.tracer.flush()
+	c.Assert(exporter.spans, HasLen, 0)
+}
+
+func (s *SuiteTracing) TestTraceSampling(c *C) {
+	exporter := &recordingExporter{}
+	srvr, err := New(Tracing(exporter), TraceSampling(0))
+	c.Assert(err, IsNil)
+
+	router := mux.NewRouter()
+	router.HandleFunc("/{token}/{filename}", func(w http.ResponseWriter, r *http.Request) {}).Methods("GET").Name(RouteDownload)
+	router.Use(srvr.TracingHandler)
+
+	router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/aaaaa/file.txt", nil))
+	srvr.tracer.Close()
+	c.Assert(exporter.spans, HasLen, 0)
+
+	// the sampling decision of the caller is kept
+	req := httptest.NewRequest("GET", "/aaaaa/file.txt", nil)
+	req.Header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	router.ServeHTTP(httptest.NewRecorder(), req)
+
+	// spans finished after a close are exported by the next flush
+	srvr.tracer.Close()
+	c.Assert(exporter.spans, HasLen, 1)
+}
+
+func (s *SuiteTracing) TestAPIAuthenticatorPropagation(c *C) {
+	var traceparent string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		traceparent = r.Header.Get("traceparent")
+	}))
+	defer ts.Close()
+
+	exporter := &recordingExporter{}
+	srvr, err := New(UseAPIAuthenticator(apiauth.APIConfig{Endpoint: ts.URL}), Tracing(exporter))
+	c.Assert(err, IsNil)
+
+	root := &Span{tracer: srvr.tracer, TraceID: newID(16), SpanID: newID(8), sampled: true}
+	ctx := context.WithValue(context.Background(), spanContextKey{}, root)
+
+	_, ok, err := authenticate(ctx, srvr.auths[string(API)], "user", "secret")
+	c.Assert(err, IsNil)
+	c.Assert(ok, Equals, true)
+
+	srvr.tracer.flush()
+
+	span := exporter.named("apiauth.authenticate")
+	c.Assert(span, NotNil)
+	c.Assert(span.ParentID, Equals, root.SpanID)
+	c.Assert(traceparent, Equals, span.traceparent())
+}
+
+func (s *SuiteTracing) TestExporters(c *C) {
+	span := &Span{TraceID: newID(16), SpanID: newID(8), Name: "GET download", Kind: spanKindServer, Error: "500 Internal Server Error"}
+	span.setAttribute("http.status_code", 500)
+
+	var request struct {
+		ResourceSpans []struct {
+			ScopeSpans []struct {
+				Spans []otlpSpan `json:"spans"`
+			} `json:"scopeSpans"`
+		} `json:"resourceSpans"`
+	}
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c.Check(r.Header.Get("Content-Type"), Equals, "application/json")
+		c.Check(json.NewDecoder(r.Body).Decode(&request), IsNil)
+	}))
+	defer ts.Close()
+
+	c.Assert(NewOTLPExporter(ts.URL, nil).ExportSpans([]*Span{span}), IsNil)
+	c.Assert(request.ResourceSpans, HasLen, 1)
+	spans := request.ResourceSpans[0].ScopeSpans[0].Spans
+	c.Assert(spans, HasLen, 1)
+	c.Assert(spans[0].TraceID, Equals, span.TraceID)
+	c.Assert(spans[0].Status.Code, Equals, 2)
+	c.Assert(spans[0].Attributes[0].Value["intValue"], Equals, "500")
+
+	var b bytes.Buffer
+	c.Assert(NewStdoutExporter(&b).ExportSpans([]*Span{span}), IsNil)
+
+	var decoded Span
+	c.Assert(json.Unmarshal(b.Bytes(), &decoded), IsNil)
+	c.Assert(decoded.SpanID, Equals, span.SpanID)
+	c.Assert(decoded.Error, Equals, span.Error)
+}
@@ -253,3 +253,15 @@ func acceptsHTML(hdr http.Header) bool {
 
 	return (false)
 }
+
+func acceptsJSON(hdr http.Header) bool {
+	actual := header.ParseAccept(hdr, "Accept")
+
+	for _, s := range actual {
+		if s.Value == "application/json" {
+			return (true)
+		}
+	}
+
+	return (false)
+}
@@ -47,18 +47,26 @@ func (s *Server) virusTotalHandler(w http.ResponseWriter, r *http.Request) {
 
 	vt, err := virustotal.NewVirusTotal(s.VirusTotalKey)
 	if err != nil {
+		scansTotal.inc("virustotal", "error")
 		http.Error(w, err.Error(), 500)
+		return
 	}
 
 	var reader io.Reader
 
 	reader = r.Body
 
+	_, span := startSpan(r.Context(), "virustotal.scan", spanKindClient)
 	result, err := vt.Scan(filename, reader)
+	span.end(err)
 	if err != nil {
+		scansTotal.inc("virustotal", "error")
 		http.Error(w, err.Error(), 500)
+		return
 	}
 
+	scansTotal.inc("virustotal", "submitted")
+
 	s.logger.Println(result)
 	w.Write([]byte(fmt.Sprintf("%v\n", result.Permalink)))
 }